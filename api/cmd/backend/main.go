@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
@@ -11,7 +12,11 @@ import (
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"my.app/pkg/b2"
+	"my.app/pkg/jobs"
 	"my.app/pkg/server"
+	"my.app/pkg/storage"
+	"my.app/pkg/storage/local"
+	"my.app/pkg/storage/s3"
 )
 
 const (
@@ -41,6 +46,47 @@ func main() {
 		fmt.Println("No .env file found")
 	}
 
+	// select the storage backend for the media files
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "b2":
+		storage.SetDefault(b2.NewFromEnv())
+	case "local":
+		localStorage, err := local.NewFromEnv()
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+		localStorage.Register(e)
+		storage.SetDefault(localStorage)
+	case "s3":
+		s3Storage, err := s3.NewFromEnv()
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+		storage.SetDefault(s3Storage)
+	default:
+		e.Logger.Fatalf("unknown storage backend %q", backend)
+	}
+
+	// run the background jobs, like the processing of uploaded files
+	queue := server.NewJobQueue(e.Logger)
+	jobs.SetDefault(queue)
+	queue.Start()
+
+	// purge the items which have been in the trash for TRASH_RETENTION
+	server.StartTrashPurger(e.Logger)
+
+	// abort the large uploads without activity for UPLOAD_SESSION_TTL
+	server.StartUploadExpirer(e.Logger)
+
+	// hash the stored files and flag those which do not match their checksum
+	server.StartScrubber(e.Logger)
+
+	// create the indexes of the media documents, which are created on first
+	// use if the database cannot be reached now
+	if err := server.EnsureIndexes(context.Background()); err != nil {
+		e.Logger.Error(err)
+	}
+
 	api := e.Group("/api")
 
 	api.Use(middleware.CORSWithConfig(middleware.CORSConfig{
@@ -53,10 +99,8 @@ func main() {
 	api.Use(middleware.CSRF())
 	api.GET("/csrf-token", server.GetCSRFToken)
 	api.File("/", "public/index.html")
-	api.POST("/media", server.GetMediaDocument)
 	api.POST("/users/login", server.UserLogin)
 	api.POST("/users/password/reset", server.UserPasswordReset)
-	api.GET("/medialist", server.GetFileList)
 
 	header := api.Group("/header")
 
@@ -91,16 +135,72 @@ func main() {
 	secure.POST("/users/delete", server.DeleteUser)
 	secure.PUT("/users/update", server.UpdateUser)
 
-	// media actions on b2
-	secure.GET("/media/upload/authorize", b2.GetUploadURL)
-	secure.GET("/media/upload/large/start/", b2.StartLargeUpload)
-	secure.GET("/media/upload/large/getUrl/:fileId", b2.GetLargeUploadURL)
-	secure.POST("/media/upload/large/finish/", b2.FinishLargeUpload)
-	secure.GET("/media/upload/large/listParts/:fileId", b2.ListLargeFileParts)
+	// media actions on the storage
+	secure.GET("/media/list", server.GetFileList)
+	secure.POST("/media/upload", server.UploadMedia)
+	secure.GET("/media/:id/download", server.DownloadMedia)
+	secure.GET("/media/:id/rendition", server.DownloadRendition)
+	secure.GET("/media/upload/authorize", server.GetUploadURL)
+	secure.GET("/media/upload/large/start/", server.StartLargeUpload)
+	secure.GET("/media/upload/large/getUrl/:fileId", server.GetLargeUploadURL)
+	secure.POST("/media/upload/large/finish/", server.FinishLargeUpload)
+	secure.GET("/media/upload/large/listParts/:fileId", server.ListLargeFileParts)
+	secure.GET("/media/upload/large/sessions", server.ListUploadSessions)
+	secure.GET("/media/upload/large/sessions/:fileId", server.ResumeUploadSession)
+	secure.DELETE("/media/upload/large/sessions/:fileId", server.AbortUploadSession)
 
 	// media actions on database
+	secure.GET("/media", server.ListMediaDocuments)
+	secure.GET("/media/search", server.SearchMedia)
+	secure.GET("/media/clusters", server.ListMediaClusters)
+	secure.GET("/media/duplicates", server.ListDuplicates)
+	secure.POST("/media/tags", server.TagMedia)
+	secure.GET("/media/:id", server.GetMediaDocumentByID)
+	secure.GET("/media/:id/similar", server.FindSimilarMedia)
+	secure.GET("/media/:id/versions", server.ListMediaVersions)
+	secure.POST("/media/:id/versions", server.UploadMediaVersion)
+	secure.GET("/media/:id/versions/:version/download", server.DownloadMediaVersion)
+	secure.POST("/media/:id/versions/:version/promote", server.PromoteMediaVersion)
+	secure.PATCH("/media/:id", server.UpdateMediaDocument)
+	secure.DELETE("/media/:id", server.DeleteMediaDocument)
 	secure.POST("/media/db/upload/", server.UploadFileToDB)
 
+	// collections of media documents
+	secure.GET("/collections", server.ListCollections)
+	secure.POST("/collections", server.CreateCollection)
+	secure.GET("/collections/:id", server.GetCollection)
+	secure.PATCH("/collections/:id", server.UpdateCollection)
+	secure.DELETE("/collections/:id", server.DeleteCollection)
+	secure.GET("/collections/:id/media", server.ListCollectionMedia)
+	secure.POST("/collections/:id/media", server.AddCollectionMedia)
+	secure.PUT("/collections/:id/media", server.OrderCollectionMedia)
+	secure.POST("/collections/:id/media/remove", server.RemoveCollectionMedia)
+
+	// tag vocabulary
+	secure.GET("/tags", server.ListTags)
+	secure.POST("/tags", server.CreateTag)
+	secure.GET("/tags/:id", server.GetTag)
+	secure.PATCH("/tags/:id", server.UpdateTag)
+	secure.DELETE("/tags/:id", server.DeleteTag)
+	secure.POST("/tags/:id/merge", server.MergeTag)
+
+	// trash of media documents and collections
+	secure.GET("/trash/media", server.ListTrashedMedia)
+	secure.POST("/trash/media/:id/restore", server.RestoreMediaDocument)
+	secure.DELETE("/trash/media/:id", server.PurgeMediaDocument)
+	secure.GET("/trash/collections", server.ListTrashedCollections)
+	secure.POST("/trash/collections/:id/restore", server.RestoreCollection)
+	secure.DELETE("/trash/collections/:id", server.PurgeCollection)
+
+	// reconciliation of the storage and the media documents
+	secure.GET("/reconcile", server.GetReconciliation)
+	secure.POST("/reconcile", server.ReconcileStorage)
+
+	// background jobs
+	secure.GET("/jobs", server.ListJobs)
+	secure.GET("/jobs/:id", server.GetJob)
+	secure.POST("/jobs/:id/retry", server.RetryJob)
+
 	// Health check endpoint.
 	e.GET("/healthz", server.HealthCheck)
 
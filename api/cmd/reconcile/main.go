@@ -0,0 +1,98 @@
+// Command reconcile compares the files in the storage with the media
+// documents, prints the drift as json and repairs it if requested. It reads
+// the same .env file as the backend.
+//
+//	go run ./cmd/reconcile                  report only
+//	go run ./cmd/reconcile -repair          cancel, import and flag
+//	go run ./cmd/reconcile -import-orphans  select single repairs
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/joho/godotenv"
+	"my.app/pkg/b2"
+	"my.app/pkg/jobs"
+	"my.app/pkg/server"
+	"my.app/pkg/storage"
+	"my.app/pkg/storage/local"
+	"my.app/pkg/storage/s3"
+)
+
+var (
+	repair        = flag.Bool("repair", false, "Make all repairs")
+	cancelStale   = flag.Bool("cancel-stale", false, "Cancel the stale unfinished large files")
+	importOrphans = flag.Bool("import-orphans", false, "Create media documents for the orphaned files and delete orphaned renditions")
+	flagBroken    = flag.Bool("flag-broken", false, "Mark the media documents whose file is missing")
+	owner         = flag.String("owner", "", "User id of the owner of imported media documents")
+)
+
+// logger writes the errors of the job queue to the standard logger
+type logger struct{}
+
+func (logger) Errorf(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
+
+func main() {
+	flag.Parse()
+
+	// load .env file
+	// Get current file full path from runtime
+	_, b, _, _ := runtime.Caller(0)
+	// Root folder of this project
+	ProjectRootPath := filepath.Join(filepath.Dir(b), "../../")
+	err := godotenv.Load(ProjectRootPath + "/.env")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "No .env file found")
+	}
+
+	// select the storage backend for the media files
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "b2":
+		storage.SetDefault(b2.NewFromEnv())
+	case "local":
+		localStorage, err := local.NewFromEnv()
+		if err != nil {
+			log.Fatal(err)
+		}
+		storage.SetDefault(localStorage)
+	case "s3":
+		s3Storage, err := s3.NewFromEnv()
+		if err != nil {
+			log.Fatal(err)
+		}
+		storage.SetDefault(s3Storage)
+	default:
+		log.Fatalf("unknown storage backend %q", backend)
+	}
+
+	// imported files are processed by the workers of the backend
+	jobs.SetDefault(server.NewJobQueue(logger{}))
+
+	report, err := server.Reconcile(context.Background(), server.ReconcileOptions{
+		CancelStale:   *repair || *cancelStale,
+		ImportOrphans: *repair || *importOrphans,
+		FlagBroken:    *repair || *flagBroken,
+		Owner:         *owner,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		log.Fatal(err)
+	}
+	if len(report.Errors) > 0 {
+		os.Exit(1)
+	}
+}
@@ -9,5 +9,6 @@ require (
 	github.com/labstack/echo/v4 v4.1.17
 	go.mongodb.org/mongo-driver v1.4.4
 	golang.org/x/crypto v0.0.0-20200820211705-5c72a883971a
+	golang.org/x/image v0.0.0-20201208152932-35266b937fa6
 	gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22
 )
@@ -0,0 +1,85 @@
+package b2
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// authLifetime is the time an account authorization is reused.
+	// B2 tokens are valid for 24 hours, they are refreshed an hour before.
+	authLifetime = 23 * time.Hour
+
+	// authTimeout limits a refresh of the authorization, which is shared by
+	// all waiting requests and thus not bound to the context of one of them
+	authTimeout = 30 * time.Second
+)
+
+// authCache holds the account authorization shared by all requests of a backend.
+// Concurrent requests which find the cache empty wait for a single refresh.
+type authCache struct {
+	mu      sync.Mutex
+	auth    *AuthorizeResponse
+	expires time.Time
+	refresh *authRefresh
+}
+
+// authRefresh is a refresh of the authorization in progress
+type authRefresh struct {
+	done chan struct{}
+	auth *AuthorizeResponse
+	err  error
+}
+
+// get returns the cached authorization, or calls authorize to get a new one
+func (c *authCache) get(ctx context.Context, authorize func(context.Context) (*AuthorizeResponse, error)) (*AuthorizeResponse, error) {
+	c.mu.Lock()
+	if c.auth != nil && time.Now().Before(c.expires) {
+		auth := c.auth
+		c.mu.Unlock()
+		return auth, nil
+	}
+
+	refresh := c.refresh
+	if refresh == nil {
+		refresh = &authRefresh{done: make(chan struct{})}
+		c.refresh = refresh
+		go c.run(refresh, authorize)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-refresh.done:
+		return refresh.auth, refresh.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *authCache) run(refresh *authRefresh, authorize func(context.Context) (*AuthorizeResponse, error)) {
+	ctx, cancel := context.WithTimeout(context.Background(), authTimeout)
+	defer cancel()
+	refresh.auth, refresh.err = authorize(ctx)
+
+	c.mu.Lock()
+	if refresh.err == nil {
+		c.auth = refresh.auth
+		c.expires = time.Now().Add(authLifetime)
+	}
+	c.refresh = nil
+	c.mu.Unlock()
+
+	close(refresh.done)
+}
+
+// invalidate drops the cached authorization if it is still the given one.
+// Requests which fail with the same expired token thus only cause one refresh.
+func (c *authCache) invalidate(auth *AuthorizeResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.auth == auth {
+		c.auth = nil
+	}
+}
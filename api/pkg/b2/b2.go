@@ -1,70 +1,90 @@
 package b2
 
 import (
-	"bytes"
-	"encoding/base64"
-	"encoding/json"
+	"context"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/labstack/echo/v4"
+	"my.app/pkg/storage"
 )
 
-// AuthorizeResponse defines the parameter for the authorization response from B2
-type AuthorizeResponse struct {
-	AccountID          string `json:"accountId"`
-	APIURL             string `json:"apiUrl"`
-	AuthorizationToken string `json:"authorizationToken"`
-	DownloadURL        string `json:"downloadUrl"`
-}
+// Config defines the connection to a B2 bucket
+type Config struct {
+	KeyID          string
+	ApplicationKey string
+	BucketID       string
 
-func redirectPolicyFunc(req *http.Request, via []*http.Request) error {
-	req.Header.Add("Authorization", "Basic "+basicAuth(os.Getenv("B2_KEY_ID"), os.Getenv("B2_APPLICATION_KEY")))
-	return nil
+	// BaseURL is the url used to authorize the account, DefaultBaseURL if empty.
+	// All other urls are taken from the authorization response.
+	BaseURL string
 }
 
-func basicAuth(username, password string) string {
-	auth := username + ":" + password
-	return base64.StdEncoding.EncodeToString([]byte(auth))
+// Storage is the storage backend for Backblaze B2
+type Storage struct {
+	bucketID string
+	client   *Client
+
+	mu   sync.Mutex
+	name string
 }
 
-func AuthorizeB2account() *AuthorizeResponse {
-	client := &http.Client{
-		CheckRedirect: redirectPolicyFunc,
+// New creates a B2 storage backend which stores the files in the configured bucket
+func New(config Config) *Storage {
+	return &Storage{
+		bucketID: config.BucketID,
+		client:   NewClient(config.KeyID, config.ApplicationKey, config.BaseURL),
 	}
+}
 
-	url := "https://api.backblazeb2.com/b2api/v2/b2_authorize_account"
-
-	request, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		fmt.Println(err)
-	}
-	request.Header.Add("Authorization", "Basic "+basicAuth(os.Getenv("B2_KEY_ID"), os.Getenv("B2_APPLICATION_KEY")))
-	resp, err := client.Do(request)
-	decoder := json.NewDecoder(resp.Body)
-	authorization := new(AuthorizeResponse)
-	err = decoder.Decode(&authorization)
-	if err != nil {
-		fmt.Println(err)
-	}
+// NewFromEnv creates a B2 storage backend configured by the B2_* environment variables
+func NewFromEnv() *Storage {
+	return New(Config{
+		KeyID:          os.Getenv("B2_KEY_ID"),
+		ApplicationKey: os.Getenv("B2_APPLICATION_KEY"),
+		BucketID:       os.Getenv("B2_BUCKET_ID"),
+		BaseURL:        os.Getenv("B2_API_URL"),
+	})
+}
 
-	return authorization
+// Authorize checks the credentials of the B2 account
+func (s *Storage) Authorize(ctx context.Context) error {
+	_, err := s.client.Authorization(ctx)
+	return err
 }
 
 // File defines the parameters of a single file in the b2 storage
 type File struct {
-	FileID          string `json:"fileId"`
-	Filename        string `json:"fileName"`
-	UploadTimestamp int    `json:"uploadTimestamp"`
-	AccountID       string `json:"accountId"`
-	BucketID        string `json:"bucketId"`
-	ContentLenght   int    `json:"contentLength"`
-	ContentType     string `json:"contentType"`
-	ContentSha1     string `json:"contentSha1"`
+	FileID          string            `json:"fileId"`
+	Filename        string            `json:"fileName"`
+	UploadTimestamp int64             `json:"uploadTimestamp"`
+	AccountID       string            `json:"accountId"`
+	BucketID        string            `json:"bucketId"`
+	ContentLength   int64             `json:"contentLength"`
+	ContentType     string            `json:"contentType"`
+	ContentSha1     string            `json:"contentSha1"`
+	FileInfo        map[string]string `json:"fileInfo"`
+
+	// Action is "folder" for the folders in a listing with a delimiter
+	Action string `json:"action"`
+}
+
+func (f *File) storageFile() *storage.File {
+	return &storage.File{
+		FileID:          f.FileID,
+		FileName:        f.Filename,
+		ContentLength:   f.ContentLength,
+		ContentType:     f.ContentType,
+		ContentSha1:     f.ContentSha1,
+		FileInfo:        f.FileInfo,
+		UploadTimestamp: f.UploadTimestamp,
+	}
 }
 
 // Files is how b2 storage api returns the json
@@ -73,244 +93,427 @@ type Files struct {
 	NextFileName string
 }
 
-// ListFileNames list the files in the b2 storage
-func ListFileNames(Authorization *AuthorizeResponse) *Files {
-
-	client := &http.Client{}
-
-	url := Authorization.APIURL + "/b2api/v2/b2_list_file_names"
-
-	requestBody := []byte(`{"bucketId":"` + os.Getenv("B2_BUCKET_ID") + `","maxFileCount":1000}`)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
-	if err != nil {
-		fmt.Println(err)
+// ListFiles lists the files in the b2 storage
+func (s *Storage) ListFiles(ctx context.Context, req storage.ListFilesRequest) (*storage.FileList, error) {
+
+	requestBody := struct {
+		BucketID      string `json:"bucketId"`
+		StartFileName string `json:"startFileName,omitempty"`
+		MaxFileCount  int    `json:"maxFileCount,omitempty"`
+		Prefix        string `json:"prefix,omitempty"`
+		Delimiter     string `json:"delimiter,omitempty"`
+	}{
+		BucketID:      s.bucketID,
+		StartFileName: req.StartFileName,
+		MaxFileCount:  req.MaxFileCount,
+		Prefix:        req.Prefix,
+		Delimiter:     req.Delimiter,
 	}
-	req.Header.Add("Authorization", Authorization.AuthorizationToken)
 
-	resp, err := client.Do(req)
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatal(err)
-	}
 	files := new(Files)
-	json.Unmarshal([]byte(bodyBytes), &files)
-	return files
-}
+	if err := s.client.Call(ctx, "b2_list_file_names", requestBody, files); err != nil {
+		return nil, err
+	}
 
-type GetB2UploadURLResponse struct {
-	AuthorizationToken string `json:"authorizationToken"`
-	BucketID           string `json:"bucketID"`
-	UploadURL          string `json:"uploadUrl"`
+	list := &storage.FileList{
+		Files:        make([]storage.File, 0, len(files.Files)),
+		NextFileName: files.NextFileName,
+	}
+	for i := range files.Files {
+		if files.Files[i].Action == "folder" {
+			list.Folders = append(list.Folders, files.Files[i].Filename)
+			continue
+		}
+		list.Files = append(list.Files, *files.Files[i].storageFile())
+	}
+	return list, nil
 }
 
 // GetUploadURL calls the b2 API to get an upload url
-func GetUploadURL(ctx echo.Context) error {
-
-	authorizeResponse := AuthorizeB2account()
+func (s *Storage) GetUploadURL(ctx context.Context, fileName string) (*storage.UploadURL, error) {
 
-	client := &http.Client{}
-
-	url := authorizeResponse.APIURL + "/b2api/v2/b2_get_upload_url"
-	requestBody := []byte(`{"bucketId":"` + os.Getenv("B2_BUCKET_ID") + `"}`)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
-	if err != nil {
-		fmt.Println(err)
+	requestBody := struct {
+		BucketID string `json:"bucketId"`
+	}{
+		BucketID: s.bucketID,
 	}
-	req.Header.Add("Authorization", authorizeResponse.AuthorizationToken)
 
-	resp, err := client.Do(req)
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatal(err)
+	response := struct {
+		BucketID           string `json:"bucketId"`
+		UploadURL          string `json:"uploadUrl"`
+		AuthorizationToken string `json:"authorizationToken"`
+	}{}
+	if err := s.client.Call(ctx, "b2_get_upload_url", requestBody, &response); err != nil {
+		return nil, err
 	}
 
-	response := new(GetB2UploadURLResponse)
-	json.Unmarshal([]byte(bodyBytes), &response)
-
-	return ctx.JSON(http.StatusOK, response)
+	return &storage.UploadURL{
+		BucketID:           response.BucketID,
+		UploadURL:          response.UploadURL,
+		AuthorizationToken: response.AuthorizationToken,
+	}, nil
 }
 
-type GetB2LargeUploadStartResponse struct {
-	AccountID       string    `json:"accountId"`
-	Action          string    `json:"action"`
-	BucketID        string    `json:"bucketId"`
-	ContentLength   int64     `json:"contentLength"`
-	ContentSha1     string    `json:"contentSha1"`
-	ContentType     string    `json:"contentType"`
-	FileID          string    `json:"fileId"`
-	FileName        string    `json:"fileName"`
-	UploadTimestamp time.Time `json:"uploadTimestamp"`
-}
+// UploadFile uploads a single file to the b2 storage
+func (s *Storage) UploadFile(ctx context.Context, req storage.UploadFileRequest, body io.ReadSeeker) (*storage.File, error) {
 
-func StartLargeUpload(ctx echo.Context) error {
+	contentType := req.ContentType
+	if contentType == "" {
+		contentType = "b2/x-auto"
+	}
 
-	authorizeResponse := AuthorizeB2account()
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	header.Set("X-Bz-File-Name", url.PathEscape(req.FileName))
+	header.Set("X-Bz-Content-Sha1", req.ContentSha1)
+	for name, value := range req.FileInfo {
+		header.Set("X-Bz-Info-"+name, url.PathEscape(value))
+	}
 
-	client := &http.Client{}
+	getURL := func() (string, string, error) {
+		uploadURL, err := s.GetUploadURL(ctx, req.FileName)
+		if err != nil {
+			return "", "", err
+		}
+		return uploadURL.UploadURL, uploadURL.AuthorizationToken, nil
+	}
 
-	url := authorizeResponse.APIURL + "/b2api/v2/b2_start_large_file"
+	response := new(File)
+	if err := s.client.Upload(ctx, "b2_upload_file", getURL, header, body, req.ContentLength, response); err != nil {
+		return nil, err
+	}
+	return response.storageFile(), nil
+}
 
-	filename := ctx.QueryParam("filename")
-	buckedID := os.Getenv("B2_BUCKET_ID")
-	contentType := ctx.QueryParam("contentType")
-	requestBody := []byte(`{"bucketId":"` + buckedID + `", "fileName":"` + filename + `", "contentType":"` + contentType + `"}`)
+// StartLargeFile calls the b2 API to prepare the upload of a large file
+func (s *Storage) StartLargeFile(ctx context.Context, fileName string, contentType string, fileInfo map[string]string) (*storage.File, error) {
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
-	if err != nil {
-		fmt.Println(err)
+	// let b2 determine the content type from the file name
+	if contentType == "" {
+		contentType = "b2/x-auto"
 	}
-	req.Header.Add("Authorization", authorizeResponse.AuthorizationToken)
 
-	resp, err := client.Do(req)
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatal(err)
+	requestBody := struct {
+		BucketID    string            `json:"bucketId"`
+		FileName    string            `json:"fileName"`
+		ContentType string            `json:"contentType"`
+		FileInfo    map[string]string `json:"fileInfo,omitempty"`
+	}{
+		BucketID:    s.bucketID,
+		FileName:    fileName,
+		ContentType: contentType,
+		FileInfo:    fileInfo,
 	}
 
-	response := new(GetB2LargeUploadStartResponse)
-	json.Unmarshal([]byte(bodyBytes), &response)
-
-	return ctx.JSON(http.StatusOK, response)
-}
-
-type GetB2LargeUploadURLResponse struct {
-	FileID             string `json:"fileId"`
-	UploadURL          string `json:"uploadUrl"`
-	AuthorizationToken string `json:"authorizationToken"`
+	response := new(File)
+	if err := s.client.Call(ctx, "b2_start_large_file", requestBody, response); err != nil {
+		return nil, err
+	}
+	return response.storageFile(), nil
 }
 
-// GetLargeUploadURL calls the b2 API to get a large upload url
-func GetLargeUploadURL(ctx echo.Context) error {
-
-	fileID := ctx.Param("fileId")
+// GetUploadPartURL calls the b2 API to get an upload url for the parts of a large file
+func (s *Storage) GetUploadPartURL(ctx context.Context, fileID string, partNumber int64) (*storage.UploadPartURL, error) {
 
-	authorizeResponse := AuthorizeB2account()
+	requestBody := struct {
+		FileID string `json:"fileId"`
+	}{
+		FileID: fileID,
+	}
 
-	client := &http.Client{}
+	response := struct {
+		FileID             string `json:"fileId"`
+		UploadURL          string `json:"uploadUrl"`
+		AuthorizationToken string `json:"authorizationToken"`
+	}{}
+	if err := s.client.Call(ctx, "b2_get_upload_part_url", requestBody, &response); err != nil {
+		return nil, err
+	}
 
-	url := authorizeResponse.APIURL + "/b2api/v2/b2_get_upload_part_url"
+	return &storage.UploadPartURL{
+		FileID:             response.FileID,
+		UploadURL:          response.UploadURL,
+		AuthorizationToken: response.AuthorizationToken,
+	}, nil
+}
 
-	requestBody := []byte(`{"fileId":"` + fileID + `"}`)
+// UploadPart uploads a part of a large file to the b2 storage
+func (s *Storage) UploadPart(ctx context.Context, fileID string, partNumber int64, contentLength int64, contentSha1 string, body io.ReadSeeker) (*storage.Part, error) {
 
-	fmt.Println(fileID)
+	header := http.Header{}
+	header.Set("X-Bz-Part-Number", strconv.FormatInt(partNumber, 10))
+	header.Set("X-Bz-Content-Sha1", contentSha1)
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
-	if err != nil {
-		fmt.Println(err)
+	getURL := func() (string, string, error) {
+		uploadURL, err := s.GetUploadPartURL(ctx, fileID, partNumber)
+		if err != nil {
+			return "", "", err
+		}
+		return uploadURL.UploadURL, uploadURL.AuthorizationToken, nil
 	}
-	req.Header.Add("Authorization", authorizeResponse.AuthorizationToken)
 
-	resp, err := client.Do(req)
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatal(err)
+	response := new(storage.Part)
+	if err := s.client.Upload(ctx, "b2_upload_part", getURL, header, body, contentLength, response); err != nil {
+		return nil, err
 	}
+	return response, nil
+}
 
-	response := new(GetB2LargeUploadURLResponse)
-	json.Unmarshal([]byte(bodyBytes), &response)
+// FinishLargeFile calls the b2 API to assemble the uploaded parts of a large file
+func (s *Storage) FinishLargeFile(ctx context.Context, fileID string, partSha1Array []string) (*storage.File, error) {
 
-	return ctx.JSON(http.StatusOK, response)
-}
+	requestBody := struct {
+		FileID        string   `json:"fileId"`
+		PartSha1Array []string `json:"partSha1Array"`
+	}{
+		FileID:        fileID,
+		PartSha1Array: partSha1Array,
+	}
 
-type finishLargeUploadRequest struct {
-	FileID        string   `json:"fileId"`
-	PartSha1Array []string `json:"partSha1Array"`
+	response := new(File)
+	if err := s.client.Call(ctx, "b2_finish_large_file", requestBody, response); err != nil {
+		return nil, err
+	}
+	return response.storageFile(), nil
 }
 
-func FinishLargeUpload(ctx echo.Context) error {
+// CancelLargeFile calls the b2 API to cancel a large file and delete its uploaded parts
+func (s *Storage) CancelLargeFile(ctx context.Context, fileID string) error {
 
-	req := new(finishLargeUploadRequest)
-	if err := ctx.Bind(req); err != nil {
-		return ctx.JSON(http.StatusBadRequest, "Invalid request object")
+	requestBody := struct {
+		FileID string `json:"fileId"`
+	}{
+		FileID: fileID,
 	}
-	ctx.Logger().Debugf("received request body: %+v", req)
 
-	authorizeResponse := AuthorizeB2account()
+	response := new(File)
+	return s.client.Call(ctx, "b2_cancel_large_file", requestBody, response)
+}
 
-	client := &http.Client{}
+// ListParts calls the b2 API to list the uploaded parts of a large file
+func (s *Storage) ListParts(ctx context.Context, fileID string, startPartNumber int64, maxPartCount int) (*storage.PartList, error) {
+
+	requestBody := struct {
+		FileID          string `json:"fileId"`
+		StartPartNumber int64  `json:"startPartNumber,omitempty"`
+		MaxPartCount    int    `json:"maxPartCount,omitempty"`
+	}{
+		FileID:          fileID,
+		StartPartNumber: startPartNumber,
+		MaxPartCount:    maxPartCount,
+	}
 
-	url := authorizeResponse.APIURL + "/b2api/v2/b2_finish_large_file"
+	response := new(storage.PartList)
+	if err := s.client.Call(ctx, "b2_list_parts", requestBody, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
 
-	requestBody, err := json.Marshal(req)
-	if err != nil {
-		log.Fatal(err)
+// ListUnfinishedLargeFiles calls the b2 API to list the large files which have not been finished
+func (s *Storage) ListUnfinishedLargeFiles(ctx context.Context, startFileID string, maxFileCount int) (*storage.UnfinishedFileList, error) {
+
+	requestBody := struct {
+		BucketID     string `json:"bucketId"`
+		StartFileID  string `json:"startFileId,omitempty"`
+		MaxFileCount int    `json:"maxFileCount,omitempty"`
+	}{
+		BucketID:     s.bucketID,
+		StartFileID:  startFileID,
+		MaxFileCount: maxFileCount,
 	}
-	fmt.Println(req.FileID)
-	fmt.Println("requestBody:", requestBody)
 
-	request, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
-	if err != nil {
-		fmt.Println(err)
+	response := struct {
+		Files      []File
+		NextFileID string `json:"nextFileId"`
+	}{}
+	if err := s.client.Call(ctx, "b2_list_unfinished_large_files", requestBody, &response); err != nil {
+		return nil, err
 	}
-	request.Header.Add("Authorization", authorizeResponse.AuthorizationToken)
 
-	resp, err := client.Do(request)
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatal(err)
+	list := &storage.UnfinishedFileList{
+		Files:      make([]storage.File, 0, len(response.Files)),
+		NextFileID: response.NextFileID,
+	}
+	for i := range response.Files {
+		list.Files = append(list.Files, *response.Files[i].storageFile())
 	}
+	return list, nil
+}
 
-	fmt.Println(bodyBytes)
+// Download downloads a file by its id from the b2 storage
+func (s *Storage) Download(ctx context.Context, fileID string) (io.ReadCloser, *storage.File, error) {
+	return s.DownloadRange(ctx, fileID, 0, -1)
+}
 
-	response := new(GetB2LargeUploadStartResponse)
-	json.Unmarshal([]byte(bodyBytes), &response)
+// DownloadRange downloads a part of a file by its id from the b2 storage
+func (s *Storage) DownloadRange(ctx context.Context, fileID string, offset int64, length int64) (io.ReadCloser, *storage.File, error) {
+
+	resp, err := s.client.Do(ctx, "b2_download_file_by_id", func(auth *AuthorizeResponse) (*http.Request, error) {
+		downloadURL := auth.DownloadURL + "/b2api/v2/b2_download_file_by_id?fileId=" + url.QueryEscape(fileID)
+		request, err := http.NewRequestWithContext(ctx, "GET", downloadURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		if offset > 0 || length >= 0 {
+			request.Header.Set("Range", storage.RangeHeader(offset, length))
+		}
+		return request, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
 
-	return ctx.JSON(http.StatusOK, response)
+	contentLength := resp.ContentLength
+	if resp.StatusCode == http.StatusPartialContent {
+		contentLength = storage.ContentRangeLength(resp.Header.Get("Content-Range"))
+	}
+	return resp.Body, downloadedFile(resp.Header, contentLength), nil
 }
 
-type listLargeFilePartsRequest struct {
-	FileID string `json:"fileId"`
-}
+// GetFileInfo reads the information of a file in the b2 storage
+func (s *Storage) GetFileInfo(ctx context.Context, fileID string) (*storage.File, error) {
 
-type FilePart struct {
-	FileID        string `json:"fileId"`
-	PartNumber    int64  `json:"partNumber"`
-	ContentLength int64  `json:"contentLength"`
-	ContentSha1   string `json:"contentSha1"`
-	ContentMd5    string `json:"contentMd5"`
-	//UploadTimestamp time.Time `json:"uploadTimestamp"`
-}
+	requestBody := struct {
+		FileID string `json:"fileId"`
+	}{
+		FileID: fileID,
+	}
 
-type ListLargeFilePartsResponse struct {
-	Parts          []FilePart `json:"parts"`
-	NextPartNumber int64      `json:"nextPartNumber"`
+	file := new(File)
+	if err := s.client.Call(ctx, "b2_get_file_info", requestBody, file); err != nil {
+		return nil, err
+	}
+	return file.storageFile(), nil
 }
 
-func ListLargeFileParts(ctx echo.Context) error {
+// DownloadURL returns an url to download a file by its name, which carries a
+// download authorization that is valid for the given duration. B2 authorizes
+// all names which start with the given prefix, so no url is signed while other
+// files start with the name of the file, e.g. "a.jpg.bak" for "a.jpg". B2
+// serves the newest version of a name, so no url is signed for older versions
+// either.
+func (s *Storage) DownloadURL(ctx context.Context, file *storage.File, validFor time.Duration) (string, error) {
 
-	fileID := ctx.Param("fileId")
+	bucketName, err := s.bucketName(ctx)
+	if err != nil {
+		return "", err
+	}
 
-	authorizeResponse := AuthorizeB2account()
+	// the file itself sorts first as the newest version of its name, a
+	// second name is another file
+	list, err := s.ListFiles(ctx, storage.ListFilesRequest{Prefix: file.FileName, MaxFileCount: 2})
+	if err != nil {
+		return "", err
+	}
+	if len(list.Files) != 1 || list.Files[0].FileName != file.FileName || list.Files[0].FileID != file.FileID {
+		return "", storage.ErrNotSignable
+	}
 
-	client := &http.Client{}
+	requestBody := struct {
+		BucketID               string `json:"bucketId"`
+		FileNamePrefix         string `json:"fileNamePrefix"`
+		ValidDurationInSeconds int64  `json:"validDurationInSeconds"`
+	}{
+		BucketID:               s.bucketID,
+		FileNamePrefix:         file.FileName,
+		ValidDurationInSeconds: int64(validFor / time.Second),
+	}
 
-	url := authorizeResponse.APIURL + "/b2api/v2/b2_list_parts"
+	response := struct {
+		AuthorizationToken string `json:"authorizationToken"`
+	}{}
+	if err := s.client.Call(ctx, "b2_get_download_authorization", requestBody, &response); err != nil {
+		return "", err
+	}
 
-	requestBody := []byte(`{"fileId":"` + fileID + `", "startPartNumber":1, "maxPartCount":1000}`)
+	auth, err := s.client.Authorization(ctx)
+	if err != nil {
+		return "", err
+	}
+	return auth.DownloadURL + "/file/" + url.PathEscape(bucketName) + "/" + escapeFileName(file.FileName) +
+		"?Authorization=" + url.QueryEscape(response.AuthorizationToken), nil
+}
 
-	fmt.Println("requestBody:", requestBody)
+// escapeFileName escapes a file name for a download url, keeping the slashes
+func escapeFileName(fileName string) string {
+	segments := strings.Split(fileName, "/")
+	for i := range segments {
+		segments[i] = url.PathEscape(segments[i])
+	}
+	return strings.Join(segments, "/")
+}
 
-	request, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
-	if err != nil {
-		fmt.Println(err)
+// bucketName returns the name of the bucket, which is needed for download urls.
+// It is taken from the restrictions of the application key or asked from B2.
+func (s *Storage) bucketName(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.name != "" {
+		return s.name, nil
 	}
-	request.Header.Add("Authorization", authorizeResponse.AuthorizationToken)
 
-	resp, err := client.Do(request)
-	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	auth, err := s.client.Authorization(ctx)
 	if err != nil {
-		log.Fatal(err)
+		return "", err
+	}
+	if auth.Allowed.BucketID == s.bucketID && auth.Allowed.BucketName != "" {
+		s.name = auth.Allowed.BucketName
+		return s.name, nil
 	}
 
-	fmt.Println(string(bodyBytes))
+	requestBody := struct {
+		AccountID string `json:"accountId"`
+		BucketID  string `json:"bucketId"`
+	}{
+		AccountID: auth.AccountID,
+		BucketID:  s.bucketID,
+	}
 
-	response := new(ListLargeFilePartsResponse)
-	err = json.Unmarshal([]byte(bodyBytes), &response)
+	response := struct {
+		Buckets []struct {
+			BucketName string `json:"bucketName"`
+		} `json:"buckets"`
+	}{}
+	if err := s.client.Call(ctx, "b2_list_buckets", requestBody, &response); err != nil {
+		return "", err
+	}
+	if len(response.Buckets) == 0 {
+		return "", fmt.Errorf("b2: bucket %s not found", s.bucketID)
+	}
+	s.name = response.Buckets[0].BucketName
+	return s.name, nil
+}
+
+// downloadedFile reads the file information from the headers of a download response
+func downloadedFile(header http.Header, contentLength int64) *storage.File {
+	fileName, err := url.PathUnescape(header.Get("X-Bz-File-Name"))
 	if err != nil {
-		log.Fatal(err)
+		fileName = header.Get("X-Bz-File-Name")
+	}
+	uploadTimestamp, _ := strconv.ParseInt(header.Get("X-Bz-Upload-Timestamp"), 10, 64)
+	return &storage.File{
+		FileID:          header.Get("X-Bz-File-Id"),
+		FileName:        fileName,
+		ContentLength:   contentLength,
+		ContentType:     header.Get("Content-Type"),
+		ContentSha1:     header.Get("X-Bz-Content-Sha1"),
+		UploadTimestamp: uploadTimestamp,
 	}
+}
 
-	fmt.Printf("%+v\n", response)
+// Delete deletes a version of a file from the b2 storage
+func (s *Storage) Delete(ctx context.Context, fileName string, fileID string) error {
+
+	requestBody := struct {
+		FileName string `json:"fileName"`
+		FileID   string `json:"fileId"`
+	}{
+		FileName: fileName,
+		FileID:   fileID,
+	}
 
-	return ctx.JSON(http.StatusOK, response)
+	response := new(File)
+	return s.client.Call(ctx, "b2_delete_file_version", requestBody, response)
 }
@@ -0,0 +1,395 @@
+package b2_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"my.app/pkg/b2"
+	"my.app/pkg/b2/b2test"
+	"my.app/pkg/storage"
+)
+
+var _ storage.Storage = (*b2.Storage)(nil)
+var _ storage.URLSigner = (*b2.Storage)(nil)
+
+func newBackend(t *testing.T) (*b2test.Server, *b2.Storage) {
+	t.Helper()
+	srv := b2test.NewServer()
+	t.Cleanup(srv.Close)
+	return srv, b2.New(srv.Config())
+}
+
+func sha1Hex(data []byte) string {
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func upload(t *testing.T, backend *b2.Storage, fileName string, data []byte) *storage.File {
+	t.Helper()
+	file, err := backend.UploadFile(context.Background(), storage.UploadFileRequest{
+		FileName:      fileName,
+		ContentType:   "text/plain",
+		ContentLength: int64(len(data)),
+		ContentSha1:   sha1Hex(data),
+		FileInfo:      map[string]string{"src_last_modified_millis": "1600000000000"},
+	}, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("upload %s: %v", fileName, err)
+	}
+	return file
+}
+
+func TestAuthorize(t *testing.T) {
+	srv, backend := newBackend(t)
+	if err := backend.Authorize(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Authorize(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.Authorizations(); n != 1 {
+		t.Errorf("got %d authorizations, want the cached one", n)
+	}
+
+	config := srv.Config()
+	config.ApplicationKey = "wrong"
+	err := b2.New(config).Authorize(context.Background())
+	apiErr := &b2.Error{}
+	if !errors.As(err, &apiErr) || apiErr.Status != http.StatusUnauthorized {
+		t.Errorf("got %v, want a 401 error", err)
+	}
+}
+
+func TestUploadAndDownload(t *testing.T) {
+	srv, backend := newBackend(t)
+	ctx := context.Background()
+	data := []byte("hello world")
+
+	file := upload(t, backend, "folder/hello.txt", data)
+	if file.FileID == "" || file.ContentLength != int64(len(data)) || file.ContentSha1 != sha1Hex(data) {
+		t.Errorf("unexpected file %+v", file)
+	}
+	if stored, ok := srv.File("folder/hello.txt"); !ok || !bytes.Equal(stored, data) {
+		t.Errorf("stored %q, want %q", stored, data)
+	}
+
+	body, downloaded, err := backend.Download(ctx, file.FileID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadAll(body)
+	body.Close()
+	if !bytes.Equal(content, data) {
+		t.Errorf("downloaded %q, want %q", content, data)
+	}
+	if downloaded.FileName != "folder/hello.txt" || downloaded.ContentSha1 != sha1Hex(data) || downloaded.ContentLength != int64(len(data)) {
+		t.Errorf("unexpected downloaded file %+v", downloaded)
+	}
+
+	body, downloaded, err = backend.DownloadRange(ctx, file.FileID, 6, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ = ioutil.ReadAll(body)
+	body.Close()
+	if string(content) != "wor" || downloaded.ContentLength != int64(len(data)) {
+		t.Errorf("downloaded range %q of %d bytes", content, downloaded.ContentLength)
+	}
+
+	info, err := backend.GetFileInfo(ctx, file.FileID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.FileInfo["src_last_modified_millis"] != "1600000000000" {
+		t.Errorf("unexpected file info %v", info.FileInfo)
+	}
+}
+
+func TestUploadChecksumMismatch(t *testing.T) {
+	_, backend := newBackend(t)
+	data := []byte("hello world")
+	_, err := backend.UploadFile(context.Background(), storage.UploadFileRequest{
+		FileName:      "hello.txt",
+		ContentLength: int64(len(data)),
+		ContentSha1:   sha1Hex([]byte("something else")),
+	}, bytes.NewReader(data))
+	if !errors.Is(err, storage.ErrBadRequest) {
+		t.Errorf("got %v, want a bad request", err)
+	}
+}
+
+func TestLargeFile(t *testing.T) {
+	srv, backend := newBackend(t)
+	ctx := context.Background()
+	parts := [][]byte{[]byte("first part, "), []byte("second part")}
+	whole := bytes.Join(parts, nil)
+
+	file, err := backend.StartLargeFile(ctx, "large.bin", "", map[string]string{storage.LargeFileSha1: sha1Hex(whole)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unfinished, err := backend.ListUnfinishedLargeFiles(ctx, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unfinished.Files) != 1 || unfinished.Files[0].FileID != file.FileID {
+		t.Errorf("unexpected unfinished files %+v", unfinished.Files)
+	}
+
+	partURL, err := backend.GetUploadPartURL(ctx, file.FileID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if partURL.FileID != file.FileID || partURL.UploadURL == "" || partURL.AuthorizationToken == "" {
+		t.Errorf("unexpected part url %+v", partURL)
+	}
+
+	sha1s := []string{}
+	for i, data := range parts {
+		part, err := backend.UploadPart(ctx, file.FileID, int64(i+1), int64(len(data)), sha1Hex(data), bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if part.ContentSha1 != sha1Hex(data) {
+			t.Errorf("part %d has checksum %s", i+1, part.ContentSha1)
+		}
+		sha1s = append(sha1s, part.ContentSha1)
+	}
+
+	list, err := backend.ListParts(ctx, file.FileID, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Parts) != 1 || list.Parts[0].PartNumber != 1 || list.NextPartNumber != 2 {
+		t.Errorf("unexpected first page of parts %+v", list)
+	}
+
+	if _, err := backend.FinishLargeFile(ctx, file.FileID, []string{sha1s[1], sha1s[0]}); !errors.Is(err, storage.ErrBadRequest) {
+		t.Errorf("finish with swapped checksums: got %v, want a bad request", err)
+	}
+	finished, err := backend.FinishLargeFile(ctx, file.FileID, sha1s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if finished.ContentLength != int64(len(whole)) || finished.FileInfo[storage.LargeFileSha1] != sha1Hex(whole) {
+		t.Errorf("unexpected finished file %+v", finished)
+	}
+	if stored, ok := srv.File("large.bin"); !ok || !bytes.Equal(stored, whole) {
+		t.Errorf("stored %q, want %q", stored, whole)
+	}
+
+	if _, err := backend.ListParts(ctx, file.FileID, 1, 10); !errors.Is(err, storage.ErrBadRequest) {
+		t.Errorf("list parts of a finished file: got %v, want a bad request", err)
+	}
+}
+
+func TestCancelLargeFile(t *testing.T) {
+	_, backend := newBackend(t)
+	ctx := context.Background()
+
+	file, err := backend.StartLargeFile(ctx, "canceled.bin", "application/octet-stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.CancelLargeFile(ctx, file.FileID); err != nil {
+		t.Fatal(err)
+	}
+	unfinished, err := backend.ListUnfinishedLargeFiles(ctx, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unfinished.Files) != 0 {
+		t.Errorf("canceled file is still listed: %+v", unfinished.Files)
+	}
+}
+
+func TestListFiles(t *testing.T) {
+	_, backend := newBackend(t)
+	for _, name := range []string{"a.jpg", "b.jpg", "photos/c.jpg", "photos/d.jpg"} {
+		upload(t, backend, name, []byte(name))
+	}
+	ctx := context.Background()
+
+	list, err := backend.ListFiles(ctx, storage.ListFilesRequest{Delimiter: "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Files) != 2 || list.Files[0].FileName != "a.jpg" || list.Files[1].FileName != "b.jpg" {
+		t.Errorf("unexpected files %+v", list.Files)
+	}
+	if len(list.Folders) != 1 || list.Folders[0] != "photos/" {
+		t.Errorf("unexpected folders %v", list.Folders)
+	}
+
+	list, err = backend.ListFiles(ctx, storage.ListFilesRequest{MaxFileCount: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Files) != 3 || list.NextFileName != "photos/d.jpg" {
+		t.Errorf("unexpected first page %+v", list)
+	}
+	list, err = backend.ListFiles(ctx, storage.ListFilesRequest{StartFileName: list.NextFileName, MaxFileCount: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Files) != 1 || list.NextFileName != "" {
+		t.Errorf("unexpected last page %+v", list)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	srv, backend := newBackend(t)
+	ctx := context.Background()
+	file := upload(t, backend, "deleted.txt", []byte("gone"))
+
+	if err := backend.Delete(ctx, file.FileName, file.FileID); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := srv.File("deleted.txt"); ok {
+		t.Error("the file is still stored")
+	}
+	if _, err := backend.GetFileInfo(ctx, file.FileID); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("file info of a deleted file: got %v, want not found", err)
+	}
+	if err := backend.Delete(ctx, file.FileName, file.FileID); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("delete twice: got %v, want not found", err)
+	}
+}
+
+func TestDownloadURL(t *testing.T) {
+	_, backend := newBackend(t)
+	ctx := context.Background()
+	file := upload(t, backend, "photos/a b.jpg", []byte("photo"))
+
+	get := func(url string) (int, string) {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	signed, err := backend.DownloadURL(ctx, file, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, body := get(signed); status != http.StatusOK || body != "photo" {
+		t.Errorf("download of the signed url: %d %q", status, body)
+	}
+
+	// an authorization for the name would cover the backup as well
+	backup := upload(t, backend, "photos/a b.jpg.bak", []byte("backup"))
+	if _, err := backend.DownloadURL(ctx, file, time.Minute); !errors.Is(err, storage.ErrNotSignable) {
+		t.Errorf("url for a name which is the prefix of another file: got %v, want ErrNotSignable", err)
+	}
+
+	signed, err = backend.DownloadURL(ctx, backup, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, body := get(signed); status != http.StatusOK || body != "backup" {
+		t.Errorf("download of the backup: %d %q", status, body)
+	}
+	if status, _ := get(strings.Replace(signed, "a%20b.jpg.bak", "a%20b.jpg", 1)); status != http.StatusUnauthorized {
+		t.Errorf("the url of the backup opened another file: %d", status)
+	}
+
+	// the name would download the newest version instead of an older one
+	newer := upload(t, backend, "photos/a b.jpg.bak", []byte("newer backup"))
+	if _, err := backend.DownloadURL(ctx, backup, time.Minute); !errors.Is(err, storage.ErrNotSignable) {
+		t.Errorf("url for an older version: got %v, want ErrNotSignable", err)
+	}
+	signed, err = backend.DownloadURL(ctx, newer, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, body := get(signed); status != http.StatusOK || body != "newer backup" {
+		t.Errorf("download of the newest version: %d %q", status, body)
+	}
+}
+
+func TestExpiredTokenIsRefreshedOnce(t *testing.T) {
+	srv, backend := newBackend(t)
+	ctx := context.Background()
+	upload(t, backend, "a.jpg", []byte("a"))
+	srv.ExpireTokens()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := backend.ListFiles(ctx, storage.ListFilesRequest{})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if n := srv.Authorizations(); n != 2 {
+		t.Errorf("got %d authorizations, want a single shared refresh", n)
+	}
+
+	// the upload gets a new upload url with a token of the new authorization
+	srv.ExpireTokens()
+	upload(t, backend, "b.jpg", []byte("b"))
+	if n := srv.Authorizations(); n != 3 {
+		t.Errorf("got %d authorizations after the second expiry, want 3", n)
+	}
+}
+
+func TestRetryBusy(t *testing.T) {
+	srv, backend := newBackend(t)
+	ctx := context.Background()
+
+	srv.Fail("b2_list_file_names", 2, http.StatusTooManyRequests, "too_many_requests")
+	srv.Fail("b2_upload_file", 2, http.StatusServiceUnavailable, "service_unavailable")
+	if _, err := backend.ListFiles(ctx, storage.ListFilesRequest{}); err != nil {
+		t.Errorf("list after 429s: %v", err)
+	}
+	upload(t, backend, "retried.txt", []byte("retried"))
+
+	// the first try and 5 retries fail
+	srv.Fail("b2_list_file_names", 6, http.StatusServiceUnavailable, "service_unavailable")
+	_, err := backend.ListFiles(ctx, storage.ListFilesRequest{})
+	if !errors.Is(err, storage.ErrUnavailable) {
+		t.Errorf("got %v, want unavailable after the last retry", err)
+	}
+	if _, err := backend.ListFiles(ctx, storage.ListFilesRequest{}); err != nil {
+		t.Errorf("list after the faults: %v", err)
+	}
+}
+
+func TestNoRetryOnBadRequest(t *testing.T) {
+	srv, backend := newBackend(t)
+	ctx := context.Background()
+
+	srv.Fail("b2_list_file_names", 2, http.StatusBadRequest, "bad_request")
+	if _, err := backend.ListFiles(ctx, storage.ListFilesRequest{}); !errors.Is(err, storage.ErrBadRequest) {
+		t.Errorf("got %v, want a bad request", err)
+	}
+	// the second fault is still queued, since the first was not retried
+	if _, err := backend.ListFiles(ctx, storage.ListFilesRequest{}); !errors.Is(err, storage.ErrBadRequest) {
+		t.Errorf("got %v, want the second bad request", err)
+	}
+	if _, err := backend.ListFiles(ctx, storage.ListFilesRequest{}); err != nil {
+		t.Error(err)
+	}
+}
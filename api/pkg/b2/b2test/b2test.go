@@ -0,0 +1,893 @@
+// Package b2test provides an in-process fake of the Backblaze B2 native API
+// which keeps the files in memory. Point the b2 storage backend at it by
+// using the server url as BaseURL:
+//
+//	srv := b2test.NewServer()
+//	defer srv.Close()
+//	backend := b2.New(srv.Config())
+//
+// Part sizes are not checked, so large files can be tested with small parts.
+package b2test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"my.app/pkg/b2"
+)
+
+const (
+	// KeyID and ApplicationKey are the credentials accepted by the server
+	KeyID          = "test-key-id"
+	ApplicationKey = "test-application-key"
+
+	// BucketID and BucketName identify the only bucket of the server
+	BucketID   = "test-bucket-id"
+	BucketName = "test-bucket"
+
+	accountID = "test-account"
+)
+
+// Server is a fake B2 server
+type Server struct {
+	*httptest.Server
+
+	mu             sync.Mutex
+	tokens         map[string]bool
+	files          map[string]*file
+	clock          int64
+	authorizations int
+	faults         map[string][]fault
+	downloadTokens map[string]downloadToken
+}
+
+// downloadToken is a download authorization for the files with a name prefix
+type downloadToken struct {
+	prefix  string
+	expires time.Time
+}
+
+// fault is an error response which is sent instead of handling a request
+type fault struct {
+	status int
+	code   string
+}
+
+type file struct {
+	FileID          string            `json:"fileId"`
+	FileName        string            `json:"fileName"`
+	AccountID       string            `json:"accountId"`
+	BucketID        string            `json:"bucketId"`
+	Action          string            `json:"action"`
+	ContentLength   int64             `json:"contentLength"`
+	ContentSha1     string            `json:"contentSha1"`
+	ContentType     string            `json:"contentType"`
+	FileInfo        map[string]string `json:"fileInfo"`
+	UploadTimestamp int64             `json:"uploadTimestamp"`
+
+	data  []byte
+	parts map[int64]*part
+}
+
+type part struct {
+	FileID          string `json:"fileId"`
+	PartNumber      int64  `json:"partNumber"`
+	ContentLength   int64  `json:"contentLength"`
+	ContentSha1     string `json:"contentSha1"`
+	UploadTimestamp int64  `json:"uploadTimestamp"`
+
+	data []byte
+}
+
+// NewServer starts a fake B2 server. The caller has to close the server.
+func NewServer() *Server {
+	s := &Server{
+		tokens: make(map[string]bool),
+		files:  make(map[string]*file),
+		faults: make(map[string][]fault),
+
+		downloadTokens: make(map[string]downloadToken),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/b2api/v2/b2_authorize_account", s.authorizeAccount)
+	mux.HandleFunc("/b2api/v2/b2_list_file_names", s.authorized(s.listFileNames))
+	mux.HandleFunc("/b2api/v2/b2_get_upload_url", s.authorized(s.getUploadURL))
+	mux.HandleFunc("/b2api/v2/b2_upload_file/", s.authorized(s.uploadFile))
+	mux.HandleFunc("/b2api/v2/b2_start_large_file", s.authorized(s.startLargeFile))
+	mux.HandleFunc("/b2api/v2/b2_get_upload_part_url", s.authorized(s.getUploadPartURL))
+	mux.HandleFunc("/b2api/v2/b2_upload_part/", s.authorized(s.uploadPart))
+	mux.HandleFunc("/b2api/v2/b2_list_parts", s.authorized(s.listParts))
+	mux.HandleFunc("/b2api/v2/b2_finish_large_file", s.authorized(s.finishLargeFile))
+	mux.HandleFunc("/b2api/v2/b2_cancel_large_file", s.authorized(s.cancelLargeFile))
+	mux.HandleFunc("/b2api/v2/b2_list_unfinished_large_files", s.authorized(s.listUnfinishedLargeFiles))
+	mux.HandleFunc("/b2api/v2/b2_download_file_by_id", s.authorized(s.downloadFileByID))
+	mux.HandleFunc("/b2api/v2/b2_get_file_info", s.authorized(s.getFileInfo))
+	mux.HandleFunc("/file/", s.downloadFileByName)
+	mux.HandleFunc("/b2api/v2/b2_get_download_authorization", s.authorized(s.getDownloadAuthorization))
+	mux.HandleFunc("/b2api/v2/b2_list_buckets", s.authorized(s.listBuckets))
+	mux.HandleFunc("/b2api/v2/b2_delete_file_version", s.authorized(s.deleteFileVersion))
+
+	s.Server = httptest.NewServer(s.injectFaults(mux))
+	return s
+}
+
+// Config returns the configuration of a b2 storage backend which uses this server
+func (s *Server) Config() b2.Config {
+	return b2.Config{
+		KeyID:          KeyID,
+		ApplicationKey: ApplicationKey,
+		BucketID:       BucketID,
+		BaseURL:        s.URL,
+	}
+}
+
+// File returns the content of the latest version of a file, or false if it does not exist
+func (s *Server) File(fileName string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f := s.latest(fileName)
+	if f == nil {
+		return nil, false
+	}
+	return f.data, true
+}
+
+// ExpireTokens lets all authorization tokens issued so far expire.
+// Requests with these tokens fail with the expired_auth_token error.
+func (s *Server) ExpireTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for token := range s.tokens {
+		s.tokens[token] = false
+	}
+}
+
+// Authorizations returns the number of successful b2_authorize_account calls
+func (s *Server) Authorizations() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.authorizations
+}
+
+// Fail lets the next count calls of the endpoint, like "b2_list_file_names",
+// fail with the given status and error code. Retryable failures carry a
+// Retry-After of zero seconds so that clients retry without waiting.
+func (s *Server) Fail(endpoint string, count int, status int, code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := 0; i < count; i++ {
+		s.faults[endpoint] = append(s.faults[endpoint], fault{status: status, code: code})
+	}
+}
+
+// injectFaults wraps the handler of the server to send the faults added with Fail
+func (s *Server) injectFaults(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		endpoint := "b2_download_file_by_name"
+		if strings.HasPrefix(r.URL.Path, "/b2api/v2/") {
+			endpoint = strings.SplitN(strings.TrimPrefix(r.URL.Path, "/b2api/v2/"), "/", 2)[0]
+		}
+
+		s.mu.Lock()
+		faults := s.faults[endpoint]
+		if len(faults) == 0 {
+			s.mu.Unlock()
+			handler.ServeHTTP(w, r)
+			return
+		}
+		f := faults[0]
+		s.faults[endpoint] = faults[1:]
+		s.mu.Unlock()
+
+		switch f.status {
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+			w.Header().Set("Retry-After", "0")
+		}
+		writeError(w, f.status, f.code, "Injected fault")
+	})
+}
+
+// errorResponse is the error format of the B2 API
+type errorResponse struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	writeJSON(w, status, &errorResponse{Status: status, Code: code, Message: message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// authorized wraps a handler which needs a valid authorization token.
+// The handler is called with the lock of the server held.
+func (s *Server) authorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		token := r.Header.Get("Authorization")
+		if token == "" {
+			token = r.URL.Query().Get("Authorization")
+		}
+		valid, ok := s.tokens[token]
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "bad_auth_token", "Invalid authorization token")
+			return
+		}
+		if !valid {
+			writeError(w, http.StatusUnauthorized, "expired_auth_token", "Authorization token has expired")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// decode reads the json request body into v. It writes an error response and
+// returns false if the body is invalid.
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Only POST is supported")
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return false
+	}
+	return true
+}
+
+// newToken creates a new authorization token. The lock has to be held.
+func (s *Server) newToken() string {
+	token := "token_" + randomHex(16)
+	s.tokens[token] = true
+	return token
+}
+
+// now returns a strictly increasing timestamp in milliseconds. The lock has to be held.
+func (s *Server) now() int64 {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	if now <= s.clock {
+		now = s.clock + 1
+	}
+	s.clock = now
+	return now
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func sha1Hex(data []byte) string {
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// latest returns the latest uploaded version of a file. The lock has to be held.
+func (s *Server) latest(fileName string) *file {
+	var latest *file
+	for _, f := range s.files {
+		if f.FileName == fileName && f.Action == "upload" && (latest == nil || f.UploadTimestamp > latest.UploadTimestamp) {
+			latest = f
+		}
+	}
+	return latest
+}
+
+func (s *Server) authorizeAccount(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Basic ")
+	credentials, err := base64.StdEncoding.DecodeString(auth)
+	if err != nil || string(credentials) != KeyID+":"+ApplicationKey {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Invalid application key")
+		return
+	}
+
+	s.authorizations++
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"accountId":               accountID,
+		"apiUrl":                  s.URL,
+		"downloadUrl":             s.URL,
+		"authorizationToken":      s.newToken(),
+		"recommendedPartSize":     100000000,
+		"absoluteMinimumPartSize": 5000000,
+		"allowed": map[string]interface{}{
+			"bucketId":     BucketID,
+			"bucketName":   BucketName,
+			"capabilities": []string{"listFiles", "readFiles", "writeFiles", "deleteFiles"},
+		},
+	})
+}
+
+func (s *Server) listFileNames(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		BucketID      string `json:"bucketId"`
+		StartFileName string `json:"startFileName"`
+		MaxFileCount  int    `json:"maxFileCount"`
+		Prefix        string `json:"prefix"`
+		Delimiter     string `json:"delimiter"`
+	}{}
+	if !decode(w, r, &req) {
+		return
+	}
+	if req.BucketID != BucketID {
+		writeError(w, http.StatusBadRequest, "bad_bucket_id", "Invalid bucketId")
+		return
+	}
+	if req.MaxFileCount <= 0 {
+		req.MaxFileCount = 100
+	}
+	if req.MaxFileCount > 10000 {
+		writeError(w, http.StatusBadRequest, "bad_request", "maxFileCount out of range")
+		return
+	}
+
+	// collect the latest version of each name, or the folder which contains it
+	entries := make(map[string]*file)
+	for _, f := range s.files {
+		if f.Action != "upload" || !strings.HasPrefix(f.FileName, req.Prefix) {
+			continue
+		}
+		name := f.FileName
+		if req.Delimiter != "" {
+			if i := strings.Index(name[len(req.Prefix):], req.Delimiter); i >= 0 {
+				folder := name[:len(req.Prefix)+i+len(req.Delimiter)]
+				entries[folder] = &file{FileName: folder, Action: "folder", FileInfo: map[string]string{}}
+				continue
+			}
+		}
+		if other, ok := entries[name]; !ok || other.UploadTimestamp < f.UploadTimestamp {
+			entries[name] = f
+		}
+	}
+
+	names := []string{}
+	for name := range entries {
+		if name >= req.StartFileName {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	response := struct {
+		Files        []*file `json:"files"`
+		NextFileName *string `json:"nextFileName"`
+	}{Files: []*file{}}
+	for _, name := range names {
+		if len(response.Files) == req.MaxFileCount {
+			next := name
+			response.NextFileName = &next
+			break
+		}
+		response.Files = append(response.Files, entries[name])
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) getUploadURL(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		BucketID string `json:"bucketId"`
+	}{}
+	if !decode(w, r, &req) {
+		return
+	}
+	if req.BucketID != BucketID {
+		writeError(w, http.StatusBadRequest, "bad_bucket_id", "Invalid bucketId")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"bucketId":           BucketID,
+		"uploadUrl":          s.URL + "/b2api/v2/b2_upload_file/" + BucketID,
+		"authorizationToken": s.newToken(),
+	})
+}
+
+// readContent reads a request body and checks it against the Content-Length
+// and X-Bz-Content-Sha1 headers. It writes an error response and returns false
+// if they do not match.
+func readContent(w http.ResponseWriter, r *http.Request) ([]byte, string, bool) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Only POST is supported")
+		return nil, "", false
+	}
+	if r.ContentLength < 0 {
+		writeError(w, http.StatusLengthRequired, "bad_request", "Content-Length is required")
+		return nil, "", false
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil || int64(len(data)) != r.ContentLength {
+		writeError(w, http.StatusBadRequest, "bad_request", "Content-Length does not match the received content")
+		return nil, "", false
+	}
+
+	expected := r.Header.Get("X-Bz-Content-Sha1")
+	switch expected {
+	case "":
+		writeError(w, http.StatusBadRequest, "bad_request", "Missing X-Bz-Content-Sha1 header")
+		return nil, "", false
+	case "do_not_verify":
+		return data, sha1Hex(data), true
+	case "hex_digits_at_end":
+		if len(data) < 40 {
+			writeError(w, http.StatusBadRequest, "bad_request", "Missing checksum at the end of the content")
+			return nil, "", false
+		}
+		expected = string(data[len(data)-40:])
+		data = data[:len(data)-40]
+	}
+	sum := sha1Hex(data)
+	if !strings.EqualFold(expected, sum) {
+		writeError(w, http.StatusBadRequest, "bad_request", "Sha1 did not match data received")
+		return nil, "", false
+	}
+	return data, sum, true
+}
+
+func (s *Server) uploadFile(w http.ResponseWriter, r *http.Request) {
+	if strings.TrimPrefix(r.URL.Path, "/b2api/v2/b2_upload_file/") != BucketID {
+		writeError(w, http.StatusBadRequest, "bad_bucket_id", "Invalid bucketId")
+		return
+	}
+	fileName, err := url.PathUnescape(r.Header.Get("X-Bz-File-Name"))
+	if err != nil || fileName == "" {
+		writeError(w, http.StatusBadRequest, "bad_request", "Invalid X-Bz-File-Name header")
+		return
+	}
+	data, sum, ok := readContent(w, r)
+	if !ok {
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" || contentType == "b2/x-auto" {
+		contentType = mime.TypeByExtension(path.Ext(fileName))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+	}
+	fileInfo := make(map[string]string)
+	for name := range r.Header {
+		if strings.HasPrefix(name, "X-Bz-Info-") {
+			value, _ := url.PathUnescape(r.Header.Get(name))
+			fileInfo[strings.ToLower(strings.TrimPrefix(name, "X-Bz-Info-"))] = value
+		}
+	}
+
+	f := &file{
+		FileID:          "4_z" + randomHex(20),
+		FileName:        fileName,
+		AccountID:       accountID,
+		BucketID:        BucketID,
+		Action:          "upload",
+		ContentLength:   int64(len(data)),
+		ContentSha1:     sum,
+		ContentType:     contentType,
+		FileInfo:        fileInfo,
+		UploadTimestamp: s.now(),
+		data:            data,
+	}
+	s.files[f.FileID] = f
+	writeJSON(w, http.StatusOK, f)
+}
+
+func (s *Server) startLargeFile(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		BucketID    string            `json:"bucketId"`
+		FileName    string            `json:"fileName"`
+		ContentType string            `json:"contentType"`
+		FileInfo    map[string]string `json:"fileInfo"`
+	}{}
+	if !decode(w, r, &req) {
+		return
+	}
+	if req.BucketID != BucketID {
+		writeError(w, http.StatusBadRequest, "bad_bucket_id", "Invalid bucketId")
+		return
+	}
+	if req.FileName == "" || req.ContentType == "" {
+		writeError(w, http.StatusBadRequest, "bad_request", "fileName and contentType are required")
+		return
+	}
+	if req.ContentType == "b2/x-auto" {
+		req.ContentType = mime.TypeByExtension(path.Ext(req.FileName))
+		if req.ContentType == "" {
+			req.ContentType = "application/octet-stream"
+		}
+	}
+	if req.FileInfo == nil {
+		req.FileInfo = make(map[string]string)
+	}
+
+	f := &file{
+		FileID:          "4_z" + randomHex(20),
+		FileName:        req.FileName,
+		AccountID:       accountID,
+		BucketID:        BucketID,
+		Action:          "start",
+		ContentSha1:     "none",
+		ContentType:     req.ContentType,
+		FileInfo:        req.FileInfo,
+		UploadTimestamp: s.now(),
+		parts:           make(map[int64]*part),
+	}
+	s.files[f.FileID] = f
+	writeJSON(w, http.StatusOK, f)
+}
+
+// unfinished returns the large file with the given id if it has not been
+// finished yet. It writes an error response and returns nil otherwise.
+func (s *Server) unfinished(w http.ResponseWriter, fileID string) *file {
+	f, ok := s.files[fileID]
+	if !ok || f.Action != "start" {
+		writeError(w, http.StatusBadRequest, "bad_request", "No active upload for: "+fileID)
+		return nil
+	}
+	return f
+}
+
+func (s *Server) getUploadPartURL(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		FileID string `json:"fileId"`
+	}{}
+	if !decode(w, r, &req) {
+		return
+	}
+	if s.unfinished(w, req.FileID) == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"fileId":             req.FileID,
+		"uploadUrl":          s.URL + "/b2api/v2/b2_upload_part/" + req.FileID,
+		"authorizationToken": s.newToken(),
+	})
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, r *http.Request) {
+	f := s.unfinished(w, strings.TrimPrefix(r.URL.Path, "/b2api/v2/b2_upload_part/"))
+	if f == nil {
+		return
+	}
+	partNumber, err := strconv.ParseInt(r.Header.Get("X-Bz-Part-Number"), 10, 64)
+	if err != nil || partNumber < 1 || partNumber > 10000 {
+		writeError(w, http.StatusBadRequest, "bad_request", "Invalid X-Bz-Part-Number header")
+		return
+	}
+	data, sum, ok := readContent(w, r)
+	if !ok {
+		return
+	}
+
+	p := &part{
+		FileID:          f.FileID,
+		PartNumber:      partNumber,
+		ContentLength:   int64(len(data)),
+		ContentSha1:     sum,
+		UploadTimestamp: s.now(),
+		data:            data,
+	}
+	f.parts[partNumber] = p
+	writeJSON(w, http.StatusOK, p)
+}
+
+func (s *Server) listParts(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		FileID          string `json:"fileId"`
+		StartPartNumber int64  `json:"startPartNumber"`
+		MaxPartCount    int    `json:"maxPartCount"`
+	}{}
+	if !decode(w, r, &req) {
+		return
+	}
+	f := s.unfinished(w, req.FileID)
+	if f == nil {
+		return
+	}
+	if req.MaxPartCount <= 0 {
+		req.MaxPartCount = 100
+	}
+	if req.MaxPartCount > 1000 {
+		writeError(w, http.StatusBadRequest, "bad_request", "maxPartCount out of range")
+		return
+	}
+
+	numbers := []int64{}
+	for n := range f.parts {
+		if n >= req.StartPartNumber {
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+
+	response := struct {
+		Parts          []*part `json:"parts"`
+		NextPartNumber *int64  `json:"nextPartNumber"`
+	}{Parts: []*part{}}
+	for _, n := range numbers {
+		if len(response.Parts) == req.MaxPartCount {
+			next := n
+			response.NextPartNumber = &next
+			break
+		}
+		response.Parts = append(response.Parts, f.parts[n])
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) cancelLargeFile(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		FileID string `json:"fileId"`
+	}{}
+	if !decode(w, r, &req) {
+		return
+	}
+	f := s.unfinished(w, req.FileID)
+	if f == nil {
+		return
+	}
+	delete(s.files, f.FileID)
+	writeJSON(w, http.StatusOK, map[string]string{
+		"accountId": accountID,
+		"bucketId":  BucketID,
+		"fileId":    f.FileID,
+		"fileName":  f.FileName,
+	})
+}
+
+func (s *Server) listUnfinishedLargeFiles(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		BucketID     string `json:"bucketId"`
+		StartFileID  string `json:"startFileId"`
+		MaxFileCount int    `json:"maxFileCount"`
+	}{}
+	if !decode(w, r, &req) {
+		return
+	}
+	if req.BucketID != BucketID {
+		writeError(w, http.StatusBadRequest, "bad_bucket_id", "Invalid bucketId")
+		return
+	}
+	if req.MaxFileCount <= 0 {
+		req.MaxFileCount = 100
+	}
+	if req.MaxFileCount > 100 {
+		writeError(w, http.StatusBadRequest, "bad_request", "maxFileCount out of range")
+		return
+	}
+
+	ids := []string{}
+	for id, f := range s.files {
+		if f.Action == "start" && id >= req.StartFileID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	response := struct {
+		Files      []*file `json:"files"`
+		NextFileID *string `json:"nextFileId"`
+	}{Files: []*file{}}
+	for _, id := range ids {
+		if len(response.Files) == req.MaxFileCount {
+			next := id
+			response.NextFileID = &next
+			break
+		}
+		response.Files = append(response.Files, s.files[id])
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) finishLargeFile(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		FileID        string   `json:"fileId"`
+		PartSha1Array []string `json:"partSha1Array"`
+	}{}
+	if !decode(w, r, &req) {
+		return
+	}
+	f := s.unfinished(w, req.FileID)
+	if f == nil {
+		return
+	}
+	if len(req.PartSha1Array) == 0 || len(req.PartSha1Array) != len(f.parts) {
+		writeError(w, http.StatusBadRequest, "bad_request", "partSha1Array does not match the uploaded parts")
+		return
+	}
+
+	var data []byte
+	for i, sum := range req.PartSha1Array {
+		p, ok := f.parts[int64(i+1)]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "bad_request", "Part number "+strconv.Itoa(i+1)+" has not been uploaded")
+			return
+		}
+		if !strings.EqualFold(p.ContentSha1, sum) {
+			writeError(w, http.StatusBadRequest, "bad_request", "Sha1 of part "+strconv.Itoa(i+1)+" does not match")
+			return
+		}
+		data = append(data, p.data...)
+	}
+
+	f.Action = "upload"
+	f.ContentLength = int64(len(data))
+	f.data = data
+	f.parts = nil
+	writeJSON(w, http.StatusOK, f)
+}
+
+// serveFile writes the content of a file as download response
+func serveFile(w http.ResponseWriter, r *http.Request, f *file) {
+	header := w.Header()
+	header.Set("Content-Type", f.ContentType)
+	header.Set("X-Bz-File-Id", f.FileID)
+	header.Set("X-Bz-File-Name", url.PathEscape(f.FileName))
+	header.Set("X-Bz-Content-Sha1", f.ContentSha1)
+	header.Set("X-Bz-Upload-Timestamp", strconv.FormatInt(f.UploadTimestamp, 10))
+	for name, value := range f.FileInfo {
+		header.Set("X-Bz-Info-"+name, url.PathEscape(value))
+	}
+	http.ServeContent(w, r, "", time.Unix(0, f.UploadTimestamp*int64(time.Millisecond)), bytes.NewReader(f.data))
+}
+
+func (s *Server) downloadFileByID(w http.ResponseWriter, r *http.Request) {
+	f, ok := s.files[r.URL.Query().Get("fileId")]
+	if !ok || f.Action != "upload" {
+		writeError(w, http.StatusNotFound, "not_found", "File not present")
+		return
+	}
+	serveFile(w, r, f)
+}
+
+func (s *Server) getFileInfo(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		FileID string `json:"fileId"`
+	}{}
+	if !decode(w, r, &req) {
+		return
+	}
+	f, ok := s.files[req.FileID]
+	if !ok || f.Action != "upload" {
+		writeError(w, http.StatusNotFound, "not_found", "File not present: "+req.FileID)
+		return
+	}
+	writeJSON(w, http.StatusOK, f)
+}
+
+// downloadFileByName serves a file for an account authorization token or a
+// download authorization which covers the name of the file
+func (s *Server) downloadFileByName(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := strings.TrimPrefix(r.URL.Path, "/file/")
+	if !strings.HasPrefix(name, BucketName+"/") {
+		writeError(w, http.StatusNotFound, "not_found", "Bucket does not exist")
+		return
+	}
+	name = strings.TrimPrefix(name, BucketName+"/")
+
+	token := r.Header.Get("Authorization")
+	if token == "" {
+		token = r.URL.Query().Get("Authorization")
+	}
+	download, isDownloadToken := s.downloadTokens[token]
+	switch {
+	case isDownloadToken && time.Now().After(download.expires):
+		writeError(w, http.StatusUnauthorized, "expired_auth_token", "Authorization token has expired")
+		return
+	case isDownloadToken && !strings.HasPrefix(name, download.prefix):
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Download authorization does not cover this file")
+		return
+	case !isDownloadToken && !s.tokens[token]:
+		writeError(w, http.StatusUnauthorized, "bad_auth_token", "Invalid authorization token")
+		return
+	}
+
+	f := s.latest(name)
+	if f == nil {
+		writeError(w, http.StatusNotFound, "not_found", "File not present")
+		return
+	}
+	serveFile(w, r, f)
+}
+
+func (s *Server) getDownloadAuthorization(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		BucketID               string `json:"bucketId"`
+		FileNamePrefix         string `json:"fileNamePrefix"`
+		ValidDurationInSeconds int64  `json:"validDurationInSeconds"`
+	}{}
+	if !decode(w, r, &req) {
+		return
+	}
+	if req.BucketID != BucketID {
+		writeError(w, http.StatusBadRequest, "bad_bucket_id", "Invalid bucketId")
+		return
+	}
+	if req.ValidDurationInSeconds < 1 || req.ValidDurationInSeconds > 604800 {
+		writeError(w, http.StatusBadRequest, "bad_request", "validDurationInSeconds out of range")
+		return
+	}
+
+	token := "download_" + randomHex(16)
+	s.downloadTokens[token] = downloadToken{
+		prefix:  req.FileNamePrefix,
+		expires: time.Now().Add(time.Duration(req.ValidDurationInSeconds) * time.Second),
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"bucketId":           BucketID,
+		"fileNamePrefix":     req.FileNamePrefix,
+		"authorizationToken": token,
+	})
+}
+
+func (s *Server) listBuckets(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		AccountID string `json:"accountId"`
+		BucketID  string `json:"bucketId"`
+	}{}
+	if !decode(w, r, &req) {
+		return
+	}
+	if req.AccountID != accountID {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Invalid accountId")
+		return
+	}
+
+	buckets := []map[string]string{}
+	if req.BucketID == "" || req.BucketID == BucketID {
+		buckets = append(buckets, map[string]string{
+			"accountId":  accountID,
+			"bucketId":   BucketID,
+			"bucketName": BucketName,
+			"bucketType": "allPrivate",
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"buckets": buckets})
+}
+
+func (s *Server) deleteFileVersion(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		FileName string `json:"fileName"`
+		FileID   string `json:"fileId"`
+	}{}
+	if !decode(w, r, &req) {
+		return
+	}
+	f, ok := s.files[req.FileID]
+	if !ok || f.FileName != req.FileName {
+		writeError(w, http.StatusBadRequest, "file_not_present", "File not present: "+req.FileName+" "+req.FileID)
+		return
+	}
+	delete(s.files, req.FileID)
+	writeJSON(w, http.StatusOK, map[string]string{"fileId": f.FileID, "fileName": f.FileName})
+}
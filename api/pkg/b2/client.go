@@ -0,0 +1,279 @@
+package b2
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AuthorizeResponse defines the parameter for the authorization response from B2
+type AuthorizeResponse struct {
+	AccountID          string `json:"accountId"`
+	APIURL             string `json:"apiUrl"`
+	AuthorizationToken string `json:"authorizationToken"`
+	DownloadURL        string `json:"downloadUrl"`
+
+	// Allowed holds the restrictions of the application key
+	Allowed struct {
+		BucketID   string `json:"bucketId"`
+		BucketName string `json:"bucketName"`
+	} `json:"allowed"`
+}
+
+// DefaultBaseURL is the url of the B2 API used to authorize the account
+const DefaultBaseURL = "https://api.backblazeb2.com"
+
+const (
+	// maxRetries is the number of times a failed request is retried
+	maxRetries = 5
+
+	// minBackoff and maxBackoff limit the wait before a retry, which doubles
+	// with every attempt unless B2 sends a Retry-After header
+	minBackoff = 1 * time.Second
+	maxBackoff = 64 * time.Second
+)
+
+// Client is a client for the B2 native API. It authorizes the account when
+// needed, refreshes expired authorizations and retries requests which failed
+// because B2 was busy.
+type Client struct {
+	keyID          string
+	applicationKey string
+	baseURL        string
+	httpClient     *http.Client
+	auth           authCache
+}
+
+// NewClient creates a client for the account with the given application key.
+// The baseURL is used to authorize the account, DefaultBaseURL if empty.
+func NewClient(keyID string, applicationKey string, baseURL string) *Client {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	c := &Client{
+		keyID:          keyID,
+		applicationKey: applicationKey,
+		baseURL:        baseURL,
+	}
+	c.httpClient = &http.Client{
+		CheckRedirect: c.redirectPolicyFunc,
+	}
+	return c
+}
+
+func (c *Client) redirectPolicyFunc(req *http.Request, via []*http.Request) error {
+	req.Header.Add("Authorization", "Basic "+basicAuth(c.keyID, c.applicationKey))
+	return nil
+}
+
+func basicAuth(username, password string) string {
+	auth := username + ":" + password
+	return base64.StdEncoding.EncodeToString([]byte(auth))
+}
+
+// Authorization returns the account authorization, which is cached by the client
+func (c *Client) Authorization(ctx context.Context) (*AuthorizeResponse, error) {
+	return c.auth.get(ctx, c.authorizeAccount)
+}
+
+// authorizeAccount requests a new account authorization. Use the cached
+// authorization in c.auth instead of calling it directly.
+func (c *Client) authorizeAccount(ctx context.Context) (*AuthorizeResponse, error) {
+
+	authorizeURL := c.baseURL + "/b2api/v2/b2_authorize_account"
+
+	resp, err := c.send(ctx, "b2_authorize_account", func() (*http.Request, error) {
+		request, err := http.NewRequestWithContext(ctx, "GET", authorizeURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Add("Authorization", "Basic "+basicAuth(c.keyID, c.applicationKey))
+		return request, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	authorization := new(AuthorizeResponse)
+	if err := json.NewDecoder(resp.Body).Decode(authorization); err != nil {
+		return nil, err
+	}
+	return authorization, nil
+}
+
+// Do sends a request with the account authorization to the B2 API. The
+// request is created for every attempt, so newRequest has to return a fresh
+// body each time. If B2 reports that the token has expired, the authorization
+// is refreshed and the request is sent once more. Failed requests are
+// returned as *Error.
+func (c *Client) Do(ctx context.Context, endpoint string, newRequest func(auth *AuthorizeResponse) (*http.Request, error)) (*http.Response, error) {
+	for refreshed := false; ; refreshed = true {
+		auth, err := c.Authorization(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := c.send(ctx, endpoint, func() (*http.Request, error) {
+			request, err := newRequest(auth)
+			if err != nil {
+				return nil, err
+			}
+			request.Header.Set("Authorization", auth.AuthorizationToken)
+			return request, nil
+		})
+
+		apiErr := &Error{}
+		if !refreshed && errors.As(err, &apiErr) && apiErr.Code == "expired_auth_token" {
+			c.auth.invalidate(auth)
+			continue
+		}
+		return resp, err
+	}
+}
+
+// Call sends a json request to an endpoint of the B2 API and decodes the response into v
+func (c *Client) Call(ctx context.Context, endpoint string, body interface{}, v interface{}) error {
+
+	requestBody, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.Do(ctx, endpoint, func(auth *AuthorizeResponse) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "POST", auth.APIURL+"/b2api/v2/"+endpoint, bytes.NewReader(requestBody))
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Upload sends content to an upload url and decodes the response into v.
+// B2 asks clients to get a new upload url when an upload fails, so getURL is
+// called for every attempt and returns the url and its authorization token.
+func (c *Client) Upload(ctx context.Context, endpoint string, getURL func() (string, string, error), header http.Header, body io.ReadSeeker, contentLength int64, v interface{}) error {
+	for attempt := 0; ; attempt++ {
+		uploadURL, token, err := getURL()
+		if err != nil {
+			return err
+		}
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		// the body is not closed by the client, it is needed again for a retry
+		var requestBody io.Reader = http.NoBody
+		if contentLength > 0 {
+			requestBody = ioutil.NopCloser(body)
+		}
+		request, err := http.NewRequestWithContext(ctx, "POST", uploadURL, requestBody)
+		if err != nil {
+			return err
+		}
+		request.ContentLength = contentLength
+		for name, values := range header {
+			request.Header[name] = values
+		}
+		request.Header.Set("Authorization", token)
+
+		var retryHeader http.Header
+		resp, err := c.httpClient.Do(request)
+		if err == nil {
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				defer resp.Body.Close()
+				return json.NewDecoder(resp.Body).Decode(v)
+			}
+			apiErr := parseError(endpoint, resp)
+			resp.Body.Close()
+			if !retryable(apiErr.Status) && apiErr.Status != http.StatusUnauthorized {
+				return apiErr
+			}
+			err, retryHeader = apiErr, resp.Header
+		} else if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if attempt == maxRetries {
+			return err
+		}
+
+		timer := time.NewTimer(retryDelay(retryHeader, attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// send sends a request and retries it with exponential backoff while B2
+// answers with a retryable status. Error responses are returned as *Error.
+func (c *Client) send(ctx context.Context, endpoint string, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		request, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := c.httpClient.Do(request)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return resp, nil
+		}
+
+		apiErr := parseError(endpoint, resp)
+		resp.Body.Close()
+		if !retryable(apiErr.Status) || attempt == maxRetries {
+			return nil, apiErr
+		}
+
+		timer := time.NewTimer(retryDelay(resp.Header, attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// retryDelay returns how long to wait before the retry after the given attempt.
+// The delay requested by B2 with Retry-After takes precedence over the backoff.
+func retryDelay(header http.Header, attempt int) time.Duration {
+	if retryAfter := header.Get("Retry-After"); retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second
+		}
+		if date, err := http.ParseTime(retryAfter); err == nil {
+			if delay := time.Until(date); delay > 0 {
+				return delay
+			}
+			return 0
+		}
+	}
+
+	backoff := maxBackoff
+	if attempt < 6 {
+		backoff = minBackoff << uint(attempt)
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	// add up to a second of jitter so that clients do not retry in lockstep
+	return backoff + time.Duration(rand.Int63n(int64(time.Second)))
+}
@@ -0,0 +1,68 @@
+package b2
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"my.app/pkg/storage"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter string
+		attempt    int
+		min, max   time.Duration
+	}{
+		{"first backoff", "", 0, time.Second, 2 * time.Second},
+		{"doubled backoff", "", 3, 8 * time.Second, 9 * time.Second},
+		{"maximum backoff", "", 6, maxBackoff, maxBackoff + time.Second},
+		{"long after the maximum", "", 40, maxBackoff, maxBackoff + time.Second},
+		{"retry after seconds", "7", 3, 7 * time.Second, 7 * time.Second},
+		{"retry after zero", "0", 5, 0, 0},
+		{"retry after a past date", "Mon, 02 Jan 2006 15:04:05 GMT", 0, 0, 0},
+		{"invalid retry after", "soon", 0, time.Second, 2 * time.Second},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.retryAfter != "" {
+			header.Set("Retry-After", tt.retryAfter)
+		}
+		delay := retryDelay(header, tt.attempt)
+		if delay < tt.min || delay > tt.max {
+			t.Errorf("%s: got %v, want between %v and %v", tt.name, delay, tt.min, tt.max)
+		}
+	}
+
+	header := http.Header{}
+	header.Set("Retry-After", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	if delay := retryDelay(header, 0); delay < 58*time.Second || delay > time.Minute {
+		t.Errorf("retry after a future date: got %v, want about a minute", delay)
+	}
+}
+
+func TestErrorIs(t *testing.T) {
+	tests := []struct {
+		err                        *Error
+		notFound, bad, unavailable bool
+	}{
+		{&Error{Status: http.StatusNotFound, Code: "not_found"}, true, false, false},
+		{&Error{Status: http.StatusBadRequest, Code: "file_not_present"}, true, false, false},
+		{&Error{Status: http.StatusBadRequest, Code: "bad_request"}, false, true, false},
+		{&Error{Status: http.StatusTooManyRequests, Code: "too_many_requests"}, false, false, true},
+		{&Error{Status: http.StatusServiceUnavailable, Code: "service_unavailable"}, false, false, true},
+		{&Error{Status: http.StatusUnauthorized, Code: "unauthorized"}, false, false, false},
+	}
+	for _, tt := range tests {
+		if got := tt.err.Is(storage.ErrNotFound); got != tt.notFound {
+			t.Errorf("%s: not found is %v", tt.err.Code, got)
+		}
+		if got := tt.err.Is(storage.ErrBadRequest); got != tt.bad {
+			t.Errorf("%s: bad request is %v", tt.err.Code, got)
+		}
+		if got := tt.err.Is(storage.ErrUnavailable); got != tt.unavailable {
+			t.Errorf("%s: unavailable is %v", tt.err.Code, got)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package b2
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"my.app/pkg/storage"
+)
+
+// Error is an error returned by the B2 API
+type Error struct {
+	// Endpoint is the B2 API call which failed
+	Endpoint string `json:"-"`
+
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("b2: %s failed: %d %s: %s", e.Endpoint, e.Status, e.Code, e.Message)
+}
+
+// Is maps the error to the errors of the storage package
+func (e *Error) Is(target error) bool {
+	switch target {
+	case storage.ErrNotFound:
+		return e.notFound()
+	case storage.ErrBadRequest:
+		return e.Status == http.StatusBadRequest && !e.notFound()
+	case storage.ErrUnavailable:
+		return retryable(e.Status)
+	}
+	return false
+}
+
+func (e *Error) notFound() bool {
+	return e.Status == http.StatusNotFound || e.Code == "not_found" || e.Code == "file_not_present"
+}
+
+// retryable reports whether a request which failed with the status should be retried
+func retryable(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusServiceUnavailable:
+		return true
+	}
+	return false
+}
+
+// parseError reads the error from a failed response. Responses without a
+// B2 error body, like those of a proxy, get the code from the HTTP status.
+func parseError(endpoint string, resp *http.Response) *Error {
+	apiErr := &Error{}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err == nil {
+		json.Unmarshal(body, apiErr)
+	}
+
+	apiErr.Endpoint = endpoint
+	apiErr.Status = resp.StatusCode
+	if apiErr.Code == "" {
+		apiErr.Code = "http_error"
+	}
+	if apiErr.Message == "" {
+		apiErr.Message = resp.Status
+	}
+	return apiErr
+}
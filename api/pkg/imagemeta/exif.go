@@ -0,0 +1,330 @@
+package imagemeta
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errInvalidTIFF = errors.New("imagemeta: invalid tiff structure")
+
+// tags of the TIFF and EXIF image file directories
+const (
+	tagImageWidth       = 0x0100
+	tagImageLength      = 0x0101
+	tagImageDescription = 0x010E
+	tagMake             = 0x010F
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagArtist           = 0x013B
+	tagXMP              = 0x02BC
+	tagCopyright        = 0x8298
+	tagIPTC             = 0x83BB
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+
+	tagExposureTime       = 0x829A
+	tagFNumber            = 0x829D
+	tagISO                = 0x8827
+	tagDateTimeOriginal   = 0x9003
+	tagOffsetTimeOriginal = 0x9011
+	tagFocalLength        = 0x920A
+	tagPixelXDimension    = 0xA002
+	tagPixelYDimension    = 0xA003
+	tagLensMake           = 0xA433
+	tagLensModel          = 0xA434
+
+	tagGPSLatitudeRef  = 0x0001
+	tagGPSLatitude     = 0x0002
+	tagGPSLongitudeRef = 0x0003
+	tagGPSLongitude    = 0x0004
+	tagGPSAltitudeRef  = 0x0005
+	tagGPSAltitude     = 0x0006
+)
+
+// sizes of the TIFF field types in bytes, by type
+var typeSizes = map[uint16]int{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4,
+}
+
+// maxIFDEntries limits the entries read from a single directory
+const maxIFDEntries = 1000
+
+// exifTimeLayout is the format of the dates in EXIF
+const exifTimeLayout = "2006:01:02 15:04:05"
+
+// tiff reads the image file directories of a TIFF structure
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// entry is a field of an image file directory
+type entry struct {
+	typ   uint16
+	count int
+	value []byte
+	order binary.ByteOrder
+}
+
+// readTIFF reads the metadata of a TIFF file, whose first directory carries
+// the EXIF fields and may carry IPTC and XMP records
+func readTIFF(r *bufio.Reader) ([]*Metadata, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	t, ifd0, err := openTIFF(data)
+	if err != nil {
+		return nil, err
+	}
+
+	found := metadata{exif: t.exif(ifd0)}
+	if e, ok := ifd0[tagIPTC]; ok {
+		found.iptc, _ = parseIPTC(e.value)
+	}
+	if e, ok := ifd0[tagXMP]; ok {
+		found.xmp, _ = parseXMP(e.value)
+	}
+	found.image = &Metadata{Width: ifd0.uint(tagImageWidth), Height: ifd0.uint(tagImageLength)}
+	return found.list(), nil
+}
+
+// parseExif reads the EXIF fields of a TIFF structure as embedded in JPEG,
+// PNG and WebP files
+func parseExif(data []byte) (*Metadata, error) {
+	t, ifd0, err := openTIFF(data)
+	if err != nil {
+		return nil, err
+	}
+	return t.exif(ifd0), nil
+}
+
+func openTIFF(data []byte) (*tiff, ifd, error) {
+	if len(data) < 8 {
+		return nil, nil, errInvalidTIFF
+	}
+	t := &tiff{data: data}
+	switch {
+	case bytes.HasPrefix(data, []byte("II*\x00")):
+		t.order = binary.LittleEndian
+	case bytes.HasPrefix(data, []byte("MM\x00*")):
+		t.order = binary.BigEndian
+	default:
+		return nil, nil, errInvalidTIFF
+	}
+
+	ifd0, err := t.readIFD(t.order.Uint32(data[4:8]))
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, ifd0, nil
+}
+
+// exif reads the fields of the first directory and its EXIF and GPS directories
+func (t *tiff) exif(ifd0 ifd) *Metadata {
+	m := &Metadata{
+		Make:        ifd0.string(tagMake),
+		Model:       ifd0.string(tagModel),
+		Orientation: ifd0.uint(tagOrientation),
+		Caption:     ifd0.string(tagImageDescription),
+		Creator:     ifd0.string(tagArtist),
+		Copyright:   ifd0.string(tagCopyright),
+	}
+
+	if exifIFD, err := t.subIFD(ifd0, tagExifIFD); err == nil {
+		m.DateTimeOriginal = parseExifTime(exifIFD.string(tagDateTimeOriginal), exifIFD.string(tagOffsetTimeOriginal))
+		m.ExposureTime = exposureTime(exifIFD.rational(tagExposureTime, 0))
+		m.FNumber = round(exifIFD.float(tagFNumber, 0), 1)
+		m.ISO = exifIFD.uint(tagISO)
+		m.FocalLength = round(exifIFD.float(tagFocalLength, 0), 1)
+		m.Width = exifIFD.uint(tagPixelXDimension)
+		m.Height = exifIFD.uint(tagPixelYDimension)
+		m.LensMake = exifIFD.string(tagLensMake)
+		m.LensModel = exifIFD.string(tagLensModel)
+	}
+
+	if gpsIFD, err := t.subIFD(ifd0, tagGPSIFD); err == nil {
+		m.GPS = gpsPosition(gpsIFD)
+	}
+	return m
+}
+
+// ifd is an image file directory
+type ifd map[uint16]entry
+
+func (t *tiff) subIFD(parent ifd, tag uint16) (ifd, error) {
+	e, ok := parent[tag]
+	if !ok {
+		return nil, errInvalidTIFF
+	}
+	return t.readIFD(uint32(e.uint(0)))
+}
+
+func (t *tiff) readIFD(offset uint32) (ifd, error) {
+	if uint64(offset)+2 > uint64(len(t.data)) {
+		return nil, errInvalidTIFF
+	}
+	count := int(t.order.Uint16(t.data[offset:]))
+	if count > maxIFDEntries || uint64(offset)+2+uint64(count)*12 > uint64(len(t.data)) {
+		return nil, errInvalidTIFF
+	}
+
+	entries := make(ifd, count)
+	for i := 0; i < count; i++ {
+		raw := t.data[int(offset)+2+i*12:]
+		tag := t.order.Uint16(raw[0:2])
+		typ := t.order.Uint16(raw[2:4])
+		n := uint64(t.order.Uint32(raw[4:8]))
+
+		size, ok := typeSizes[typ]
+		if !ok {
+			continue
+		}
+		length := n * uint64(size)
+		var value []byte
+		if length <= 4 {
+			value = raw[8 : 8+length]
+		} else {
+			valueOffset := uint64(t.order.Uint32(raw[8:12]))
+			if valueOffset+length > uint64(len(t.data)) {
+				continue
+			}
+			value = t.data[valueOffset : valueOffset+length]
+		}
+		entries[tag] = entry{typ: typ, count: int(n), value: value, order: t.order}
+	}
+	return entries, nil
+}
+
+// uint returns the i-th value of a BYTE, SHORT or LONG field
+func (e entry) uint(i int) int {
+	if i >= e.count {
+		return 0
+	}
+	switch e.typ {
+	case 1, 7:
+		return int(e.value[i])
+	case 3:
+		return int(e.order.Uint16(e.value[i*2:]))
+	case 4, 13:
+		return int(e.order.Uint32(e.value[i*4:]))
+	}
+	return 0
+}
+
+// rational returns the i-th value of a RATIONAL or SRATIONAL field
+func (e entry) rational(i int) (int64, int64) {
+	if i >= e.count {
+		return 0, 0
+	}
+	switch e.typ {
+	case 5:
+		return int64(e.order.Uint32(e.value[i*8:])), int64(e.order.Uint32(e.value[i*8+4:]))
+	case 10:
+		return int64(int32(e.order.Uint32(e.value[i*8:]))), int64(int32(e.order.Uint32(e.value[i*8+4:])))
+	}
+	return 0, 0
+}
+
+func (d ifd) uint(tag uint16) int {
+	return d[tag].uint(0)
+}
+
+func (d ifd) rational(tag uint16, i int) (int64, int64) {
+	return d[tag].rational(i)
+}
+
+func (d ifd) float(tag uint16, i int) float64 {
+	num, den := d.rational(tag, i)
+	if den == 0 {
+		return 0
+	}
+	return float64(num) / float64(den)
+}
+
+// string returns the value of an ASCII field without padding
+func (d ifd) string(tag uint16) string {
+	e, ok := d[tag]
+	if !ok || e.typ != 2 {
+		return ""
+	}
+	if i := bytes.IndexByte(e.value, 0); i >= 0 {
+		e.value = e.value[:i]
+	}
+	return strings.TrimSpace(decodeText(e.value))
+}
+
+// parseExifTime parses an EXIF date, which is local time unless an offset is given
+func parseExifTime(value string, offset string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	if offset != "" {
+		if t, err := time.Parse(exifTimeLayout+"-07:00", value+offset); err == nil {
+			return t
+		}
+	}
+	t, err := time.Parse(exifTimeLayout, value)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// exposureTime formats an exposure time in seconds as fraction, e.g. "1/250"
+func exposureTime(num int64, den int64) string {
+	if num <= 0 || den <= 0 {
+		return ""
+	}
+	if num < den {
+		return "1/" + strconv.FormatInt(int64(math.Round(float64(den)/float64(num))), 10)
+	}
+	return strconv.FormatFloat(float64(num)/float64(den), 'f', -1, 64)
+}
+
+func gpsPosition(gps ifd) *GPS {
+	if _, ok := gps[tagGPSLatitude]; !ok {
+		return nil
+	}
+	if _, ok := gps[tagGPSLongitude]; !ok {
+		return nil
+	}
+
+	position := &GPS{
+		Latitude:  degrees(gps, tagGPSLatitude),
+		Longitude: degrees(gps, tagGPSLongitude),
+		Altitude:  round(gps.float(tagGPSAltitude, 0), 2),
+	}
+	if gps.string(tagGPSLatitudeRef) == "S" {
+		position.Latitude = -position.Latitude
+	}
+	if gps.string(tagGPSLongitudeRef) == "W" {
+		position.Longitude = -position.Longitude
+	}
+	if gps.uint(tagGPSAltitudeRef) == 1 {
+		position.Altitude = -position.Altitude
+	}
+	if position.Latitude < -90 || position.Latitude > 90 || position.Longitude < -180 || position.Longitude > 180 {
+		return nil
+	}
+	return position
+}
+
+// degrees converts a GPS coordinate of degrees, minutes and seconds
+func degrees(gps ifd, tag uint16) float64 {
+	value := gps.float(tag, 0) + gps.float(tag, 1)/60 + gps.float(tag, 2)/3600
+	return round(value, 7)
+}
+
+func round(value float64, places int) float64 {
+	factor := math.Pow(10, float64(places))
+	return math.Round(value*factor) / factor
+}
@@ -0,0 +1,173 @@
+// Package imagemeta reads the EXIF, IPTC and XMP metadata embedded in JPEG,
+// TIFF, PNG and WebP images.
+package imagemeta
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// ErrUnsupported is returned for files which are not in a supported image format
+var ErrUnsupported = errors.New("imagemeta: unsupported image format")
+
+// maxSize limits the bytes which are read from an image. The metadata of
+// JPEG, PNG and WebP files is read from the segments before the image data,
+// TIFF files are read into memory up to this size.
+const maxSize = 32 << 20
+
+// GPS is a position in WGS 84 coordinates
+type GPS struct {
+	Latitude  float64
+	Longitude float64
+	Altitude  float64
+}
+
+// Metadata holds the metadata of an image. Fields which the image does not
+// carry are left empty.
+type Metadata struct {
+	Width  int
+	Height int
+
+	// EXIF
+	Make             string
+	Model            string
+	LensMake         string
+	LensModel        string
+	Orientation      int
+	DateTimeOriginal time.Time
+	ExposureTime     string
+	FNumber          float64
+	ISO              int
+	FocalLength      float64
+	GPS              *GPS
+
+	// IPTC and XMP
+	Title     string
+	Caption   string
+	Keywords  []string
+	Creator   string
+	Credit    string
+	Copyright string
+	City      string
+	Country   string
+}
+
+// Extract reads the metadata of an image. EXIF values take precedence over
+// IPTC values, which take precedence over XMP values. The keywords of IPTC and
+// XMP are merged.
+func Extract(r io.Reader) (*Metadata, error) {
+	br := bufio.NewReader(io.LimitReader(r, maxSize))
+	header, _ := br.Peek(12)
+
+	var parts []*Metadata
+	var err error
+	switch {
+	case bytes.HasPrefix(header, []byte{0xFF, 0xD8}):
+		parts, err = readJPEG(br)
+	case bytes.HasPrefix(header, []byte("II*\x00")), bytes.HasPrefix(header, []byte("MM\x00*")):
+		parts, err = readTIFF(br)
+	case bytes.HasPrefix(header, pngSignature):
+		parts, err = readPNG(br)
+	case len(header) == 12 && string(header[:4]) == "RIFF" && string(header[8:]) == "WEBP":
+		parts, err = readWebP(br)
+	default:
+		return nil, ErrUnsupported
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m := new(Metadata)
+	for _, part := range parts {
+		m.merge(part)
+	}
+	return m, nil
+}
+
+// metadata collects the results of the parsers of a file by their source. The
+// dimensions of the image data take precedence over those recorded in EXIF,
+// which may be outdated if the image was resized.
+type metadata struct {
+	image, exif, iptc, xmp *Metadata
+}
+
+func (m *metadata) list() []*Metadata {
+	parts := []*Metadata{}
+	for _, part := range []*Metadata{m.image, m.exif, m.iptc, m.xmp} {
+		if part != nil {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+// merge fills the empty fields of m with the values of other
+func (m *Metadata) merge(other *Metadata) {
+	mergeInt(&m.Width, other.Width)
+	mergeInt(&m.Height, other.Height)
+	mergeString(&m.Make, other.Make)
+	mergeString(&m.Model, other.Model)
+	mergeString(&m.LensMake, other.LensMake)
+	mergeString(&m.LensModel, other.LensModel)
+	mergeInt(&m.Orientation, other.Orientation)
+	if m.DateTimeOriginal.IsZero() {
+		m.DateTimeOriginal = other.DateTimeOriginal
+	}
+	mergeString(&m.ExposureTime, other.ExposureTime)
+	if m.FNumber == 0 {
+		m.FNumber = other.FNumber
+	}
+	mergeInt(&m.ISO, other.ISO)
+	if m.FocalLength == 0 {
+		m.FocalLength = other.FocalLength
+	}
+	if m.GPS == nil {
+		m.GPS = other.GPS
+	}
+	mergeString(&m.Title, other.Title)
+	mergeString(&m.Caption, other.Caption)
+	mergeString(&m.Creator, other.Creator)
+	mergeString(&m.Credit, other.Credit)
+	mergeString(&m.Copyright, other.Copyright)
+	mergeString(&m.City, other.City)
+	mergeString(&m.Country, other.Country)
+
+	for _, keyword := range other.Keywords {
+		if !containsFold(m.Keywords, keyword) {
+			m.Keywords = append(m.Keywords, keyword)
+		}
+	}
+}
+
+func mergeString(dst *string, value string) {
+	if *dst == "" {
+		*dst = value
+	}
+}
+
+func mergeInt(dst *int, value int) {
+	if *dst == 0 {
+		*dst = value
+	}
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// addKeyword adds a keyword which is not empty and not yet in the list
+func (m *Metadata) addKeyword(keyword string) {
+	keyword = strings.TrimSpace(keyword)
+	if keyword != "" && !containsFold(m.Keywords, keyword) {
+		m.Keywords = append(m.Keywords, keyword)
+	}
+}
@@ -0,0 +1,399 @@
+package imagemeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The fixtures are built by the helpers below, so that every byte of them is
+// visible in the test.
+
+// field is an entry of an image file directory with its value in the byte
+// order of the file
+type field struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	data  []byte
+}
+
+// tiffWriter writes the fields and directories of a TIFF structure
+type tiffWriter struct {
+	order binary.ByteOrder
+}
+
+func (w tiffWriter) ascii(tag uint16, value string) field {
+	data := append([]byte(value), 0)
+	return field{tag, 2, uint32(len(data)), data}
+}
+
+func (w tiffWriter) byte(tag uint16, value byte) field {
+	return field{tag, 1, 1, []byte{value}}
+}
+
+func (w tiffWriter) short(tag uint16, value uint16) field {
+	data := make([]byte, 2)
+	w.order.PutUint16(data, value)
+	return field{tag, 3, 1, data}
+}
+
+func (w tiffWriter) long(tag uint16, value uint32) field {
+	data := make([]byte, 4)
+	w.order.PutUint32(data, value)
+	return field{tag, 4, 1, data}
+}
+
+// rational writes pairs of numerators and denominators
+func (w tiffWriter) rational(tag uint16, values ...uint32) field {
+	data := make([]byte, 4*len(values))
+	for i, v := range values {
+		w.order.PutUint32(data[4*i:], v)
+	}
+	return field{tag, 5, uint32(len(values) / 2), data}
+}
+
+func (w tiffWriter) undefined(tag uint16, data []byte) field {
+	return field{tag, 7, uint32(len(data)), data}
+}
+
+// build writes a TIFF structure with the first directory and the EXIF and GPS
+// directories, which are left out if they are nil
+func (w tiffWriter) build(ifd0 []field, exif []field, gps []field) []byte {
+	dirs := [][]field{ifd0}
+	pointers := []uint16{}
+	if exif != nil {
+		dirs, pointers = append(dirs, exif), append(pointers, tagExifIFD)
+	}
+	if gps != nil {
+		dirs, pointers = append(dirs, gps), append(pointers, tagGPSIFD)
+	}
+	for _, tag := range pointers {
+		dirs[0] = append(dirs[0], w.long(tag, 0))
+	}
+
+	offsets := []uint32{8}
+	for _, dir := range dirs {
+		offsets = append(offsets, offsets[len(offsets)-1]+dirSize(dir))
+	}
+	for i, tag := range pointers {
+		dirs[0][len(dirs[0])-len(pointers)+i] = w.long(tag, offsets[i+1])
+	}
+
+	out := make([]byte, 8)
+	if w.order == binary.LittleEndian {
+		copy(out, "II*\x00")
+	} else {
+		copy(out, "MM\x00*")
+	}
+	w.order.PutUint32(out[4:], 8)
+	for i, dir := range dirs {
+		out = append(out, w.dir(dir, offsets[i])...)
+	}
+	return out
+}
+
+// dirSize returns the bytes of a directory and its values
+func dirSize(dir []field) uint32 {
+	size := uint32(2 + 12*len(dir) + 4)
+	for _, f := range dir {
+		if len(f.data) > 4 {
+			size += uint32(len(f.data) + len(f.data)%2)
+		}
+	}
+	return size
+}
+
+// dir writes a directory at offset, followed by the values which do not fit
+// into its entries
+func (w tiffWriter) dir(dir []field, offset uint32) []byte {
+	entries := make([]byte, 2, 2+12*len(dir)+4)
+	w.order.PutUint16(entries, uint16(len(dir)))
+	values := []byte{}
+	valueOffset := offset + uint32(2+12*len(dir)+4)
+
+	for _, f := range dir {
+		entry := make([]byte, 12)
+		w.order.PutUint16(entry[0:], f.tag)
+		w.order.PutUint16(entry[2:], f.typ)
+		w.order.PutUint32(entry[4:], f.count)
+		if len(f.data) <= 4 {
+			copy(entry[8:], f.data)
+		} else {
+			w.order.PutUint32(entry[8:], valueOffset+uint32(len(values)))
+			values = append(values, f.data...)
+			if len(f.data)%2 != 0 {
+				values = append(values, 0)
+			}
+		}
+		entries = append(entries, entry...)
+	}
+	entries = append(entries, 0, 0, 0, 0)
+	return append(entries, values...)
+}
+
+// jpeg writes a JPEG file with the segments and a frame header of the given
+// size, which is followed by the start of the scan
+func jpeg(width, height uint16, segments ...[]byte) []byte {
+	out := []byte{0xFF, 0xD8}
+	for _, segment := range segments {
+		out = append(out, segment...)
+	}
+	frame := []byte{8, byte(height >> 8), byte(height), byte(width >> 8), byte(width), 1, 1, 0x11, 0}
+	out = append(out, segment(0xC0, frame)...)
+	return append(out, 0xFF, 0xDA, 0, 2)
+}
+
+func segment(marker byte, data []byte) []byte {
+	out := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(out[2:], uint16(len(data)+2))
+	return append(out, data...)
+}
+
+func exifSegment(tiff []byte) []byte {
+	return segment(0xE1, append(append([]byte{}, exifPrefix...), tiff...))
+}
+
+func xmpSegment(packet string) []byte {
+	return segment(0xE1, append(append([]byte{}, xmpPrefix...), packet...))
+}
+
+// iptcSegment wraps IPTC datasets into the image resource block of a
+// Photoshop APP13 segment
+func iptcSegment(datasets ...[]byte) []byte {
+	iptc := bytes.Join(datasets, nil)
+	data := append([]byte{}, photoshopPrefix...)
+	data = append(data, "8BIM\x04\x04\x00\x00"...)
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(iptc)))
+	data = append(data, size...)
+	data = append(data, iptc...)
+	if len(iptc)%2 != 0 {
+		data = append(data, 0)
+	}
+	return segment(0xED, data)
+}
+
+func iptcDataset(dataset byte, value string) []byte {
+	out := []byte{0x1C, 2, dataset, byte(len(value) >> 8), byte(len(value))}
+	return append(out, value...)
+}
+
+const xmpPacket = `<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:dc="http://purl.org/dc/elements/1.1/"
+    xmlns:tiff="http://ns.adobe.com/tiff/1.0/"
+    xmlns:exif="http://ns.adobe.com/exif/1.0/"
+    xmlns:exifEX="http://cipa.jp/exif/1.0/"
+    xmlns:photoshop="http://ns.adobe.com/photoshop/1.0/"
+    tiff:Orientation="3"
+    photoshop:Country="France"
+    exif:GPSLatitude="43,41.7N"
+    exif:GPSLongitude="7,15.6E"
+    exif:DateTimeOriginal="2021-08-01T20:15:00+02:00">
+   <dc:title><rdf:Alt><rdf:li xml:lang="x-default">XMP title</rdf:li></rdf:Alt></dc:title>
+   <dc:subject><rdf:Bag><rdf:li>summer</rdf:li><rdf:li>holiday</rdf:li></rdf:Bag></dc:subject>
+   <exifEX:LensModel>XF23mmF2 R WR</exifEX:LensModel>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>`
+
+var (
+	little = tiffWriter{binary.LittleEndian}
+	big    = tiffWriter{binary.BigEndian}
+
+	// a TIFF file as written by a camera
+	tiffFixture = little.build(
+		[]field{
+			little.long(tagImageWidth, 640),
+			little.long(tagImageLength, 480),
+			little.ascii(tagImageDescription, "A lake"),
+			little.ascii(tagMake, "Canon"),
+			little.ascii(tagModel, "EOS 5D"),
+			little.short(tagOrientation, 6),
+			little.ascii(tagArtist, "Jane Doe"),
+			little.ascii(tagCopyright, "(c) Jane Doe"),
+		},
+		[]field{
+			little.ascii(tagDateTimeOriginal, "2020:07:14 18:30:05"),
+			little.ascii(tagOffsetTimeOriginal, "+02:00"),
+			little.rational(tagExposureTime, 1, 250),
+			little.rational(tagFNumber, 28, 10),
+			little.short(tagISO, 200),
+			little.rational(tagFocalLength, 50, 1),
+			little.ascii(tagLensModel, "EF50mm f/1.8"),
+		},
+		[]field{
+			little.ascii(tagGPSLatitudeRef, "N"),
+			little.rational(tagGPSLatitude, 52, 1, 31, 1, 1234, 100),
+			little.ascii(tagGPSLongitudeRef, "E"),
+			little.rational(tagGPSLongitude, 13, 1, 24, 1, 30, 1),
+			little.byte(tagGPSAltitudeRef, 0),
+			little.rational(tagGPSAltitude, 3456, 100),
+		},
+	)
+
+	// a JPEG file with big-endian EXIF, whose dimensions are outdated
+	jpegExifFixture = jpeg(1200, 900, exifSegment(big.build(
+		[]field{
+			big.ascii(tagMake, "NIKON"),
+			big.short(tagOrientation, 8),
+		},
+		[]field{
+			big.long(tagPixelXDimension, 4000),
+			big.long(tagPixelYDimension, 3000),
+			big.ascii(tagDateTimeOriginal, "2019:01:02 03:04:05"),
+			big.rational(tagExposureTime, 2, 1),
+			big.undefined(0x9000, []byte("0231")),
+		},
+		[]field{
+			big.ascii(tagGPSLatitudeRef, "S"),
+			big.rational(tagGPSLatitude, 33, 1, 51, 1, 54, 1),
+			big.ascii(tagGPSLongitudeRef, "W"),
+			big.rational(tagGPSLongitude, 70, 1, 40, 1, 0, 1),
+			big.byte(tagGPSAltitudeRef, 1),
+			big.rational(tagGPSAltitude, 10, 1),
+		},
+	)))
+
+	// a JPEG file with IPTC and XMP, the caption is Latin-1
+	jpegIPTCFixture = jpeg(3, 2,
+		iptcSegment(
+			iptcDataset(iptcObjectName, "Sunset"),
+			iptcDataset(iptcKeywords, "beach"),
+			iptcDataset(iptcKeywords, "Summer"),
+			iptcDataset(iptcCity, "Nice"),
+			iptcDataset(iptcCaption, "Plage \xe0 Nice"),
+		),
+		xmpSegment(xmpPacket),
+	)
+)
+
+func TestExtract(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		date     string
+		expected Metadata
+	}{
+		{
+			name: "little-endian TIFF",
+			data: tiffFixture,
+			date: "2020-07-14T18:30:05+02:00",
+			expected: Metadata{
+				Width:        640,
+				Height:       480,
+				Make:         "Canon",
+				Model:        "EOS 5D",
+				LensModel:    "EF50mm f/1.8",
+				Orientation:  6,
+				ExposureTime: "1/250",
+				FNumber:      2.8,
+				ISO:          200,
+				FocalLength:  50,
+				GPS:          &GPS{Latitude: 52.5200944, Longitude: 13.4083333, Altitude: 34.56},
+				Caption:      "A lake",
+				Creator:      "Jane Doe",
+				Copyright:    "(c) Jane Doe",
+			},
+		},
+		{
+			name: "big-endian EXIF in JPEG",
+			data: jpegExifFixture,
+			date: "2019-01-02T03:04:05Z",
+			expected: Metadata{
+				Width:        1200,
+				Height:       900,
+				Make:         "NIKON",
+				Orientation:  8,
+				ExposureTime: "2",
+				GPS:          &GPS{Latitude: -33.865, Longitude: -70.6666667, Altitude: -10},
+			},
+		},
+		{
+			name: "IPTC and XMP in JPEG",
+			data: jpegIPTCFixture,
+			date: "2021-08-01T20:15:00+02:00",
+			expected: Metadata{
+				Width:       3,
+				Height:      2,
+				LensModel:   "XF23mmF2 R WR",
+				Orientation: 3,
+				GPS:         &GPS{Latitude: 43.695, Longitude: 7.26},
+				Title:       "Sunset",
+				Caption:     "Plage à Nice",
+				Keywords:    []string{"beach", "Summer", "holiday"},
+				City:        "Nice",
+				Country:     "France",
+			},
+		},
+	}
+	for _, tt := range tests {
+		m, err := Extract(bytes.NewReader(tt.data))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		// the zone of a date is compared by its offset
+		if got := m.DateTimeOriginal.Format(time.RFC3339); got != tt.date {
+			t.Errorf("%s: date %s, want %s", tt.name, got, tt.date)
+		}
+		m.DateTimeOriginal = time.Time{}
+		if !reflect.DeepEqual(*m, tt.expected) {
+			t.Errorf("%s:\ngot  %+v\nwant %+v", tt.name, *m, tt.expected)
+		}
+		if m.GPS != nil && tt.expected.GPS != nil && *m.GPS != *tt.expected.GPS {
+			t.Errorf("%s: GPS %+v, want %+v", tt.name, *m.GPS, *tt.expected.GPS)
+		}
+	}
+}
+
+func TestExtractUnsupported(t *testing.T) {
+	for _, data := range [][]byte{nil, []byte("GIF89a"), []byte("RIFF\x00\x00\x00\x00WAVE")} {
+		if _, err := Extract(bytes.NewReader(data)); err != ErrUnsupported {
+			t.Errorf("%q: got %v, want ErrUnsupported", data, err)
+		}
+	}
+}
+
+// TestExtractTruncated cuts the fixtures at every byte. Broken metadata must
+// not crash the parsers, and a JPEG file which ends before the start of its
+// scan is an error.
+func TestExtractTruncated(t *testing.T) {
+	for _, fixture := range [][]byte{jpegExifFixture, jpegIPTCFixture} {
+		// the length of the scan header is not read
+		for n := 2; n < len(fixture)-2; n++ {
+			if _, err := Extract(bytes.NewReader(fixture[:n])); err == nil {
+				t.Errorf("no error for a JPEG file cut after %d of %d bytes", n, len(fixture))
+			}
+		}
+	}
+
+	// a TIFF file is read as far as it goes
+	for n := 0; n < len(tiffFixture); n++ {
+		Extract(bytes.NewReader(tiffFixture[:n]))
+	}
+	if _, err := Extract(bytes.NewReader(tiffFixture[:20])); err != errInvalidTIFF {
+		t.Errorf("TIFF file cut in the first directory: got %v, want errInvalidTIFF", err)
+	}
+
+	for _, data := range [][]byte{
+		iptcDataset(iptcKeywords, "truncated")[:8],
+		{0x1C, 2, iptcKeywords, 0x80, 4, 0, 0},
+		{0x1D, 2, iptcKeywords, 0, 0},
+	} {
+		if _, err := parseIPTC(data); err != errInvalidIPTC {
+			t.Errorf("IPTC % x: got %v, want errInvalidIPTC", data, err)
+		}
+	}
+
+	if _, err := parseXMP([]byte(xmpPacket[:len(xmpPacket)/2])); err == nil {
+		t.Error("no error for a truncated XMP packet")
+	}
+}
@@ -0,0 +1,89 @@
+package imagemeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+var errInvalidIPTC = errors.New("imagemeta: invalid iptc record")
+
+// datasets of the IPTC application record
+const (
+	iptcObjectName = 5
+	iptcKeywords   = 25
+	iptcByline     = 80
+	iptcCity       = 90
+	iptcCountry    = 101
+	iptcCredit     = 110
+	iptcCopyright  = 116
+	iptcCaption    = 120
+)
+
+// parseIPTC reads the application record of IPTC-IIM data
+func parseIPTC(data []byte) (*Metadata, error) {
+	m := new(Metadata)
+	for len(data) >= 5 {
+		if data[0] != 0x1C {
+			return m, errInvalidIPTC
+		}
+		record, dataset := data[1], data[2]
+		size := int(binary.BigEndian.Uint16(data[3:5]))
+		data = data[5:]
+
+		// extended datasets carry the length of their size first
+		if size&0x8000 != 0 {
+			n := size & 0x7FFF
+			if n > 4 || n > len(data) {
+				return m, errInvalidIPTC
+			}
+			size = 0
+			for _, b := range data[:n] {
+				size = size<<8 | int(b)
+			}
+			data = data[n:]
+		}
+		if size > len(data) {
+			return m, errInvalidIPTC
+		}
+		value := strings.TrimSpace(decodeText(bytes.TrimRight(data[:size], "\x00")))
+		data = data[size:]
+
+		if record != 2 {
+			continue
+		}
+		switch dataset {
+		case iptcObjectName:
+			mergeString(&m.Title, value)
+		case iptcKeywords:
+			m.addKeyword(value)
+		case iptcByline:
+			mergeString(&m.Creator, value)
+		case iptcCity:
+			mergeString(&m.City, value)
+		case iptcCountry:
+			mergeString(&m.Country, value)
+		case iptcCredit:
+			mergeString(&m.Credit, value)
+		case iptcCopyright:
+			mergeString(&m.Copyright, value)
+		case iptcCaption:
+			mergeString(&m.Caption, value)
+		}
+	}
+	return m, nil
+}
+
+// decodeText decodes text which is UTF-8, or Latin-1 as in many older files
+func decodeText(b []byte) string {
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
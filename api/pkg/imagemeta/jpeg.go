@@ -0,0 +1,128 @@
+package imagemeta
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var (
+	exifPrefix      = []byte("Exif\x00\x00")
+	xmpPrefix       = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	photoshopPrefix = []byte("Photoshop 3.0\x00")
+
+	errInvalidJPEG = errors.New("imagemeta: invalid jpeg")
+)
+
+// readJPEG reads the APP segments and the frame header of a JPEG file. It
+// stops at the start of the scan, so the image data is not read.
+func readJPEG(r *bufio.Reader) ([]*Metadata, error) {
+	if _, err := r.Discard(2); err != nil {
+		return nil, err
+	}
+
+	found := metadata{}
+	for {
+		marker, err := nextMarker(r)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		// markers without a segment
+		case marker == 0x01 || marker >= 0xD0 && marker <= 0xD8:
+			continue
+		// start of scan or end of image
+		case marker == 0xDA || marker == 0xD9:
+			return found.list(), nil
+		}
+
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return nil, err
+		}
+		if length < 2 {
+			return nil, errInvalidJPEG
+		}
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return nil, err
+		}
+
+		switch {
+		case marker == 0xE1 && bytes.HasPrefix(segment, exifPrefix) && found.exif == nil:
+			found.exif, _ = parseExif(segment[len(exifPrefix):])
+		case marker == 0xE1 && bytes.HasPrefix(segment, xmpPrefix) && found.xmp == nil:
+			found.xmp, _ = parseXMP(segment[len(xmpPrefix):])
+		case marker == 0xED && bytes.HasPrefix(segment, photoshopPrefix) && found.iptc == nil:
+			if iptc := photoshopIPTC(segment[len(photoshopPrefix):]); iptc != nil {
+				found.iptc, _ = parseIPTC(iptc)
+			}
+		case isStartOfFrame(marker) && len(segment) >= 5 && found.image == nil:
+			found.image = &Metadata{
+				Height: int(binary.BigEndian.Uint16(segment[1:3])),
+				Width:  int(binary.BigEndian.Uint16(segment[3:5])),
+			}
+		}
+	}
+}
+
+// nextMarker reads the next marker, skipping any fill bytes
+func nextMarker(r *bufio.Reader) (byte, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != 0xFF {
+		return 0, errInvalidJPEG
+	}
+	for b == 0xFF {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+	}
+	return b, nil
+}
+
+// isStartOfFrame reports whether the marker starts a frame header, which
+// holds the dimensions of the image
+func isStartOfFrame(marker byte) bool {
+	return marker >= 0xC0 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC
+}
+
+// photoshopIPTC returns the IPTC record of the image resource blocks in a
+// Photoshop APP13 segment, or nil
+func photoshopIPTC(data []byte) []byte {
+	for len(data) >= 12 && string(data[:4]) == "8BIM" {
+		id := binary.BigEndian.Uint16(data[4:6])
+
+		// the name is a pascal string padded to an even length
+		nameLength := int(data[6]) + 1
+		if nameLength%2 != 0 {
+			nameLength++
+		}
+		data = data[6:]
+		if len(data) < nameLength+4 {
+			return nil
+		}
+		size := int(binary.BigEndian.Uint32(data[nameLength:]))
+		data = data[nameLength+4:]
+		if size < 0 || size > len(data) {
+			return nil
+		}
+
+		if id == 0x0404 {
+			return data[:size]
+		}
+		if size%2 != 0 {
+			size++
+		}
+		if size > len(data) {
+			return nil
+		}
+		data = data[size:]
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package imagemeta
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+var errInvalidPNG = errors.New("imagemeta: invalid png")
+
+// maxChunkSize limits the size of the chunks which are read into memory
+const maxChunkSize = 4 << 20
+
+// readPNG reads the header, the eXIf chunk and the XMP text chunk of a PNG
+// file. It stops at the image data, which the metadata has to precede.
+func readPNG(r *bufio.Reader) ([]*Metadata, error) {
+	if _, err := r.Discard(len(pngSignature)); err != nil {
+		return nil, err
+	}
+
+	found := metadata{}
+	for {
+		var header struct {
+			Length uint32
+			Type   [4]byte
+		}
+		if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+			return nil, err
+		}
+
+		switch string(header.Type[:]) {
+		case "IDAT", "IEND":
+			return found.list(), nil
+		case "IHDR", "eXIf", "iTXt":
+			if header.Length > maxChunkSize {
+				return nil, errInvalidPNG
+			}
+			data := make([]byte, header.Length)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil, err
+			}
+			readPNGChunk(string(header.Type[:]), data, &found)
+		default:
+			if _, err := r.Discard(int(header.Length)); err != nil {
+				return nil, err
+			}
+		}
+
+		// crc
+		if _, err := r.Discard(4); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func readPNGChunk(typ string, data []byte, found *metadata) {
+	switch typ {
+	case "IHDR":
+		if len(data) >= 8 {
+			found.image = &Metadata{
+				Width:  int(binary.BigEndian.Uint32(data[0:4])),
+				Height: int(binary.BigEndian.Uint32(data[4:8])),
+			}
+		}
+	case "eXIf":
+		if found.exif == nil {
+			found.exif, _ = parseExif(data)
+		}
+	case "iTXt":
+		if found.xmp == nil {
+			if text, ok := pngXMP(data); ok {
+				found.xmp, _ = parseXMP(text)
+			}
+		}
+	}
+}
+
+// pngXMP returns the text of an international text chunk with the XMP keyword
+func pngXMP(data []byte) ([]byte, bool) {
+	keyword := []byte("XML:com.adobe.xmp\x00")
+	if !bytes.HasPrefix(data, keyword) || len(data) < len(keyword)+2 {
+		return nil, false
+	}
+	compressed := data[len(keyword)] == 1
+	data = data[len(keyword)+2:]
+
+	// skip the language tag and the translated keyword
+	for i := 0; i < 2; i++ {
+		end := bytes.IndexByte(data, 0)
+		if end < 0 {
+			return nil, false
+		}
+		data = data[end+1:]
+	}
+
+	if !compressed {
+		return data, true
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, false
+	}
+	defer zr.Close()
+	text, err := ioutil.ReadAll(io.LimitReader(zr, maxChunkSize))
+	if err != nil {
+		return nil, false
+	}
+	return text, true
+}
@@ -0,0 +1,103 @@
+package imagemeta
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var errInvalidWebP = errors.New("imagemeta: invalid webp")
+
+// webpHeaderSize is the part of an image chunk which holds the dimensions
+const webpHeaderSize = 10
+
+// readWebP reads the chunks of a WebP file. The dimensions are read from the
+// extended format header, or from the header of a lossy or lossless image.
+// As the metadata chunks follow the image data, files which are larger than
+// the read limit are read up to the limit.
+func readWebP(r *bufio.Reader) ([]*Metadata, error) {
+	if _, err := r.Discard(12); err != nil {
+		return nil, err
+	}
+
+	found := metadata{}
+	for {
+		var header struct {
+			Type   [4]byte
+			Length uint32
+		}
+		if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+			return webpResult(&found, err)
+		}
+
+		// chunks are padded to an even length
+		length := int64(header.Length) + int64(header.Length)%2
+		read := length
+		switch string(header.Type[:]) {
+		case "VP8 ", "VP8L":
+			if read > webpHeaderSize {
+				read = webpHeaderSize
+			}
+		case "VP8X", "EXIF", "XMP ":
+			if length > maxChunkSize {
+				return nil, errInvalidWebP
+			}
+		default:
+			read = 0
+		}
+
+		data := make([]byte, read)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return webpResult(&found, err)
+		}
+		if _, err := r.Discard(int(length - read)); err != nil {
+			return webpResult(&found, err)
+		}
+		if int64(len(data)) > int64(header.Length) {
+			data = data[:header.Length]
+		}
+		readWebPChunk(string(header.Type[:]), data, &found)
+	}
+}
+
+// webpResult returns the metadata found up to the end of the file or the read limit
+func webpResult(found *metadata, err error) ([]*Metadata, error) {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return found.list(), nil
+	}
+	return nil, err
+}
+
+func readWebPChunk(typ string, data []byte, found *metadata) {
+	switch typ {
+	case "VP8X":
+		if len(data) >= 10 {
+			found.image = &Metadata{Width: int(uint24(data[4:7])) + 1, Height: int(uint24(data[7:10])) + 1}
+		}
+	case "VP8 ":
+		// lossy bitstream: frame tag, start code, 14 bit dimensions
+		if found.image == nil && len(data) >= 10 && bytes.Equal(data[3:6], []byte{0x9D, 0x01, 0x2A}) {
+			found.image = &Metadata{
+				Width:  int(binary.LittleEndian.Uint16(data[6:8]) & 0x3FFF),
+				Height: int(binary.LittleEndian.Uint16(data[8:10]) & 0x3FFF),
+			}
+		}
+	case "VP8L":
+		// lossless bitstream: signature, 14 bit dimensions minus one
+		if found.image == nil && len(data) >= 5 && data[0] == 0x2F {
+			bits := binary.LittleEndian.Uint32(data[1:5])
+			found.image = &Metadata{Width: int(bits&0x3FFF) + 1, Height: int(bits>>14&0x3FFF) + 1}
+		}
+	case "EXIF":
+		// some writers keep the prefix of the JPEG segment
+		found.exif, _ = parseExif(bytes.TrimPrefix(data, exifPrefix))
+	case "XMP ":
+		found.xmp, _ = parseXMP(data)
+	}
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
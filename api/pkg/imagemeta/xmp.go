@@ -0,0 +1,179 @@
+package imagemeta
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// namespaces of the XMP properties which are read
+const (
+	nsRDF       = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	nsDC        = "http://purl.org/dc/elements/1.1/"
+	nsXMP       = "http://ns.adobe.com/xap/1.0/"
+	nsPhotoshop = "http://ns.adobe.com/photoshop/1.0/"
+	nsTIFF      = "http://ns.adobe.com/tiff/1.0/"
+	nsExif      = "http://ns.adobe.com/exif/1.0/"
+	nsExifEX    = "http://cipa.jp/exif/1.0/"
+	nsAux       = "http://ns.adobe.com/exif/1.0/aux/"
+)
+
+// xmpTimeLayouts are the date formats allowed in XMP, which are subsets of ISO 8601
+var xmpTimeLayouts = []string{
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// xmpProperties holds the values of the properties of an XMP packet by their
+// namespace and name. Arrays have a value for each item.
+type xmpProperties map[xml.Name][]string
+
+// parseXMP reads an XMP packet. Properties may be written as elements or as
+// attributes of rdf:Description, the first item of an alternative is used.
+func parseXMP(data []byte) (*Metadata, error) {
+	props := make(xmpProperties)
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+
+	// the names of the open elements which are properties
+	stack := []xml.Name{}
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return props.metadata(), err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if t.Name.Space != nsRDF {
+				stack = append(stack, t.Name)
+			}
+			for _, attr := range t.Attr {
+				if attr.Name.Space != "" && attr.Name.Space != nsRDF && attr.Name.Space != "xmlns" && attr.Name.Space != "xml" {
+					props[attr.Name] = append(props[attr.Name], attr.Value)
+				}
+			}
+		case xml.EndElement:
+			if t.Name.Space != nsRDF && len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			value := strings.TrimSpace(string(t))
+			if value != "" && len(stack) > 0 {
+				name := stack[len(stack)-1]
+				props[name] = append(props[name], value)
+			}
+		}
+	}
+	return props.metadata(), nil
+}
+
+func (p xmpProperties) first(space string, local string) string {
+	if values := p[xml.Name{Space: space, Local: local}]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (p xmpProperties) metadata() *Metadata {
+	m := &Metadata{
+		Make:      p.first(nsTIFF, "Make"),
+		Model:     p.first(nsTIFF, "Model"),
+		LensModel: p.first(nsExifEX, "LensModel"),
+		Title:     p.first(nsDC, "title"),
+		Caption:   p.first(nsDC, "description"),
+		Creator:   p.first(nsDC, "creator"),
+		Copyright: p.first(nsDC, "rights"),
+		Credit:    p.first(nsPhotoshop, "Credit"),
+		City:      p.first(nsPhotoshop, "City"),
+		Country:   p.first(nsPhotoshop, "Country"),
+	}
+	mergeString(&m.LensModel, p.first(nsAux, "Lens"))
+	m.Orientation, _ = strconv.Atoi(p.first(nsTIFF, "Orientation"))
+	m.ISO, _ = strconv.Atoi(p.first(nsExif, "ISOSpeedRatings"))
+	m.ExposureTime = p.first(nsExif, "ExposureTime")
+	m.FNumber = round(parseXMPRational(p.first(nsExif, "FNumber")), 1)
+	m.FocalLength = round(parseXMPRational(p.first(nsExif, "FocalLength")), 1)
+
+	for _, name := range []xml.Name{{Space: nsExif, Local: "DateTimeOriginal"}, {Space: nsPhotoshop, Local: "DateCreated"}, {Space: nsXMP, Local: "CreateDate"}} {
+		if t := parseXMPTime(p.first(name.Space, name.Local)); !t.IsZero() {
+			m.DateTimeOriginal = t
+			break
+		}
+	}
+
+	latitude, okLat := parseXMPCoordinate(p.first(nsExif, "GPSLatitude"))
+	longitude, okLong := parseXMPCoordinate(p.first(nsExif, "GPSLongitude"))
+	if okLat && okLong && latitude >= -90 && latitude <= 90 && longitude >= -180 && longitude <= 180 {
+		m.GPS = &GPS{Latitude: latitude, Longitude: longitude}
+	}
+
+	for _, keyword := range p[xml.Name{Space: nsDC, Local: "subject"}] {
+		m.addKeyword(keyword)
+	}
+	return m
+}
+
+func parseXMPTime(value string) time.Time {
+	for _, layout := range xmpTimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// parseXMPRational parses a rational like "28/10"
+func parseXMPRational(value string) float64 {
+	parts := strings.SplitN(value, "/", 2)
+	num, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return 0
+	}
+	if len(parts) == 1 {
+		return num
+	}
+	den, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil || den == 0 {
+		return 0
+	}
+	return num / den
+}
+
+// parseXMPCoordinate parses a GPS coordinate like "52,31.2345N" or "13,24,30W"
+func parseXMPCoordinate(value string) (float64, bool) {
+	if len(value) < 2 {
+		return 0, false
+	}
+	ref := value[len(value)-1]
+	parts := strings.Split(value[:len(value)-1], ",")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, false
+	}
+
+	coordinate := 0.0
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0, false
+		}
+		coordinate += v / []float64{1, 60, 3600}[i]
+	}
+	switch ref {
+	case 'S', 'W':
+		coordinate = -coordinate
+	case 'N', 'E':
+	default:
+		return 0, false
+	}
+	return round(coordinate, 7), true
+}
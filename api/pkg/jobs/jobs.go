@@ -0,0 +1,124 @@
+// Package jobs runs work in the background which is too slow for a request,
+// like the processing of uploaded media. Jobs are kept in a Store, so they
+// survive restarts of the server and can be inspected.
+package jobs
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when a requested job does not exist
+	ErrNotFound = errors.New("jobs: job not found")
+
+	// ErrLeaseLost is returned when a job is updated by a worker whose lease
+	// expired, so that another worker took the job over
+	ErrLeaseLost = errors.New("jobs: lease lost")
+
+	// ErrNotDead is returned when a job is retried which is not dead
+	ErrNotDead = errors.New("jobs: job is not dead")
+)
+
+// Status is the state of a job
+type Status string
+
+// the states of a job. A job which failed waits as queued for its retry, a
+// job which failed too often or permanently is dead.
+const (
+	StatusQueued    Status = "queued"
+	StatusRunning   Status = "running"
+	StatusSucceeded Status = "succeeded"
+	StatusDead      Status = "dead"
+)
+
+// Job is a unit of work for the handler which is registered for its type
+type Job struct {
+	ID   string `bson:"_id" json:"id"`
+	Type string `bson:"type" json:"type"`
+
+	// Key makes enqueueing idempotent, there is only one job for every key
+	Key     string            `bson:"key,omitempty" json:"key,omitempty"`
+	Payload map[string]string `bson:"payload,omitempty" json:"payload,omitempty"`
+
+	Status      Status `bson:"status" json:"status"`
+	Attempts    int    `bson:"attempts" json:"attempts"`
+	MaxAttempts int    `bson:"maxAttempts" json:"maxAttempts"`
+	LastError   string `bson:"lastError,omitempty" json:"lastError,omitempty"`
+
+	// RunAt is the time when a queued job is due
+	RunAt time.Time `bson:"runAt" json:"runAt"`
+
+	// a running job belongs to the worker which holds the token until the lease expires
+	LeaseToken   string    `bson:"leaseToken,omitempty" json:"-"`
+	LeaseExpires time.Time `bson:"leaseExpires,omitempty" json:"-"`
+
+	CreatedAt  time.Time  `bson:"createdAt" json:"createdAt"`
+	UpdatedAt  time.Time  `bson:"updatedAt" json:"updatedAt"`
+	FinishedAt *time.Time `bson:"finishedAt,omitempty" json:"finishedAt,omitempty"`
+}
+
+// ListJobsRequest filters and pages the jobs of a Store. Empty fields do not filter.
+type ListJobsRequest struct {
+	Type   string
+	Status Status
+	Key    string
+	Skip   int64
+	Limit  int64
+}
+
+// Store keeps the jobs
+type Store interface {
+	// Enqueue adds a job. If a job with the same key exists, no job is added
+	// and the existing job is returned. If it waits for a retry, it is due
+	// again at job.RunAt. If it is dead, it is queued again at job.RunAt with
+	// a fresh set of attempts.
+	Enqueue(ctx context.Context, job *Job) (*Job, error)
+
+	// Claim leases the next due job of one of the types to a worker until
+	// now+lease and counts the attempt. Running jobs whose lease expired are
+	// due again. It returns nil if no job is due.
+	Claim(ctx context.Context, types []string, now time.Time, lease time.Duration) (*Job, error)
+
+	// Update saves a job, as long as it still holds the lease token it was read with
+	Update(ctx context.Context, job *Job) error
+
+	Get(ctx context.Context, id string) (*Job, error)
+
+	// List returns the jobs which match the request, the newest first, and the total count
+	List(ctx context.Context, req ListJobsRequest) ([]*Job, int64, error)
+}
+
+// permanentError marks errors which are not resolved by retrying
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps the error of a handler, so that the job is dead at once
+// instead of being retried
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// IsPermanent reports whether the error was wrapped by Permanent
+func IsPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+var defaultQueue *Queue
+
+// SetDefault sets the queue used by the API.
+// It has to be called once at startup before the server accepts requests.
+func SetDefault(q *Queue) {
+	defaultQueue = q
+}
+
+// Default returns the queue used by the API
+func Default() *Queue {
+	return defaultQueue
+}
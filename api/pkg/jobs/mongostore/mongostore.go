@@ -0,0 +1,248 @@
+// Package mongostore keeps the jobs of the job queue in a MongoDB collection
+package mongostore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"my.app/pkg/jobs"
+	"my.app/pkg/mongoindex"
+)
+
+// duplicateKeyCode is the error code of MongoDB for violations of unique indexes
+const duplicateKeyCode = 11000
+
+// indexes are created on the collection of the jobs when it is first used
+var indexes = []mongo.IndexModel{
+	{
+		Keys: bson.D{{Key: "key", Value: 1}},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"key": bson.M{"$exists": true}}),
+	},
+	{Keys: bson.D{{Key: "status", Value: 1}, {Key: "runAt", Value: 1}}},
+	{Keys: bson.D{{Key: "createdAt", Value: -1}}},
+}
+
+// Store implements jobs.Store
+type Store struct {
+	collection func(ctx context.Context) (*mongo.Collection, error)
+	indexes    *mongoindex.Indexes
+}
+
+// New creates a store for the collection returned by collection, which is
+// called for every operation, so that the database may connect on first use
+func New(collection func(ctx context.Context) (*mongo.Collection, error)) *Store {
+	return &Store{collection: collection, indexes: mongoindex.New(indexes)}
+}
+
+// jobs returns the collection, whose indexes are created on first use
+func (s *Store) jobs(ctx context.Context) (*mongo.Collection, error) {
+	c, err := s.collection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.indexes.Ensure(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Enqueue adds a job or returns the job with the same key, which is queued
+// again if it is dead
+func (s *Store) Enqueue(ctx context.Context, job *jobs.Job) (*jobs.Job, error) {
+	c, err := s.jobs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if job.ID == "" {
+		job.ID = primitive.NewObjectID().Hex()
+	}
+	_, err = c.InsertOne(ctx, job)
+	if err == nil {
+		return job, nil
+	}
+	if job.Key == "" || !isDuplicateKey(err) {
+		return nil, err
+	}
+
+	// a job which waits for its retry is due at once
+	existing := new(jobs.Job)
+	err = c.FindOneAndUpdate(ctx,
+		bson.M{"key": job.Key, "status": jobs.StatusQueued, "runAt": bson.M{"$gt": job.RunAt}},
+		bson.M{"$set": bson.M{"runAt": job.RunAt, "updatedAt": job.UpdatedAt}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(existing)
+
+	// a dead job is queued again with a fresh set of attempts
+	if err == mongo.ErrNoDocuments {
+		err = c.FindOneAndUpdate(ctx,
+			bson.M{"key": job.Key, "status": jobs.StatusDead},
+			bson.M{
+				"$set":   bson.M{"status": jobs.StatusQueued, "attempts": 0, "runAt": job.RunAt, "updatedAt": job.UpdatedAt},
+				"$unset": bson.M{"finishedAt": ""},
+			},
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(existing)
+	}
+	if err == mongo.ErrNoDocuments {
+		err = c.FindOne(ctx, bson.M{"key": job.Key}).Decode(existing)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return existing, nil
+}
+
+// Claim leases the job which is due for the longest time
+func (s *Store) Claim(ctx context.Context, types []string, now time.Time, lease time.Duration) (*jobs.Job, error) {
+	if len(types) == 0 {
+		return nil, nil
+	}
+	c, err := s.jobs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := newLeaseToken()
+	if err != nil {
+		return nil, err
+	}
+	filter := bson.M{
+		"type": bson.M{"$in": types},
+		"$or": bson.A{
+			bson.M{"status": jobs.StatusQueued, "runAt": bson.M{"$lte": now}},
+			bson.M{"status": jobs.StatusRunning, "leaseExpires": bson.M{"$lte": now}},
+		},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"status":       jobs.StatusRunning,
+			"leaseToken":   token,
+			"leaseExpires": now.Add(lease),
+			"updatedAt":    now,
+		},
+		"$inc": bson.M{"attempts": 1},
+	}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "runAt", Value: 1}}).
+		SetReturnDocument(options.After)
+
+	job := new(jobs.Job)
+	err = c.FindOneAndUpdate(ctx, filter, update, opts).Decode(job)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Update replaces a job, if no other worker took its lease over
+func (s *Store) Update(ctx context.Context, job *jobs.Job) error {
+	c, err := s.jobs(ctx)
+	if err != nil {
+		return err
+	}
+
+	filter := bson.M{"_id": job.ID, "leaseToken": job.LeaseToken}
+	if job.LeaseToken == "" {
+		filter["leaseToken"] = bson.M{"$exists": false}
+	}
+	result, err := c.ReplaceOne(ctx, filter, job)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return jobs.ErrLeaseLost
+	}
+	return nil
+}
+
+// Get returns a job by its id
+func (s *Store) Get(ctx context.Context, id string) (*jobs.Job, error) {
+	c, err := s.jobs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	job := new(jobs.Job)
+	err = c.FindOne(ctx, bson.M{"_id": id}).Decode(job)
+	if err == mongo.ErrNoDocuments {
+		return nil, jobs.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// List returns a page of the jobs which match the request, the newest first
+func (s *Store) List(ctx context.Context, req jobs.ListJobsRequest) ([]*jobs.Job, int64, error) {
+	c, err := s.jobs(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	filter := bson.M{}
+	if req.Type != "" {
+		filter["type"] = req.Type
+	}
+	if req.Status != "" {
+		filter["status"] = req.Status
+	}
+	if req.Key != "" {
+		filter["key"] = req.Key
+	}
+
+	total, err := c.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip(req.Skip)
+	if req.Limit > 0 {
+		opts.SetLimit(req.Limit)
+	}
+	cursor, err := c.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	list := []*jobs.Job{}
+	if err := cursor.All(ctx, &list); err != nil {
+		return nil, 0, err
+	}
+	return list, total, nil
+}
+
+func isDuplicateKey(err error) bool {
+	var writeErr mongo.WriteException
+	if !errors.As(err, &writeErr) {
+		return false
+	}
+	for _, e := range writeErr.WriteErrors {
+		if e.Code == duplicateKeyCode {
+			return true
+		}
+	}
+	return false
+}
+
+// newLeaseToken returns a random token which identifies a lease
+func newLeaseToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
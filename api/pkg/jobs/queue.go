@@ -0,0 +1,296 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// the defaults of Options
+const (
+	defaultWorkers      = 2
+	defaultPollInterval = 5 * time.Second
+	defaultLease        = 15 * time.Minute
+	defaultMaxAttempts  = 5
+	defaultMinBackoff   = 10 * time.Second
+	defaultMaxBackoff   = time.Hour
+
+	// updateTimeout limits saving the result of a job, which happens even
+	// while the queue is stopped
+	updateTimeout = 10 * time.Second
+)
+
+// Handler does the work of a job. Jobs whose handler fails are retried with
+// backoff, unless the error is Permanent.
+type Handler func(ctx context.Context, job *Job) error
+
+// Logger receives the errors of the store, echo.Logger implements it
+type Logger interface {
+	Errorf(format string, args ...interface{})
+}
+
+// Options configure a Queue, zero values are replaced by defaults
+type Options struct {
+	// Workers is the number of jobs which run at the same time
+	Workers int
+
+	// PollInterval is the time idle workers wait before they look for due
+	// jobs. Jobs enqueued by the same queue wake a worker at once.
+	PollInterval time.Duration
+
+	// Lease is the time a handler may run. If a worker dies, its job is
+	// taken over by another worker after the lease expired.
+	Lease time.Duration
+
+	// MaxAttempts is the number of runs before a failing job is dead
+	MaxAttempts int
+
+	// the delay before the first retry, which doubles with every further retry
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	Logger Logger
+}
+
+// Queue runs the jobs of a Store with a pool of workers
+type Queue struct {
+	store    Store
+	options  Options
+	handlers map[string]Handler
+	wake     chan struct{}
+
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+}
+
+// NewQueue creates a queue for a store. Handlers have to be registered
+// before the queue is started.
+func NewQueue(store Store, options Options) *Queue {
+	if options.Workers < 1 {
+		options.Workers = defaultWorkers
+	}
+	if options.PollInterval <= 0 {
+		options.PollInterval = defaultPollInterval
+	}
+	if options.Lease <= 0 {
+		options.Lease = defaultLease
+	}
+	if options.MaxAttempts < 1 {
+		options.MaxAttempts = defaultMaxAttempts
+	}
+	if options.MinBackoff <= 0 {
+		options.MinBackoff = defaultMinBackoff
+	}
+	if options.MaxBackoff < options.MinBackoff {
+		options.MaxBackoff = defaultMaxBackoff
+	}
+	return &Queue{
+		store:    store,
+		options:  options,
+		handlers: make(map[string]Handler),
+		wake:     make(chan struct{}, options.Workers),
+	}
+}
+
+// Register sets the handler for the jobs of a type
+func (q *Queue) Register(jobType string, handler Handler) {
+	q.handlers[jobType] = handler
+}
+
+// Enqueue adds a job which is due at once. Jobs with the same key are only
+// added once, the existing job is returned instead. If it waits for a retry,
+// it is due at once again, and if it is dead, it is queued again like Retry
+// does.
+func (q *Queue) Enqueue(ctx context.Context, jobType string, key string, payload map[string]string) (*Job, error) {
+	now := time.Now()
+	job, err := q.store.Enqueue(ctx, &Job{
+		Type:        jobType,
+		Key:         key,
+		Payload:     payload,
+		Status:      StatusQueued,
+		MaxAttempts: q.options.MaxAttempts,
+		RunAt:       now,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	})
+	if err != nil {
+		return nil, err
+	}
+	q.notify()
+	return job, nil
+}
+
+// Retry queues a dead job again with a fresh set of attempts
+func (q *Queue) Retry(ctx context.Context, id string) (*Job, error) {
+	job, err := q.store.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if job.Status != StatusDead {
+		return nil, ErrNotDead
+	}
+
+	now := time.Now()
+	job.Status = StatusQueued
+	job.Attempts = 0
+	job.RunAt = now
+	job.UpdatedAt = now
+	job.FinishedAt = nil
+	if err := q.store.Update(ctx, job); err != nil {
+		return nil, err
+	}
+	q.notify()
+	return job, nil
+}
+
+// Get returns a job
+func (q *Queue) Get(ctx context.Context, id string) (*Job, error) {
+	return q.store.Get(ctx, id)
+}
+
+// List returns the jobs which match the request and their total count
+func (q *Queue) List(ctx context.Context, req ListJobsRequest) ([]*Job, int64, error) {
+	return q.store.List(ctx, req)
+}
+
+// notify wakes an idle worker
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start starts the workers
+func (q *Queue) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	q.cancel = cancel
+
+	types := make([]string, 0, len(q.handlers))
+	for jobType := range q.handlers {
+		types = append(types, jobType)
+	}
+	for i := 0; i < q.options.Workers; i++ {
+		q.workers.Add(1)
+		go q.work(ctx, types)
+	}
+}
+
+// Stop stops the workers and waits until their jobs returned. Interrupted
+// jobs are queued again without counting the attempt.
+func (q *Queue) Stop() {
+	if q.cancel != nil {
+		q.cancel()
+	}
+	q.workers.Wait()
+}
+
+func (q *Queue) work(ctx context.Context, types []string) {
+	defer q.workers.Done()
+
+	timer := time.NewTimer(q.options.PollInterval)
+	defer timer.Stop()
+	for ctx.Err() == nil {
+		job, err := q.store.Claim(ctx, types, time.Now(), q.options.Lease)
+		if err != nil && ctx.Err() == nil {
+			q.logf("jobs: claiming a job failed: %v", err)
+		}
+		if job != nil {
+			q.run(ctx, job)
+			continue
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(q.options.PollInterval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// run calls the handler of a job and saves the result
+func (q *Queue) run(ctx context.Context, job *Job) {
+	var err error
+	if job.Attempts > job.MaxAttempts {
+		// the job was taken over from workers which died on every attempt
+		err = Permanent(fmt.Errorf("jobs: the lease expired on all attempts, last error: %s", job.LastError))
+	} else {
+		err = q.call(ctx, job)
+	}
+
+	now := time.Now()
+	job.UpdatedAt = now
+	job.LeaseExpires = time.Time{}
+	switch {
+	case err == nil:
+		job.Status = StatusSucceeded
+		job.LastError = ""
+		job.FinishedAt = &now
+	case ctx.Err() != nil:
+		job.Status = StatusQueued
+		job.Attempts--
+		job.RunAt = now
+	case IsPermanent(err) || job.Attempts >= job.MaxAttempts:
+		job.Status = StatusDead
+		job.LastError = err.Error()
+		job.FinishedAt = &now
+	default:
+		job.Status = StatusQueued
+		job.LastError = err.Error()
+		job.RunAt = now.Add(q.backoff(job.Attempts))
+	}
+
+	updateCtx, cancel := context.WithTimeout(context.Background(), updateTimeout)
+	defer cancel()
+	if err := q.store.Update(updateCtx, job); err != nil {
+		q.logf("jobs: saving job %s failed: %v", job.ID, err)
+	}
+}
+
+// call runs the handler of a job, which may not exceed the lease
+func (q *Queue) call(ctx context.Context, job *Job) (err error) {
+	handler, ok := q.handlers[job.Type]
+	if !ok {
+		return Permanent(fmt.Errorf("jobs: no handler for type %q", job.Type))
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("jobs: handler panicked: %v", r)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, q.options.Lease)
+	defer cancel()
+	return handler(ctx, job)
+}
+
+// backoff returns the delay before the next attempt, which doubles with
+// every attempt. Up to a fifth is added at random, so that jobs which failed
+// together do not retry together.
+func (q *Queue) backoff(attempt int) time.Duration {
+	delay := q.options.MinBackoff
+	for i := 1; i < attempt && delay < q.options.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > q.options.MaxBackoff {
+		delay = q.options.MaxBackoff
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/5+1))
+}
+
+func (q *Queue) logf(format string, args ...interface{}) {
+	if q.options.Logger != nil {
+		q.options.Logger.Errorf(format, args...)
+	}
+}
@@ -0,0 +1,410 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStore keeps jobs in memory with the semantics of the MongoDB store
+type memStore struct {
+	mu     sync.Mutex
+	jobs   map[string]Job
+	nextID int
+}
+
+func newMemStore() *memStore {
+	return &memStore{jobs: make(map[string]Job)}
+}
+
+func (s *memStore) Enqueue(ctx context.Context, job *Job) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, existing := range s.jobs {
+		if job.Key != "" && existing.Key == job.Key {
+			if existing.Status == StatusQueued && existing.RunAt.After(job.RunAt) {
+				existing.RunAt, existing.UpdatedAt = job.RunAt, job.UpdatedAt
+				s.jobs[id] = existing
+			}
+			if existing.Status == StatusDead {
+				existing.Status, existing.Attempts, existing.FinishedAt = StatusQueued, 0, nil
+				existing.RunAt, existing.UpdatedAt = job.RunAt, job.UpdatedAt
+				s.jobs[id] = existing
+			}
+			return &existing, nil
+		}
+	}
+	s.nextID++
+	job.ID = strconv.Itoa(s.nextID)
+	s.jobs[job.ID] = *job
+	return job, nil
+}
+
+func (s *memStore) Claim(ctx context.Context, types []string, now time.Time, lease time.Duration) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	due := []Job{}
+	for _, job := range s.jobs {
+		if !contains(types, job.Type) {
+			continue
+		}
+		if job.Status == StatusQueued && !job.RunAt.After(now) || job.Status == StatusRunning && !job.LeaseExpires.After(now) {
+			due = append(due, job)
+		}
+	}
+	if len(due) == 0 {
+		return nil, nil
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].RunAt.Before(due[j].RunAt) })
+
+	job := due[0]
+	s.nextID++
+	job.Status = StatusRunning
+	job.LeaseToken = "lease-" + strconv.Itoa(s.nextID)
+	job.LeaseExpires = now.Add(lease)
+	job.UpdatedAt = now
+	job.Attempts++
+	s.jobs[job.ID] = job
+	return &job, nil
+}
+
+func (s *memStore) Update(ctx context.Context, job *Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.jobs[job.ID]; !ok || existing.LeaseToken != job.LeaseToken {
+		return ErrLeaseLost
+	}
+	s.jobs[job.ID] = *job
+	return nil
+}
+
+func (s *memStore) Get(ctx context.Context, id string) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &job, nil
+}
+
+func (s *memStore) List(ctx context.Context, req ListJobsRequest) ([]*Job, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []*Job{}
+	for _, job := range s.jobs {
+		if (req.Type == "" || job.Type == req.Type) && (req.Status == "" || job.Status == req.Status) && (req.Key == "" || job.Key == req.Key) {
+			job := job
+			list = append(list, &job)
+		}
+	}
+	return list, int64(len(list)), nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+var errFailed = errors.New("failed")
+
+func newTestQueue(store Store) *Queue {
+	return NewQueue(store, Options{
+		Workers:      1,
+		PollInterval: 10 * time.Millisecond,
+		Lease:        time.Minute,
+		MaxAttempts:  3,
+		MinBackoff:   10 * time.Second,
+		MaxBackoff:   time.Minute,
+	})
+}
+
+// claimAndRun claims the next job and runs it, like a worker does
+func claimAndRun(t *testing.T, q *Queue, store Store) *Job {
+	t.Helper()
+	return claimAndRunAt(t, q, store, time.Now())
+}
+
+// claimAndRunAt claims the job which is due at a time, e.g. in the future
+// when leases have expired, and runs it
+func claimAndRunAt(t *testing.T, q *Queue, store Store, now time.Time) *Job {
+	t.Helper()
+	ctx := context.Background()
+	job, err := store.Claim(ctx, []string{"test"}, now, q.options.Lease)
+	if err != nil || job == nil {
+		t.Fatalf("claimed %v, %v", job, err)
+	}
+	q.run(ctx, job)
+	job, err = store.Get(ctx, job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func TestBackoff(t *testing.T) {
+	q := newTestQueue(newMemStore())
+	tests := []struct {
+		attempt int
+		min     time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{4, time.Minute},
+		{20, time.Minute},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			// up to a fifth is added at random
+			if delay := q.backoff(tt.attempt); delay < tt.min || delay > tt.min+tt.min/5 {
+				t.Errorf("attempt %d: backoff %v, want between %v and %v", tt.attempt, delay, tt.min, tt.min+tt.min/5)
+				break
+			}
+		}
+	}
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	store := newMemStore()
+	q := newTestQueue(store)
+	q.Register("test", func(ctx context.Context, job *Job) error { return errFailed })
+
+	if _, err := q.Enqueue(context.Background(), "test", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	job := claimAndRun(t, q, store)
+	if job.Status != StatusQueued || job.Attempts != 1 || job.LastError != "failed" {
+		t.Errorf("unexpected job after the first failure %+v", job)
+	}
+	if wait := job.RunAt.Sub(start); wait < 10*time.Second || wait > 13*time.Second {
+		t.Errorf("retry after %v, want the first backoff", wait)
+	}
+
+	// the job is not due before its backoff
+	if claimed, _ := store.Claim(context.Background(), []string{"test"}, time.Now(), time.Minute); claimed != nil {
+		t.Errorf("claimed a job which waits for its retry")
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	tests := []struct {
+		name     string
+		handler  Handler
+		attempts int
+		lastErr  string
+	}{
+		{"max attempts", func(ctx context.Context, job *Job) error { return errFailed }, 3, "failed"},
+		{"permanent error", func(ctx context.Context, job *Job) error { return Permanent(errFailed) }, 1, "failed"},
+		{"panic", func(ctx context.Context, job *Job) error { panic("boom") }, 3, "jobs: handler panicked: boom"},
+	}
+	for _, tt := range tests {
+		store := newMemStore()
+		q := newTestQueue(store)
+		q.Register("test", tt.handler)
+		if _, err := q.Enqueue(context.Background(), "test", "", nil); err != nil {
+			t.Fatal(err)
+		}
+
+		var job *Job
+		for i := 0; i < tt.attempts; i++ {
+			job = claimAndRun(t, q, store)
+			// the retry is made due at once
+			job.RunAt = time.Now()
+			store.jobs[job.ID] = *job
+		}
+		if job.Status != StatusDead || job.Attempts != tt.attempts || job.LastError != tt.lastErr || job.FinishedAt == nil {
+			t.Errorf("%s: unexpected job %+v", tt.name, job)
+		}
+	}
+}
+
+func TestEnqueueDeadJob(t *testing.T) {
+	store := newMemStore()
+	q := newTestQueue(store)
+	ready := false
+	q.Register("test", func(ctx context.Context, job *Job) error {
+		if !ready {
+			return errFailed
+		}
+		return nil
+	})
+	ctx := context.Background()
+
+	// the job waits for something which takes longer than its attempts, like
+	// the processing of a large file for its media document
+	if _, err := q.Enqueue(ctx, "test", "key", nil); err != nil {
+		t.Fatal(err)
+	}
+	var job *Job
+	for i := 0; i < q.options.MaxAttempts; i++ {
+		job = claimAndRunAt(t, q, store, time.Now().Add(time.Duration(i)*time.Hour))
+	}
+	if job.Status != StatusDead {
+		t.Fatalf("unexpected job %+v", job)
+	}
+
+	// enqueueing the key again, once the job can succeed, queues the dead job
+	ready = true
+	again, err := q.Enqueue(ctx, "test", "key", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != job.ID || again.Status != StatusQueued || again.Attempts != 0 || again.FinishedAt != nil || again.RunAt.After(time.Now()) {
+		t.Fatalf("enqueued %+v for the key of a dead job", again)
+	}
+	job = claimAndRun(t, q, store)
+	if job.ID != again.ID || job.Status != StatusSucceeded || job.Attempts != 1 {
+		t.Errorf("unexpected job %+v", job)
+	}
+}
+
+func TestLease(t *testing.T) {
+	store := newMemStore()
+	q := newTestQueue(store)
+	var deadline time.Time
+	q.Register("test", func(ctx context.Context, job *Job) error {
+		deadline, _ = ctx.Deadline()
+		return nil
+	})
+	ctx := context.Background()
+	if _, err := q.Enqueue(ctx, "test", "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// a worker dies with its job, which is taken over when the lease expired
+	now := time.Now()
+	lost, _ := store.Claim(ctx, []string{"test"}, now, time.Minute)
+	if claimed, _ := store.Claim(ctx, []string{"test"}, now.Add(30*time.Second), time.Minute); claimed != nil {
+		t.Fatal("claimed a job whose lease is valid")
+	}
+	job := claimAndRunAt(t, q, store, now.Add(2*time.Minute))
+	if job.Status != StatusSucceeded || job.Attempts != 2 {
+		t.Errorf("unexpected job %+v", job)
+	}
+	if until := time.Until(deadline); until <= 0 || until > time.Minute {
+		t.Errorf("the handler may run for %v, want the lease", until)
+	}
+
+	// the worker which lost the lease cannot save its result
+	lost.Status = StatusDead
+	if err := store.Update(ctx, lost); err != ErrLeaseLost {
+		t.Errorf("got %v, want ErrLeaseLost", err)
+	}
+
+	// a job whose lease expired on every attempt is dead without running again
+	store = newMemStore()
+	q = newTestQueue(store)
+	ran := false
+	q.Register("test", func(ctx context.Context, job *Job) error {
+		ran = true
+		return nil
+	})
+	if _, err := q.Enqueue(ctx, "test", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < q.options.MaxAttempts; i++ {
+		store.Claim(ctx, []string{"test"}, time.Now().Add(time.Duration(i)*2*time.Minute), time.Minute)
+	}
+	job = claimAndRunAt(t, q, store, time.Now().Add(time.Hour))
+	if ran || job.Status != StatusDead || !strings.Contains(job.LastError, "lease expired on all attempts") {
+		t.Errorf("ran %v, unexpected job %+v", ran, job)
+	}
+}
+
+func TestStopRequeues(t *testing.T) {
+	store := newMemStore()
+	q := newTestQueue(store)
+	q.Register("test", func(ctx context.Context, job *Job) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if _, err := q.Enqueue(context.Background(), "test", "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job, _ := store.Claim(ctx, []string{"test"}, time.Now(), time.Minute)
+	cancel()
+	q.run(ctx, job)
+
+	// the interrupted attempt does not count
+	job, _ = store.Get(context.Background(), job.ID)
+	if job.Status != StatusQueued || job.Attempts != 0 || job.RunAt.After(time.Now()) {
+		t.Errorf("unexpected job %+v", job)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	store := newMemStore()
+	q := newTestQueue(store)
+	q.Register("test", func(ctx context.Context, job *Job) error { return Permanent(errFailed) })
+	ctx := context.Background()
+
+	queued, err := q.Enqueue(ctx, "test", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Retry(ctx, queued.ID); err != ErrNotDead {
+		t.Errorf("retry of a queued job: got %v, want ErrNotDead", err)
+	}
+	if _, err := q.Retry(ctx, "missing"); err != ErrNotFound {
+		t.Errorf("retry of a missing job: got %v, want ErrNotFound", err)
+	}
+
+	dead := claimAndRun(t, q, store)
+	if dead.Status != StatusDead {
+		t.Fatalf("unexpected job %+v", dead)
+	}
+	job, err := q.Retry(ctx, dead.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != StatusQueued || job.Attempts != 0 || job.FinishedAt != nil || job.RunAt.After(time.Now()) {
+		t.Errorf("unexpected retried job %+v", job)
+	}
+	if claimed, _ := store.Claim(ctx, []string{"test"}, time.Now(), time.Minute); claimed == nil || claimed.ID != dead.ID {
+		t.Errorf("the retried job is not due")
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	store := newMemStore()
+	q := newTestQueue(store)
+	done := make(chan string, 1)
+	q.Register("test", func(ctx context.Context, job *Job) error {
+		done <- job.Payload["name"]
+		return nil
+	})
+	q.Start()
+	defer q.Stop()
+
+	job, err := q.Enqueue(context.Background(), "test", "key", map[string]string{"name": "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case name := <-done:
+		if name != "first" {
+			t.Errorf("ran the job %s", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the job did not run")
+	}
+
+	// a job is only added once for its key
+	again, err := q.Enqueue(context.Background(), "test", "key", map[string]string{"name": "second"})
+	if err != nil || again.ID != job.ID {
+		t.Errorf("enqueued %+v, %v for the same key", again, err)
+	}
+}
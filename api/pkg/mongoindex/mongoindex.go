@@ -0,0 +1,47 @@
+// Package mongoindex creates the indexes of MongoDB collections when the
+// collections are first used
+package mongoindex
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// timeout limits the creation of the indexes
+const timeout = 30 * time.Second
+
+// Indexes are the indexes of a collection, which are created once
+type Indexes struct {
+	models []mongo.IndexModel
+
+	mu      sync.Mutex
+	created bool
+}
+
+// New returns the indexes for the models
+func New(models []mongo.IndexModel) *Indexes {
+	return &Indexes{models: models}
+}
+
+// Ensure creates the indexes on the collection, unless this was done before.
+// The indexes are created with a context of their own, so a canceled request
+// does not fail the creation for the requests which wait for it. If the
+// creation fails, the next call tries again.
+func (i *Indexes) Ensure(c *mongo.Collection) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.created {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if _, err := c.Indexes().CreateMany(ctx, i.models); err != nil {
+		return err
+	}
+	i.created = true
+	return nil
+}
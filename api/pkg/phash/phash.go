@@ -0,0 +1,145 @@
+// Package phash computes perceptual hashes of images, which stay the same or
+// change in a few bits only when an image is resized, re-encoded or slightly
+// edited. Their Hamming distance measures how different two images look.
+package phash
+
+import (
+	"image"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+)
+
+const (
+	// the image is reduced to sampleSize x sampleSize gray values
+	sampleSize = 32
+
+	// the hash holds the signs of the hashSize x hashSize lowest frequencies
+	hashSize = 8
+
+	// the hash is split into bands of bandBits bits for the index
+	bandBits = 16
+	bandMask = 1<<bandBits - 1
+
+	// Bands is the number of bands of a hash
+	Bands = 64 / bandBits
+)
+
+// MaxDistance is the largest distance Probes supports. Beyond it, the number
+// of probes grows too large for an index lookup.
+const MaxDistance = 15
+
+// Hash returns the DCT based perceptual hash of an image. The orientation is
+// the EXIF orientation from 1 to 8, so that a rotated copy gets the hash of
+// the upright image. Other values are treated as 1.
+func Hash(img image.Image, orientation int) uint64 {
+	gray := reorient(sample(img), orientation)
+
+	// cosine table of the DCT-II, only the lowest frequencies are needed
+	var cosines [hashSize][sampleSize]float64
+	for k := 0; k < hashSize; k++ {
+		for x := 0; x < sampleSize; x++ {
+			cosines[k][x] = math.Cos(math.Pi * float64((2*x+1)*k) / (2 * sampleSize))
+		}
+	}
+
+	// DCT of the rows, then of the columns
+	var rows [sampleSize][hashSize]float64
+	for y := 0; y < sampleSize; y++ {
+		for k := 0; k < hashSize; k++ {
+			sum := 0.0
+			for x := 0; x < sampleSize; x++ {
+				sum += gray[y*sampleSize+x] * cosines[k][x]
+			}
+			rows[y][k] = sum
+		}
+	}
+	coefficients := make([]float64, 0, hashSize*hashSize)
+	for l := 0; l < hashSize; l++ {
+		for k := 0; k < hashSize; k++ {
+			sum := 0.0
+			for y := 0; y < sampleSize; y++ {
+				sum += rows[y][k] * cosines[l][y]
+			}
+			coefficients = append(coefficients, sum)
+		}
+	}
+
+	sorted := append([]float64(nil), coefficients...)
+	sort.Float64s(sorted)
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+
+	var hash uint64
+	for i, c := range coefficients {
+		if c > median {
+			hash |= 1 << uint(63-i)
+		}
+	}
+	return hash
+}
+
+// Distance returns the number of bits in which two hashes differ
+func Distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// String formats a hash as 16 hex digits
+func String(hash uint64) string {
+	s := strconv.FormatUint(hash, 16)
+	for len(s) < 16 {
+		s = "0" + s
+	}
+	return s
+}
+
+// Parse parses a hash formatted by String
+func Parse(s string) (uint64, error) {
+	return strconv.ParseUint(s, 16, 64)
+}
+
+// BandKeys returns the keys under which a hash is indexed. Every band of the
+// hash is a key, tagged with its position.
+func BandKeys(hash uint64) []int32 {
+	keys := make([]int32, Bands)
+	for i := range keys {
+		keys[i] = bandKey(i, hash>>(uint(i)*bandBits)&bandMask)
+	}
+	return keys
+}
+
+func bandKey(band int, value uint64) int32 {
+	return int32(band<<bandBits | int(value))
+}
+
+// Probes returns the band keys which have to be looked up to find all hashes
+// within distance of hash. If two hashes differ in at most distance bits, one
+// of their Bands bands differs in at most distance/Bands bits, so the probes
+// are the bands of hash with up to that many bits flipped. The result still
+// has to be checked with Distance. The distance is limited to MaxDistance.
+func Probes(hash uint64, distance int) []int32 {
+	if distance > MaxDistance {
+		distance = MaxDistance
+	}
+	flips := distance / Bands
+
+	probes := []int32{}
+	for i := 0; i < Bands; i++ {
+		value := hash >> (uint(i) * bandBits) & bandMask
+		probes = appendFlipped(probes, i, value, 0, flips)
+	}
+	return probes
+}
+
+// appendFlipped adds the keys of value with up to flips of the bits from
+// bit upwards flipped
+func appendFlipped(probes []int32, band int, value uint64, bit int, flips int) []int32 {
+	probes = append(probes, bandKey(band, value))
+	if flips == 0 {
+		return probes
+	}
+	for b := bit; b < bandBits; b++ {
+		probes = appendFlipped(probes, band, value^1<<uint(b), b+1, flips-1)
+	}
+	return probes
+}
@@ -0,0 +1,147 @@
+package phash
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// photoImage returns an image with smooth shapes and some noise, which looks
+// more like a photo than random pixels do
+func photoImage(width, height int, seed int64) *image.RGBA {
+	rnd := rand.New(rand.NewSource(seed))
+	phase, cx, cy := rnd.Float64()*2*math.Pi, rnd.Float64(), rnd.Float64()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			fx, fy := float64(x)/float64(width), float64(y)/float64(height)
+			shade := 128 + 60*math.Sin(6*fx+2*fy+phase) + 40*math.Cos(9*fy-3*fx+phase)
+			if (fx-cx)*(fx-cx)+(fy-cy)*(fy-cy) < 0.04 {
+				shade -= 70
+			}
+			shade += float64(rnd.Intn(17) - 8)
+			v := uint8(math.Max(0, math.Min(255, shade)))
+			img.SetRGBA(x, y, color.RGBA{R: v, G: uint8(int(v) * 3 / 4), B: 255 - v, A: 255})
+		}
+	}
+	return img
+}
+
+// halfSize scales an image to half of its width and height by averaging
+// every 2 x 2 pixels
+func halfSize(img *image.RGBA) *image.RGBA {
+	b := img.Bounds()
+	result := image.NewRGBA(image.Rect(0, 0, b.Dx()/2, b.Dy()/2))
+	for y := 0; y < b.Dy()/2; y++ {
+		for x := 0; x < b.Dx()/2; x++ {
+			var sum [4]int
+			for _, p := range []image.Point{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+				c := img.RGBAAt(2*x+p.X, 2*y+p.Y)
+				sum[0] += int(c.R)
+				sum[1] += int(c.G)
+				sum[2] += int(c.B)
+				sum[3] += int(c.A)
+			}
+			result.SetRGBA(x, y, color.RGBA{R: uint8(sum[0] / 4), G: uint8(sum[1] / 4), B: uint8(sum[2] / 4), A: uint8(sum[3] / 4)})
+		}
+	}
+	return result
+}
+
+// reencode returns an image encoded as JPEG and decoded again
+func reencode(t *testing.T, img image.Image, quality int) image.Image {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := jpeg.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func TestHashStable(t *testing.T) {
+	original := photoImage(640, 480, 1)
+	hash := Hash(original, 1)
+
+	tests := []struct {
+		name string
+		img  image.Image
+	}{
+		{"half size", halfSize(original)},
+		{"quarter size", halfSize(halfSize(original))},
+		{"re-encoded", reencode(t, original, 75)},
+		{"half size and re-encoded", reencode(t, halfSize(original), 60)},
+	}
+	for _, tt := range tests {
+		if d := Distance(hash, Hash(tt.img, 1)); d > 10 {
+			t.Errorf("%s: distance %d from the original", tt.name, d)
+		}
+	}
+
+	// a different image is far from the original
+	if d := Distance(hash, Hash(photoImage(640, 480, 2), 1)); d <= 10 {
+		t.Errorf("distance %d from a different image", d)
+	}
+}
+
+func TestProbes(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for distance := 0; distance <= MaxDistance; distance++ {
+		for i := 0; i < 200; i++ {
+			hash := rnd.Uint64()
+
+			// the differing bits are spread as evenly over the bands as
+			// possible every other time, which is the worst case
+			other := hash
+			for flipped := 0; flipped < distance; {
+				bit := uint(rnd.Intn(64))
+				if i%2 == 0 {
+					bit = uint(flipped%Bands*bandBits + flipped/Bands)
+				}
+				if other>>bit&1 == hash>>bit&1 {
+					other ^= 1 << bit
+					flipped++
+				}
+			}
+
+			if !containsAny(Probes(hash, distance), BandKeys(other)) {
+				t.Errorf("distance %d: %s is not found from %s", distance, String(other), String(hash))
+			}
+		}
+	}
+}
+
+func TestProbesCount(t *testing.T) {
+	tests := []struct {
+		distance int
+		want     int
+	}{
+		{0, Bands},
+		{3, Bands},
+		{4, Bands * (1 + bandBits)},
+		{8, Bands * (1 + bandBits + bandBits*(bandBits-1)/2)},
+		{MaxDistance + 5, Bands * (1 + bandBits + bandBits*(bandBits-1)/2 + bandBits*(bandBits-1)*(bandBits-2)/6)},
+	}
+	for _, tt := range tests {
+		if got := len(Probes(0, tt.distance)); got != tt.want {
+			t.Errorf("distance %d: %d probes, want %d", tt.distance, got, tt.want)
+		}
+	}
+}
+
+func containsAny(probes []int32, keys []int32) bool {
+	for _, probe := range probes {
+		for _, key := range keys {
+			if probe == key {
+				return true
+			}
+		}
+	}
+	return false
+}
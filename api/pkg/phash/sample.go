@@ -0,0 +1,129 @@
+package phash
+
+import "image"
+
+// sample reduces an image to sampleSize x sampleSize luma values. Every
+// value is the average over its area of the image, so that the result does
+// not depend on the size of the image.
+func sample(img image.Image) []float64 {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width == 0 || height == 0 {
+		return make([]float64, sampleSize*sampleSize)
+	}
+	xWeights := areaWeights(width)
+	yWeights := areaWeights(height)
+
+	// the rows are reduced first, then the columns
+	rows := make([]float64, height*sampleSize)
+	luma := make([]float64, width)
+	for y := 0; y < height; y++ {
+		readLuma(img, b.Min.X, b.Min.Y+y, luma)
+		row := rows[y*sampleSize : (y+1)*sampleSize]
+		for x, value := range luma {
+			for _, w := range xWeights[x] {
+				row[w.target] += value * w.weight
+			}
+		}
+	}
+
+	result := make([]float64, sampleSize*sampleSize)
+	for y := 0; y < height; y++ {
+		row := rows[y*sampleSize : (y+1)*sampleSize]
+		for _, w := range yWeights[y] {
+			out := result[w.target*sampleSize : (w.target+1)*sampleSize]
+			for x, value := range row {
+				out[x] += value * w.weight
+			}
+		}
+	}
+	return result
+}
+
+// readLuma reads the luma values of a row of an image. Images decoded for
+// renditions are RGBA, which is read directly.
+func readLuma(img image.Image, x0, y int, luma []float64) {
+	if rgba, ok := img.(*image.RGBA); ok {
+		pix := rgba.Pix[rgba.PixOffset(x0, y):]
+		for x := range luma {
+			p := pix[x*4 : x*4+3]
+			luma[x] = 0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])
+		}
+		return
+	}
+	for x := range luma {
+		r, g, b, _ := img.At(x0+x, y).RGBA()
+		luma[x] = (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 257
+	}
+}
+
+// areaWeight is the share of a source pixel in a sample
+type areaWeight struct {
+	target int
+	weight float64
+}
+
+// areaWeights returns for every of n source pixels the samples it covers,
+// weighted so that every sample is the average of its pixels
+func areaWeights(n int) [][]areaWeight {
+	weights := make([][]areaWeight, n)
+	scale := float64(n) / sampleSize
+	for t := 0; t < sampleSize; t++ {
+		start, end := float64(t)*scale, float64(t+1)*scale
+		for s := int(start); s < n && float64(s) < end; s++ {
+			overlap := minFloat(float64(s+1), end) - maxFloat(float64(s), start)
+			if overlap > 0 {
+				weights[s] = append(weights[s], areaWeight{target: t, weight: overlap / scale})
+			}
+		}
+	}
+	return weights
+}
+
+// reorient turns the samples of an image with an EXIF orientation upright
+func reorient(samples []float64, orientation int) []float64 {
+	if orientation < 2 || orientation > 8 {
+		return samples
+	}
+	const last = sampleSize - 1
+	result := make([]float64, len(samples))
+	for y := 0; y < sampleSize; y++ {
+		for x := 0; x < sampleSize; x++ {
+
+			// the position of the upright sample x, y in the stored image
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = last-x, y
+			case 3:
+				sx, sy = last-x, last-y
+			case 4:
+				sx, sy = x, last-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, last-x
+			case 7:
+				sx, sy = last-y, last-x
+			case 8:
+				sx, sy = last-y, x
+			}
+			result[y*sampleSize+x] = samples[sy*sampleSize+sx]
+		}
+	}
+	return result
+}
+
+func minFloat(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
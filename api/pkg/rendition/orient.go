@@ -0,0 +1,47 @@
+package rendition
+
+import "image"
+
+// orient turns an image upright according to its EXIF orientation, which
+// describes how the stored pixels have to be transformed for display:
+//
+//	1: none                    5: mirror along the top-left diagonal
+//	2: mirror horizontally     6: rotate 90° clockwise
+//	3: rotate 180°             7: mirror along the top-right diagonal
+//	4: mirror vertically       8: rotate 90° counterclockwise
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+
+	width, height := src.Rect.Dx(), src.Rect.Dy()
+	dstWidth, dstHeight := width, height
+	if orientation >= 5 {
+		dstWidth, dstHeight = height, width
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = width-1-x, y
+			case 3:
+				dx, dy = width-1-x, height-1-y
+			case 4:
+				dx, dy = x, height-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = height-1-y, x
+			case 7:
+				dx, dy = height-1-y, width-1-x
+			case 8:
+				dx, dy = y, width-1-x
+			}
+			copy(dst.Pix[dy*dst.Stride+dx*4:dy*dst.Stride+dx*4+4], src.Pix[y*src.Stride+x*4:])
+		}
+	}
+	return dst
+}
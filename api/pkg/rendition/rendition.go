@@ -0,0 +1,179 @@
+// Package rendition creates scaled down derivatives of images, like the
+// thumbnails and previews which are shown instead of the originals.
+package rendition
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strconv"
+	"strings"
+
+	// decoders of the formats renditions can be created for
+	_ "image/gif"
+)
+
+// ErrTooLarge is returned for images which have too many pixels to be decoded
+var ErrTooLarge = errors.New("rendition: image too large")
+
+// MaxPixels limits the size of the images which are decoded, as every pixel
+// takes four bytes of memory
+const MaxPixels = 100 * 1000 * 1000
+
+// formats of the renditions
+const (
+	JPEG = "jpeg"
+	PNG  = "png"
+	WebP = "webp"
+)
+
+// Spec describes a rendition
+type Spec struct {
+	Name string
+
+	// Size is the maximum width and height. Images are scaled down to fit, but never up.
+	Size int
+
+	Format string
+
+	// Quality is the JPEG quality from 1 to 100, other formats are lossless
+	Quality int
+}
+
+// DefaultSpecs are the renditions created if nothing else is configured
+var DefaultSpecs = []Spec{
+	{Name: "thumbnail", Size: 256, Format: JPEG, Quality: 80},
+	{Name: "preview", Size: 1024, Format: JPEG, Quality: 85},
+	{Name: "web", Size: 2048, Format: JPEG, Quality: 82},
+}
+
+// ContentType returns the content type of the rendition
+func (spec Spec) ContentType() string {
+	return "image/" + spec.Format
+}
+
+// Extension returns the file name extension of the rendition
+func (spec Spec) Extension() string {
+	if spec.Format == JPEG {
+		return ".jpg"
+	}
+	return "." + spec.Format
+}
+
+// ParseSpecs parses a comma separated list of renditions written as
+// name:size:format or name:size:format:quality, e.g. "thumbnail:256:jpeg:80".
+func ParseSpecs(value string) ([]Spec, error) {
+	specs := []Spec{}
+	names := make(map[string]bool)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		fields := strings.Split(item, ":")
+		if len(fields) < 3 || len(fields) > 4 {
+			return nil, fmt.Errorf("rendition: invalid spec %q", item)
+		}
+
+		spec := Spec{Name: fields[0], Format: strings.ToLower(fields[2]), Quality: 85}
+		if spec.Name == "" || strings.ContainsAny(spec.Name, "/\\.") || names[spec.Name] {
+			return nil, fmt.Errorf("rendition: invalid or duplicate name in %q", item)
+		}
+		names[spec.Name] = true
+
+		var err error
+		if spec.Size, err = strconv.Atoi(fields[1]); err != nil || spec.Size < 1 || spec.Size > maxWebPSize {
+			return nil, fmt.Errorf("rendition: invalid size in %q", item)
+		}
+		if spec.Format == "jpg" {
+			spec.Format = JPEG
+		}
+		if spec.Format != JPEG && spec.Format != PNG && spec.Format != WebP {
+			return nil, fmt.Errorf("rendition: unknown format in %q", item)
+		}
+		if len(fields) == 4 {
+			if spec.Quality, err = strconv.Atoi(fields[3]); err != nil || spec.Quality < 1 || spec.Quality > 100 {
+				return nil, fmt.Errorf("rendition: invalid quality in %q", item)
+			}
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// Decode reads an image in a format which the image package can decode.
+// Images with more than MaxPixels pixels are rejected before they are decoded.
+func Decode(r io.ReadSeeker) (*image.RGBA, error) {
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, err
+	}
+	if config.Width*config.Height > MaxPixels {
+		return nil, ErrTooLarge
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	rgba, ok := img.(*image.RGBA)
+	if !ok || rgba.Rect.Min != (image.Point{}) {
+		rgba = image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+		draw.Draw(rgba, rgba.Rect, img, img.Bounds().Min, draw.Src)
+	}
+	return rgba, nil
+}
+
+// Generate scales an image down to the size of the rendition, turns it
+// upright according to its EXIF orientation and writes it in the format of
+// the rendition. It returns the size of the rendition.
+func Generate(w io.Writer, src *image.RGBA, orientation int, spec Spec) (int, int, error) {
+	width, height := src.Rect.Dx(), src.Rect.Dy()
+
+	// the orientation swaps the edges, which have to fit into the size afterwards
+	if orientation >= 5 && orientation <= 8 {
+		width, height = height, width
+	}
+	if width > spec.Size || height > spec.Size {
+		if width >= height {
+			width, height = spec.Size, max(1, (height*spec.Size+width/2)/width)
+		} else {
+			width, height = max(1, (width*spec.Size+height/2)/height), spec.Size
+		}
+	}
+	if orientation >= 5 && orientation <= 8 {
+		width, height = height, width
+	}
+
+	img := orient(resize(src, width, height), orientation)
+
+	var err error
+	switch spec.Format {
+	case JPEG:
+		err = jpeg.Encode(w, img, &jpeg.Options{Quality: spec.Quality})
+	case PNG:
+		err = png.Encode(w, img)
+	case WebP:
+		err = encodeWebP(w, img)
+	default:
+		err = fmt.Errorf("rendition: unknown format %q", spec.Format)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return img.Rect.Dx(), img.Rect.Dy(), nil
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
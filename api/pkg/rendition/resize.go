@@ -0,0 +1,156 @@
+package rendition
+
+import (
+	"image"
+	"math"
+	"runtime"
+	"sync"
+)
+
+// contribution is the weighted range of source pixels a target pixel is computed of
+type contribution struct {
+	start   int
+	weights []float32
+}
+
+// catmullRom is the Catmull-Rom cubic, which keeps edges sharp when scaling down
+func catmullRom(x float64) float64 {
+	x = math.Abs(x)
+	switch {
+	case x < 1:
+		return (1.5*x-2.5)*x*x + 1
+	case x < 2:
+		return ((-0.5*x+2.5)*x-4)*x + 2
+	}
+	return 0
+}
+
+// contributions computes the filter weights for scaling a row or column of
+// srcLen pixels to dstLen pixels. The filter is widened by the scale factor,
+// so that every source pixel contributes when scaling down.
+func contributions(srcLen int, dstLen int) []contribution {
+	scale := float64(srcLen) / float64(dstLen)
+	width := math.Max(scale, 1)
+	support := 2 * width
+
+	result := make([]contribution, dstLen)
+	for i := range result {
+		center := (float64(i) + 0.5) * scale
+		start := int(math.Floor(center - support))
+		if start < 0 {
+			start = 0
+		}
+		end := int(math.Ceil(center + support))
+		if end > srcLen {
+			end = srcLen
+		}
+
+		weights := make([]float32, end-start)
+		sum := 0.0
+		for j := start; j < end; j++ {
+			w := catmullRom((float64(j) + 0.5 - center) / width)
+			weights[j-start] = float32(w)
+			sum += w
+		}
+		if sum != 0 {
+			for j := range weights {
+				weights[j] = float32(float64(weights[j]) / sum)
+			}
+		}
+		result[i] = contribution{start: start, weights: weights}
+	}
+	return result
+}
+
+// resize scales an image to the given size. The pixels are premultiplied by
+// alpha, so transparent pixels do not bleed their color into their neighbors.
+func resize(src *image.RGBA, width int, height int) *image.RGBA {
+	if src.Rect.Dx() == width && src.Rect.Dy() == height {
+		return src
+	}
+
+	// the horizontal pass runs first, as it shrinks the image for the vertical pass
+	tmp := image.NewRGBA(image.Rect(0, 0, width, src.Rect.Dy()))
+	columns := contributions(src.Rect.Dx(), width)
+	parallel(src.Rect.Dy(), func(y int) {
+		in := src.Pix[y*src.Stride:]
+		out := tmp.Pix[y*tmp.Stride:]
+		for x, c := range columns {
+			var r, g, b, a float32
+			for i, w := range c.weights {
+				p := in[(c.start+i)*4:]
+				r += float32(p[0]) * w
+				g += float32(p[1]) * w
+				b += float32(p[2]) * w
+				a += float32(p[3]) * w
+			}
+			setPixel(out[x*4:], r, g, b, a)
+		}
+	})
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	rows := contributions(src.Rect.Dy(), height)
+	parallel(height, func(y int) {
+		c := rows[y]
+		out := dst.Pix[y*dst.Stride:]
+		for x := 0; x < width; x++ {
+			var r, g, b, a float32
+			for i, w := range c.weights {
+				p := tmp.Pix[(c.start+i)*tmp.Stride+x*4:]
+				r += float32(p[0]) * w
+				g += float32(p[1]) * w
+				b += float32(p[2]) * w
+				a += float32(p[3]) * w
+			}
+			setPixel(out[x*4:], r, g, b, a)
+		}
+	})
+	return dst
+}
+
+// setPixel stores a premultiplied pixel, whose colors may not exceed its
+// alpha after the cubic filter overshot
+func setPixel(p []uint8, r, g, b, a float32) {
+	alpha := clamp(a)
+	p[0] = minUint8(clamp(r), alpha)
+	p[1] = minUint8(clamp(g), alpha)
+	p[2] = minUint8(clamp(b), alpha)
+	p[3] = alpha
+}
+
+func clamp(v float32) uint8 {
+	switch {
+	case v <= 0:
+		return 0
+	case v >= 255:
+		return 255
+	}
+	return uint8(v + 0.5)
+}
+
+func minUint8(a, b uint8) uint8 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// parallel calls fn for the rows 0 to n-1, spread over the CPUs
+func parallel(n int, fn func(y int)) {
+	workers := runtime.GOMAXPROCS(0)
+	if workers > n {
+		workers = n
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for y := w; y < n; y += workers {
+				fn(y)
+			}
+		}(w)
+	}
+	wg.Wait()
+}
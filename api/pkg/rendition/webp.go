@@ -0,0 +1,574 @@
+package rendition
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+)
+
+// The renditions in WebP format are written in the lossless VP8L format, as
+// described in https://developers.google.com/speed/webp/docs/webp_lossless_bitstream_specification.
+// The encoder subtracts green and predicts every pixel from its neighbors,
+// then writes the residuals with prefix codes. It does not use backward
+// references and color caches, so it is simple, but files are larger than
+// those of a full encoder.
+
+const (
+	maxWebPSize = 1 << 14
+
+	// the transforms
+	transformPredictor     = 0
+	transformSubtractGreen = 2
+
+	// predictorBits is the log2 of the size of the blocks which share a predictor
+	predictorBits = 4
+
+	// the size of the alphabet of the green prefix code includes the length
+	// prefixes of backward references
+	greenAlphabetSize    = 256 + 24
+	distanceAlphabetSize = 40
+
+	maxCodeLength           = 15
+	maxCodeLengthCodeLength = 7
+)
+
+// codeLengthCodeOrder is the order in which the lengths of the code length code are written
+var codeLengthCodeOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// encodeWebP writes an image as lossless WebP
+func encodeWebP(w io.Writer, img *image.RGBA) error {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	if width > maxWebPSize || height > maxWebPSize {
+		return errors.New("rendition: image too large for WebP")
+	}
+
+	// VP8L stores ARGB pixels which are not premultiplied
+	argb := make([]uint32, width*height)
+	hasAlpha := false
+	for y := 0; y < height; y++ {
+		row := img.Pix[y*img.Stride:]
+		for x := 0; x < width; x++ {
+			p := row[x*4:]
+			r, g, b, a := uint32(p[0]), uint32(p[1]), uint32(p[2]), uint32(p[3])
+			if a != 255 {
+				hasAlpha = true
+				if a > 0 {
+					r, g, b = (r*255+a/2)/a, (g*255+a/2)/a, (b*255+a/2)/a
+				}
+			}
+			argb[y*width+x] = a<<24 | r<<16 | g<<8 | b
+		}
+	}
+
+	bw := new(bitWriter)
+	bw.write(0x2f, 8)
+	bw.write(uint32(width-1), 14)
+	bw.write(uint32(height-1), 14)
+	if hasAlpha {
+		bw.write(1, 1)
+	} else {
+		bw.write(0, 1)
+	}
+	bw.write(0, 3)
+
+	bw.write(1, 1)
+	bw.write(transformSubtractGreen, 2)
+	subtractGreen(argb)
+
+	bw.write(1, 1)
+	bw.write(transformPredictor, 2)
+	bw.write(predictorBits-2, 3)
+	modes := predict(argb, width, height)
+	writeImageData(bw, modes, false)
+
+	bw.write(0, 1)
+	writeImageData(bw, argb, true)
+
+	data := bw.bytes()
+	padding := len(data) & 1
+
+	header := make([]byte, 20)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(12+len(data)+padding))
+	copy(header[8:], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(header[16:], uint32(len(data)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if padding == 1 {
+		_, err := w.Write([]byte{0})
+		return err
+	}
+	return nil
+}
+
+// subtractGreen subtracts the green value from the red and blue values
+func subtractGreen(argb []uint32) {
+	for i, p := range argb {
+		green := (p >> 8) & 0xff
+		r := ((p >> 16) - green) & 0xff
+		b := (p - green) & 0xff
+		argb[i] = p&0xff00ff00 | r<<16 | b
+	}
+}
+
+// predict replaces the pixels by the difference to their prediction from the
+// neighbors. It chooses the predictor with the smallest residuals for each
+// block and returns the image of the chosen predictors.
+func predict(argb []uint32, width int, height int) []uint32 {
+	blockSize := 1 << predictorBits
+	blocksX := (width + blockSize - 1) >> predictorBits
+	blocksY := (height + blockSize - 1) >> predictorBits
+	modes := make([]uint32, blocksX*blocksY)
+
+	for by := 0; by < blocksY; by++ {
+		for bx := 0; bx < blocksX; bx++ {
+			best, bestCost := 0, -1
+			for mode := 0; mode < 14; mode++ {
+				cost := 0
+				for y := by * blockSize; y < height && y < (by+1)*blockSize; y++ {
+					for x := bx * blockSize; x < width && x < (bx+1)*blockSize; x++ {
+						cost += residualCost(sub(argb[y*width+x], prediction(argb, width, x, y, mode)))
+					}
+				}
+				if bestCost < 0 || cost < bestCost {
+					best, bestCost = mode, cost
+				}
+			}
+			modes[by*blocksX+bx] = 0xff000000 | uint32(best)<<8
+		}
+	}
+
+	// the residuals are computed from the last pixel backwards, as the
+	// predictions are made from the original values of the pixels before
+	for y := height - 1; y >= 0; y-- {
+		for x := width - 1; x >= 0; x-- {
+			mode := int(modes[(y>>predictorBits)*blocksX+x>>predictorBits]>>8) & 0xf
+			argb[y*width+x] = sub(argb[y*width+x], prediction(argb, width, x, y, mode))
+		}
+	}
+	return modes
+}
+
+// prediction computes the prediction of a pixel. The first pixel is
+// predicted as opaque black, the other pixels of the top row from their left
+// and those of the left column from their top neighbor.
+func prediction(argb []uint32, width int, x int, y int, mode int) uint32 {
+	i := y*width + x
+	switch {
+	case x == 0 && y == 0:
+		return 0xff000000
+	case y == 0:
+		return argb[i-1]
+	case x == 0:
+		return argb[i-width]
+	}
+
+	// the top right neighbor of the last column is the first pixel of the row,
+	// which follows it in memory
+	left, top, topLeft, topRight := argb[i-1], argb[i-width], argb[i-width-1], argb[i-width+1]
+	switch mode {
+	case 0:
+		return 0xff000000
+	case 1:
+		return left
+	case 2:
+		return top
+	case 3:
+		return topRight
+	case 4:
+		return topLeft
+	case 5:
+		return average2(average2(left, topRight), top)
+	case 6:
+		return average2(left, topLeft)
+	case 7:
+		return average2(left, top)
+	case 8:
+		return average2(topLeft, top)
+	case 9:
+		return average2(top, topRight)
+	case 10:
+		return average2(average2(left, topLeft), average2(top, topRight))
+	case 11:
+		return selectPredictor(left, top, topLeft)
+	case 12:
+		return clampAddSubtractFull(left, top, topLeft)
+	default:
+		return clampAddSubtractHalf(average2(left, top), topLeft)
+	}
+}
+
+func average2(a, b uint32) uint32 {
+	return (((a ^ b) & 0xfefefefe) >> 1) + (a & b)
+}
+
+// selectPredictor returns the left or the top pixel, whichever is closer to the gradient
+func selectPredictor(left, top, topLeft uint32) uint32 {
+	if channelDistance(top, topLeft) < channelDistance(left, topLeft) {
+		return left
+	}
+	return top
+}
+
+func channelDistance(a, b uint32) int {
+	d := 0
+	for shift := uint(0); shift < 32; shift += 8 {
+		v := int(a>>shift&0xff) - int(b>>shift&0xff)
+		if v < 0 {
+			v = -v
+		}
+		d += v
+	}
+	return d
+}
+
+func clampAddSubtractFull(a, b, c uint32) uint32 {
+	var p uint32
+	for shift := uint(0); shift < 32; shift += 8 {
+		v := int(a>>shift&0xff) + int(b>>shift&0xff) - int(c>>shift&0xff)
+		p |= clamp255(v) << shift
+	}
+	return p
+}
+
+func clampAddSubtractHalf(a, b uint32) uint32 {
+	var p uint32
+	for shift := uint(0); shift < 32; shift += 8 {
+		ca, cb := int(a>>shift&0xff), int(b>>shift&0xff)
+		p |= clamp255(ca+(ca-cb)/2) << shift
+	}
+	return p
+}
+
+func clamp255(v int) uint32 {
+	switch {
+	case v < 0:
+		return 0
+	case v > 255:
+		return 255
+	}
+	return uint32(v)
+}
+
+// sub subtracts each channel modulo 256
+func sub(a, b uint32) uint32 {
+	ag := (a | 0x00ff00ff) - (b & 0xff00ff00)
+	rb := (a | 0xff00ff00) - (b & 0x00ff00ff)
+	return ag&0xff00ff00 | rb&0x00ff00ff
+}
+
+// residualCost estimates the bits of a residual by the distance of its channels to zero
+func residualCost(p uint32) int {
+	cost := 0
+	for shift := uint(0); shift < 32; shift += 8 {
+		v := int(int8(p >> shift))
+		if v < 0 {
+			v = -v
+		}
+		cost += v
+	}
+	return cost
+}
+
+// writeImageData writes an image without color cache and backward
+// references, so all pixels are literals. Only the main image may have meta
+// prefix codes, which are not used.
+func writeImageData(bw *bitWriter, argb []uint32, main bool) {
+	bw.write(0, 1)
+	if main {
+		bw.write(0, 1)
+	}
+
+	green := make([]uint32, greenAlphabetSize)
+	red := make([]uint32, 256)
+	blue := make([]uint32, 256)
+	alpha := make([]uint32, 256)
+	for _, p := range argb {
+		green[p>>8&0xff]++
+		red[p>>16&0xff]++
+		blue[p&0xff]++
+		alpha[p>>24]++
+	}
+
+	codes := make([]*prefixCode, 5)
+	for i, histogram := range [][]uint32{green, red, blue, alpha, make([]uint32, distanceAlphabetSize)} {
+		codes[i] = writePrefixCode(bw, histogram)
+	}
+	for _, p := range argb {
+		codes[0].write(bw, int(p>>8&0xff))
+		codes[1].write(bw, int(p>>16&0xff))
+		codes[2].write(bw, int(p&0xff))
+		codes[3].write(bw, int(p>>24))
+	}
+}
+
+// prefixCode is a canonical Huffman code
+type prefixCode struct {
+	lengths []uint8
+
+	// codes are bit reversed, as the bit stream is read from the least significant bit
+	codes []uint16
+
+	// a code with a single symbol uses no bits
+	single bool
+}
+
+func newPrefixCode(lengths []uint8) *prefixCode {
+	code := &prefixCode{lengths: lengths, codes: make([]uint16, len(lengths))}
+
+	var count [maxCodeLength + 1]int
+	used := 0
+	for _, length := range lengths {
+		if length > 0 {
+			count[length]++
+			used++
+		}
+	}
+	code.single = used == 1
+
+	var next [maxCodeLength + 1]int
+	c := 0
+	for length := 1; length <= maxCodeLength; length++ {
+		c = (c + count[length-1]) << 1
+		next[length] = c
+	}
+	for symbol, length := range lengths {
+		if length == 0 {
+			continue
+		}
+		value := next[length]
+		next[length]++
+
+		reversed := 0
+		for i := 0; i < int(length); i++ {
+			reversed = reversed<<1 | value>>uint(i)&1
+		}
+		code.codes[symbol] = uint16(reversed)
+	}
+	return code
+}
+
+func (code *prefixCode) write(bw *bitWriter, symbol int) {
+	if !code.single {
+		bw.write(uint32(code.codes[symbol]), uint(code.lengths[symbol]))
+	}
+}
+
+// writePrefixCode writes the prefix code for a histogram and returns it.
+// Codes of up to two symbols below 256 are written as simple codes.
+func writePrefixCode(bw *bitWriter, histogram []uint32) *prefixCode {
+	symbols := []int{}
+	for symbol, count := range histogram {
+		if count > 0 {
+			symbols = append(symbols, symbol)
+		}
+	}
+
+	if len(symbols) <= 2 && (len(symbols) == 0 || symbols[len(symbols)-1] < 256) {
+		if len(symbols) == 0 {
+			symbols = []int{0}
+		}
+		bw.write(1, 1)
+		bw.write(uint32(len(symbols)-1), 1)
+		if symbols[0] <= 1 {
+			bw.write(0, 1)
+			bw.write(uint32(symbols[0]), 1)
+		} else {
+			bw.write(1, 1)
+			bw.write(uint32(symbols[0]), 8)
+		}
+		if len(symbols) == 2 {
+			bw.write(uint32(symbols[1]), 8)
+		}
+
+		lengths := make([]uint8, len(histogram))
+		for _, symbol := range symbols {
+			lengths[symbol] = 1
+		}
+		return newPrefixCode(lengths)
+	}
+
+	code := newPrefixCode(codeLengths(histogram, maxCodeLength))
+
+	// the code lengths are written with run lengths, using a prefix code of their own
+	tokens := codeLengthTokens(code.lengths)
+	tokenHistogram := make([]uint32, len(codeLengthCodeOrder))
+	for _, t := range tokens {
+		tokenHistogram[t.symbol]++
+	}
+	lengthCode := newPrefixCode(codeLengths(tokenHistogram, maxCodeLengthCodeLength))
+
+	n := len(codeLengthCodeOrder)
+	for n > 4 && lengthCode.lengths[codeLengthCodeOrder[n-1]] == 0 {
+		n--
+	}
+	bw.write(0, 1)
+	bw.write(uint32(n-4), 4)
+	for _, symbol := range codeLengthCodeOrder[:n] {
+		bw.write(uint32(lengthCode.lengths[symbol]), 3)
+	}
+
+	// all symbols of the alphabet are written
+	bw.write(0, 1)
+	for _, t := range tokens {
+		lengthCode.write(bw, t.symbol)
+		bw.write(t.extra, t.extraBits)
+	}
+	return code
+}
+
+// codeLengthToken is a symbol of the code length code with its extra bits
+type codeLengthToken struct {
+	symbol    int
+	extra     uint32
+	extraBits uint
+}
+
+// codeLengthTokens encodes code lengths. 16 repeats the previous non-zero
+// length 3 to 6 times, 17 and 18 repeat zero 3 to 10 and 11 to 138 times.
+func codeLengthTokens(lengths []uint8) []codeLengthToken {
+	tokens := []codeLengthToken{}
+	previous := uint8(8)
+	for i := 0; i < len(lengths); {
+		length := lengths[i]
+		run := 1
+		for i+run < len(lengths) && lengths[i+run] == length {
+			run++
+		}
+		i += run
+
+		if length == 0 {
+			for run >= 11 {
+				n := run
+				if n > 138 {
+					n = 138
+				}
+				tokens = append(tokens, codeLengthToken{symbol: 18, extra: uint32(n - 11), extraBits: 7})
+				run -= n
+			}
+			if run >= 3 {
+				tokens = append(tokens, codeLengthToken{symbol: 17, extra: uint32(run - 3), extraBits: 3})
+				run = 0
+			}
+		} else {
+			if length != previous {
+				tokens = append(tokens, codeLengthToken{symbol: int(length)})
+				previous = length
+				run--
+			}
+			for run >= 3 {
+				n := run
+				if n > 6 {
+					n = 6
+				}
+				tokens = append(tokens, codeLengthToken{symbol: 16, extra: uint32(n - 3), extraBits: 2})
+				run -= n
+			}
+		}
+		for ; run > 0; run-- {
+			tokens = append(tokens, codeLengthToken{symbol: int(length)})
+		}
+	}
+	return tokens
+}
+
+// huffmanNode is a node of the tree which codeLengths builds
+type huffmanNode struct {
+	count       uint32
+	symbol      int
+	left, right *huffmanNode
+}
+
+type huffmanHeap []*huffmanNode
+
+func (h huffmanHeap) Len() int            { return len(h) }
+func (h huffmanHeap) Less(i, j int) bool  { return h[i].count < h[j].count }
+func (h huffmanHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *huffmanHeap) Push(x interface{}) { *h = append(*h, x.(*huffmanNode)) }
+func (h *huffmanHeap) Pop() interface{} {
+	old := *h
+	node := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return node
+}
+
+// codeLengths computes the lengths of a Huffman code for a histogram. If the
+// longest code exceeds maxLength, small counts are raised until it fits.
+func codeLengths(histogram []uint32, maxLength int) []uint8 {
+	lengths := make([]uint8, len(histogram))
+	for minCount := uint32(1); ; minCount *= 2 {
+		h := huffmanHeap{}
+		for symbol, count := range histogram {
+			if count == 0 {
+				continue
+			}
+			if count < minCount {
+				count = minCount
+			}
+			h = append(h, &huffmanNode{count: count, symbol: symbol})
+		}
+		switch len(h) {
+		case 0:
+			return lengths
+		case 1:
+			lengths[h[0].symbol] = 1
+			return lengths
+		}
+
+		heap.Init(&h)
+		for h.Len() > 1 {
+			a := heap.Pop(&h).(*huffmanNode)
+			b := heap.Pop(&h).(*huffmanNode)
+			heap.Push(&h, &huffmanNode{count: a.count + b.count, symbol: -1, left: a, right: b})
+		}
+
+		longest := 0
+		var walk func(node *huffmanNode, depth int)
+		walk = func(node *huffmanNode, depth int) {
+			if node.left == nil {
+				lengths[node.symbol] = uint8(depth)
+				if depth > longest {
+					longest = depth
+				}
+				return
+			}
+			walk(node.left, depth+1)
+			walk(node.right, depth+1)
+		}
+		walk(h[0], 0)
+		if longest <= maxLength {
+			return lengths
+		}
+	}
+}
+
+// bitWriter writes a bit stream starting with the least significant bit
+type bitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+func (bw *bitWriter) write(value uint32, n uint) {
+	bw.acc |= uint64(value) << bw.nbits
+	bw.nbits += n
+	for bw.nbits >= 8 {
+		bw.buf = append(bw.buf, byte(bw.acc))
+		bw.acc >>= 8
+		bw.nbits -= 8
+	}
+}
+
+func (bw *bitWriter) bytes() []byte {
+	if bw.nbits > 0 {
+		bw.buf = append(bw.buf, byte(bw.acc))
+		bw.acc, bw.nbits = 0, 0
+	}
+	return bw.buf
+}
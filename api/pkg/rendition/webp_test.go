@@ -0,0 +1,130 @@
+package rendition
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+// testImage returns an image with gradients and noise, so that the predictors
+// and prefix codes differ between blocks. With alpha, the alpha channel
+// varies as well and includes fully transparent pixels.
+func testImage(width, height int, alpha bool, seed int64) *image.RGBA {
+	rnd := rand.New(rand.NewSource(seed))
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.NRGBA{
+				R: uint8(x * 255 / width),
+				G: uint8(y * 255 / height),
+				B: uint8(rnd.Intn(256)),
+				A: 255,
+			}
+			if alpha {
+				c.A = uint8((x + y) * 37 % 256)
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+// uniformImage returns an image of a single color, which has a single symbol
+// in every prefix code
+func uniformImage(width, height int, c color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	return img
+}
+
+func TestEncodeWebP(t *testing.T) {
+	tests := []struct {
+		name string
+		img  *image.RGBA
+	}{
+		{"single pixel", testImage(1, 1, false, 1)},
+		{"single column", testImage(1, 7, false, 2)},
+		{"single row", testImage(9, 1, false, 3)},
+		{"odd size", testImage(17, 9, false, 4)},
+		{"larger than a predictor block", testImage(37, 33, false, 5)},
+		{"odd size with alpha", testImage(19, 23, true, 6)},
+		{"larger than a predictor block with alpha", testImage(65, 47, true, 7)},
+		{"uniform", uniformImage(21, 13, color.RGBA{R: 200, G: 100, B: 50, A: 255})},
+		{"transparent", uniformImage(5, 3, color.RGBA{})},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := encodeWebP(&buf, tt.img); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		decoded, err := webp.Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Errorf("%s: decode: %v", tt.name, err)
+			continue
+		}
+		if decoded.Bounds() != tt.img.Rect {
+			t.Errorf("%s: decoded %v, want %v", tt.name, decoded.Bounds(), tt.img.Rect)
+			continue
+		}
+		comparePixels(t, tt.name, tt.img, decoded)
+	}
+}
+
+// comparePixels compares a decoded image with the original. Opaque pixels
+// have to be equal. The encoder stores pixels which are not premultiplied, so
+// translucent pixels may be off by one after their round trip.
+func comparePixels(t *testing.T, name string, want *image.RGBA, got image.Image) {
+	t.Helper()
+	for y := want.Rect.Min.Y; y < want.Rect.Max.Y; y++ {
+		for x := want.Rect.Min.X; x < want.Rect.Max.X; x++ {
+			w := want.RGBAAt(x, y)
+			g := color.RGBAModel.Convert(got.At(x, y)).(color.RGBA)
+			tolerance := 0
+			if w.A != 255 {
+				tolerance = 1
+			}
+			if w.A != g.A || diff(w.R, g.R) > tolerance || diff(w.G, g.G) > tolerance || diff(w.B, g.B) > tolerance {
+				t.Errorf("%s: pixel %d,%d is %v, want %v", name, x, y, g, w)
+				return
+			}
+		}
+	}
+}
+
+func diff(a, b uint8) int {
+	if a > b {
+		return int(a - b)
+	}
+	return int(b - a)
+}
+
+func TestGenerateWebP(t *testing.T) {
+	var buf bytes.Buffer
+	width, height, err := Generate(&buf, testImage(40, 30, true, 8), 6, Spec{Name: "thumbnail", Size: 15, Format: WebP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the orientation turns the image by 90 degrees
+	if width != 11 || height != 15 {
+		t.Errorf("rendition of %dx%d, want 11x15", width, height)
+	}
+	config, err := webp.DecodeConfig(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Width != width || config.Height != height {
+		t.Errorf("decoded a rendition of %dx%d", config.Width, config.Height)
+	}
+
+	if err := encodeWebP(&buf, image.NewRGBA(image.Rect(0, 0, maxWebPSize+1, 1))); err == nil {
+		t.Error("encoded an image larger than the maximum size of WebP")
+	}
+}
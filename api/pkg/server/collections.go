@@ -0,0 +1,932 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxCollectionName        = 200
+	maxCollectionDescription = 2000
+	maxCollectionDepth       = 20
+
+	// maxCollectionMedia keeps the ordered list of a collection far below
+	// the size limit of a MongoDB document
+	maxCollectionMedia = 10000
+
+	// maxCollectionBatch is the number of media documents which can be
+	// added or removed in one request
+	maxCollectionBatch = 1000
+)
+
+// errCollectionNotFound is returned when a collection does not exist
+var errCollectionNotFound = errors.New("server: collection not found")
+
+// MediaCollection is an ordered collection of media documents, e.g. an album
+// or the assets of a campaign. Collections only refer to the media documents,
+// a document can belong to many collections.
+type MediaCollection struct {
+	ID          primitive.ObjectID  `bson:"_id" json:"id"`
+	Name        string              `bson:"name" json:"name"`
+	Description string              `bson:"description,omitempty" json:"description,omitempty"`
+	Parent      *primitive.ObjectID `bson:"parent,omitempty" json:"parent,omitempty"`
+	Owner       string              `bson:"owner" json:"owner"`
+
+	// the media document which represents the collection, the first one if
+	// none was chosen
+	Cover *primitive.ObjectID `bson:"cover,omitempty" json:"cover,omitempty"`
+
+	// the media documents in their order
+	Media      []primitive.ObjectID `bson:"media" json:"media,omitempty"`
+	MediaCount int                  `bson:"-" json:"mediaCount"`
+
+	// users who hold one of the permissions may view the collection, users
+	// who have one of the roles may also change its media
+	Permissions []string `bson:"permissions,omitempty" json:"permissions,omitempty"`
+	Roles       []string `bson:"roles,omitempty" json:"roles,omitempty"`
+
+	DateCreated time.Time  `bson:"datecreated" json:"dateCreated"`
+	DateUpdated *time.Time `bson:"dateupdated,omitempty" json:"dateUpdated,omitempty"`
+
+	// the time the collection was moved to the trash and the user who did
+	DateDeleted *time.Time `bson:"datedeleted,omitempty" json:"dateDeleted,omitempty"`
+	DeletedBy   string     `bson:"deletedby,omitempty" json:"deletedBy,omitempty"`
+}
+
+// MediaCollectionPage is a page of collections
+type MediaCollectionPage struct {
+	Collections []*MediaCollection `json:"collections"`
+	Total       int64              `json:"total"`
+	Page        int64              `json:"page"`
+	PageSize    int64              `json:"pageSize"`
+}
+
+// MediaCollectionRequest holds the fields of a collection which can be set.
+// Fields which are not sent are left as they are, an empty parent or cover
+// removes it.
+type MediaCollectionRequest struct {
+	Name        *string   `json:"name"`
+	Description *string   `json:"description"`
+	Parent      *string   `json:"parent"`
+	Cover       *string   `json:"cover"`
+	Permissions *[]string `json:"permissions"`
+	Roles       *[]string `json:"roles"`
+}
+
+// CollectionMediaRequest lists media documents of a collection. Position is
+// the index at which added documents are inserted, they are appended if it
+// is not sent.
+type CollectionMediaRequest struct {
+	IDs      []string `json:"ids"`
+	Position *int     `json:"position"`
+}
+
+// readsCollection reports whether a collection may be viewed, which
+// administrators, the owner, users who may change it and users who hold one
+// of its permissions may
+func (access *MediaAccess) readsCollection(c *MediaCollection) bool {
+	if access.editsCollection(c) {
+		return true
+	}
+	for _, permission := range access.Permissions {
+		for _, required := range c.Permissions {
+			if permission == required {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// editsCollection reports whether the media of a collection may be changed,
+// which administrators, the owner and users with one of its roles may
+func (access *MediaAccess) editsCollection(c *MediaCollection) bool {
+	if access.managesCollection(c) {
+		return true
+	}
+	for _, role := range c.Roles {
+		if access.Role != "" && access.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+// managesCollection reports whether a collection may be deleted and its
+// permissions and roles may be changed, which administrators and the owner may
+func (access *MediaAccess) managesCollection(c *MediaCollection) bool {
+	return access == nil || (access.UserID != "" && access.UserID == c.Owner)
+}
+
+// collectionFilter returns the filter which restricts a query to the
+// collections which may be viewed and are not in the trash, see readsCollection
+func (access *MediaAccess) collectionFilter() bson.M {
+	if access == nil {
+		return bson.M{"datedeleted": bson.M{"$exists": false}}
+	}
+	or := bson.A{}
+	if access.UserID != "" {
+		or = append(or, bson.M{"owner": access.UserID})
+	}
+	if access.Role != "" {
+		or = append(or, bson.M{"roles": access.Role})
+	}
+	if len(access.Permissions) > 0 {
+		or = append(or, bson.M{"permissions": bson.M{"$in": access.Permissions}})
+	}
+	if len(or) == 0 {
+		return bson.M{"_id": bson.M{"$exists": false}}
+	}
+	return bson.M{"$or": or, "datedeleted": bson.M{"$exists": false}}
+}
+
+// findCollection reads the collection with the given hex id. Collections in
+// the trash are not found.
+func findCollection(ctx context.Context, collection *mongo.Collection, id string) (*MediaCollection, error) {
+	return findCollectionIn(ctx, collection, id, false)
+}
+
+// findTrashedCollection reads the collection with the given hex id, which
+// has to be in the trash
+func findTrashedCollection(ctx context.Context, collection *mongo.Collection, id string) (*MediaCollection, error) {
+	return findCollectionIn(ctx, collection, id, true)
+}
+
+func findCollectionIn(ctx context.Context, collection *mongo.Collection, id string, trashed bool) (*MediaCollection, error) {
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, errCollectionNotFound
+	}
+	c := new(MediaCollection)
+	err = collection.FindOne(ctx, bson.M{"_id": objID, "datedeleted": bson.M{"$exists": trashed}}).Decode(c)
+	if err == mongo.ErrNoDocuments {
+		return nil, errCollectionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.MediaCount = len(c.Media)
+	return c, nil
+}
+
+// collectionError answers a request whose collection could not be read or written
+func collectionError(ctx echo.Context, err error) error {
+	if err == errCollectionNotFound {
+		return ctx.JSON(http.StatusNotFound, "The collection does not exist.")
+	}
+	ctx.Logger().Error(err)
+	return ctx.JSON(http.StatusInternalServerError, "The collection could not be saved.")
+}
+
+// readCollection reads the collection of the request and the access of the
+// user. It answers the request and returns nil if the collection does not
+// exist or may not be viewed.
+func readCollection(ctx echo.Context) (*mongo.Collection, *MediaCollection, *MediaAccess, error) {
+	reqCtx := ctx.Request().Context()
+	collection, err := collectionsCollection(reqCtx)
+	if err != nil {
+		return nil, nil, nil, collectionError(ctx, err)
+	}
+	c, err := findCollection(reqCtx, collection, ctx.Param("id"))
+	if err != nil {
+		return nil, nil, nil, collectionError(ctx, err)
+	}
+	access, err := mediaAccess(ctx)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return nil, nil, nil, ctx.JSON(http.StatusInternalServerError, "The permissions could not be checked.")
+	}
+	if !access.readsCollection(c) {
+		return nil, nil, nil, ctx.JSON(http.StatusForbidden, "You are not allowed to view this collection.")
+	}
+	return collection, c, access, nil
+}
+
+// unknownRoles returns the roles which do not exist in the roles collection
+func unknownRoles(ctx context.Context, roles []string) ([]string, error) {
+	collection, err := usersCollection(ctx, "roles")
+	if err != nil {
+		return nil, err
+	}
+	known, err := collection.Distinct(ctx, "name", bson.M{"name": bson.M{"$in": roles}})
+	if err != nil {
+		return nil, err
+	}
+
+	exists := make(map[string]bool)
+	for _, name := range known {
+		if name, ok := name.(string); ok {
+			exists[name] = true
+		}
+	}
+	unknown := []string{}
+	for _, role := range roles {
+		if !exists[role] {
+			unknown = append(unknown, role)
+		}
+	}
+	return unknown, nil
+}
+
+// apply sets the fields of a request on a collection and checks them. It
+// returns the invalid fields with their messages.
+func (req *MediaCollectionRequest) apply(ctx echo.Context, collection *mongo.Collection, c *MediaCollection, access *MediaAccess) (map[string]string, error) {
+	reqCtx := ctx.Request().Context()
+	fields := make(map[string]string)
+
+	if req.Name != nil {
+		c.Name = strings.TrimSpace(*req.Name)
+	}
+	switch {
+	case c.Name == "":
+		fields["name"] = "The name is required."
+	case len(c.Name) > maxCollectionName:
+		fields["name"] = "The name must not be longer than " + strconv.Itoa(maxCollectionName) + " bytes."
+	}
+
+	if req.Description != nil {
+		c.Description = strings.TrimSpace(*req.Description)
+		if len(c.Description) > maxCollectionDescription {
+			fields["description"] = "The description must not be longer than " + strconv.Itoa(maxCollectionDescription) + " bytes."
+		}
+	}
+
+	if req.Cover != nil {
+		c.Cover = nil
+		if *req.Cover != "" {
+			cover, err := primitive.ObjectIDFromHex(*req.Cover)
+			if err != nil || !containsID(c.Media, cover) {
+				fields["cover"] = "The cover has to be a media document of the collection."
+			} else {
+				c.Cover = &cover
+			}
+		}
+	}
+	if c.Cover == nil && len(c.Media) > 0 {
+		c.Cover = &c.Media[0]
+	}
+
+	if req.Permissions != nil {
+		c.Permissions = *req.Permissions
+		if len(c.Permissions) > 0 {
+			unknown, err := unknownPermissions(reqCtx, c.Permissions)
+			if err != nil {
+				return nil, err
+			}
+			if len(unknown) > 0 {
+				fields["permissions"] = "Unknown permissions: " + strings.Join(unknown, ", ") + "."
+			}
+		}
+	}
+	if req.Roles != nil {
+		c.Roles = *req.Roles
+		if len(c.Roles) > 0 {
+			unknown, err := unknownRoles(reqCtx, c.Roles)
+			if err != nil {
+				return nil, err
+			}
+			if len(unknown) > 0 {
+				fields["roles"] = "Unknown roles: " + strings.Join(unknown, ", ") + "."
+			}
+		}
+	}
+
+	if req.Parent != nil {
+		c.Parent = nil
+		if *req.Parent != "" {
+			message, err := c.setParent(reqCtx, collection, *req.Parent, access)
+			if err != nil {
+				return nil, err
+			}
+			if message != "" {
+				fields["parent"] = message
+			}
+		}
+	}
+	return fields, nil
+}
+
+// setParent nests a collection in the collection with the given hex id,
+// which the user has to be allowed to change and which must not be below the
+// collection. It returns the message for the client if the parent is invalid.
+func (c *MediaCollection) setParent(ctx context.Context, collection *mongo.Collection, id string, access *MediaAccess) (string, error) {
+	parent, err := findCollection(ctx, collection, id)
+	if err == errCollectionNotFound {
+		return "The parent collection does not exist.", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if !access.editsCollection(parent) {
+		return "You are not allowed to change the parent collection.", nil
+	}
+
+	ancestor := parent
+	for depth := 0; ; depth++ {
+		if ancestor.ID == c.ID {
+			return "A collection cannot be nested in itself.", nil
+		}
+		if ancestor.Parent == nil {
+			break
+		}
+		if depth == maxCollectionDepth {
+			return "Collections cannot be nested more than " + strconv.Itoa(maxCollectionDepth) + " levels deep.", nil
+		}
+		id := *ancestor.Parent
+		ancestor = new(MediaCollection)
+		err := collection.FindOne(ctx, bson.M{"_id": id},
+			options.FindOne().SetProjection(bson.M{"parent": 1})).Decode(ancestor)
+		if err == mongo.ErrNoDocuments {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	c.Parent = &parent.ID
+	return "", nil
+}
+
+// containsID reports whether ids contain id
+func containsID(ids []primitive.ObjectID, id primitive.ObjectID) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// readIDs reads the ids of a CollectionMediaRequest. It returns
+// the invalid fields with their messages.
+func (req *CollectionMediaRequest) readIDs() ([]primitive.ObjectID, map[string]string) {
+	fields := make(map[string]string)
+	ids := []primitive.ObjectID{}
+	for _, id := range req.IDs {
+		objID, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			fields["ids"] = "The ids have to be ids of media documents."
+			return nil, fields
+		}
+		if !containsID(ids, objID) {
+			ids = append(ids, objID)
+		}
+	}
+	if len(ids) == 0 || len(ids) > maxCollectionBatch {
+		fields["ids"] = "Between 1 and " + strconv.Itoa(maxCollectionBatch) + " media documents can be changed at once."
+	}
+	return ids, fields
+}
+
+// coverUpdate is the stage of an update pipeline which keeps the cover of a
+// collection if it is still in the collection, otherwise the first media
+// document becomes the cover
+var coverUpdate = bson.M{"$set": bson.M{"cover": bson.M{"$cond": bson.A{
+	bson.M{"$in": bson.A{"$cover", "$media"}},
+	"$cover",
+	bson.M{"$arrayElemAt": bson.A{"$media", 0}},
+}}}}
+
+// removeCollectionMedia removes media documents from the collections which
+// match filter
+func removeCollectionMedia(ctx context.Context, collection *mongo.Collection, filter bson.M, ids []primitive.ObjectID) error {
+	_, err := collection.UpdateMany(ctx, filter, bson.A{
+		bson.M{"$set": bson.M{
+			"media": bson.M{"$filter": bson.M{
+				"input": "$media",
+				"cond":  bson.M{"$not": bson.A{bson.M{"$in": bson.A{"$$this", bson.M{"$literal": ids}}}}},
+			}},
+			"dateupdated": time.Now(),
+		}},
+		coverUpdate,
+	})
+	return err
+}
+
+// removeFromCollections removes a deleted media document from all collections
+func removeFromCollections(ctx context.Context, id primitive.ObjectID) error {
+	collection, err := collectionsCollection(ctx)
+	if err != nil {
+		return err
+	}
+	return removeCollectionMedia(ctx, collection, bson.M{"media": id}, []primitive.ObjectID{id})
+}
+
+// ListCollections returns the collections the user may view, sorted by name.
+// The query parameter parent selects the collections nested in a collection,
+// "root" the top level collections. media selects the collections which
+// contain a media document, page and pageSize select the page.
+func ListCollections(ctx echo.Context) error {
+
+	page, pageSize, invalid := readPage(ctx)
+	if invalid != "" {
+		return ctx.JSON(http.StatusBadRequest, invalid)
+	}
+
+	access, err := mediaAccess(ctx)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The permissions could not be checked.")
+	}
+	filter := access.collectionFilter()
+	switch parent := ctx.QueryParam("parent"); parent {
+	case "":
+	case "root":
+		filter["parent"] = bson.M{"$exists": false}
+	default:
+		id, err := primitive.ObjectIDFromHex(parent)
+		if err != nil {
+			return ctx.JSON(http.StatusBadRequest, "The parent has to be the id of a collection or root.")
+		}
+		filter["parent"] = id
+	}
+	if media := ctx.QueryParam("media"); media != "" {
+		id, err := primitive.ObjectIDFromHex(media)
+		if err != nil {
+			return ctx.JSON(http.StatusBadRequest, "The media has to be the id of a media document.")
+		}
+		filter["media"] = id
+	}
+
+	reqCtx := ctx.Request().Context()
+	collection, err := collectionsCollection(reqCtx)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The collections could not be read.")
+	}
+
+	result := &MediaCollectionPage{Collections: []*MediaCollection{}, Page: page, PageSize: pageSize}
+	result.Total, err = collection.CountDocuments(reqCtx, filter)
+	if err == nil {
+		var cur *mongo.Cursor
+		cur, err = collection.Aggregate(reqCtx, mongo.Pipeline{
+			{{Key: "$match", Value: filter}},
+			{{Key: "$sort", Value: bson.D{{Key: "name", Value: 1}, {Key: "_id", Value: 1}}}},
+			{{Key: "$skip", Value: (page - 1) * pageSize}},
+			{{Key: "$limit", Value: pageSize}},
+			{{Key: "$addFields", Value: bson.M{"mediaCount": bson.M{"$size": "$media"}}}},
+			{{Key: "$project", Value: bson.M{"media": 0}}},
+		})
+		var rows []struct {
+			MediaCollection `bson:",inline"`
+			MediaCount      int `bson:"mediaCount"`
+		}
+		if err == nil {
+			err = cur.All(reqCtx, &rows)
+		}
+		for i := range rows {
+			c := rows[i].MediaCollection
+			c.MediaCount = rows[i].MediaCount
+			result.Collections = append(result.Collections, &c)
+		}
+	}
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The collections could not be read.")
+	}
+
+	return ctx.JSON(http.StatusOK, result)
+}
+
+// GetCollection returns a collection with the ids of its media documents
+func GetCollection(ctx echo.Context) error {
+
+	_, c, _, err := readCollection(ctx)
+	if c == nil {
+		return err
+	}
+
+	return ctx.JSON(http.StatusOK, c)
+}
+
+// CreateCollection creates a collection which is owned by the user. It may be
+// nested in a collection the user may change.
+func CreateCollection(ctx echo.Context) error {
+
+	// Get the jwt token from context
+	user := ctx.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+
+	userID, _ := claims["ID"].(string)
+	if userID == "" {
+		return ctx.JSON(http.StatusForbidden, "You are not allowed to create a collection.")
+	}
+
+	req := new(MediaCollectionRequest)
+	if invalid := decodeStrict(ctx, req); invalid != nil {
+		return ctx.JSON(http.StatusBadRequest, invalid)
+	}
+
+	reqCtx := ctx.Request().Context()
+	collection, err := collectionsCollection(reqCtx)
+	if err != nil {
+		return collectionError(ctx, err)
+	}
+	access, err := mediaAccess(ctx)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The permissions could not be checked.")
+	}
+
+	c := &MediaCollection{
+		ID:          primitive.NewObjectID(),
+		Owner:       userID,
+		Media:       []primitive.ObjectID{},
+		DateCreated: time.Now(),
+	}
+	fields, err := req.apply(ctx, collection, c, access)
+	if err != nil {
+		return collectionError(ctx, err)
+	}
+	if len(fields) > 0 {
+		return ctx.JSON(http.StatusBadRequest, &ValidationError{Message: "The collection is invalid.", Fields: fields})
+	}
+
+	if _, err := collection.InsertOne(reqCtx, c); err != nil {
+		return collectionError(ctx, err)
+	}
+
+	return ctx.JSON(http.StatusCreated, c)
+}
+
+// UpdateCollection changes the fields of a collection. Users who may change
+// its media may rename, nest and describe it and choose its cover, only
+// administrators and the owner may change its permissions and roles.
+func UpdateCollection(ctx echo.Context) error {
+
+	collection, c, access, err := readCollection(ctx)
+	if c == nil {
+		return err
+	}
+	if !access.editsCollection(c) {
+		return ctx.JSON(http.StatusForbidden, "You are not allowed to change this collection.")
+	}
+
+	req := new(MediaCollectionRequest)
+	if invalid := decodeStrict(ctx, req); invalid != nil {
+		return ctx.JSON(http.StatusBadRequest, invalid)
+	}
+	if (req.Permissions != nil || req.Roles != nil) && !access.managesCollection(c) {
+		return ctx.JSON(http.StatusForbidden, "You are not allowed to change the permissions of this collection.")
+	}
+
+	fields, err := req.apply(ctx, collection, c, access)
+	if err != nil {
+		return collectionError(ctx, err)
+	}
+	if len(fields) > 0 {
+		return ctx.JSON(http.StatusBadRequest, &ValidationError{Message: "The collection is invalid.", Fields: fields})
+	}
+
+	set := bson.M{
+		"name":        c.Name,
+		"description": c.Description,
+		"permissions": c.Permissions,
+		"roles":       c.Roles,
+		"dateupdated": time.Now(),
+	}
+	unset := bson.M{}
+	if c.Parent != nil {
+		set["parent"] = c.Parent
+	} else {
+		unset["parent"] = ""
+	}
+	if c.Cover != nil {
+		set["cover"] = c.Cover
+	} else {
+		unset["cover"] = ""
+	}
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+
+	reqCtx := ctx.Request().Context()
+	updated := new(MediaCollection)
+	err = collection.FindOneAndUpdate(reqCtx, bson.M{"_id": c.ID}, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(updated)
+	if err == mongo.ErrNoDocuments {
+		err = errCollectionNotFound
+	}
+	if err != nil {
+		return collectionError(ctx, err)
+	}
+	updated.MediaCount = len(updated.Media)
+
+	return ctx.JSON(http.StatusOK, updated)
+}
+
+// DeleteCollection moves a collection to the trash, which only administrators
+// and the owner may. The collections nested in it stay with it, and move to
+// its parent once it is purged.
+func DeleteCollection(ctx echo.Context) error {
+
+	collection, c, access, err := readCollection(ctx)
+	if c == nil {
+		return err
+	}
+	if !access.managesCollection(c) {
+		return ctx.JSON(http.StatusForbidden, "You are not allowed to delete this collection.")
+	}
+
+	// Get the jwt token from context
+	user := ctx.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+
+	set := bson.M{"datedeleted": time.Now()}
+	if userID, ok := claims["ID"].(string); ok {
+		set["deletedby"] = userID
+	}
+
+	reqCtx := ctx.Request().Context()
+	_, err = collection.UpdateOne(reqCtx, bson.M{"_id": c.ID, "datedeleted": bson.M{"$exists": false}}, bson.M{"$set": set})
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The collection could not be deleted.")
+	}
+
+	return ctx.NoContent(http.StatusNoContent)
+}
+
+// purgeCollection deletes a collection for good. The collections nested in
+// it move to its parent, its media documents are kept.
+func purgeCollection(ctx context.Context, collection *mongo.Collection, c *MediaCollection) error {
+	if err := moveChildren(ctx, collection, c.ID, c.Parent); err != nil {
+		return err
+	}
+	_, err := collection.DeleteOne(ctx, bson.M{"_id": c.ID})
+	return err
+}
+
+// ListCollectionMedia returns the media documents of a collection in their
+// order. Documents the user may not read and documents in the trash are left out. The query parameters
+// page and pageSize select the page.
+func ListCollectionMedia(ctx echo.Context) error {
+
+	page, pageSize, invalid := readPage(ctx)
+	if invalid != "" {
+		return ctx.JSON(http.StatusBadRequest, invalid)
+	}
+
+	_, c, access, err := readCollection(ctx)
+	if c == nil {
+		return err
+	}
+
+	reqCtx := ctx.Request().Context()
+	media, err := mediaCollection(reqCtx)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The media documents could not be read.")
+	}
+
+	// the readable documents keep the order of the collection
+	filter := access.filter()
+	filter["_id"] = bson.M{"$in": c.Media}
+	readable, err := media.Distinct(reqCtx, "_id", filter)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The media documents could not be read.")
+	}
+	allowed := make(map[primitive.ObjectID]bool)
+	for _, id := range readable {
+		if id, ok := id.(primitive.ObjectID); ok {
+			allowed[id] = true
+		}
+	}
+	ids := []primitive.ObjectID{}
+	for _, id := range c.Media {
+		if allowed[id] {
+			ids = append(ids, id)
+		}
+	}
+
+	result := &MediaDocumentPage{Documents: []*MediaDocument{}, Total: int64(len(ids)), Page: page, PageSize: pageSize}
+	start, end := (page-1)*pageSize, page*pageSize
+	if start > int64(len(ids)) {
+		start = int64(len(ids))
+	}
+	if end > int64(len(ids)) {
+		end = int64(len(ids))
+	}
+	ids = ids[start:end]
+	if len(ids) == 0 {
+		return ctx.JSON(http.StatusOK, result)
+	}
+
+	cur, err := media.Find(reqCtx, bson.M{"_id": bson.M{"$in": ids}})
+	var docs []*MediaDocument
+	if err == nil {
+		err = cur.All(reqCtx, &docs)
+	}
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The media documents could not be read.")
+	}
+	byID := make(map[primitive.ObjectID]*MediaDocument)
+	for _, doc := range docs {
+		byID[doc.ID] = doc
+	}
+	for _, id := range ids {
+		if doc, ok := byID[id]; ok {
+			result.Documents = append(result.Documents, doc)
+		}
+	}
+
+	return ctx.JSON(http.StatusOK, result)
+}
+
+// AddCollectionMedia adds media documents the user may read to a collection.
+// Documents which are in the collection already keep their position.
+func AddCollectionMedia(ctx echo.Context) error {
+
+	collection, c, access, err := readCollection(ctx)
+	if c == nil {
+		return err
+	}
+	if !access.editsCollection(c) {
+		return ctx.JSON(http.StatusForbidden, "You are not allowed to change this collection.")
+	}
+
+	req := new(CollectionMediaRequest)
+	if invalid := decodeStrict(ctx, req); invalid != nil {
+		return ctx.JSON(http.StatusBadRequest, invalid)
+	}
+	ids, fields := req.readIDs()
+	position := len(c.Media)
+	if req.Position != nil {
+		position = *req.Position
+		if position < 0 || position > len(c.Media) {
+			fields["position"] = "The position has to be between 0 and " + strconv.Itoa(len(c.Media)) + "."
+		}
+	}
+	if len(fields) > 0 {
+		return ctx.JSON(http.StatusBadRequest, &ValidationError{Message: "The media documents are invalid.", Fields: fields})
+	}
+
+	reqCtx := ctx.Request().Context()
+	media, err := mediaCollection(reqCtx)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The collection could not be saved.")
+	}
+	filter := access.filter()
+	filter["_id"] = bson.M{"$in": ids}
+	readable, err := media.CountDocuments(reqCtx, filter)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The collection could not be saved.")
+	}
+	if readable != int64(len(ids)) {
+		fields["ids"] = "Some media documents do not exist or you are not allowed to read them."
+		return ctx.JSON(http.StatusBadRequest, &ValidationError{Message: "The media documents are invalid.", Fields: fields})
+	}
+
+	added := []primitive.ObjectID{}
+	for _, id := range ids {
+		if !containsID(c.Media, id) {
+			added = append(added, id)
+		}
+	}
+	if len(added) == 0 {
+		return ctx.JSON(http.StatusOK, c)
+	}
+	if len(c.Media)+len(added) > maxCollectionMedia {
+		fields["ids"] = "A collection must not have more than " + strconv.Itoa(maxCollectionMedia) + " media documents."
+		return ctx.JSON(http.StatusBadRequest, &ValidationError{Message: "The media documents are invalid.", Fields: fields})
+	}
+
+	parts := bson.A{}
+	if position > 0 {
+		parts = append(parts, bson.M{"$slice": bson.A{"$media", position}})
+	}
+	parts = append(parts, bson.M{"$literal": added}, bson.M{"$slice": bson.A{"$media", position, maxCollectionMedia}})
+
+	// the documents must not have been added and the limit must not have
+	// been reached in the meantime
+	updated := new(MediaCollection)
+	err = collection.FindOneAndUpdate(reqCtx,
+		bson.M{
+			"_id":   c.ID,
+			"media": bson.M{"$nin": added},
+			"media." + strconv.Itoa(maxCollectionMedia-len(added)): bson.M{"$exists": false},
+		},
+		bson.A{
+			bson.M{"$set": bson.M{"media": bson.M{"$concatArrays": parts}, "dateupdated": time.Now()}},
+			coverUpdate,
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(updated)
+	if err == mongo.ErrNoDocuments {
+		return ctx.JSON(http.StatusConflict, "The collection was changed at the same time, please try again.")
+	}
+	if err != nil {
+		return collectionError(ctx, err)
+	}
+	updated.MediaCount = len(updated.Media)
+
+	return ctx.JSON(http.StatusOK, updated)
+}
+
+// RemoveCollectionMedia removes media documents from a collection. The
+// documents themselves are kept.
+func RemoveCollectionMedia(ctx echo.Context) error {
+
+	collection, c, access, err := readCollection(ctx)
+	if c == nil {
+		return err
+	}
+	if !access.editsCollection(c) {
+		return ctx.JSON(http.StatusForbidden, "You are not allowed to change this collection.")
+	}
+
+	req := new(CollectionMediaRequest)
+	if invalid := decodeStrict(ctx, req); invalid != nil {
+		return ctx.JSON(http.StatusBadRequest, invalid)
+	}
+	ids, fields := req.readIDs()
+	if req.Position != nil {
+		fields["position"] = "The position cannot be used to remove media documents."
+	}
+	if len(fields) > 0 {
+		return ctx.JSON(http.StatusBadRequest, &ValidationError{Message: "The media documents are invalid.", Fields: fields})
+	}
+
+	reqCtx := ctx.Request().Context()
+	if err := removeCollectionMedia(reqCtx, collection, bson.M{"_id": c.ID}, ids); err != nil {
+		return collectionError(ctx, err)
+	}
+	c, err = findCollection(reqCtx, collection, c.ID.Hex())
+	if err != nil {
+		return collectionError(ctx, err)
+	}
+
+	return ctx.JSON(http.StatusOK, c)
+}
+
+// OrderCollectionMedia puts the media documents of a collection in the order
+// of the request, which has to list all of them
+func OrderCollectionMedia(ctx echo.Context) error {
+
+	collection, c, access, err := readCollection(ctx)
+	if c == nil {
+		return err
+	}
+	if !access.editsCollection(c) {
+		return ctx.JSON(http.StatusForbidden, "You are not allowed to change this collection.")
+	}
+
+	req := new(CollectionMediaRequest)
+	if invalid := decodeStrict(ctx, req); invalid != nil {
+		return ctx.JSON(http.StatusBadRequest, invalid)
+	}
+	ids := []primitive.ObjectID{}
+	fields := make(map[string]string)
+	for _, id := range req.IDs {
+		objID, err := primitive.ObjectIDFromHex(id)
+		if err != nil || !containsID(c.Media, objID) || containsID(ids, objID) {
+			fields["ids"] = "The ids have to list each media document of the collection once."
+			break
+		}
+		ids = append(ids, objID)
+	}
+	if len(ids) != len(c.Media) {
+		fields["ids"] = "The ids have to list each media document of the collection once."
+	}
+	if req.Position != nil {
+		fields["position"] = "The position cannot be used to order media documents."
+	}
+	if len(fields) > 0 {
+		return ctx.JSON(http.StatusBadRequest, &ValidationError{Message: "The order is invalid.", Fields: fields})
+	}
+
+	// the media documents must not have changed in the meantime
+	filter := bson.M{"_id": c.ID, "media": bson.M{"$size": len(ids)}}
+	if len(ids) > 0 {
+		filter["media"] = bson.M{"$size": len(ids), "$all": ids}
+	}
+	reqCtx := ctx.Request().Context()
+	updated := new(MediaCollection)
+	err = collection.FindOneAndUpdate(reqCtx, filter,
+		bson.M{"$set": bson.M{"media": ids, "dateupdated": time.Now()}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(updated)
+	if err == mongo.ErrNoDocuments {
+		return ctx.JSON(http.StatusConflict, "The collection was changed at the same time, please try again.")
+	}
+	if err != nil {
+		return collectionError(ctx, err)
+	}
+	updated.MediaCount = len(updated.Media)
+
+	return ctx.JSON(http.StatusOK, updated)
+}
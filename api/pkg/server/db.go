@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"my.app/pkg/mongoindex"
+)
+
+// connectTimeout limits the time to connect to MongoDB
+const connectTimeout = 10 * time.Second
+
+var (
+	dbMu     sync.Mutex
+	dbClient *mongo.Client
+)
+
+// database returns a client which is connected to MONGO_DB_URI. The client is
+// created on first use and shared by all requests, so that handlers do not
+// have to open a connection of their own.
+func database(ctx context.Context) (*mongo.Client, error) {
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	if dbClient != nil {
+		return dbClient, nil
+	}
+
+	connectCtx, cancel := context.WithTimeout(ctx, connectTimeout)
+	defer cancel()
+
+	client, err := mongo.Connect(connectCtx, options.Client().ApplyURI(os.Getenv("MONGO_DB_URI")))
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Ping(connectCtx, nil); err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+	dbClient = client
+	return dbClient, nil
+}
+
+// indexedCollection returns a collection of the media database, whose
+// indexes are created when it is first used
+func indexedCollection(ctx context.Context, name string, indexes *mongoindex.Indexes) (*mongo.Collection, error) {
+	client, err := database(ctx)
+	if err != nil {
+		return nil, err
+	}
+	collection := client.Database("db-media").Collection(name)
+	if err := indexes.Ensure(collection); err != nil {
+		return nil, err
+	}
+	return collection, nil
+}
+
+// mediaIndexes are created on the media collection when it is first used
+var mediaIndexes = mongoindex.New([]mongo.IndexModel{
+	{Keys: bson.D{{Key: "b2fileId", Value: 1}}},
+	{Keys: bson.D{{Key: "contentSha1", Value: 1}}},
+	{Keys: bson.D{{Key: "duplicateof", Value: 1}}},
+	{Keys: bson.D{{Key: "phashBands", Value: 1}}},
+	{Keys: bson.D{{Key: "versions.b2fileId", Value: 1}}},
+	{Keys: bson.D{{Key: "renditions.fileId", Value: 1}}},
+	{Keys: bson.D{{Key: "datedeleted", Value: 1}}},
+	{Keys: bson.D{{Key: "dateverified", Value: 1}}},
+})
+
+// mediaCollection returns the collection which holds the media documents
+func mediaCollection(ctx context.Context) (*mongo.Collection, error) {
+	return indexedCollection(ctx, "media", mediaIndexes)
+}
+
+// tagIndexes are created on the tags collection when it is first used. A
+// name or synonym may only belong to a single tag.
+var tagIndexes = mongoindex.New([]mongo.IndexModel{
+	{Keys: bson.D{{Key: "key", Value: 1}}, Options: options.Index().SetUnique(true)},
+	{
+		Keys: bson.D{{Key: "synonymKeys", Value: 1}},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"synonymKeys": bson.M{"$exists": true}}),
+	},
+	{Keys: bson.D{{Key: "parent", Value: 1}, {Key: "key", Value: 1}}},
+})
+
+// tagsCollection returns the collection which holds the tag vocabulary
+func tagsCollection(ctx context.Context) (*mongo.Collection, error) {
+	return indexedCollection(ctx, "tags", tagIndexes)
+}
+
+// collectionIndexes are created on the collections collection when it is
+// first used
+var collectionIndexes = mongoindex.New([]mongo.IndexModel{
+	{Keys: bson.D{{Key: "media", Value: 1}}},
+	{Keys: bson.D{{Key: "cover", Value: 1}}},
+	{Keys: bson.D{{Key: "parent", Value: 1}, {Key: "name", Value: 1}}},
+	{Keys: bson.D{{Key: "owner", Value: 1}}},
+	{Keys: bson.D{{Key: "datedeleted", Value: 1}}},
+})
+
+// collectionsCollection returns the collection which holds the collections
+// of media documents
+func collectionsCollection(ctx context.Context) (*mongo.Collection, error) {
+	return indexedCollection(ctx, "collections", collectionIndexes)
+}
+
+// uploadIndexes are created on the uploads collection when it is first used
+var uploadIndexes = mongoindex.New([]mongo.IndexModel{
+	{Keys: bson.D{{Key: "owner", Value: 1}, {Key: "dateupdated", Value: -1}}},
+	{Keys: bson.D{{Key: "expiresat", Value: 1}}},
+})
+
+// uploadsCollection returns the collection which holds the sessions of the
+// large uploads in progress
+func uploadsCollection(ctx context.Context) (*mongo.Collection, error) {
+	return indexedCollection(ctx, "uploads", uploadIndexes)
+}
+
+// jobsCollection returns the collection which holds the background jobs
+func jobsCollection(ctx context.Context) (*mongo.Collection, error) {
+	client, err := database(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return client.Database("db-media").Collection("jobs"), nil
+}
+
+// usersCollection returns a collection of the users database, e.g. "users" or "permissions"
+func usersCollection(ctx context.Context, name string) (*mongo.Collection, error) {
+	client, err := database(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return client.Database("db-users").Collection(name), nil
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"my.app/pkg/storage"
+)
+
+const (
+	// defaultDownloadURLTTL is the lifetime of signed download urls
+	defaultDownloadURLTTL = 15 * time.Minute
+
+	// maxDownloadURLTTL is the longest lifetime B2 and S3 accept for signed urls
+	maxDownloadURLTTL = 7 * 24 * time.Hour
+)
+
+// downloadURLTTL returns the lifetime of signed download urls configured with
+// DOWNLOAD_URL_TTL as a duration like "15m"
+func downloadURLTTL() time.Duration {
+	ttl, err := time.ParseDuration(os.Getenv("DOWNLOAD_URL_TTL"))
+	if err != nil || ttl < time.Second {
+		return defaultDownloadURLTTL
+	}
+	if ttl > maxDownloadURLTTL {
+		return maxDownloadURLTTL
+	}
+	return ttl
+}
+
+// DownloadMedia sends the file of a media document to a user who may read it.
+//
+// If the storage backend can sign download urls, the client is redirected to
+// a signed url which is valid for DOWNLOAD_URL_TTL. Otherwise, or with the
+// query parameter stream=true, the file is streamed through the API, which
+// supports Range requests.
+func DownloadMedia(ctx echo.Context) error {
+
+	doc, err := findMediaDocument(ctx.Request().Context(), ctx.Param("id"))
+	if err != nil {
+		return mediaDocumentError(ctx, err)
+	}
+
+	allowed, err := canRead(ctx, doc)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The permissions could not be checked.")
+	}
+	if !allowed {
+		return ctx.JSON(http.StatusForbidden, "You are not allowed to download this file.")
+	}
+	if doc.FileID == "" {
+		return ctx.JSON(http.StatusNotFound, "The media document has no file.")
+	}
+
+	file := &storage.File{
+		FileID:        doc.FileID,
+		FileName:      doc.StorageFileName,
+		ContentLength: doc.Size,
+		ContentType:   doc.ContentType,
+	}
+	return sendFile(ctx, file, doc.Filename)
+}
+
+// sendFile redirects the client to a signed url of a file, or streams the
+// file if the storage cannot sign an url for it or the client asked for stream=true
+func sendFile(ctx echo.Context, file *storage.File, filename string) error {
+
+	if signer, ok := storage.Default().(storage.URLSigner); ok && ctx.QueryParam("stream") != "true" {
+		downloadURL, err := signer.DownloadURL(ctx.Request().Context(), file, downloadURLTTL())
+		if err == nil {
+			ctx.Response().Header().Set("Cache-Control", "no-store")
+			return ctx.Redirect(http.StatusTemporaryRedirect, downloadURL)
+		}
+		if !errors.Is(err, storage.ErrNotSignable) {
+			return storageError(ctx, err)
+		}
+	}
+
+	return streamFile(ctx, file, filename)
+}
+
+// streamFile sends a file from the storage. Range and conditional requests are
+// answered by http.ServeContent, which reads the file through a storageReader.
+func streamFile(ctx echo.Context, file *storage.File, filename string) error {
+
+	header := ctx.Response().Header()
+	if file.ContentType != "" {
+		header.Set("Content-Type", file.ContentType)
+	} else {
+		header.Set("Content-Type", "application/octet-stream")
+	}
+	if filename != "" {
+		header.Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": filename}))
+	}
+
+	reader := &storageReader{
+		ctx:     ctx.Request().Context(),
+		backend: storage.Default(),
+		fileID:  file.FileID,
+		size:    file.ContentLength,
+	}
+	defer reader.Close()
+
+	// the status is held back until the first byte could be read, so that
+	// errors of the storage are answered like in all other handlers
+	w := &deferredWriter{ResponseWriter: ctx.Response()}
+	http.ServeContent(w, ctx.Request(), "", time.Time{}, reader)
+	if !w.flushed {
+		if reader.err != nil {
+			for _, name := range []string{"Content-Type", "Content-Disposition", "Content-Length", "Content-Range", "Accept-Ranges"} {
+				header.Del(name)
+			}
+			return storageError(ctx, reader.err)
+		}
+		w.flush()
+	}
+	return nil
+}
+
+// storageReader reads a file from the storage as io.ReadSeeker. Every seek
+// starts a new download from the new offset when the next Read is called.
+type storageReader struct {
+	ctx     context.Context
+	backend storage.Storage
+	fileID  string
+	size    int64
+	offset  int64
+	body    io.ReadCloser
+	err     error
+}
+
+func (r *storageReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		body, _, err := r.backend.DownloadRange(r.ctx, r.fileID, r.offset, -1)
+		if err != nil {
+			r.err = err
+			return 0, err
+		}
+		r.body = body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *storageReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("server: seek before the start of the file")
+	}
+	if offset != r.offset {
+		r.Close()
+		r.offset = offset
+	}
+	return offset, nil
+}
+
+func (r *storageReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+// deferredWriter passes the status to the response with the first write
+type deferredWriter struct {
+	http.ResponseWriter
+	status  int
+	flushed bool
+}
+
+func (w *deferredWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *deferredWriter) Write(p []byte) (int, error) {
+	if !w.flushed {
+		w.flush()
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *deferredWriter) flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	w.flushed = true
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// the policies for uploads of files which are in the library already
+const (
+	// keep both files and mark the new media document as duplicate
+	duplicatesKeep = "keep"
+
+	// drop the new file and answer with the existing media document
+	duplicatesLink = "link"
+
+	// drop the new file and answer with a conflict
+	duplicatesReject = "reject"
+)
+
+// duplicatePolicy returns the policy of the query parameter duplicates, which
+// defaults to DUPLICATE_POLICY and then to keep. It returns false for unknown policies.
+func duplicatePolicy(ctx echo.Context) (string, bool) {
+	policy := ctx.QueryParam("duplicates")
+	if policy == "" {
+		policy = os.Getenv("DUPLICATE_POLICY")
+	}
+	switch policy {
+	case "":
+		return duplicatesKeep, true
+	case duplicatesKeep, duplicatesLink, duplicatesReject:
+		return policy, true
+	}
+	return "", false
+}
+
+// DuplicateError is the response to an upload which was rejected because the
+// file is in the library already
+type DuplicateError struct {
+	Message     string             `json:"message"`
+	DuplicateOf primitive.ObjectID `json:"duplicateOf"`
+}
+
+// findDuplicate returns the oldest media document which is not a copy itself
+// or in the trash and has the same content as doc. It returns nil if the
+// content is unique or its checksum is unknown.
+func findDuplicate(ctx context.Context, collection *mongo.Collection, doc *MediaDocument) (*MediaDocument, error) {
+	if doc.ContentSha1 == "" {
+		return nil, nil
+	}
+
+	filter := bson.M{
+		"_id":         bson.M{"$ne": doc.ID},
+		"contentSha1": doc.ContentSha1,
+		"b2FileSize":  doc.Size,
+		"duplicateof": bson.M{"$exists": false},
+		"datedeleted": bson.M{"$exists": false},
+	}
+	existing := new(MediaDocument)
+	err := collection.FindOne(ctx, filter, options.FindOne().
+		SetSort(bson.D{{Key: "datecreated", Value: 1}, {Key: "_id", Value: 1}})).Decode(existing)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return existing, nil
+}
+
+// applyDuplicatePolicy checks a new media document for an existing copy. The
+// document is marked as duplicate if the policy keeps both. Otherwise, the
+// existing document is returned for the answer and the new file has to be dropped.
+func applyDuplicatePolicy(ctx context.Context, collection *mongo.Collection, doc *MediaDocument, policy string) (*MediaDocument, error) {
+	existing, err := findDuplicate(ctx, collection, doc)
+	if err != nil || existing == nil {
+		return nil, err
+	}
+	if policy == duplicatesKeep {
+		doc.DuplicateOf = &existing.ID
+		return nil, nil
+	}
+	return existing, nil
+}
+
+// duplicateResponse answers an upload of a file which is in the library already
+func duplicateResponse(ctx echo.Context, existing *MediaDocument, policy string) error {
+	if policy == duplicatesLink {
+		return ctx.JSON(http.StatusOK, existing)
+	}
+	return ctx.JSON(http.StatusConflict, &DuplicateError{
+		Message:     "The file is in the library already.",
+		DuplicateOf: existing.ID,
+	})
+}
+
+// promoteDuplicates marks the oldest copy of a deleted media document as the
+// original, which the other copies are linked to
+func promoteDuplicates(ctx context.Context, collection *mongo.Collection, doc *MediaDocument) error {
+	if doc.DuplicateOf != nil {
+		return nil
+	}
+
+	promoted := new(MediaDocument)
+	err := collection.FindOne(ctx, bson.M{"duplicateof": doc.ID}, options.FindOne().
+		SetSort(bson.D{{Key: "datecreated", Value: 1}, {Key: "_id", Value: 1}})).Decode(promoted)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := collection.UpdateOne(ctx, bson.M{"_id": promoted.ID}, bson.M{"$unset": bson.M{"duplicateof": ""}}); err != nil {
+		return err
+	}
+	_, err = collection.UpdateMany(ctx, bson.M{"duplicateof": doc.ID}, bson.M{"$set": bson.M{"duplicateof": promoted.ID}})
+	return err
+}
+
+// DuplicateDocument is a media document in a DuplicateGroup
+type DuplicateDocument struct {
+	ID          primitive.ObjectID `bson:"id" json:"id"`
+	Filename    string             `bson:"filename" json:"filename"`
+	DateCreated time.Time          `bson:"dateCreated" json:"dateCreated"`
+	Owner       string             `bson:"owner" json:"owner"`
+}
+
+// DuplicateGroup are the media documents with the same content, the oldest first
+type DuplicateGroup struct {
+	ContentSha1 string              `bson:"_id" json:"contentSha1"`
+	Count       int64               `bson:"count" json:"count"`
+	Size        int64               `bson:"size" json:"size"`
+	WastedBytes int64               `bson:"wastedBytes" json:"wastedBytes"`
+	Documents   []DuplicateDocument `bson:"documents" json:"documents"`
+}
+
+// DuplicateReport is a page of the groups of duplicates in the library
+type DuplicateReport struct {
+	Groups   []DuplicateGroup `json:"groups"`
+	Total    int64            `json:"total"`
+	Page     int64            `json:"page"`
+	PageSize int64            `json:"pageSize"`
+}
+
+// ListDuplicates returns the groups of media documents with the same content,
+// those which waste the most storage first. Documents in the trash are left
+// out. The query parameters page and pageSize select the page.
+func ListDuplicates(ctx echo.Context) error {
+
+	// Get the jwt token from context
+	user := ctx.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+
+	// check if the user has admin rights
+	isAdmin := claims["is_admin"].(bool)
+	if !isAdmin {
+		return ctx.JSON(http.StatusUnauthorized, "Administrator rights are required to list the duplicates.")
+	}
+
+	page, pageSize, invalid := readPage(ctx)
+	if invalid != "" {
+		return ctx.JSON(http.StatusBadRequest, invalid)
+	}
+
+	reqCtx := ctx.Request().Context()
+	collection, err := mediaCollection(reqCtx)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The duplicates could not be read.")
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"contentSha1": bson.M{"$exists": true, "$ne": ""}, "datedeleted": bson.M{"$exists": false}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "datecreated", Value: 1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   "$contentSha1",
+			"count": bson.M{"$sum": 1},
+			"size":  bson.M{"$first": "$b2FileSize"},
+			"documents": bson.M{"$push": bson.M{
+				"id":          "$_id",
+				"filename":    "$filename",
+				"dateCreated": "$datecreated",
+				"owner":       "$owner",
+			}},
+		}}},
+		{{Key: "$match", Value: bson.M{"count": bson.M{"$gt": 1}}}},
+		{{Key: "$facet", Value: bson.M{
+			"total": bson.A{bson.M{"$count": "groups"}},
+			"groups": bson.A{
+				bson.M{"$addFields": bson.M{"wastedBytes": bson.M{"$multiply": bson.A{"$size", bson.M{"$subtract": bson.A{"$count", 1}}}}}},
+				bson.M{"$sort": bson.D{{Key: "wastedBytes", Value: -1}, {Key: "_id", Value: 1}}},
+				bson.M{"$skip": (page - 1) * pageSize},
+				bson.M{"$limit": pageSize},
+			},
+		}}},
+	}
+
+	var result []struct {
+		Total []struct {
+			Groups int64 `bson:"groups"`
+		} `bson:"total"`
+		Groups []DuplicateGroup `bson:"groups"`
+	}
+	cur, err := collection.Aggregate(reqCtx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err == nil {
+		err = cur.All(reqCtx, &result)
+	}
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The duplicates could not be read.")
+	}
+
+	report := &DuplicateReport{Groups: []DuplicateGroup{}, Page: page, PageSize: pageSize}
+	if len(result) > 0 {
+		if len(result[0].Total) > 0 {
+			report.Total = result[0].Total[0].Groups
+		}
+		if result[0].Groups != nil {
+			report.Groups = result[0].Groups
+		}
+	}
+	return ctx.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,388 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// earthRadius is the mean radius of the earth in meters
+	earthRadius = 6371008.8
+
+	// maxSearchRadius is the largest radius of a search around a point in
+	// meters, half the circumference of the earth
+	maxSearchRadius = 20015000
+
+	// maxPolygonPoints limits the size of the polygons of a search
+	maxPolygonPoints = 1000
+
+	// boxEdgeStep is the largest distance in degrees between the points of
+	// the edges of a box along a latitude. Edges of GeoJSON polygons are
+	// great circles, so the edges are split to follow the latitude.
+	boxEdgeStep = 1.0
+
+	// maxPolygonWidth is the widest part of a box which is queried as one
+	// polygon, wider boxes are split into several polygons
+	maxPolygonWidth = 90.0
+
+	// maxPolarLatitude keeps the corners of boxes off the poles, where all
+	// longitudes are the same point
+	maxPolarLatitude = 89.9999
+)
+
+// errInvalidGeoArea is returned for areas the database rejects, e.g.
+// polygons whose edges cross
+var errInvalidGeoArea = errors.New("server: invalid geo area")
+
+// geoJSONPoint is the form of a Geoinformation in the database, a GeoJSON
+// point which is indexed with a 2dsphere index
+type geoJSONPoint struct {
+	Type        string    `bson:"type"`
+	Coordinates []float64 `bson:"coordinates"`
+	Altitude    float64   `bson:"altitude,omitempty"`
+}
+
+// MarshalBSON stores a Geoinformation as a GeoJSON point
+func (g Geoinformation) MarshalBSON() ([]byte, error) {
+	return bson.Marshal(geoJSONPoint{
+		Type:        "Point",
+		Coordinates: []float64{g.Longitude, g.Latitude},
+		Altitude:    g.Altitude,
+	})
+}
+
+// UnmarshalBSON reads a Geoinformation stored as GeoJSON point, or with the
+// latitude and longitude fields which were stored before
+func (g *Geoinformation) UnmarshalBSON(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	var stored struct {
+		Coordinates []float64 `bson:"coordinates"`
+		Altitude    float64   `bson:"altitude"`
+		Latitude    float64   `bson:"latitude"`
+		Longitude   float64   `bson:"longitude"`
+	}
+	if err := bson.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+
+	g.Latitude, g.Longitude, g.Altitude = stored.Latitude, stored.Longitude, stored.Altitude
+	if len(stored.Coordinates) >= 2 {
+		g.Longitude, g.Latitude = stored.Coordinates[0], stored.Coordinates[1]
+	}
+	return nil
+}
+
+// valid reports whether the coordinates are in range
+func (g *Geoinformation) valid() bool {
+	return g.Latitude >= -90 && g.Latitude <= 90 && g.Longitude >= -180 && g.Longitude <= 180
+}
+
+// migrateGeoPoints stores the locations which were stored as latitude and
+// longitude fields as GeoJSON points, which the 2dsphere index requires.
+// Locations out of range are removed, and so are locations at 0,0, which
+// every document stored when the location was not optional yet.
+func migrateGeoPoints(ctx context.Context, collection *mongo.Collection) error {
+	cur, err := collection.Find(ctx, bson.M{"metadata.geo.latitude": bson.M{"$exists": true}})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var doc struct {
+			ID       primitive.ObjectID `bson:"_id"`
+			Metadata struct {
+				Geo Geoinformation `bson:"geo"`
+			} `bson:"metadata"`
+		}
+		if err := cur.Decode(&doc); err != nil {
+			return err
+		}
+
+		update := bson.M{"$set": bson.M{"metadata.geo": doc.Metadata.Geo}}
+		geo := doc.Metadata.Geo
+		if !geo.valid() || geo.Latitude == 0 && geo.Longitude == 0 {
+			update = bson.M{"$unset": bson.M{"metadata.geo": ""}}
+		}
+		if _, err := collection.UpdateOne(ctx, bson.M{"_id": doc.ID}, update); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+// GeoPosition is a point on the earth
+type GeoPosition struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// GeoBox is the area between two latitudes and two longitudes. Boxes whose
+// west is east of their east cross the antimeridian.
+type GeoBox struct {
+	South float64 `json:"south"`
+	West  float64 `json:"west"`
+	North float64 `json:"north"`
+	East  float64 `json:"east"`
+}
+
+// GeoArea is the area a search is restricted to, one of a circle, a box or a polygon
+type GeoArea struct {
+	// a circle around Center with a Radius in meters
+	Center *GeoPosition
+	Radius float64
+
+	Box *GeoBox
+
+	Polygon []GeoPosition
+}
+
+// readGeoArea reads the area of a search from the query parameters near and
+// radius, bbox or polygon, whose coordinates are written latitude first, as
+// Google Maps does:
+//
+//	near=lat,lng&radius=meters
+//	bbox=south,west,north,east
+//	polygon=lat,lng,lat,lng,lat,lng,...
+//
+// It returns nil if there is no area, and the invalid fields with their messages.
+func readGeoArea(near, radius, bbox, polygon string, fields map[string]string) *GeoArea {
+	given := 0
+	for _, value := range []string{near, bbox, polygon} {
+		if value != "" {
+			given++
+		}
+	}
+	if given == 0 {
+		if radius != "" {
+			fields["radius"] = "A radius requires near."
+		}
+		return nil
+	}
+	if given > 1 {
+		fields["near"] = "Only one of near, bbox and polygon can be used."
+		return nil
+	}
+
+	area := new(GeoArea)
+	switch {
+	case near != "":
+		positions, ok := parseGeoPositions(near)
+		if !ok || len(positions) != 1 {
+			fields["near"] = "The point has to be written as latitude,longitude."
+		} else {
+			area.Center = &positions[0]
+		}
+		r, err := strconv.ParseFloat(radius, 64)
+		if err != nil || r <= 0 || r > maxSearchRadius {
+			fields["radius"] = "The radius has to be between 0 and " + strconv.Itoa(maxSearchRadius) + " meters."
+		}
+		area.Radius = r
+
+	case bbox != "":
+		positions, ok := parseGeoPositions(bbox)
+		if !ok || len(positions) != 2 || positions[0].Latitude > positions[1].Latitude {
+			fields["bbox"] = "The box has to be written as south,west,north,east."
+		} else {
+			area.Box = &GeoBox{
+				South: positions[0].Latitude,
+				West:  positions[0].Longitude,
+				North: positions[1].Latitude,
+				East:  positions[1].Longitude,
+			}
+		}
+
+	default:
+		positions, ok := parseGeoPositions(polygon)
+		if ok && len(positions) > 1 && positions[0] == positions[len(positions)-1] {
+			positions = positions[:len(positions)-1]
+		}
+		if !ok || len(positions) < 3 || len(positions) > maxPolygonPoints {
+			fields["polygon"] = "The polygon has to be written as at least three points latitude,longitude,latitude,longitude,..."
+		}
+		area.Polygon = positions
+	}
+	return area
+}
+
+// parseGeoPositions parses comma separated pairs of latitude and longitude
+func parseGeoPositions(value string) ([]GeoPosition, bool) {
+	parts := strings.Split(value, ",")
+	if len(parts)%2 != 0 {
+		return nil, false
+	}
+	positions := make([]GeoPosition, 0, len(parts)/2)
+	for i := 0; i < len(parts); i += 2 {
+		lat, err := strconv.ParseFloat(strings.TrimSpace(parts[i]), 64)
+		if err != nil || lat < -90 || lat > 90 {
+			return nil, false
+		}
+		lng, err := strconv.ParseFloat(strings.TrimSpace(parts[i+1]), 64)
+		if err != nil || lng < -180 || lng > 180 {
+			return nil, false
+		}
+		positions = append(positions, GeoPosition{Latitude: lat, Longitude: lng})
+	}
+	return positions, true
+}
+
+// geoFilter returns the condition of the locations within an area
+func (area *GeoArea) geoFilter() bson.M {
+	switch {
+	case area.Center != nil:
+		return bson.M{"$geoWithin": bson.M{"$centerSphere": bson.A{
+			bson.A{area.Center.Longitude, area.Center.Latitude},
+			area.Radius / earthRadius,
+		}}}
+	case area.Box != nil:
+		return bson.M{"$geoWithin": bson.M{"$geometry": area.Box.geometry()}}
+	}
+
+	ring := bson.A{}
+	for _, p := range area.Polygon {
+		ring = append(ring, bson.A{p.Longitude, p.Latitude})
+	}
+	ring = append(ring, bson.A{area.Polygon[0].Longitude, area.Polygon[0].Latitude})
+	return bson.M{"$geoWithin": bson.M{"$geometry": bson.M{
+		"type":        "Polygon",
+		"coordinates": bson.A{ring},
+	}}}
+}
+
+// geometry returns a box as GeoJSON multipolygon. Its edges along the
+// latitudes are split into short segments and wide boxes are split into
+// several polygons, so that the great circle edges of GeoJSON follow the box.
+func (box *GeoBox) geometry() bson.M {
+	south := math.Max(box.South, -maxPolarLatitude)
+	north := math.Min(box.North, maxPolarLatitude)
+	width := box.East - box.West
+	if width <= 0 {
+		width += 360
+	}
+
+	polygons := bson.A{}
+	for start := 0.0; start < width; start += maxPolygonWidth {
+		end := math.Min(start+maxPolygonWidth, width)
+		steps := int(math.Ceil((end - start) / boxEdgeStep))
+
+		ring := bson.A{}
+		for i := 0; i <= steps; i++ {
+			ring = append(ring, bson.A{normalizeLongitude(box.West + start + (end-start)*float64(i)/float64(steps)), south})
+		}
+		for i := steps; i >= 0; i-- {
+			ring = append(ring, bson.A{normalizeLongitude(box.West + start + (end-start)*float64(i)/float64(steps)), north})
+		}
+		ring = append(ring, ring[0])
+		polygons = append(polygons, bson.A{ring})
+	}
+	return bson.M{"type": "MultiPolygon", "coordinates": polygons}
+}
+
+// normalizeLongitude returns a longitude between -180 and 180
+func normalizeLongitude(lng float64) float64 {
+	for lng > 180 {
+		lng -= 360
+	}
+	for lng < -180 {
+		lng += 360
+	}
+	return lng
+}
+
+// isBadValue reports whether the database rejected the values of a query
+func isBadValue(err error) bool {
+	var cmdErr mongo.CommandError
+	return errors.As(err, &cmdErr) && cmdErr.Code == 2
+}
+
+const (
+	// clusterCellsPerTile is the number of grid cells along each edge of a
+	// map tile, which makes cells of 64 pixels with tiles of 256 pixels
+	clusterCellsPerTile = 4
+
+	maxClusterZoom = 22
+)
+
+// GeoCluster is the number of located media documents in a cell of the grid
+// of a map view
+type GeoCluster struct {
+	// the mean position of the documents
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+
+	Count  int64  `json:"count"`
+	Bounds GeoBox `json:"bounds"`
+
+	// the document of a cell with a single document
+	DocumentID *primitive.ObjectID `json:"documentId,omitempty"`
+}
+
+// GeoClusterResult are the clusters of a map view
+type GeoClusterResult struct {
+	Zoom     int          `json:"zoom"`
+	CellSize float64      `json:"cellSize"`
+	Clusters []GeoCluster `json:"clusters"`
+}
+
+// clusterCellSize returns the size of the grid cells in degrees at a zoom
+// level, at which the world is 2^zoom map tiles wide
+func clusterCellSize(zoom int) float64 {
+	return 360 / float64(int64(clusterCellsPerTile)<<uint(zoom))
+}
+
+// gridCell returns the bounds of a cell of a grid which starts at -90, -180
+func gridCell(x, y int, cellSize float64) GeoBox {
+	box := GeoBox{
+		South: float64(y)*cellSize - 90,
+		West:  float64(x)*cellSize - 180,
+	}
+	box.North = math.Min(box.South+cellSize, 90)
+	box.East = math.Min(box.West+cellSize, 180)
+	return box
+}
+
+// ListMediaClusters counts the located media documents the user may read
+// in the cells of a grid, for the markers of a map view. The query parameter
+// zoom is the zoom level of the map, from 0 for the whole world in a single
+// tile to 22. The grid has four cells per tile edge, so that the count of a
+// cell is a marker every 64 pixels. Usually, bbox restricts the clusters to
+// the visible part of the map, all other parameters of SearchMedia filter the
+// documents as well.
+func ListMediaClusters(ctx echo.Context) error {
+
+	zoom, err := strconv.Atoi(ctx.QueryParam("zoom"))
+	if err != nil || zoom < 0 || zoom > maxClusterZoom {
+		return ctx.JSON(http.StatusBadRequest, "The zoom has to be between 0 and "+strconv.Itoa(maxClusterZoom)+".")
+	}
+
+	query, fields := readMediaQuery(ctx.QueryParams())
+	if len(fields) > 0 {
+		return ctx.JSON(http.StatusBadRequest, &ValidationError{Message: "The search is invalid.", Fields: fields})
+	}
+	if query.Access, err = mediaAccess(ctx); err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The permissions could not be checked.")
+	}
+
+	result := &GeoClusterResult{Zoom: zoom, CellSize: clusterCellSize(zoom)}
+	result.Clusters, err = mediaIndex.Clusters(ctx.Request().Context(), query, result.CellSize)
+	if err == errInvalidGeoArea {
+		return ctx.JSON(http.StatusBadRequest, "The area of the search is invalid.")
+	}
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The clusters could not be counted.")
+	}
+	return ctx.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo/v4"
+	"my.app/pkg/jobs"
+	"my.app/pkg/jobs/mongostore"
+)
+
+// NewJobQueue creates the queue of the background jobs of the API, which
+// are kept in the jobs collection. JOB_WORKERS sets the number of jobs which
+// run at the same time, JOB_MAX_ATTEMPTS the number of runs before a failing
+// job is dead.
+func NewJobQueue(logger jobs.Logger) *jobs.Queue {
+	options := jobs.Options{Logger: logger}
+	options.Workers, _ = strconv.Atoi(os.Getenv("JOB_WORKERS"))
+	options.MaxAttempts, _ = strconv.Atoi(os.Getenv("JOB_MAX_ATTEMPTS"))
+
+	queue := jobs.NewQueue(mongostore.New(jobsCollection), options)
+	queue.Register(processMediaJob, processMedia)
+	queue.Register(purgeTrashJob, purgeTrash)
+	queue.Register(expireUploadsJob, expireUploads)
+	queue.Register(scrubMediaJob, scrubMedia)
+	return queue
+}
+
+// schedule queues a job of the type at the start of every interval. The
+// start of the interval is the key of the job, so the job runs once per
+// interval, no matter how many servers run.
+func schedule(logger jobs.Logger, jobType string, interval time.Duration) {
+	go func() {
+		for {
+			start := time.Now().Truncate(interval)
+			key := jobType + ":" + strconv.FormatInt(start.Unix(), 10)
+			if _, err := jobs.Default().Enqueue(context.Background(), jobType, key, map[string]string{}); err != nil {
+				logger.Errorf("queue the job %s: %v", key, err)
+			}
+			time.Sleep(time.Until(start.Add(interval)))
+		}
+	}()
+}
+
+// JobPage is a page of the background jobs
+type JobPage struct {
+	Jobs     []*jobs.Job `json:"jobs"`
+	Total    int64       `json:"total"`
+	Page     int64       `json:"page"`
+	PageSize int64       `json:"pageSize"`
+}
+
+// ListJobs returns the background jobs, newest first. The query parameters
+// page and pageSize select the page, type, status and key filter the jobs.
+// The job which processes an uploaded file has the key process-media:<b2fileId>.
+func ListJobs(ctx echo.Context) error {
+
+	// Get the jwt token from context
+	user := ctx.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+
+	// check if the user has admin rights
+	isAdmin := claims["is_admin"].(bool)
+	if !isAdmin {
+		return ctx.JSON(http.StatusUnauthorized, "Administrator rights are required to list the jobs.")
+	}
+
+	page, pageSize, invalid := readPage(ctx)
+	if invalid != "" {
+		return ctx.JSON(http.StatusBadRequest, invalid)
+	}
+
+	list, total, err := jobs.Default().List(ctx.Request().Context(), jobs.ListJobsRequest{
+		Type:   ctx.QueryParam("type"),
+		Status: jobs.Status(ctx.QueryParam("status")),
+		Key:    ctx.QueryParam("key"),
+		Skip:   (page - 1) * pageSize,
+		Limit:  pageSize,
+	})
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The jobs could not be read.")
+	}
+
+	return ctx.JSON(http.StatusOK, &JobPage{Jobs: list, Total: total, Page: page, PageSize: pageSize})
+}
+
+// GetJob returns the status of a background job
+func GetJob(ctx echo.Context) error {
+
+	// Get the jwt token from context
+	user := ctx.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+
+	// check if the user has admin rights
+	isAdmin := claims["is_admin"].(bool)
+	if !isAdmin {
+		return ctx.JSON(http.StatusUnauthorized, "Administrator rights are required to read a job.")
+	}
+
+	job, err := jobs.Default().Get(ctx.Request().Context(), ctx.Param("id"))
+	if err == jobs.ErrNotFound {
+		return ctx.JSON(http.StatusNotFound, "The job does not exist.")
+	}
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The job could not be read.")
+	}
+
+	return ctx.JSON(http.StatusOK, job)
+}
+
+// RetryJob queues a dead job again
+func RetryJob(ctx echo.Context) error {
+
+	// Get the jwt token from context
+	user := ctx.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+
+	// check if the user has admin rights
+	isAdmin := claims["is_admin"].(bool)
+	if !isAdmin {
+		return ctx.JSON(http.StatusUnauthorized, "Administrator rights are required to retry a job.")
+	}
+
+	job, err := jobs.Default().Retry(ctx.Request().Context(), ctx.Param("id"))
+	switch err {
+	case nil:
+		return ctx.JSON(http.StatusOK, job)
+	case jobs.ErrNotFound:
+		return ctx.JSON(http.StatusNotFound, "The job does not exist.")
+	case jobs.ErrNotDead, jobs.ErrLeaseLost:
+		return ctx.JSON(http.StatusConflict, "Only dead jobs can be retried.")
+	}
+	ctx.Logger().Error(err)
+	return ctx.JSON(http.StatusInternalServerError, "The job could not be retried.")
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"my.app/pkg/storage"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+
+	// maxSortedListing limits the files which are read from the storage to
+	// sort a listing by anything but the name in ascending order
+	maxSortedListing = 10000
+)
+
+// Asset is a single entry of the media listing, either a file or a folder
+type Asset struct {
+	ID          string     `json:"id,omitempty"`
+	Name        string     `json:"name"`
+	Folder      bool       `json:"folder"`
+	ContentType string     `json:"contentType,omitempty"`
+	Size        int64      `json:"size"`
+	ContentSha1 string     `json:"contentSha1,omitempty"`
+	UploadedAt  *time.Time `json:"uploadedAt,omitempty"`
+}
+
+// AssetPage is a single page of the media listing
+type AssetPage struct {
+	Assets []Asset `json:"assets"`
+
+	// NextCursor is passed as cursor to get the next page, it is empty on the last page
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// listCursor is the position in a listing, which is handed to clients as an opaque string.
+// Listings by name in ascending order continue at a file name, all others at an offset.
+type listCursor struct {
+	Sort          string `json:"s"`
+	Prefix        string `json:"p,omitempty"`
+	Delimiter     string `json:"d,omitempty"`
+	StartFileName string `json:"n,omitempty"`
+	Offset        int    `json:"o,omitempty"`
+}
+
+func (c *listCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (*listCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	c := new(listCursor)
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// assetLess compares assets for the sort options of the listing
+var assetLess = map[string]func(a, b *Asset) bool{
+	"name":      func(a, b *Asset) bool { return a.Name < b.Name },
+	"-name":     func(a, b *Asset) bool { return a.Name > b.Name },
+	"size":      func(a, b *Asset) bool { return a.Size < b.Size },
+	"-size":     func(a, b *Asset) bool { return a.Size > b.Size },
+	"uploaded":  func(a, b *Asset) bool { return uploadedBefore(a, b) },
+	"-uploaded": func(a, b *Asset) bool { return uploadedBefore(b, a) },
+}
+
+// uploadedBefore orders assets by upload time, folders have none and come first
+func uploadedBefore(a, b *Asset) bool {
+	if a.UploadedAt == nil || b.UploadedAt == nil {
+		return a.UploadedAt == nil && b.UploadedAt != nil
+	}
+	return a.UploadedAt.Before(*b.UploadedAt)
+}
+
+var errListingTooLarge = errors.New("server: too many files to sort")
+
+// GetFileList lists the files in the storage page by page.
+//
+// The query parameters are prefix and delimiter to browse folders, pageSize,
+// sort (name, size or uploaded, with a leading "-" for descending order) and
+// cursor, which is the nextCursor of the previous page.
+func GetFileList(ctx echo.Context) error {
+
+	cursor := &listCursor{
+		Sort:      ctx.QueryParam("sort"),
+		Prefix:    ctx.QueryParam("prefix"),
+		Delimiter: ctx.QueryParam("delimiter"),
+	}
+	if cursor.Sort == "" {
+		cursor.Sort = "name"
+	}
+	if _, ok := assetLess[cursor.Sort]; !ok {
+		return ctx.JSON(http.StatusBadRequest, "The sort order has to be one of name, size or uploaded, optionally with a leading -.")
+	}
+
+	if value := ctx.QueryParam("cursor"); value != "" {
+		previous, err := decodeCursor(value)
+		if err != nil || previous.Sort != cursor.Sort || previous.Prefix != cursor.Prefix || previous.Delimiter != cursor.Delimiter {
+			return ctx.JSON(http.StatusBadRequest, "The cursor does not belong to this listing.")
+		}
+		cursor = previous
+	}
+
+	pageSize := defaultPageSize
+	if value := ctx.QueryParam("pageSize"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 1 || size > maxPageSize {
+			return ctx.JSON(http.StatusBadRequest, "The page size has to be between 1 and 1000.")
+		}
+		pageSize = size
+	}
+
+	var page *AssetPage
+	var err error
+	if cursor.Sort == "name" {
+		page, err = listByName(ctx.Request().Context(), cursor, pageSize)
+	} else {
+		page, err = listSorted(ctx.Request().Context(), cursor, pageSize)
+	}
+	if err == errListingTooLarge {
+		return ctx.JSON(http.StatusBadRequest, "There are too many files to sort them, please narrow the listing down with a prefix.")
+	}
+	if err != nil {
+		return storageError(ctx, err)
+	}
+	return ctx.JSON(http.StatusOK, page)
+}
+
+// listByName reads a single page from the storage, which lists by name anyway
+func listByName(ctx context.Context, cursor *listCursor, pageSize int) (*AssetPage, error) {
+	files, err := storage.Default().ListFiles(ctx, storage.ListFilesRequest{
+		StartFileName: cursor.StartFileName,
+		MaxFileCount:  pageSize,
+		Prefix:        cursor.Prefix,
+		Delimiter:     cursor.Delimiter,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	page := &AssetPage{Assets: newAssets(files)}
+	sortAssets(page.Assets, "name")
+	if files.NextFileName != "" {
+		next := *cursor
+		next.StartFileName = files.NextFileName
+		page.NextCursor = next.encode()
+	}
+	return page, nil
+}
+
+// listSorted reads the whole listing from the storage to sort it
+func listSorted(ctx context.Context, cursor *listCursor, pageSize int) (*AssetPage, error) {
+	assets := []Asset{}
+	req := storage.ListFilesRequest{
+		MaxFileCount: maxPageSize,
+		Prefix:       cursor.Prefix,
+		Delimiter:    cursor.Delimiter,
+	}
+	for {
+		files, err := storage.Default().ListFiles(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		assets = append(assets, newAssets(files)...)
+		if len(assets) > maxSortedListing {
+			return nil, errListingTooLarge
+		}
+		if files.NextFileName == "" {
+			break
+		}
+		req.StartFileName = files.NextFileName
+	}
+	sortAssets(assets, cursor.Sort)
+
+	page := &AssetPage{Assets: []Asset{}}
+	if cursor.Offset < len(assets) {
+		end := cursor.Offset + pageSize
+		if end < len(assets) {
+			next := *cursor
+			next.Offset = end
+			page.NextCursor = next.encode()
+		} else {
+			end = len(assets)
+		}
+		page.Assets = assets[cursor.Offset:end]
+	}
+	return page, nil
+}
+
+// newAssets converts a page of the storage listing
+func newAssets(files *storage.FileList) []Asset {
+	assets := make([]Asset, 0, len(files.Files)+len(files.Folders))
+	for _, folder := range files.Folders {
+		assets = append(assets, Asset{Name: folder, Folder: true})
+	}
+	for _, file := range files.Files {
+		uploadedAt := time.Unix(0, file.UploadTimestamp*int64(time.Millisecond)).UTC()
+		assets = append(assets, Asset{
+			ID:          file.FileID,
+			Name:        file.FileName,
+			ContentType: file.ContentType,
+			Size:        file.ContentLength,
+			ContentSha1: file.ContentSha1,
+			UploadedAt:  &uploadedAt,
+		})
+	}
+	return assets
+}
+
+// sortAssets sorts assets stably, assets which are equal stay ordered by name
+func sortAssets(assets []Asset, order string) {
+	less := assetLess[order]
+	sort.SliceStable(assets, func(i, j int) bool {
+		return assets[i].Name < assets[j].Name
+	})
+	sort.SliceStable(assets, func(i, j int) bool {
+		return less(&assets[i], &assets[j])
+	})
+}
@@ -0,0 +1,638 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"my.app/pkg/storage"
+)
+
+const (
+	// defaultDocumentPageSize is the number of media documents returned per page
+	defaultDocumentPageSize = 50
+
+	maxDocumentPageSize = 500
+
+	maxFilenameLength = 255
+	maxTags           = 100
+	maxTagLength      = 100
+)
+
+// errMediaNotFound is returned when a media document does not exist
+var errMediaNotFound = errors.New("server: media document not found")
+
+// findMediaDocument reads the media document with the given hex id.
+// Documents in the trash are not found.
+func findMediaDocument(ctx context.Context, id string) (*MediaDocument, error) {
+	return findMedia(ctx, id, false)
+}
+
+// findTrashedMediaDocument reads the media document with the given hex id,
+// which has to be in the trash
+func findTrashedMediaDocument(ctx context.Context, id string) (*MediaDocument, error) {
+	return findMedia(ctx, id, true)
+}
+
+func findMedia(ctx context.Context, id string, trashed bool) (*MediaDocument, error) {
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, errMediaNotFound
+	}
+
+	collection, err := mediaCollection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := new(MediaDocument)
+	err = collection.FindOne(ctx, bson.M{"_id": objID, "datedeleted": bson.M{"$exists": trashed}}).Decode(doc)
+	if err == mongo.ErrNoDocuments {
+		return nil, errMediaNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// isPublic reports whether a media document was marked as public on upload
+func (doc *MediaDocument) isPublic() bool {
+	public, _ := doc.FilterData["isPublic"].(bool)
+	return public
+}
+
+// userPermissions reads the permissions and the role of the user of the request
+func userPermissions(ctx echo.Context) ([]string, string, error) {
+
+	// Get the jwt token from context
+	user := ctx.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+
+	userID, _ := claims["ID"].(string)
+	objID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, "", nil
+	}
+
+	collection, err := usersCollection(ctx.Request().Context(), "users")
+	if err != nil {
+		return nil, "", err
+	}
+
+	result := struct {
+		Permissions []string `bson:"permissions"`
+		Role        string   `bson:"role"`
+	}{}
+	err = collection.FindOne(ctx.Request().Context(), bson.M{"_id": objID},
+		options.FindOne().SetProjection(bson.M{"permissions": 1, "role": 1})).Decode(&result)
+	if err == mongo.ErrNoDocuments {
+		return nil, "", nil
+	}
+	return result.Permissions, result.Role, err
+}
+
+// canRead checks whether the user of the request may access a media document.
+// Administrators and the owner may always, other users if the document is
+// public or if they hold one of the permissions of the document.
+func canRead(ctx echo.Context, doc *MediaDocument) (bool, error) {
+	if canWrite(ctx, doc) || doc.isPublic() {
+		return true, nil
+	}
+	if len(doc.Permissions) == 0 {
+		return false, nil
+	}
+
+	permissions, _, err := userPermissions(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, permission := range permissions {
+		for _, required := range doc.Permissions {
+			if permission == required {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// canWrite checks whether the user of the request may change or delete a
+// media document, which administrators and the owner may
+func canWrite(ctx echo.Context, doc *MediaDocument) bool {
+
+	// Get the jwt token from context
+	user := ctx.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+
+	if isAdmin, _ := claims["is_admin"].(bool); isAdmin {
+		return true
+	}
+	userID, _ := claims["ID"].(string)
+	return userID != "" && userID == doc.Owner
+}
+
+// MediaAccess describes which media documents a user who is no
+// administrator may read, see canRead
+type MediaAccess struct {
+	UserID      string
+	Permissions []string
+	Role        string
+}
+
+// mediaAccess returns the access of the user of the request, which is nil
+// for administrators
+func mediaAccess(ctx echo.Context) (*MediaAccess, error) {
+
+	// Get the jwt token from context
+	user := ctx.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+
+	if isAdmin, _ := claims["is_admin"].(bool); isAdmin {
+		return nil, nil
+	}
+
+	permissions, role, err := userPermissions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	userID, _ := claims["ID"].(string)
+	return &MediaAccess{UserID: userID, Permissions: permissions, Role: role}, nil
+}
+
+// filter returns the filter which restricts a query to the readable media
+// documents. Without access restriction, the filter matches all documents
+// which are not in the trash.
+func (access *MediaAccess) filter() bson.M {
+	if access == nil {
+		return bson.M{"datedeleted": bson.M{"$exists": false}}
+	}
+	or := bson.A{bson.M{"filterData.isPublic": true}}
+	if access.UserID != "" {
+		or = append(or, bson.M{"owner": access.UserID})
+	}
+	if len(access.Permissions) > 0 {
+		or = append(or, bson.M{"permissions": bson.M{"$in": access.Permissions}})
+	}
+	return bson.M{"$or": or, "datedeleted": bson.M{"$exists": false}}
+}
+
+// readableFilter returns the filter which restricts a query to the media
+// documents the user of the request may read, see canRead
+func readableFilter(ctx echo.Context) (bson.M, error) {
+	access, err := mediaAccess(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return access.filter(), nil
+}
+
+// mediaDocumentError answers a request whose media document could not be read
+func mediaDocumentError(ctx echo.Context, err error) error {
+	if err == errMediaNotFound {
+		return ctx.JSON(http.StatusNotFound, "The media document does not exist.")
+	}
+	ctx.Logger().Error(err)
+	return ctx.JSON(http.StatusInternalServerError, "The media document could not be read.")
+}
+
+// MediaDocumentPage is a page of the media documents
+type MediaDocumentPage struct {
+	Documents []*MediaDocument `json:"documents"`
+	Total     int64            `json:"total"`
+	Page      int64            `json:"page"`
+	PageSize  int64            `json:"pageSize"`
+}
+
+// readPage reads the query parameters page and pageSize. If they are
+// invalid, it returns the message for the client.
+func readPage(ctx echo.Context) (int64, int64, string) {
+	page, err := strconv.ParseInt(ctx.QueryParam("page"), 10, 64)
+	if ctx.QueryParam("page") == "" {
+		page, err = 1, nil
+	}
+	if err != nil || page < 1 {
+		return 0, 0, "The page has to be a positive number."
+	}
+	pageSize, err := strconv.ParseInt(ctx.QueryParam("pageSize"), 10, 64)
+	if ctx.QueryParam("pageSize") == "" {
+		pageSize, err = defaultDocumentPageSize, nil
+	}
+	if err != nil || pageSize < 1 || pageSize > maxDocumentPageSize {
+		return 0, 0, "The pageSize has to be between 1 and " + strconv.Itoa(maxDocumentPageSize) + "."
+	}
+	return page, pageSize, ""
+}
+
+// ListMediaDocuments returns the media documents the user may read, newest
+// first. The query parameters page and pageSize select the page, type and tag
+// filter the documents.
+func ListMediaDocuments(ctx echo.Context) error {
+
+	page, pageSize, invalid := readPage(ctx)
+	if invalid != "" {
+		return ctx.JSON(http.StatusBadRequest, invalid)
+	}
+
+	filter, err := readableFilter(ctx)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The permissions could not be checked.")
+	}
+	if mediaType := ctx.QueryParam("type"); mediaType != "" {
+		filter["type"] = mediaType
+	}
+	if tag := ctx.QueryParam("tag"); tag != "" {
+		filter["tags"] = tag
+	}
+
+	reqCtx := ctx.Request().Context()
+	collection, err := mediaCollection(reqCtx)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The media documents could not be read.")
+	}
+
+	result := &MediaDocumentPage{Documents: []*MediaDocument{}, Page: page, PageSize: pageSize}
+	result.Total, err = collection.CountDocuments(reqCtx, filter)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The media documents could not be read.")
+	}
+
+	cur, err := collection.Find(reqCtx, filter, options.Find().
+		SetSort(bson.D{{Key: "datecreated", Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip((page-1)*pageSize).
+		SetLimit(pageSize))
+	if err == nil {
+		err = cur.All(reqCtx, &result.Documents)
+	}
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The media documents could not be read.")
+	}
+
+	return ctx.JSON(http.StatusOK, result)
+}
+
+// GetMediaDocumentByID returns a single media document
+func GetMediaDocumentByID(ctx echo.Context) error {
+
+	doc, err := findMediaDocument(ctx.Request().Context(), ctx.Param("id"))
+	if err != nil {
+		return mediaDocumentError(ctx, err)
+	}
+
+	allowed, err := canRead(ctx, doc)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The permissions could not be checked.")
+	}
+	if !allowed {
+		return ctx.JSON(http.StatusForbidden, "You are not allowed to read this media document.")
+	}
+
+	return ctx.JSON(http.StatusOK, doc)
+}
+
+// MediaDocumentUpdate holds the fields of a media document which can be
+// changed. Fields which are not sent are left as they are.
+type MediaDocumentUpdate struct {
+	Filename         *string                 `json:"filename"`
+	LastModifiedDate *string                 `json:"lastModifiedDate"`
+	FileInfo         *map[string]interface{} `json:"fileInfo"`
+	FilterData       *map[string]interface{} `json:"filterData"`
+	Tags             *[]string               `json:"tags"`
+	Permissions      *[]string               `json:"permissions"`
+	Metadata         *MetadataUpdate         `json:"metadata"`
+}
+
+// MetadataUpdate holds the metadata of a media document update. Only the
+// metadata fields which are sent are changed, so that the metadata which was
+// extracted from the file is kept. A field sent as null is removed.
+type MetadataUpdate struct {
+	Metadata
+
+	// fields maps the sent json field names to their raw values
+	fields map[string]json.RawMessage
+}
+
+// UnmarshalJSON decodes the metadata and keeps which fields were sent
+func (update *MetadataUpdate) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&update.Metadata); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &update.fields)
+}
+
+// paths returns the metadata.<field> paths of the sent fields to set, and
+// of the fields sent as null to unset
+func (update *MetadataUpdate) paths() (bson.M, bson.M) {
+	set, unset := bson.M{}, bson.M{}
+	value := reflect.ValueOf(update.Metadata)
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		key := strings.Split(field.Tag.Get("bson"), ",")[0]
+		if key == "" {
+			key = strings.ToLower(field.Name)
+		}
+
+		// json matches the field names without regard to the case
+		for sent, raw := range update.fields {
+			if !strings.EqualFold(sent, name) {
+				continue
+			}
+			if string(bytes.TrimSpace(raw)) == "null" {
+				unset["metadata."+key] = ""
+			} else {
+				set["metadata."+key] = value.Field(i).Interface()
+			}
+		}
+	}
+	return set, unset
+}
+
+// ValidationError lists the invalid fields of a request with a message for each
+type ValidationError struct {
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields"`
+}
+
+// validate checks and normalizes the fields of the update
+func (update *MediaDocumentUpdate) validate(ctx context.Context) (map[string]string, error) {
+	fields := make(map[string]string)
+
+	if update.Filename != nil {
+		filename := strings.TrimSpace(*update.Filename)
+		switch {
+		case filename == "":
+			fields["filename"] = "The filename must not be empty."
+		case len(filename) > maxFilenameLength:
+			fields["filename"] = "The filename must not be longer than " + strconv.Itoa(maxFilenameLength) + " bytes."
+		case strings.ContainsAny(filename, "/\\"):
+			fields["filename"] = "The filename must not contain slashes."
+		}
+		update.Filename = &filename
+	}
+
+	if update.Tags != nil {
+		tags := []string{}
+		for _, tag := range *update.Tags {
+			tag = normalizeTag(tag)
+			if tag == "" || hasTag(tags, tag) {
+				continue
+			}
+			if len(tag) > maxTagLength {
+				fields["tags"] = "A tag must not be longer than " + strconv.Itoa(maxTagLength) + " bytes."
+			}
+			tags = append(tags, tag)
+		}
+		if len(tags) > maxTags {
+			fields["tags"] = "A media document must not have more than " + strconv.Itoa(maxTags) + " tags."
+		}
+
+		// tags of the vocabulary are written like their name in the vocabulary
+		tags, unknown, err := resolveTags(ctx, tags)
+		if err != nil {
+			return nil, err
+		}
+		if len(unknown) > 0 && controlledTags() {
+			fields["tags"] = "Unknown tags: " + strings.Join(unknown, ", ") + "."
+		}
+		update.Tags = &tags
+	}
+
+	if update.Permissions != nil && len(*update.Permissions) > 0 {
+		unknown, err := unknownPermissions(ctx, *update.Permissions)
+		if err != nil {
+			return nil, err
+		}
+		if len(unknown) > 0 {
+			fields["permissions"] = "Unknown permissions: " + strings.Join(unknown, ", ") + "."
+		}
+	}
+
+	if update.Metadata != nil {
+		if update.Metadata.PixelX < 0 || update.Metadata.PixelY < 0 {
+			fields["metadata"] = "The pixel dimensions must not be negative."
+		}
+		geo := update.Metadata.Geo
+		if geo != nil && !geo.valid() {
+			fields["metadata.geo"] = "The coordinates are out of range."
+		}
+	}
+
+	return fields, nil
+}
+
+// unknownPermissions returns the permissions which do not exist in the permissions collection
+func unknownPermissions(ctx context.Context, permissions []string) ([]string, error) {
+	collection, err := usersCollection(ctx, "permissions")
+	if err != nil {
+		return nil, err
+	}
+	known, err := collection.Distinct(ctx, "name", bson.M{"name": bson.M{"$in": permissions}})
+	if err != nil {
+		return nil, err
+	}
+
+	exists := make(map[string]bool)
+	for _, name := range known {
+		if name, ok := name.(string); ok {
+			exists[name] = true
+		}
+	}
+	unknown := []string{}
+	for _, permission := range permissions {
+		if !exists[permission] {
+			unknown = append(unknown, permission)
+		}
+	}
+	return unknown, nil
+}
+
+// decodeStrict decodes the json body of a request into v and rejects unknown fields
+func decodeStrict(ctx echo.Context, v interface{}) *ValidationError {
+	decoder := json.NewDecoder(ctx.Request().Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	if err == nil {
+		return nil
+	}
+
+	invalid := &ValidationError{Message: "Invalid request object.", Fields: map[string]string{}}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		invalid.Fields[typeErr.Field] = "The field must be of type " + typeErr.Type.String() + "."
+	} else if strings.HasPrefix(err.Error(), "json: unknown field ") {
+		field, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		invalid.Fields[field] = "The field is unknown or cannot be changed."
+	}
+	return invalid
+}
+
+// UpdateMediaDocument changes the fields of a media document, which only
+// administrators and the owner may
+func UpdateMediaDocument(ctx echo.Context) error {
+
+	reqCtx := ctx.Request().Context()
+	doc, err := findMediaDocument(reqCtx, ctx.Param("id"))
+	if err != nil {
+		return mediaDocumentError(ctx, err)
+	}
+	if !canWrite(ctx, doc) {
+		return ctx.JSON(http.StatusForbidden, "You are not allowed to change this media document.")
+	}
+
+	update := new(MediaDocumentUpdate)
+	if invalid := decodeStrict(ctx, update); invalid != nil {
+		return ctx.JSON(http.StatusBadRequest, invalid)
+	}
+	fields, err := update.validate(reqCtx)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The media document could not be validated.")
+	}
+	if len(fields) > 0 {
+		return ctx.JSON(http.StatusBadRequest, &ValidationError{Message: "The media document is invalid.", Fields: fields})
+	}
+
+	set := bson.M{"dateupdated": time.Now()}
+	if update.Filename != nil {
+		set["filename"] = *update.Filename
+	}
+	if update.LastModifiedDate != nil {
+		set["lastModifiedDate"] = *update.LastModifiedDate
+	}
+	if update.FileInfo != nil {
+		set["fileInfo"] = *update.FileInfo
+	}
+	if update.FilterData != nil {
+		set["filterData"] = *update.FilterData
+	}
+	if update.Tags != nil {
+		set["tags"] = *update.Tags
+	}
+	if update.Permissions != nil {
+		set["permissions"] = *update.Permissions
+	}
+	unset := bson.M{}
+	if update.Metadata != nil {
+		metadataSet, metadataUnset := update.Metadata.paths()
+		for key, value := range metadataSet {
+			set[key] = value
+		}
+		unset = metadataUnset
+	}
+
+	collection, err := mediaCollection(reqCtx)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The media document could not be updated.")
+	}
+	updated := new(MediaDocument)
+	changes := bson.M{"$set": set}
+	if len(unset) > 0 {
+		changes["$unset"] = unset
+	}
+	err = collection.FindOneAndUpdate(reqCtx, bson.M{"_id": doc.ID}, changes,
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(updated)
+	if err == mongo.ErrNoDocuments {
+		return ctx.JSON(http.StatusNotFound, "The media document does not exist.")
+	}
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The media document could not be updated.")
+	}
+
+	return ctx.JSON(http.StatusOK, updated)
+}
+
+// DeleteMediaDocument moves a media document to the trash, which only
+// administrators and the owner may. It is hidden until an administrator
+// restores it, and purged with its files once TRASH_RETENTION has passed.
+func DeleteMediaDocument(ctx echo.Context) error {
+
+	reqCtx := ctx.Request().Context()
+	doc, err := findMediaDocument(reqCtx, ctx.Param("id"))
+	if err != nil {
+		return mediaDocumentError(ctx, err)
+	}
+	if !canWrite(ctx, doc) {
+		return ctx.JSON(http.StatusForbidden, "You are not allowed to delete this media document.")
+	}
+
+	// Get the jwt token from context
+	user := ctx.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+
+	set := bson.M{"datedeleted": time.Now()}
+	if userID, ok := claims["ID"].(string); ok {
+		set["deletedby"] = userID
+	}
+
+	collection, err := mediaCollection(reqCtx)
+	if err == nil {
+		_, err = collection.UpdateOne(reqCtx, bson.M{"_id": doc.ID, "datedeleted": bson.M{"$exists": false}}, bson.M{"$set": set})
+	}
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The media document could not be deleted.")
+	}
+
+	return ctx.NoContent(http.StatusNoContent)
+}
+
+// purgeMediaDocument deletes a media document and the files of all its
+// versions and renditions in the storage. The document is kept if a file
+// could not be deleted, so that the purge can be repeated. The oldest copy of
+// a purged original becomes the new original of its copies, and the document
+// is removed from all collections.
+func purgeMediaDocument(ctx context.Context, doc *MediaDocument) error {
+	backend := storage.Default()
+	if doc.FileID != "" {
+		err := backend.Delete(ctx, doc.StorageFileName, doc.FileID)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+	}
+	for _, version := range doc.Versions {
+		if version.FileID == doc.FileID {
+			continue
+		}
+		err := backend.Delete(ctx, version.StorageFileName, version.FileID)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+	}
+	if err := removeRenditions(ctx, backend, doc); err != nil {
+		return err
+	}
+
+	collection, err := mediaCollection(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := collection.DeleteOne(ctx, bson.M{"_id": doc.ID}); err != nil {
+		return err
+	}
+	if err := promoteDuplicates(ctx, collection, doc); err != nil {
+		return err
+	}
+	return removeFromCollections(ctx, doc.ID)
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"my.app/pkg/storage"
+)
+
+// MediaIngestV1 is the request which creates the media document for a file
+// that the client uploaded to the storage by itself. The storage fields are
+// optional, if they are sent they have to match the stored file.
+type MediaIngestV1 struct {
+	FileID          string `json:"b2fileId"`
+	StorageFileName string `json:"b2fileName"`
+	ContentType     string `json:"b2ContentType"`
+	Size            int64  `json:"b2FileSize"`
+
+	Filename         string                 `json:"filename"`
+	LastModifiedDate string                 `json:"lastModifiedDate"`
+	FileInfo         map[string]interface{} `json:"fileInfo"`
+	FilterData       map[string]interface{} `json:"filterData"`
+	Tags             []string               `json:"tags"`
+	Permissions      []string               `json:"permissions"`
+	Metadata         *Metadata              `json:"metadata"`
+}
+
+// checkFile compares the storage fields of the request with the stored file
+func (req *MediaIngestV1) checkFile(file *storage.File, fields map[string]string) {
+	if req.StorageFileName != "" && req.StorageFileName != file.FileName {
+		fields["b2fileName"] = "The file name does not match the stored file."
+	}
+	if req.ContentType != "" && req.ContentType != file.ContentType {
+		fields["b2ContentType"] = "The content type does not match the stored file."
+	}
+	if req.Size != 0 && req.Size != file.ContentLength {
+		fields["b2FileSize"] = "The size does not match the stored file."
+	}
+}
+
+// fileSha1 returns the SHA1 checksum of a stored file if the storage verified
+// it. The checksum of large files and checksums which the uploader claimed
+// are left empty, processMedia computes them from the content.
+func fileSha1(file *storage.File) string {
+	if file.ContentSha1 == "none" || strings.HasPrefix(file.ContentSha1, "unverified:") {
+		return ""
+	}
+	return file.ContentSha1
+}
+
+// UploadFileToDB creates the media document for a file in the storage. The
+// request is checked against MediaIngestV1, the owner, the creation date and
+// the storage fields are set by the server.
+//
+// The query parameter duplicates decides what happens to a file which is in
+// the library already, as for UploadMedia. Files which are linked or rejected
+// are deleted from the storage. The checksum is only known if the storage
+// verified it, otherwise copies are marked once the file has been processed.
+func UploadFileToDB(ctx echo.Context) error {
+
+	// Get the jwt token from context
+	user := ctx.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+
+	// check if the user has admin rights
+	isAdmin := claims["is_admin"].(bool)
+	if !isAdmin {
+		return ctx.JSON(http.StatusUnauthorized, "Administrator rights are required to upload a new file to the database.")
+	}
+
+	policy, ok := duplicatePolicy(ctx)
+	if !ok {
+		return ctx.JSON(http.StatusBadRequest, "The duplicates policy has to be keep, link or reject.")
+	}
+
+	req := new(MediaIngestV1)
+	if invalid := decodeStrict(ctx, req); invalid != nil {
+		return ctx.JSON(http.StatusBadRequest, invalid)
+	}
+
+	fields := make(map[string]string)
+	if req.FileID == "" {
+		fields["b2fileId"] = "The id of the stored file is required."
+	}
+	if req.LastModifiedDate != "" {
+		if _, err := time.Parse(time.RFC3339, req.LastModifiedDate); err != nil {
+			fields["lastModifiedDate"] = "The date has to be in RFC 3339 format."
+		}
+	}
+	if len(fields) > 0 {
+		return ctx.JSON(http.StatusBadRequest, &ValidationError{Message: "The media document is invalid.", Fields: fields})
+	}
+
+	reqCtx := ctx.Request().Context()
+	file, err := storage.Default().GetFileInfo(reqCtx, req.FileID)
+	if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrBadRequest) {
+		fields["b2fileId"] = "The file does not exist in the storage."
+		return ctx.JSON(http.StatusBadRequest, &ValidationError{Message: "The media document is invalid.", Fields: fields})
+	}
+	if err != nil {
+		return storageError(ctx, err)
+	}
+	req.checkFile(file, fields)
+
+	if req.Filename == "" {
+		req.Filename = path.Base(file.FileName)
+	}
+	update := &MediaDocumentUpdate{
+		Filename:    &req.Filename,
+		Tags:        &req.Tags,
+		Permissions: &req.Permissions,
+	}
+	if req.Metadata != nil {
+		update.Metadata = &MetadataUpdate{Metadata: *req.Metadata}
+	}
+	updateFields, err := update.validate(reqCtx)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The media document could not be validated.")
+	}
+	for field, message := range updateFields {
+		fields[field] = message
+	}
+	if len(fields) > 0 {
+		return ctx.JSON(http.StatusBadRequest, &ValidationError{Message: "The media document is invalid.", Fields: fields})
+	}
+
+	collection, err := mediaCollection(reqCtx)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The media document could not be created.")
+	}
+
+	// the frontend may report a finished upload more than once, and a file
+	// may already be a version of another document
+	err = collection.FindOne(reqCtx, bson.M{"$or": bson.A{
+		bson.M{"b2fileId": file.FileID},
+		bson.M{"versions.b2fileId": file.FileID},
+	}}).Err()
+	if err == nil {
+		return ctx.JSON(http.StatusConflict, "A media document for this file exists already.")
+	}
+	if err != mongo.ErrNoDocuments {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The media document could not be created.")
+	}
+
+	owner, _ := claims["ID"].(string)
+	doc := &MediaDocument{
+		ID:               primitive.NewObjectID(),
+		FileID:           file.FileID,
+		StorageFileName:  file.FileName,
+		ContentType:      file.ContentType,
+		Size:             file.ContentLength,
+		ContentSha1:      fileSha1(file),
+		LastModifiedDate: req.LastModifiedDate,
+		FileInfo:         req.FileInfo,
+		FilterData:       req.FilterData,
+		Filename:         *update.Filename,
+		DateCreated:      time.Now(),
+		Type:             strings.SplitN(file.ContentType, "/", 2)[0],
+		Owner:            owner,
+		Tags:             *update.Tags,
+		Permissions:      *update.Permissions,
+		Metadata:         req.Metadata,
+	}
+
+	existing, err := applyDuplicatePolicy(reqCtx, collection, doc, policy)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The media document could not be created.")
+	}
+	if existing != nil {
+		removeStoredFile(ctx, file)
+		return duplicateResponse(ctx, existing, policy)
+	}
+
+	if _, err := collection.InsertOne(reqCtx, doc); err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The media document could not be created.")
+	}
+
+	// the metadata and renditions are added in the background, a job which
+	// the large upload enqueued before is due at once
+	if _, err := enqueueProcessing(reqCtx, doc.FileID); err != nil {
+		ctx.Logger().Error(err)
+	}
+
+	return ctx.JSON(http.StatusCreated, doc)
+}
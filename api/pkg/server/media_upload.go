@@ -0,0 +1,366 @@
+package server
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"my.app/pkg/storage"
+)
+
+const (
+	// defaultUploadPartSize is the size of the parts of large files, files up
+	// to this size are uploaded as a single file
+	defaultUploadPartSize = 100 * 1000 * 1000
+
+	// minUploadPartSize is the smallest part size accepted by B2 and S3
+	minUploadPartSize = 5 * 1000 * 1000
+
+	// maxUploadParts is the largest number of parts of a large file in B2 and S3
+	maxUploadParts = 10000
+
+	// maxFormFieldSize limits the form fields which are sent along with the file
+	maxFormFieldSize = 1 << 20
+
+	// cleanupTimeout limits the removal of a failed upload from the storage
+	cleanupTimeout = 30 * time.Second
+)
+
+var errTooManyParts = errors.New("server: the file has too many parts")
+
+// maxStreamParts limits the parts of an upload through the API, a variable so
+// that tests do not need gigabytes of content
+var maxStreamParts = maxUploadParts
+
+// uploadPartSize returns the part size configured with UPLOAD_PART_SIZE in bytes
+func uploadPartSize() int64 {
+	size, err := strconv.ParseInt(os.Getenv("UPLOAD_PART_SIZE"), 10, 64)
+	if err != nil {
+		return defaultUploadPartSize
+	}
+	if size < minUploadPartSize {
+		return minUploadPartSize
+	}
+	return size
+}
+
+// UploadMedia receives a media file, uploads it to the storage and creates its
+// media document, so that browsers do not have to talk to the storage.
+//
+// The file is either the "file" field of a multipart form, or the raw request
+// body with its name in the filename query parameter. A form may also carry
+// the fields fileInfo and filterData as json objects and lastModifiedDate.
+//
+// The query parameter duplicates decides what happens to a file which is in
+// the library already: keep stores it as a copy, link answers with the
+// existing media document and reject with a conflict.
+func UploadMedia(ctx echo.Context) error {
+
+	// Get the jwt token from context
+	user := ctx.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+
+	// check if the user has admin rights
+	isAdmin := claims["is_admin"].(bool)
+	if !isAdmin {
+		return ctx.JSON(http.StatusUnauthorized, "Administrator rights are required to upload a new file.")
+	}
+
+	policy, ok := duplicatePolicy(ctx)
+	if !ok {
+		return ctx.JSON(http.StatusBadRequest, "The duplicates policy has to be keep, link or reject.")
+	}
+
+	doc := &MediaDocument{
+		ID:          primitive.NewObjectID(),
+		DateCreated: time.Now(),
+	}
+	if userID, ok := claims["ID"].(string); ok {
+		doc.Owner = userID
+	}
+
+	req := ctx.Request()
+	var file *storage.File
+	var err error
+
+	mediaType, params, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		form := multipart.NewReader(req.Body, params["boundary"])
+		for {
+			part, partErr := form.NextPart()
+			if partErr == io.EOF {
+				break
+			}
+			if partErr != nil {
+				return ctx.JSON(http.StatusBadRequest, "The multipart form could not be read.")
+			}
+
+			switch part.FormName() {
+			case "file":
+				if file != nil {
+					return ctx.JSON(http.StatusBadRequest, "Only one file can be uploaded per request.")
+				}
+				file, err = uploadMediaFile(req.Context(), doc, doc.ID.Hex(), part.FileName(), part.Header.Get("Content-Type"), part)
+			case "fileInfo":
+				err = readFormJSON(part, &doc.FileInfo)
+			case "filterData":
+				err = readFormJSON(part, &doc.FilterData)
+			case "lastModifiedDate":
+				var value []byte
+				value, err = ioutil.ReadAll(io.LimitReader(part, maxFormFieldSize))
+				doc.LastModifiedDate = string(value)
+			}
+			part.Close()
+			if err != nil {
+				break
+			}
+		}
+	} else {
+		file, err = uploadMediaFile(req.Context(), doc, doc.ID.Hex(), ctx.QueryParam("filename"), req.Header.Get("Content-Type"), req.Body)
+	}
+
+	if err != nil {
+		if file != nil {
+			removeStoredFile(ctx, file)
+		}
+		return uploadError(ctx, err)
+	}
+	if file == nil {
+		return ctx.JSON(http.StatusBadRequest, "A file is required.")
+	}
+
+	collection, err := mediaCollection(req.Context())
+	if err != nil {
+		ctx.Logger().Error(err)
+		removeStoredFile(ctx, file)
+		return ctx.JSON(http.StatusInternalServerError, "The media document could not be created.")
+	}
+
+	existing, err := applyDuplicatePolicy(req.Context(), collection, doc, policy)
+	if err != nil {
+		ctx.Logger().Error(err)
+		removeStoredFile(ctx, file)
+		return ctx.JSON(http.StatusInternalServerError, "The media document could not be created.")
+	}
+	if existing != nil {
+		removeStoredFile(ctx, file)
+		return duplicateResponse(ctx, existing, policy)
+	}
+
+	if _, err := collection.InsertOne(req.Context(), doc); err != nil {
+		ctx.Logger().Error(err)
+		removeStoredFile(ctx, file)
+		return ctx.JSON(http.StatusInternalServerError, "The media document could not be created.")
+	}
+
+	// the metadata and renditions are added in the background
+	if _, err := enqueueProcessing(req.Context(), doc.FileID); err != nil {
+		ctx.Logger().Error(err)
+	}
+
+	return ctx.JSON(http.StatusCreated, doc)
+}
+
+// errBadForm marks errors caused by invalid form fields
+var errBadForm = errors.New("server: invalid form field")
+
+// readFormJSON decodes a form field which holds a json object
+func readFormJSON(part *multipart.Part, v interface{}) error {
+	if err := json.NewDecoder(io.LimitReader(part, maxFormFieldSize)).Decode(v); err != nil {
+		return errBadForm
+	}
+	return nil
+}
+
+// uploadError answers an upload which failed before the media document was created
+func uploadError(ctx echo.Context, err error) error {
+	switch err {
+	case errBadForm:
+		return ctx.JSON(http.StatusBadRequest, "The form fields fileInfo and filterData have to be json objects.")
+	case errMissingFilename:
+		return ctx.JSON(http.StatusBadRequest, "A filename is required to upload a file.")
+	case errTooManyParts:
+		return ctx.JSON(http.StatusRequestEntityTooLarge, "The file is too large.")
+	}
+	return storageError(ctx, err)
+}
+
+var errMissingFilename = errors.New("server: missing file name")
+
+// uploadMediaFile uploads the content of r to the storage and adds the file to doc.
+// The file is stored in folder, which is the id of the document or a folder of
+// its versions, so equal names do not collide.
+func uploadMediaFile(ctx context.Context, doc *MediaDocument, folder string, filename string, contentType string, r io.Reader) (*storage.File, error) {
+
+	// browsers may send the full path of the file
+	filename = path.Base(strings.Replace(filename, "\\", "/", -1))
+	if filename == "." || filename == "/" {
+		return nil, errMissingFilename
+	}
+	if contentType == "" || contentType == "application/octet-stream" {
+		if byExtension := mime.TypeByExtension(path.Ext(filename)); byExtension != "" {
+			contentType = byExtension
+		}
+	}
+
+	file, sha1, err := uploadStream(ctx, storage.Default(), folder+"/"+filename, contentType, r)
+	if err != nil {
+		return nil, err
+	}
+
+	doc.Filename = filename
+	doc.Type = strings.SplitN(file.ContentType, "/", 2)[0]
+	doc.FileID = file.FileID
+	doc.StorageFileName = file.FileName
+	doc.ContentType = file.ContentType
+	doc.Size = file.ContentLength
+	doc.ContentSha1 = sha1
+	return file, nil
+}
+
+// removeStoredFile deletes a file whose media document could not be created.
+// A file which cannot be deleted is only logged, the reconciliation finds it
+// as an orphan later.
+func removeStoredFile(ctx echo.Context, file *storage.File) {
+	deleteCtx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+	if err := storage.Default().Delete(deleteCtx, file.FileName, file.FileID); err != nil {
+		ctx.Logger().Error(err)
+	}
+}
+
+// spooledPart is a part of an upload which is buffered in a temporary file,
+// since the storage needs its length and checksum before the content
+type spooledPart struct {
+	file *os.File
+	size int64
+	sha1 string
+}
+
+// spool reads up to limit bytes of r into a temporary file. The content is
+// also written to total, which computes the checksum of the whole upload.
+func spool(r io.Reader, limit int64, total hash.Hash) (*spooledPart, error) {
+	f, err := ioutil.TempFile("", "upload")
+	if err != nil {
+		return nil, err
+	}
+
+	partHash := sha1.New()
+	size, err := io.CopyN(io.MultiWriter(f, partHash, total), r, limit)
+	if err != nil && err != io.EOF {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &spooledPart{file: f, size: size, sha1: hex.EncodeToString(partHash.Sum(nil))}, nil
+}
+
+func (p *spooledPart) remove() {
+	p.file.Close()
+	os.Remove(p.file.Name())
+}
+
+// uploadStream uploads the content of r to the storage. Content which fits
+// into a single part is uploaded as a single file, anything larger as a large
+// file. At most two parts are kept on disk at a time. It returns the uploaded
+// file and the SHA1 checksum of the whole content, which is only known once
+// the last part was read, so it is kept by the media document rather than by
+// the storage.
+func uploadStream(ctx context.Context, backend storage.Storage, fileName string, contentType string, r io.Reader) (*storage.File, string, error) {
+
+	partSize := uploadPartSize()
+	total := sha1.New()
+
+	first, err := spool(r, partSize, total)
+	if err != nil {
+		return nil, "", err
+	}
+	defer first.remove()
+	second, err := spool(r, partSize, total)
+	if err != nil {
+		return nil, "", err
+	}
+	defer second.remove()
+
+	if second.size == 0 {
+		file, err := backend.UploadFile(ctx, storage.UploadFileRequest{
+			FileName:      fileName,
+			ContentType:   contentType,
+			ContentLength: first.size,
+			ContentSha1:   first.sha1,
+		}, first.file)
+		if err != nil {
+			return nil, "", err
+		}
+		return file, hex.EncodeToString(total.Sum(nil)), nil
+	}
+
+	large, err := backend.StartLargeFile(ctx, fileName, contentType, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	partSha1Array, err := uploadParts(ctx, backend, large.FileID, []*spooledPart{first, second}, r, partSize, total)
+	if err == nil {
+		var file *storage.File
+		file, err = backend.FinishLargeFile(ctx, large.FileID, partSha1Array)
+		if err == nil {
+			return file, hex.EncodeToString(total.Sum(nil)), nil
+		}
+	}
+
+	cancelCtx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+	backend.CancelLargeFile(cancelCtx, large.FileID)
+	return nil, "", err
+}
+
+// uploadParts uploads the spooled parts and the rest of r as parts of a large
+// file and returns the checksums of the parts. Every part is removed from the
+// disk once it has been uploaded.
+func uploadParts(ctx context.Context, backend storage.Storage, fileID string, spooled []*spooledPart, r io.Reader, partSize int64, total hash.Hash) ([]string, error) {
+
+	partSha1Array := []string{}
+	for partNumber := int64(1); ; partNumber++ {
+		var part *spooledPart
+		if len(spooled) > 0 {
+			part, spooled = spooled[0], spooled[1:]
+		} else {
+			var err error
+			if part, err = spool(r, partSize, total); err != nil {
+				return nil, err
+			}
+		}
+		if part.size == 0 {
+			part.remove()
+			return partSha1Array, nil
+		}
+		if partNumber > int64(maxStreamParts) {
+			part.remove()
+			return nil, errTooManyParts
+		}
+
+		_, err := backend.UploadPart(ctx, fileID, partNumber, part.size, part.sha1, part.file)
+		part.remove()
+		if err != nil {
+			return nil, err
+		}
+		partSha1Array = append(partSha1Array, part.sha1)
+	}
+}
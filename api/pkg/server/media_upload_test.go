@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+
+	"my.app/pkg/storage"
+)
+
+// fakeStorage keeps the files uploaded by uploadStream in memory. The
+// methods which uploadStream does not use are left to the nil interface.
+type fakeStorage struct {
+	storage.Storage
+
+	files    map[string][]byte
+	fileInfo map[string]string
+	parts    [][]byte
+	started  bool
+	finished bool
+	canceled bool
+
+	// failPart makes the upload of this part fail
+	failPart int64
+}
+
+func newFakeStorage() *fakeStorage {
+	return &fakeStorage{files: make(map[string][]byte)}
+}
+
+func (s *fakeStorage) UploadFile(ctx context.Context, req storage.UploadFileRequest, body io.ReadSeeker) (*storage.File, error) {
+	content, err := readFrom(body)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) != req.ContentLength || sha1Hex(content) != req.ContentSha1 {
+		return nil, storage.ErrBadRequest
+	}
+	s.files[req.FileName] = content
+	return &storage.File{FileID: req.FileName, FileName: req.FileName, ContentType: req.ContentType, ContentLength: req.ContentLength, ContentSha1: req.ContentSha1}, nil
+}
+
+func (s *fakeStorage) StartLargeFile(ctx context.Context, fileName string, contentType string, fileInfo map[string]string) (*storage.File, error) {
+	s.started = true
+	s.fileInfo = fileInfo
+	return &storage.File{FileID: fileName, FileName: fileName, ContentType: contentType, ContentSha1: "none", FileInfo: fileInfo}, nil
+}
+
+func (s *fakeStorage) UploadPart(ctx context.Context, fileID string, partNumber int64, contentLength int64, contentSha1 string, body io.ReadSeeker) (*storage.Part, error) {
+	if partNumber == s.failPart {
+		return nil, storage.ErrUnavailable
+	}
+	content, err := readFrom(body)
+	if err != nil {
+		return nil, err
+	}
+	if partNumber != int64(len(s.parts)+1) || int64(len(content)) != contentLength || sha1Hex(content) != contentSha1 {
+		return nil, storage.ErrBadRequest
+	}
+	s.parts = append(s.parts, content)
+	return &storage.Part{FileID: fileID, PartNumber: partNumber, ContentLength: contentLength, ContentSha1: contentSha1}, nil
+}
+
+func (s *fakeStorage) FinishLargeFile(ctx context.Context, fileID string, partSha1Array []string) (*storage.File, error) {
+	if len(partSha1Array) != len(s.parts) {
+		return nil, storage.ErrBadRequest
+	}
+	for i, part := range s.parts {
+		if sha1Hex(part) != partSha1Array[i] {
+			return nil, storage.ErrBadRequest
+		}
+	}
+	s.finished = true
+	s.files[fileID] = bytes.Join(s.parts, nil)
+	return &storage.File{FileID: fileID, FileName: fileID, ContentLength: int64(len(s.files[fileID])), ContentSha1: "none", FileInfo: s.fileInfo}, nil
+}
+
+func (s *fakeStorage) GetFileInfo(ctx context.Context, fileID string) (*storage.File, error) {
+	content, ok := s.files[fileID]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return &storage.File{FileID: fileID, FileName: fileID, ContentLength: int64(len(content)), ContentSha1: "none", FileInfo: s.fileInfo}, nil
+}
+
+func (s *fakeStorage) Download(ctx context.Context, fileID string) (io.ReadCloser, *storage.File, error) {
+	content, ok := s.files[fileID]
+	if !ok {
+		return nil, nil, storage.ErrNotFound
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), &storage.File{FileID: fileID, FileName: fileID, ContentLength: int64(len(content))}, nil
+}
+
+func (s *fakeStorage) CancelLargeFile(ctx context.Context, fileID string) error {
+	s.canceled = true
+	return nil
+}
+
+// readFrom reads a body from its start, as the storage does on retries
+func readFrom(body io.ReadSeeker) ([]byte, error) {
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(body)
+}
+
+func sha1Hex(data []byte) string {
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// setUploadPartSize configures the smallest part size for a test
+func setUploadPartSize(t *testing.T) int {
+	os.Setenv("UPLOAD_PART_SIZE", strconv.Itoa(minUploadPartSize))
+	t.Cleanup(func() { os.Unsetenv("UPLOAD_PART_SIZE") })
+	return minUploadPartSize
+}
+
+func TestUploadStream(t *testing.T) {
+	partSize := setUploadPartSize(t)
+
+	tests := []struct {
+		name  string
+		size  int
+		parts int
+	}{
+		{"empty body", 0, 0},
+		{"small file", 1000, 0},
+		{"exactly one part", partSize, 0},
+		{"one byte more than a part", partSize + 1, 2},
+		{"three parts", 2*partSize + 10, 3},
+	}
+	for _, tt := range tests {
+		content := bytes.Repeat([]byte("0123456789"), tt.size/10+1)[:tt.size]
+		backend := newFakeStorage()
+
+		file, sum, err := uploadStream(context.Background(), backend, "folder/file.bin", "application/octet-stream", bytes.NewReader(content))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if sum != sha1Hex(content) {
+			t.Errorf("%s: checksum %s, want %s", tt.name, sum, sha1Hex(content))
+		}
+		if stored, ok := backend.files["folder/file.bin"]; !ok || !bytes.Equal(stored, content) {
+			t.Errorf("%s: stored %d bytes, want %d", tt.name, len(stored), len(content))
+		}
+		if file.ContentLength != int64(tt.size) {
+			t.Errorf("%s: file of %d bytes, want %d", tt.name, file.ContentLength, tt.size)
+		}
+
+		// content up to the part size is a single file, anything larger a large file
+		if backend.started != (tt.parts > 0) || len(backend.parts) != tt.parts {
+			t.Errorf("%s: started a large file %v with %d parts, want %d parts", tt.name, backend.started, len(backend.parts), tt.parts)
+		}
+	}
+}
+
+func TestUploadStreamTooManyParts(t *testing.T) {
+	partSize := setUploadPartSize(t)
+	maxStreamParts = 2
+	t.Cleanup(func() { maxStreamParts = maxUploadParts })
+
+	backend := newFakeStorage()
+	content := bytes.NewReader(make([]byte, 2*partSize+1))
+	if _, _, err := uploadStream(context.Background(), backend, "large.bin", "", content); err != errTooManyParts {
+		t.Fatalf("got %v, want errTooManyParts", err)
+	}
+	if !backend.canceled || backend.finished || len(backend.parts) != 2 {
+		t.Errorf("finished %v a large file with %d parts", backend.finished, len(backend.parts))
+	}
+
+	backend = newFakeStorage()
+	content = bytes.NewReader(make([]byte, 2*partSize))
+	if _, _, err := uploadStream(context.Background(), backend, "large.bin", "", content); err != nil {
+		t.Errorf("the largest file failed: %v", err)
+	}
+}
+
+func TestUploadStreamCancel(t *testing.T) {
+	partSize := setUploadPartSize(t)
+	backend := newFakeStorage()
+	backend.failPart = 2
+
+	content := bytes.NewReader(make([]byte, 2*partSize))
+	if _, _, err := uploadStream(context.Background(), backend, "large.bin", "", content); !errors.Is(err, storage.ErrUnavailable) {
+		t.Fatalf("got %v, want the error of the part", err)
+	}
+	if !backend.canceled || backend.finished {
+		t.Errorf("the large file was not canceled")
+	}
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"my.app/pkg/imagemeta"
+	"my.app/pkg/storage"
+)
+
+// extractMetadata reads the EXIF, IPTC and XMP metadata of an uploaded image
+// from the storage. It returns nil for other files and images in unsupported
+// formats.
+func extractMetadata(ctx context.Context, backend storage.Storage, doc *MediaDocument) (*imagemeta.Metadata, error) {
+	if doc.Type != "image" || doc.FileID == "" {
+		return nil, nil
+	}
+
+	body, _, err := backend.Download(ctx, doc.FileID)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	meta, err := imagemeta.Extract(body)
+	if err == imagemeta.ErrUnsupported {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// applyImageMetadata sets the metadata fields which were found in the image
+// and are still unset, so that the fields which users set are kept. The IPTC
+// and XMP keywords are added to the tags. It returns the fields it set as
+// paths for $set and the tags it added.
+func (doc *MediaDocument) applyImageMetadata(meta *imagemeta.Metadata) (bson.M, []string) {
+	if doc.Metadata == nil {
+		doc.Metadata = new(Metadata)
+	}
+	m := doc.Metadata
+	set := bson.M{}
+
+	setString := func(key string, dst *string, value string) {
+		if *dst == "" && value != "" {
+			*dst = value
+			set["metadata."+key] = value
+		}
+	}
+	lens := meta.LensModel
+	if lens == "" {
+		lens = meta.LensMake
+	}
+	setString("originalfilename", &m.OriginalFilename, doc.Filename)
+	setString("make", &m.Make, meta.Make)
+	setString("model", &m.Model, meta.Model)
+	setString("lens", &m.Lens, lens)
+	setString("exposuretime", &m.ExposureTime, meta.ExposureTime)
+	setString("title", &m.Title, meta.Title)
+	setString("caption", &m.Caption, meta.Caption)
+	setString("creator", &m.Creator, meta.Creator)
+	setString("credit", &m.Credit, meta.Credit)
+	setString("copyright", &m.Copyright, meta.Copyright)
+	setString("city", &m.City, meta.City)
+	setString("country", &m.Country, meta.Country)
+
+	if m.OriginalDatetime.IsZero() && !meta.DateTimeOriginal.IsZero() {
+		m.OriginalDatetime = meta.DateTimeOriginal
+		set["metadata.originaldatetime"] = m.OriginalDatetime
+	}
+	if m.PixelX == 0 && m.PixelY == 0 && meta.Width > 0 && meta.Height > 0 {
+		m.PixelX, m.PixelY = meta.Width, meta.Height
+		set["metadata.pixelx"], set["metadata.pixely"] = m.PixelX, m.PixelY
+	}
+	if m.Orientation == 0 && meta.Orientation > 0 {
+		m.Orientation = meta.Orientation
+		set["metadata.orientation"] = m.Orientation
+	}
+	if m.FNumber == 0 && meta.FNumber > 0 {
+		m.FNumber = meta.FNumber
+		set["metadata.fnumber"] = m.FNumber
+	}
+	if m.ISO == 0 && meta.ISO > 0 {
+		m.ISO = meta.ISO
+		set["metadata.iso"] = m.ISO
+	}
+	if m.FocalLength == 0 && meta.FocalLength > 0 {
+		m.FocalLength = meta.FocalLength
+		set["metadata.focallength"] = m.FocalLength
+	}
+	if m.Geo == nil && meta.GPS != nil {
+		geo := &Geoinformation{
+			Latitude:  meta.GPS.Latitude,
+			Longitude: meta.GPS.Longitude,
+			Altitude:  meta.GPS.Altitude,
+		}
+
+		// broken coordinates would be rejected by the 2dsphere index
+		if geo.valid() {
+			m.Geo = geo
+			set["metadata.geo"] = geo
+		}
+	}
+
+	added := []string{}
+	for _, keyword := range meta.Keywords {
+		keyword = normalizeTag(keyword)
+		if keyword == "" || len(doc.Tags) >= maxTags || len(keyword) > maxTagLength || hasTag(doc.Tags, keyword) {
+			continue
+		}
+		doc.Tags = append(doc.Tags, keyword)
+		added = append(added, keyword)
+	}
+	return set, added
+}
+
+// errMetadataConflict is returned when the metadata of an image could not be
+// saved, because its media document changed every time
+var errMetadataConflict = errors.New("server: the media document changed while its metadata was saved")
+
+// maxMetadataAttempts is the number of times saveImageMetadata reads a
+// media document which changed again
+const maxMetadataAttempts = 3
+
+// saveImageMetadata saves the metadata fields and tags which
+// applyImageMetadata added to a media document. The document is only updated
+// if it did not change since it was read. Otherwise the metadata is applied to
+// the document as it is now, so that the changes of users are kept.
+func saveImageMetadata(ctx context.Context, collection *mongo.Collection, doc *MediaDocument, meta *imagemeta.Metadata, set bson.M, tags []string) error {
+	for attempt := 1; ; attempt++ {
+		update := bson.M{}
+		if len(set) > 0 {
+			update["$set"] = set
+		}
+		if len(tags) > 0 {
+			update["$addToSet"] = bson.M{"tags": bson.M{"$each": tags}}
+		}
+		if len(update) == 0 {
+			return nil
+		}
+
+		filter := bson.M{"_id": doc.ID, "b2fileId": doc.FileID, "dateupdated": doc.DateUpdated}
+		if doc.DateUpdated == nil {
+			filter["dateupdated"] = bson.M{"$exists": false}
+		}
+		result, err := collection.UpdateOne(ctx, filter, update)
+		if err != nil || result.MatchedCount > 0 {
+			return err
+		}
+		if attempt == maxMetadataAttempts {
+			return errMetadataConflict
+		}
+
+		// the document was changed, deleted or got another version
+		current := new(MediaDocument)
+		err = collection.FindOne(ctx, bson.M{"_id": doc.ID, "b2fileId": doc.FileID}).Decode(current)
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		doc = current
+		set, tags = doc.applyImageMetadata(meta)
+	}
+}
+
+// hasTag reports whether tags contain a tag, ignoring the case
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
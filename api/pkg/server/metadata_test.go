@@ -0,0 +1,115 @@
+package server
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"my.app/pkg/imagemeta"
+)
+
+func TestApplyImageMetadata(t *testing.T) {
+	meta := &imagemeta.Metadata{
+		Width:       4000,
+		Height:      3000,
+		Make:        "Camera",
+		Model:       "Model 1",
+		LensMake:    "Lens Maker",
+		LensModel:   "Lens 50mm",
+		Orientation: 6,
+		ISO:         200,
+		GPS:         &imagemeta.GPS{Latitude: 47.5, Longitude: 8.7},
+		Title:       "Extracted title",
+		Keywords:    []string{"  mountains ", "Lake", "lake", ""},
+	}
+
+	// the fields and tags of users are kept
+	doc := &MediaDocument{
+		Filename: "photo.jpg",
+		Tags:     []string{"lake"},
+		Metadata: &Metadata{Title: "Title of the user", ISO: 100},
+	}
+	set, added := doc.applyImageMetadata(meta)
+
+	want := bson.M{
+		"metadata.originalfilename": "photo.jpg",
+		"metadata.make":             "Camera",
+		"metadata.model":            "Model 1",
+		"metadata.lens":             "Lens 50mm",
+		"metadata.pixelx":           4000,
+		"metadata.pixely":           3000,
+		"metadata.orientation":      6,
+		"metadata.geo":              &Geoinformation{Latitude: 47.5, Longitude: 8.7},
+	}
+	if !reflect.DeepEqual(set, want) {
+		t.Errorf("set %v, want %v", set, want)
+	}
+	if !reflect.DeepEqual(added, []string{"mountains"}) {
+		t.Errorf("added the tags %v", added)
+	}
+	if doc.Metadata.Title != "Title of the user" || doc.Metadata.ISO != 100 || doc.Metadata.Orientation != 6 {
+		t.Errorf("unexpected metadata %+v", doc.Metadata)
+	}
+	if !reflect.DeepEqual(doc.Tags, []string{"lake", "mountains"}) {
+		t.Errorf("tags %v", doc.Tags)
+	}
+
+	// metadata which was applied before is not set again
+	if set, added := doc.applyImageMetadata(meta); len(set) > 0 || len(added) > 0 {
+		t.Errorf("applied %v and %v again", set, added)
+	}
+}
+
+func TestMetadataUpdatePaths(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		wantSet   bson.M
+		wantUnset bson.M
+	}{
+		{
+			name:      "title only",
+			body:      `{"metadata":{"title":"x"}}`,
+			wantSet:   bson.M{"metadata.title": "x"},
+			wantUnset: bson.M{},
+		},
+		{
+			name:      "fields without bson names",
+			body:      `{"metadata":{"pixelX":100,"Make":"Camera","fNumber":2.8}}`,
+			wantSet:   bson.M{"metadata.pixelx": 100, "metadata.make": "Camera", "metadata.fnumber": 2.8},
+			wantUnset: bson.M{},
+		},
+		{
+			name:      "removed location",
+			body:      `{"metadata":{"geo":null,"caption":""}}`,
+			wantSet:   bson.M{"metadata.caption": ""},
+			wantUnset: bson.M{"metadata.geo": ""},
+		},
+		{
+			name:      "location",
+			body:      `{"metadata":{"geo":{"latitude":47.5,"longitude":8.7}}}`,
+			wantSet:   bson.M{"metadata.geo": &Geoinformation{Latitude: 47.5, Longitude: 8.7}},
+			wantUnset: bson.M{},
+		},
+	}
+	for _, tt := range tests {
+		update := new(MediaDocumentUpdate)
+		if err := json.Unmarshal([]byte(tt.body), update); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		set, unset := update.Metadata.paths()
+		if !reflect.DeepEqual(set, tt.wantSet) {
+			t.Errorf("%s: set %v, want %v", tt.name, set, tt.wantSet)
+		}
+		if !reflect.DeepEqual(unset, tt.wantUnset) {
+			t.Errorf("%s: unset %v, want %v", tt.name, unset, tt.wantUnset)
+		}
+	}
+
+	// unknown metadata fields are rejected
+	if err := json.Unmarshal([]byte(`{"metadata":{"unknown":1}}`), new(MediaDocumentUpdate)); err == nil {
+		t.Error("an unknown metadata field was accepted")
+	}
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"my.app/pkg/jobs"
+	"my.app/pkg/phash"
+	"my.app/pkg/storage"
+)
+
+// processMediaJob is the type of the jobs which process an uploaded file
+const processMediaJob = "process-media"
+
+// errDocumentPending is returned while a file has no media document. Large
+// files are finished before the client creates their media document. If the
+// job is dead before the document is created, enqueueProcessing queues it
+// again.
+var errDocumentPending = errors.New("server: the media document of the file does not exist yet")
+
+// enqueueProcessing queues the processing of a stored file. The file id is
+// the key of the job, so the file is processed once, no matter whether the
+// large upload or the media document enqueued it first. A dead job is queued
+// again.
+func enqueueProcessing(ctx context.Context, fileID string) (*jobs.Job, error) {
+	return jobs.Default().Enqueue(ctx, processMediaJob, processMediaJob+":"+fileID, map[string]string{"fileId": fileID})
+}
+
+// reprocessMedia queues the processing of a file which may have been
+// processed before, e.g. when an earlier version becomes current again.
+// Unlike enqueueProcessing, every call adds a job.
+func reprocessMedia(ctx context.Context, fileID string) (*jobs.Job, error) {
+	key := processMediaJob + ":" + fileID + ":" + primitive.NewObjectID().Hex()
+	return jobs.Default().Enqueue(ctx, processMediaJob, key, map[string]string{"fileId": fileID})
+}
+
+// processMedia computes the missing checksum of a file, reads the metadata
+// and computes the perceptual hash and the renditions of images. The results
+// of the steps which succeeded are saved, even if another step failed and the
+// job is retried.
+func processMedia(ctx context.Context, job *jobs.Job) error {
+	collection, err := mediaCollection(ctx)
+	if err != nil {
+		return err
+	}
+
+	backend := storage.Default()
+	doc := new(MediaDocument)
+	err = collection.FindOne(ctx, bson.M{"b2fileId": job.Payload["fileId"]}).Decode(doc)
+	if err == mongo.ErrNoDocuments {
+
+		// the file was deleted, for example because it was a rejected duplicate
+		if _, err := backend.GetFileInfo(ctx, job.Payload["fileId"]); errors.Is(err, storage.ErrNotFound) {
+			return nil
+		}
+
+		// the file is an earlier version, which is processed when it is promoted
+		if err := collection.FindOne(ctx, bson.M{"versions.b2fileId": job.Payload["fileId"]}).Err(); err == nil {
+			return nil
+		}
+		return errDocumentPending
+	}
+	if err != nil {
+		return err
+	}
+
+	var stepErr error
+	if doc.ContentSha1 == "" {
+		var sha1 string
+		if sha1, stepErr = storedFileSha1(ctx, backend, doc.FileID); stepErr == nil {
+			doc.ContentSha1, doc.Corruption, stepErr = checkLargeFileSha1(ctx, backend, doc.FileID, sha1)
+		}
+
+		// the copies of large files can only be found once their checksum is known
+		if stepErr == nil && doc.DuplicateOf == nil && doc.Corruption == nil {
+			var existing *MediaDocument
+			if existing, stepErr = findDuplicate(ctx, collection, doc); existing != nil {
+				doc.DuplicateOf = &existing.ID
+			}
+		}
+	}
+	meta, err := extractMetadata(ctx, backend, doc)
+	if err != nil && stepErr == nil {
+		stepErr = err
+	}
+	var metadataSet bson.M
+	var keywords []string
+	if meta != nil {
+
+		// keywords are written like the tags of the vocabulary, unknown
+		// keywords are dropped if only the vocabulary is allowed
+		if tags, unknown, err := resolveTags(ctx, meta.Keywords); err != nil {
+			meta.Keywords = nil
+			if stepErr == nil {
+				stepErr = err
+			}
+		} else {
+			if controlledTags() {
+				tags = withoutTags(tags, unknown)
+			}
+			meta.Keywords = tags
+		}
+		metadataSet, keywords = doc.applyImageMetadata(meta)
+	}
+	img, err := loadImage(ctx, backend, doc)
+	if err != nil && stepErr == nil {
+		stepErr = err
+	}
+	if img != nil {
+		hash := phash.Hash(img, doc.orientation())
+		doc.PHash = phash.String(hash)
+		doc.PHashBands = phash.BandKeys(hash)
+		if err := generateRenditions(ctx, backend, doc, img); err != nil && stepErr == nil {
+			stepErr = err
+		}
+	}
+
+	// the metadata is saved without overwriting what users changed while the
+	// file was processed
+	if meta != nil {
+		if err := saveImageMetadata(ctx, collection, doc, meta, metadataSet, keywords); err != nil && stepErr == nil {
+			stepErr = err
+		}
+	}
+
+	set := bson.M{}
+	if doc.ContentSha1 != "" {
+		set["contentSha1"] = doc.ContentSha1
+	}
+	if doc.Corruption != nil {
+		set["corruption"] = doc.Corruption
+	}
+	if doc.DuplicateOf != nil {
+		set["duplicateof"] = doc.DuplicateOf
+	}
+	if doc.PHash != "" {
+		set["phash"] = doc.PHash
+		set["phashBands"] = doc.PHashBands
+	}
+	if len(doc.Renditions) > 0 {
+		set["renditions"] = doc.Renditions
+	}
+	if stepErr == nil {
+		set["dateprocessed"] = time.Now()
+	}
+	if len(set) > 0 {
+		result, err := collection.UpdateOne(ctx, bson.M{"_id": doc.ID, "b2fileId": doc.FileID}, bson.M{"$set": set})
+		if err != nil {
+			return err
+		}
+
+		// the document was deleted or got another version while it was processed
+		if result.MatchedCount == 0 {
+			return removeRenditions(ctx, backend, doc)
+		}
+	}
+	return stepErr
+}
+
+// checkLargeFileSha1 compares the checksum of a stored file with the checksum
+// of the whole file which the client gave when it started the large upload,
+// see LargeFileSha1. It returns the checksum which the document keeps, which
+// is the one of the client, so that the scrubber verifies the file against
+// what the user meant to upload. A mismatch is returned as corruption.
+func checkLargeFileSha1(ctx context.Context, backend storage.Storage, fileID string, sha1 string) (string, *Corruption, error) {
+	file, err := backend.GetFileInfo(ctx, fileID)
+	if err != nil {
+		return "", nil, err
+	}
+	expected := file.FileInfo[storage.LargeFileSha1]
+	if expected == "" || expected == sha1 {
+		return sha1, nil, nil
+	}
+	return expected, &Corruption{
+		FileID:       fileID,
+		ExpectedSha1: expected,
+		ActualSha1:   sha1,
+		DateDetected: time.Now(),
+	}, nil
+}
+
+// storedFileSha1 computes the SHA1 checksum of a file in the storage
+func storedFileSha1(ctx context.Context, backend storage.Storage, fileID string) (string, error) {
+	body, _, err := backend.Download(ctx, fileID)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	hash := sha1.New()
+	if _, err := io.Copy(hash, body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
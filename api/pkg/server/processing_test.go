@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"my.app/pkg/storage"
+)
+
+func TestCheckLargeFileSha1(t *testing.T) {
+	content := []byte("the content of a large file")
+	sum := sha1Hex(content)
+	other := sha1Hex([]byte("what the client meant to upload"))
+
+	tests := []struct {
+		name       string
+		fileInfo   map[string]string
+		want       string
+		corruption bool
+	}{
+		{"no checksum of the client", nil, sum, false},
+		{"matching checksum", map[string]string{storage.LargeFileSha1: sum}, sum, false},
+		{"mismatched checksum", map[string]string{storage.LargeFileSha1: other}, other, true},
+	}
+	for _, tt := range tests {
+		backend := newFakeStorage()
+		backend.files["file"] = content
+		backend.fileInfo = tt.fileInfo
+
+		got, corruption, err := checkLargeFileSha1(context.Background(), backend, "file", sum)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: checksum %s, want %s", tt.name, got, tt.want)
+		}
+		if (corruption != nil) != tt.corruption {
+			t.Errorf("%s: corruption %+v", tt.name, corruption)
+			continue
+		}
+		if corruption != nil && (corruption.ExpectedSha1 != other || corruption.ActualSha1 != sum || corruption.FileID != "file") {
+			t.Errorf("%s: unexpected corruption %+v", tt.name, corruption)
+		}
+	}
+
+	if _, _, err := checkLargeFileSha1(context.Background(), newFakeStorage(), "missing", sum); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("got %v for a missing file, want ErrNotFound", err)
+	}
+}
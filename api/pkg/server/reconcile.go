@@ -0,0 +1,524 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"my.app/pkg/storage"
+)
+
+const (
+	// defaultReconcileMinAge is the age a stored file or an unfinished large
+	// file needs before a reconciliation treats it as drift
+	defaultReconcileMinAge = 24 * time.Hour
+
+	// reconcileFilePageSize is the number of stored files listed at once
+	reconcileFilePageSize = 1000
+
+	// reconcileLargeFilePageSize is the number of unfinished large files
+	// listed at once, B2 lists at most 100
+	reconcileLargeFilePageSize = 100
+)
+
+// renditionFilePattern matches the names of the rendition files, see renditionFileName
+var renditionFilePattern = regexp.MustCompile(`^[0-9a-f]{24}/renditions/`)
+
+// reconcileMinAge returns the age configured with RECONCILE_MIN_AGE as a
+// duration like "24h". Younger files may belong to an upload whose media
+// document is about to be created.
+func reconcileMinAge() time.Duration {
+	age, err := time.ParseDuration(os.Getenv("RECONCILE_MIN_AGE"))
+	if err != nil || age < 0 {
+		return defaultReconcileMinAge
+	}
+	return age
+}
+
+// ReconcileOptions select the repairs of a reconciliation. Without any, the
+// drift is only reported.
+type ReconcileOptions struct {
+	// CancelStale cancels the stale unfinished large files
+	CancelStale bool `json:"cancelStale"`
+
+	// ImportOrphans creates media documents for the orphaned files. Orphaned
+	// renditions are deleted instead, they are created again by the processing.
+	ImportOrphans bool `json:"importOrphans"`
+
+	// FlagBroken marks the media documents whose current file is missing with
+	// fileMissing, and removes the mark once the file exists again
+	FlagBroken bool `json:"flagBroken"`
+
+	// Owner is the owner of the imported media documents
+	Owner string `json:"-"`
+}
+
+// MissingFile is a file of a media document which does not exist in the storage
+type MissingFile struct {
+	MediaID         primitive.ObjectID `json:"mediaId"`
+	Version         int                `json:"version"`
+	Current         bool               `json:"current"`
+	FileID          string             `json:"b2fileId"`
+	StorageFileName string             `json:"b2fileName"`
+}
+
+// ReconcileReport describes the drift between the storage and the media
+// documents, and the repairs which were made
+type ReconcileReport struct {
+	StartedAt        time.Time `json:"startedAt"`
+	FinishedAt       time.Time `json:"finishedAt"`
+	FilesChecked     int64     `json:"filesChecked"`
+	DocumentsChecked int64     `json:"documentsChecked"`
+
+	// the unfinished large files which were started before the minimum age
+	StaleLargeFiles []storage.File `json:"staleLargeFiles"`
+
+	// the stored files and renditions which no media document refers to
+	OrphanFiles      []storage.File `json:"orphanFiles"`
+	OrphanRenditions []storage.File `json:"orphanRenditions"`
+
+	// the files of media documents which do not exist in the storage
+	MissingFiles []MissingFile `json:"missingFiles"`
+
+	// the repairs: the ids of the canceled large files and deleted renditions,
+	// and the imported, flagged and no longer flagged media documents
+	Canceled  []string             `json:"canceled"`
+	Deleted   []string             `json:"deleted"`
+	Imported  []primitive.ObjectID `json:"imported"`
+	Flagged   []primitive.ObjectID `json:"flagged"`
+	Unflagged []primitive.ObjectID `json:"unflagged"`
+
+	// the files and documents which could not be checked or repaired
+	Errors []string `json:"errors"`
+}
+
+// fail records an error which did not stop the reconciliation
+func (report *ReconcileReport) fail(format string, args ...interface{}) {
+	report.Errors = append(report.Errors, fmt.Sprintf(format, args...))
+}
+
+// uploadTime returns the time a file was uploaded to the storage
+func uploadTime(file *storage.File) time.Time {
+	return time.Unix(0, file.UploadTimestamp*int64(time.Millisecond))
+}
+
+var (
+	reconcileMu sync.Mutex
+	reconciling bool
+)
+
+// errReconciling is returned while another reconciliation is running
+var errReconciling = errors.New("a reconciliation is running already")
+
+// Reconcile compares the files in the storage with the media documents. It
+// reports the unfinished large files, the stored files which no document
+// refers to and the files of documents which do not exist in the storage,
+// and repairs the drift as selected by the options.
+//
+// Files younger than RECONCILE_MIN_AGE and documents created after the start
+// are skipped, since their upload may still be in progress. Only the latest
+// file of every name is listed, documents which refer to an older file are
+// checked one by one.
+func Reconcile(ctx context.Context, opts ReconcileOptions) (*ReconcileReport, error) {
+	reconcileMu.Lock()
+	if reconciling {
+		reconcileMu.Unlock()
+		return nil, errReconciling
+	}
+	reconciling = true
+	reconcileMu.Unlock()
+	defer func() {
+		reconcileMu.Lock()
+		reconciling = false
+		reconcileMu.Unlock()
+	}()
+
+	report := &ReconcileReport{
+		StartedAt:        time.Now(),
+		StaleLargeFiles:  []storage.File{},
+		OrphanFiles:      []storage.File{},
+		OrphanRenditions: []storage.File{},
+		MissingFiles:     []MissingFile{},
+		Canceled:         []string{},
+		Deleted:          []string{},
+		Imported:         []primitive.ObjectID{},
+		Flagged:          []primitive.ObjectID{},
+		Unflagged:        []primitive.ObjectID{},
+		Errors:           []string{},
+	}
+	before := report.StartedAt.Add(-reconcileMinAge())
+
+	media, err := mediaCollection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	backend := storage.Default()
+
+	if err := reconcileLargeFiles(ctx, backend, opts, before, report); err != nil {
+		return nil, err
+	}
+	stored, err := reconcileFiles(ctx, backend, media, opts, before, report)
+	if err != nil {
+		return nil, err
+	}
+	if err := reconcileDocuments(ctx, backend, media, stored, opts, report); err != nil {
+		return nil, err
+	}
+
+	report.FinishedAt = time.Now()
+	return report, nil
+}
+
+// reconcileLargeFiles reports the unfinished large files which were started
+// before the given time and cancels them if selected. Uploads whose session
+// has not expired yet are skipped, the client may still resume them.
+func reconcileLargeFiles(ctx context.Context, backend storage.Storage, opts ReconcileOptions, before time.Time, report *ReconcileReport) error {
+	startFileID := ""
+	for {
+		list, err := backend.ListUnfinishedLargeFiles(ctx, startFileID, reconcileLargeFilePageSize)
+		if err != nil {
+			return err
+		}
+		active, err := activeUploads(ctx, list.Files)
+		if err != nil {
+			return err
+		}
+		for i := range list.Files {
+			file := &list.Files[i]
+			if !uploadTime(file).Before(before) || active[file.FileID] {
+				continue
+			}
+			report.StaleLargeFiles = append(report.StaleLargeFiles, *file)
+			if !opts.CancelStale {
+				continue
+			}
+			if err := backend.CancelLargeFile(ctx, file.FileID); err != nil {
+				report.fail("cancel the large file %s: %v", file.FileID, err)
+				continue
+			}
+			report.Canceled = append(report.Canceled, file.FileID)
+		}
+		if list.NextFileID == "" {
+			return nil
+		}
+		startFileID = list.NextFileID
+	}
+}
+
+// activeUploads returns which of the large files have an upload session
+// which has not expired
+func activeUploads(ctx context.Context, files []storage.File) (map[string]bool, error) {
+	active := make(map[string]bool)
+	if len(files) == 0 {
+		return active, nil
+	}
+	ids := make([]string, 0, len(files))
+	for _, file := range files {
+		ids = append(ids, file.FileID)
+	}
+
+	collection, err := uploadsCollection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cur, err := collection.Find(ctx, bson.M{"_id": bson.M{"$in": ids}, "expiresat": bson.M{"$gte": time.Now()}})
+	if err != nil {
+		return nil, err
+	}
+	var sessions []*UploadSession
+	if err := cur.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+	for _, session := range sessions {
+		active[session.FileID] = true
+	}
+	return active, nil
+}
+
+// reconcileFiles walks the stored files and reports those which were
+// uploaded before the given time and which no media document refers to. It
+// returns the ids of all listed files.
+func reconcileFiles(ctx context.Context, backend storage.Storage, media *mongo.Collection, opts ReconcileOptions, before time.Time, report *ReconcileReport) (map[string]bool, error) {
+	stored := make(map[string]bool)
+	startFileName := ""
+	for {
+		list, err := backend.ListFiles(ctx, storage.ListFilesRequest{
+			StartFileName: startFileName,
+			MaxFileCount:  reconcileFilePageSize,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		candidates := []storage.File{}
+		ids := []string{}
+		for _, file := range list.Files {
+			report.FilesChecked++
+			stored[file.FileID] = true
+			if uploadTime(&file).Before(before) {
+				candidates = append(candidates, file)
+				ids = append(ids, file.FileID)
+			}
+		}
+
+		known, err := knownFiles(ctx, media, ids)
+		if err != nil {
+			return nil, err
+		}
+		for i := range candidates {
+			file := &candidates[i]
+			if known[file.FileID] {
+				continue
+			}
+			if renditionFilePattern.MatchString(file.FileName) {
+				report.OrphanRenditions = append(report.OrphanRenditions, *file)
+				if !opts.ImportOrphans {
+					continue
+				}
+				if err := backend.Delete(ctx, file.FileName, file.FileID); err != nil {
+					report.fail("delete the rendition %s: %v", file.FileID, err)
+					continue
+				}
+				report.Deleted = append(report.Deleted, file.FileID)
+				continue
+			}
+
+			report.OrphanFiles = append(report.OrphanFiles, *file)
+			if !opts.ImportOrphans {
+				continue
+			}
+			doc, err := importOrphan(ctx, backend, media, file.FileID, opts.Owner)
+			if doc != nil {
+				report.Imported = append(report.Imported, doc.ID)
+			}
+			if err != nil {
+				report.fail("import the file %s: %v", file.FileID, err)
+			}
+		}
+
+		if list.NextFileName == "" {
+			return stored, nil
+		}
+		startFileName = list.NextFileName
+	}
+}
+
+// knownFiles returns which of the file ids a media document, including those
+// in the trash, refers to as file, version or rendition
+func knownFiles(ctx context.Context, media *mongo.Collection, ids []string) (map[string]bool, error) {
+	known := make(map[string]bool)
+	if len(ids) == 0 {
+		return known, nil
+	}
+
+	cur, err := media.Find(ctx, bson.M{"$or": bson.A{
+		bson.M{"b2fileId": bson.M{"$in": ids}},
+		bson.M{"versions.b2fileId": bson.M{"$in": ids}},
+		bson.M{"renditions.fileId": bson.M{"$in": ids}},
+	}}, options.Find().SetProjection(bson.M{"b2fileId": 1, "versions.b2fileId": 1, "renditions.fileId": 1}))
+	if err != nil {
+		return nil, err
+	}
+	var docs []*MediaDocument
+	if err := cur.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	for _, doc := range docs {
+		known[doc.FileID] = true
+		for _, version := range doc.Versions {
+			known[version.FileID] = true
+		}
+		for _, r := range doc.Renditions {
+			known[r.FileID] = true
+		}
+	}
+	return known, nil
+}
+
+// importOrphan creates the media document for a stored file which has none
+// and queues its processing. Copies of files in the library are kept as
+// duplicates. It returns nil if a document was created in the meantime, and
+// the document along with the error if the processing could not be queued.
+func importOrphan(ctx context.Context, backend storage.Storage, media *mongo.Collection, fileID string, owner string) (*MediaDocument, error) {
+	file, err := backend.GetFileInfo(ctx, fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = media.FindOne(ctx, bson.M{"$or": bson.A{
+		bson.M{"b2fileId": file.FileID},
+		bson.M{"versions.b2fileId": file.FileID},
+	}}).Err()
+	if err == nil {
+		return nil, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	contentType := file.ContentType
+	if contentType == "" || contentType == "application/octet-stream" {
+		if byExtension := mime.TypeByExtension(path.Ext(file.FileName)); byExtension != "" {
+			contentType = byExtension
+		}
+	}
+	doc := &MediaDocument{
+		ID:              primitive.NewObjectID(),
+		FileID:          file.FileID,
+		StorageFileName: file.FileName,
+		ContentType:     contentType,
+		Size:            file.ContentLength,
+		ContentSha1:     fileSha1(file),
+		Filename:        path.Base(file.FileName),
+		DateCreated:     time.Now(),
+		Type:            strings.SplitN(contentType, "/", 2)[0],
+		Owner:           owner,
+	}
+	if _, err := applyDuplicatePolicy(ctx, media, doc, duplicatesKeep); err != nil {
+		return nil, err
+	}
+	if _, err := media.InsertOne(ctx, doc); err != nil {
+		return nil, err
+	}
+	if _, err := enqueueProcessing(ctx, doc.FileID); err != nil {
+		return doc, err
+	}
+	return doc, nil
+}
+
+// reconcileDocuments checks the files of the media documents which were
+// created before the reconciliation started against the listed files. Files
+// which were not listed are looked up one by one, since only the latest file
+// of every name is listed.
+func reconcileDocuments(ctx context.Context, backend storage.Storage, media *mongo.Collection, stored map[string]bool, opts ReconcileOptions, report *ReconcileReport) error {
+	cur, err := media.Find(ctx, bson.M{"datecreated": bson.M{"$not": bson.M{"$gte": report.StartedAt}}},
+		options.Find().SetProjection(bson.M{
+			"b2fileId": 1, "b2fileName": 1, "version": 1, "versions": 1, "filemissing": 1,
+		}))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		doc := new(MediaDocument)
+		if err := cur.Decode(doc); err != nil {
+			return err
+		}
+		report.DocumentsChecked++
+
+		currentMissing := false
+		checked := true
+		for _, version := range doc.versions() {
+			if version.FileID == "" || stored[version.FileID] {
+				continue
+			}
+			_, err := backend.GetFileInfo(ctx, version.FileID)
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, storage.ErrNotFound) && !errors.Is(err, storage.ErrBadRequest) {
+				report.fail("check the file %s of the media document %s: %v", version.FileID, doc.ID.Hex(), err)
+				checked = false
+				continue
+			}
+			current := version.FileID == doc.FileID
+			currentMissing = currentMissing || current
+			report.MissingFiles = append(report.MissingFiles, MissingFile{
+				MediaID:         doc.ID,
+				Version:         version.Number,
+				Current:         current,
+				FileID:          version.FileID,
+				StorageFileName: version.StorageFileName,
+			})
+		}
+
+		if !opts.FlagBroken || !checked || currentMissing == (doc.FileMissing != nil) {
+			continue
+		}
+		filter := bson.M{"_id": doc.ID, "b2fileId": doc.FileID}
+		if currentMissing {
+			_, err = media.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"filemissing": time.Now()}})
+		} else {
+			_, err = media.UpdateOne(ctx, filter, bson.M{"$unset": bson.M{"filemissing": ""}})
+		}
+		if err != nil {
+			report.fail("flag the media document %s: %v", doc.ID.Hex(), err)
+			continue
+		}
+		if currentMissing {
+			report.Flagged = append(report.Flagged, doc.ID)
+		} else {
+			report.Unflagged = append(report.Unflagged, doc.ID)
+		}
+	}
+	return cur.Err()
+}
+
+// GetReconciliation reports the drift between the storage and the media
+// documents without repairing it, see Reconcile
+func GetReconciliation(ctx echo.Context) error {
+
+	// Get the jwt token from context
+	user := ctx.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+
+	// check if the user has admin rights
+	isAdmin := claims["is_admin"].(bool)
+	if !isAdmin {
+		return ctx.JSON(http.StatusUnauthorized, "Administrator rights are required to reconcile the storage.")
+	}
+
+	return reconcileResponse(ctx, ReconcileOptions{})
+}
+
+// ReconcileStorage reports the drift between the storage and the media
+// documents and repairs it as selected by the ReconcileOptions of the
+// request. The administrator becomes the owner of the imported documents.
+func ReconcileStorage(ctx echo.Context) error {
+
+	// Get the jwt token from context
+	user := ctx.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+
+	// check if the user has admin rights
+	isAdmin := claims["is_admin"].(bool)
+	if !isAdmin {
+		return ctx.JSON(http.StatusUnauthorized, "Administrator rights are required to reconcile the storage.")
+	}
+
+	opts := ReconcileOptions{}
+	if invalid := decodeStrict(ctx, &opts); invalid != nil {
+		return ctx.JSON(http.StatusBadRequest, invalid)
+	}
+	opts.Owner, _ = claims["ID"].(string)
+
+	return reconcileResponse(ctx, opts)
+}
+
+// reconcileResponse runs a reconciliation and answers with its report
+func reconcileResponse(ctx echo.Context, opts ReconcileOptions) error {
+	report, err := Reconcile(ctx.Request().Context(), opts)
+	if err == errReconciling {
+		return ctx.JSON(http.StatusConflict, "A reconciliation is running already.")
+	}
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The storage could not be reconciled.")
+	}
+	return ctx.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"image"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"my.app/pkg/rendition"
+	"my.app/pkg/storage"
+)
+
+// Rendition is a scaled down derivative of an image, which is stored next to
+// the original in the storage
+type Rendition struct {
+	Name        string `bson:"name" json:"name"`
+	FileID      string `bson:"fileId" json:"fileId"`
+	FileName    string `bson:"fileName" json:"fileName"`
+	ContentType string `bson:"contentType" json:"contentType"`
+	Width       int    `bson:"width" json:"width"`
+	Height      int    `bson:"height" json:"height"`
+	Size        int64  `bson:"size" json:"size"`
+}
+
+// renditionSpecs returns the renditions configured with RENDITIONS as a comma
+// separated list of name:size:format[:quality], e.g. "thumbnail:256:jpeg:80".
+// Without configuration rendition.DefaultSpecs are created, "none" turns
+// renditions off.
+func renditionSpecs() ([]rendition.Spec, error) {
+	value := strings.TrimSpace(os.Getenv("RENDITIONS"))
+	switch value {
+	case "":
+		return rendition.DefaultSpecs, nil
+	case "none":
+		return nil, nil
+	}
+	return rendition.ParseSpecs(value)
+}
+
+// renditionFileName returns the name of a rendition in the storage, which is
+// in the folder of the document like the files uploaded through the API. The
+// renditions of later versions have a folder of their own.
+func renditionFileName(doc *MediaDocument, spec rendition.Spec) string {
+	if doc.Version > 1 {
+		return doc.ID.Hex() + "/renditions/" + versionFolder(doc.Version) + "/" + spec.Name + spec.Extension()
+	}
+	return doc.ID.Hex() + "/renditions/" + spec.Name + spec.Extension()
+}
+
+// loadImage downloads and decodes an image. It returns nil for other files,
+// images in formats which cannot be decoded and images which are too large,
+// which get no renditions and no perceptual hash.
+func loadImage(ctx context.Context, backend storage.Storage, doc *MediaDocument) (*image.RGBA, error) {
+	if doc.Type != "image" || doc.FileID == "" {
+		return nil, nil
+	}
+
+	body, _, err := backend.Download(ctx, doc.FileID)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	// the original is spooled to disk, as its size is checked before it is decoded
+	f, err := ioutil.TempFile("", "rendition")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := io.Copy(f, body); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	img, err := rendition.Decode(f)
+	if errors.Is(err, image.ErrFormat) || errors.Is(err, rendition.ErrTooLarge) {
+		return nil, nil
+	}
+	return img, err
+}
+
+// orientation returns the EXIF orientation of a media document
+func (doc *MediaDocument) orientation() int {
+	if doc.Metadata == nil {
+		return 0
+	}
+	return doc.Metadata.Orientation
+}
+
+// generateRenditions creates the configured renditions of an image loaded
+// with loadImage, uploads them to the storage and adds them to the media document
+func generateRenditions(ctx context.Context, backend storage.Storage, doc *MediaDocument, img *image.RGBA) error {
+	specs, err := renditionSpecs()
+	if err != nil || len(specs) == 0 {
+		return err
+	}
+
+	for _, spec := range specs {
+		var buf bytes.Buffer
+		width, height, err := rendition.Generate(&buf, img, doc.orientation(), spec)
+		if err != nil {
+			return err
+		}
+
+		sum := sha1.Sum(buf.Bytes())
+		file, err := backend.UploadFile(ctx, storage.UploadFileRequest{
+			FileName:      renditionFileName(doc, spec),
+			ContentType:   spec.ContentType(),
+			ContentLength: int64(buf.Len()),
+			ContentSha1:   hex.EncodeToString(sum[:]),
+		}, bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			return err
+		}
+
+		replaced := doc.setRendition(Rendition{
+			Name:        spec.Name,
+			FileID:      file.FileID,
+			FileName:    file.FileName,
+			ContentType: file.ContentType,
+			Width:       width,
+			Height:      height,
+			Size:        file.ContentLength,
+		})
+		// a replaced rendition which cannot be deleted is left to the reconciliation
+		if replaced != nil && replaced.FileID != file.FileID {
+			err := backend.Delete(ctx, replaced.FileName, replaced.FileID)
+			if err != nil && !errors.Is(err, storage.ErrNotFound) {
+				log.Printf("delete the replaced rendition %s: %v", replaced.FileName, err)
+			}
+		}
+	}
+	return nil
+}
+
+// setRendition adds a rendition to the document or replaces the rendition of
+// the same name, which is returned
+func (doc *MediaDocument) setRendition(r Rendition) *Rendition {
+	for i := range doc.Renditions {
+		if doc.Renditions[i].Name == r.Name {
+			replaced := doc.Renditions[i]
+			doc.Renditions[i] = r
+			return &replaced
+		}
+	}
+	doc.Renditions = append(doc.Renditions, r)
+	return nil
+}
+
+// removeRenditions deletes the renditions of a document from the storage.
+// Renditions which do not exist anymore are ignored.
+func removeRenditions(ctx context.Context, backend storage.Storage, doc *MediaDocument) error {
+	for _, r := range doc.Renditions {
+		err := backend.Delete(ctx, r.FileName, r.FileID)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// bestRendition returns the smallest rendition whose longer edge has at
+// least size pixels. If all renditions are smaller, the largest is returned.
+func (doc *MediaDocument) bestRendition(size int) *Rendition {
+	var best *Rendition
+	for i := range doc.Renditions {
+		r := &doc.Renditions[i]
+		edge, bestEdge := longerEdge(r), 0
+		if best != nil {
+			bestEdge = longerEdge(best)
+		}
+
+		switch {
+		case best == nil:
+			best = r
+		case edge >= size && (bestEdge < size || edge < bestEdge):
+			best = r
+		case bestEdge < size && edge > bestEdge:
+			best = r
+		}
+	}
+	return best
+}
+
+func longerEdge(r *Rendition) int {
+	if r.Width > r.Height {
+		return r.Width
+	}
+	return r.Height
+}
+
+// DownloadRendition sends the rendition of a media document which fits best
+// for the size in pixels given in the query parameter size. Without size the
+// smallest rendition is sent. Like DownloadMedia, the client is redirected to
+// a signed url if the storage supports it.
+func DownloadRendition(ctx echo.Context) error {
+
+	size := 0
+	if value := ctx.QueryParam("size"); value != "" {
+		var err error
+		if size, err = strconv.Atoi(value); err != nil || size < 1 {
+			return ctx.JSON(http.StatusBadRequest, "The size has to be a positive number of pixels.")
+		}
+	}
+
+	doc, err := findMediaDocument(ctx.Request().Context(), ctx.Param("id"))
+	if err != nil {
+		return mediaDocumentError(ctx, err)
+	}
+
+	allowed, err := canRead(ctx, doc)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The permissions could not be checked.")
+	}
+	if !allowed {
+		return ctx.JSON(http.StatusForbidden, "You are not allowed to download this file.")
+	}
+
+	r := doc.bestRendition(size)
+	if r == nil {
+		return ctx.JSON(http.StatusNotFound, "The media document has no renditions.")
+	}
+
+	file := &storage.File{
+		FileID:        r.FileID,
+		FileName:      r.FileName,
+		ContentLength: r.Size,
+		ContentType:   r.ContentType,
+	}
+	filename := strings.TrimSuffix(doc.Filename, path.Ext(doc.Filename)) + "-" + r.Name + path.Ext(r.FileName)
+	return sendFile(ctx, file, filename)
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func TestLoadImage(t *testing.T) {
+	var small bytes.Buffer
+	if err := png.Encode(&small, image.NewRGBA(image.Rect(0, 0, 3, 2))); err != nil {
+		t.Fatal(err)
+	}
+
+	// the header of a GIF of 20000x20000 pixels, which is too large to be decoded
+	large := []byte("GIF89a\x20\x4e\x20\x4e\x00\x00\x00")
+
+	tests := []struct {
+		name    string
+		content []byte
+		decoded bool
+	}{
+		{"image", small.Bytes(), true},
+		{"unknown format", []byte("not an image"), false},
+		{"too large", large, false},
+	}
+	for _, tt := range tests {
+		backend := newFakeStorage()
+		backend.files["file"] = tt.content
+		doc := &MediaDocument{Type: "image", FileID: "file"}
+
+		img, err := loadImage(context.Background(), backend, doc)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if (img != nil) != tt.decoded {
+			t.Errorf("%s: decoded %v", tt.name, img != nil)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"my.app/pkg/jobs"
+	"my.app/pkg/storage"
+)
+
+const (
+	// scrubMediaJob is the type of the jobs which verify the stored files
+	scrubMediaJob = "scrub-media"
+
+	// defaultScrubBatchSize is the number of files verified by a single job
+	defaultScrubBatchSize = 20
+
+	// defaultScrubMaxAge is the time after which a file is verified again
+	defaultScrubMaxAge = 30 * 24 * time.Hour
+
+	// scrubInterval is the time between two jobs
+	scrubInterval = time.Hour
+)
+
+// Corruption describes a file in the storage which does not match the
+// checksum of its media document
+type Corruption struct {
+	FileID       string    `bson:"fileId" json:"fileId"`
+	ExpectedSha1 string    `bson:"expectedSha1" json:"expectedSha1"`
+	ActualSha1   string    `bson:"actualSha1" json:"actualSha1"`
+	DateDetected time.Time `bson:"datedetected" json:"dateDetected"`
+}
+
+// scrubBatchSize returns the number of files verified by a single job,
+// configured with SCRUB_BATCH_SIZE. 0 disables the scrubber.
+func scrubBatchSize() int64 {
+	size, err := strconv.ParseInt(os.Getenv("SCRUB_BATCH_SIZE"), 10, 64)
+	if err != nil || size < 0 {
+		return defaultScrubBatchSize
+	}
+	return size
+}
+
+// scrubMaxAge returns the time after which a file is verified again,
+// configured with SCRUB_MAX_AGE as a duration like "720h"
+func scrubMaxAge() time.Duration {
+	age, err := time.ParseDuration(os.Getenv("SCRUB_MAX_AGE"))
+	if err != nil || age < time.Hour {
+		return defaultScrubMaxAge
+	}
+	return age
+}
+
+// StartScrubber queues a job which verifies the stored files every hour,
+// see schedule. It does nothing if SCRUB_BATCH_SIZE is 0.
+func StartScrubber(logger jobs.Logger) {
+	if scrubBatchSize() == 0 {
+		return
+	}
+	schedule(logger, scrubMediaJob, scrubInterval)
+}
+
+// scrubMedia hashes the files of the media documents which were verified
+// longest ago and flags those which do not match the checksum of their
+// document. Documents which could not be verified are skipped, the job fails
+// and they are verified on a retry.
+func scrubMedia(ctx context.Context, job *jobs.Job) error {
+	batchSize := scrubBatchSize()
+	if batchSize == 0 {
+		return nil
+	}
+
+	media, err := mediaCollection(ctx)
+	if err != nil {
+		return err
+	}
+	filter := bson.M{
+		"datedeleted":  bson.M{"$exists": false},
+		"b2fileId":     bson.M{"$exists": true},
+		"contentSha1":  bson.M{"$exists": true},
+		"dateverified": bson.M{"$not": bson.M{"$gte": time.Now().Add(-scrubMaxAge())}},
+	}
+	// documents which were never verified sort first
+	cur, err := media.Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "dateverified", Value: 1}}).
+		SetLimit(batchSize).
+		SetProjection(bson.M{"b2fileId": 1, "contentSha1": 1}))
+	if err != nil {
+		return err
+	}
+	var docs []*MediaDocument
+	if err := cur.All(ctx, &docs); err != nil {
+		return err
+	}
+
+	backend := storage.Default()
+	var scrubErr error
+	for _, doc := range docs {
+		if err := scrubMediaDocument(ctx, backend, media, doc); err != nil && scrubErr == nil {
+			scrubErr = err
+		}
+	}
+	return scrubErr
+}
+
+// scrubMediaDocument hashes the file of a media document and records the
+// result. A file which is gone is flagged as missing, like the
+// reconciliation does.
+func scrubMediaDocument(ctx context.Context, backend storage.Storage, media *mongo.Collection, doc *MediaDocument) error {
+	sha1, err := storedFileSha1(ctx, backend, doc.FileID)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+
+	now := time.Now()
+	update := bson.M{"$set": bson.M{"dateverified": now}}
+	switch {
+	case err != nil:
+		update["$set"] = bson.M{"dateverified": now, "filemissing": now}
+	case sha1 != doc.ContentSha1:
+		update["$set"] = bson.M{"dateverified": now, "corruption": &Corruption{
+			FileID:       doc.FileID,
+			ExpectedSha1: doc.ContentSha1,
+			ActualSha1:   sha1,
+			DateDetected: now,
+		}}
+	default:
+		update["$unset"] = bson.M{"corruption": ""}
+	}
+
+	// the document may have got another version while its file was hashed
+	filter := bson.M{"_id": doc.ID, "b2fileId": doc.FileID, "contentSha1": doc.ContentSha1}
+	_, err = media.UpdateOne(ctx, filter, update)
+	return err
+}
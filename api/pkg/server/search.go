@@ -0,0 +1,293 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// the fields search results can be sorted by
+const (
+	SortRelevance   = "relevance"
+	SortDateCreated = "dateCreated"
+	SortDateTaken   = "dateTaken"
+	SortFilename    = "filename"
+	SortSize        = "size"
+)
+
+// the facets which can be counted for search results
+const (
+	FacetType   = "type"
+	FacetTag    = "tag"
+	FacetCamera = "camera"
+	FacetYear   = "year"
+)
+
+// maxFacetValues is the number of the most frequent values returned per facet
+const maxFacetValues = 50
+
+// customFieldPrefixes are the query parameters which filter by the custom
+// metadata the frontend stores with a media document
+var customFieldPrefixes = []string{"fileInfo.", "filterData."}
+
+// MediaQuery is a search for media documents. Empty fields do not restrict
+// the search.
+type MediaQuery struct {
+	// Text is searched in the file names, tags and descriptive metadata
+	Text string
+
+	// the documents have one of the types and all of the tags
+	Types []string
+	Tags  []string
+
+	Owner string
+	Make  string
+	Model string
+
+	// the ranges of the creation date and the date the photo was taken, the
+	// start is included and the end is not
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time
+	TakenFrom   *time.Time
+	TakenTo     *time.Time
+
+	// Area restricts the search to the documents located within it
+	Area *GeoArea
+
+	// Custom maps custom metadata fields like "fileInfo.category" to the
+	// value they have to match
+	Custom map[string]string
+
+	// Access restricts the search to the readable documents, it is nil for
+	// administrators
+	Access *MediaAccess
+
+	Sort       string
+	Descending bool
+	Skip       int64
+	Limit      int64
+
+	// Facets are the facets to count over all matching documents
+	Facets []string
+}
+
+// FacetCount is the number of matching documents with a value of a facet
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+
+	// the make of a camera model
+	Make string `json:"make,omitempty"`
+}
+
+// MediaFacets are the counts of the requested facets
+type MediaFacets struct {
+	Type   []FacetCount `json:"type,omitempty"`
+	Tag    []FacetCount `json:"tag,omitempty"`
+	Camera []FacetCount `json:"camera,omitempty"`
+	Year   []FacetCount `json:"year,omitempty"`
+}
+
+// MediaSearchResult is a page of the media documents which match a search
+type MediaSearchResult struct {
+	Documents []*MediaDocument `json:"documents"`
+	Total     int64            `json:"total"`
+	Page      int64            `json:"page"`
+	PageSize  int64            `json:"pageSize"`
+	Facets    *MediaFacets     `json:"facets,omitempty"`
+}
+
+// MediaIndex searches the media documents. The server uses the MongoDB
+// collection itself, SetMediaIndex replaces it, e.g. by an embedded index.
+type MediaIndex interface {
+	// EnsureIndexes prepares the index, it is called at startup
+	EnsureIndexes(ctx context.Context) error
+
+	// Search returns the documents and facets of a query, without Page and PageSize
+	Search(ctx context.Context, query *MediaQuery) (*MediaSearchResult, error)
+
+	// Clusters counts the located documents of a query in the cells of a
+	// grid, whose cells are cellSize degrees wide and high
+	Clusters(ctx context.Context, query *MediaQuery, cellSize float64) ([]GeoCluster, error)
+}
+
+var mediaIndex MediaIndex = new(mongoMediaIndex)
+
+// SetMediaIndex sets the index which SearchMedia uses
+func SetMediaIndex(index MediaIndex) {
+	mediaIndex = index
+}
+
+// EnsureIndexes creates the indexes of the media collection and the media
+// index, which the server does at startup
+func EnsureIndexes(ctx context.Context) error {
+	if _, err := mediaCollection(ctx); err != nil {
+		return err
+	}
+	return mediaIndex.EnsureIndexes(ctx)
+}
+
+// SearchMedia searches the media documents the user may read. The query
+// parameters are
+//
+//	q                       words in the file names, tags and descriptive metadata
+//	type, tag               the type and tags, may be repeated
+//	owner, make, model      exact values
+//	createdFrom, createdTo  the range of the creation date
+//	takenFrom, takenTo      the range of the date the photo was taken
+//	fileInfo.*, filterData.*  custom metadata, e.g. filterData.isPublic=true
+//	near, radius            the location within radius meters of near=lat,lng
+//	bbox                    the location within the box bbox=south,west,north,east
+//	polygon                 the location within polygon=lat,lng,lat,lng,lat,lng,...
+//	sort                    relevance, dateCreated, dateTaken, filename or size,
+//	                        with a leading "-" for descending order
+//	facets                  comma separated: type, tag, camera and year
+//	page, pageSize          the page
+//
+// Dates are in RFC 3339 format or plain dates, the end of a range is
+// included. Results are sorted by relevance if there is a text, otherwise
+// by -dateCreated.
+func SearchMedia(ctx echo.Context) error {
+
+	page, pageSize, invalid := readPage(ctx)
+	if invalid != "" {
+		return ctx.JSON(http.StatusBadRequest, invalid)
+	}
+
+	params := ctx.QueryParams()
+	query, fields := readMediaQuery(params)
+	query.Skip = (page - 1) * pageSize
+	query.Limit = pageSize
+
+	query.Sort = params.Get("sort")
+	if strings.HasPrefix(query.Sort, "-") {
+		query.Sort = query.Sort[1:]
+		query.Descending = true
+	}
+	switch query.Sort {
+	case "":
+		if query.Text != "" {
+			query.Sort = SortRelevance
+		} else {
+			query.Sort, query.Descending = SortDateCreated, true
+		}
+	case SortRelevance:
+		if query.Text == "" {
+			fields["sort"] = "Sorting by relevance requires a text."
+		}
+	case SortDateCreated, SortDateTaken, SortFilename, SortSize:
+	default:
+		fields["sort"] = "The sort has to be relevance, dateCreated, dateTaken, filename or size."
+	}
+
+	if value := params.Get("facets"); value != "" {
+		for _, facet := range strings.Split(value, ",") {
+			switch facet = strings.TrimSpace(facet); facet {
+			case FacetType, FacetTag, FacetCamera, FacetYear:
+				query.Facets = append(query.Facets, facet)
+			default:
+				fields["facets"] = "The facets have to be type, tag, camera or year."
+			}
+		}
+	}
+
+	if len(fields) > 0 {
+		return ctx.JSON(http.StatusBadRequest, &ValidationError{Message: "The search is invalid.", Fields: fields})
+	}
+
+	access, err := mediaAccess(ctx)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The permissions could not be checked.")
+	}
+	query.Access = access
+
+	result, err := mediaIndex.Search(ctx.Request().Context(), query)
+	if err == errInvalidGeoArea {
+		return ctx.JSON(http.StatusBadRequest, "The area of the search is invalid.")
+	}
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The media documents could not be searched.")
+	}
+	result.Page = page
+	result.PageSize = pageSize
+	return ctx.JSON(http.StatusOK, result)
+}
+
+// readMediaQuery reads the filters of a search from the query parameters,
+// see SearchMedia. It returns the invalid fields with their messages.
+func readMediaQuery(params url.Values) (*MediaQuery, map[string]string) {
+	query := &MediaQuery{
+		Text:   strings.TrimSpace(params.Get("q")),
+		Types:  params["type"],
+		Tags:   params["tag"],
+		Owner:  params.Get("owner"),
+		Make:   params.Get("make"),
+		Model:  params.Get("model"),
+		Custom: make(map[string]string),
+	}
+
+	fields := make(map[string]string)
+	dateRanges := []struct {
+		from, to string
+		start    **time.Time
+		end      **time.Time
+	}{
+		{"createdFrom", "createdTo", &query.CreatedFrom, &query.CreatedTo},
+		{"takenFrom", "takenTo", &query.TakenFrom, &query.TakenTo},
+	}
+	for _, r := range dateRanges {
+		var ok bool
+		if *r.start, ok = parseSearchDate(params.Get(r.from), false); !ok {
+			fields[r.from] = "The date has to be in RFC 3339 format or a date like 2006-01-02."
+		}
+		if *r.end, ok = parseSearchDate(params.Get(r.to), true); !ok {
+			fields[r.to] = "The date has to be in RFC 3339 format or a date like 2006-01-02."
+		}
+	}
+
+	for name, values := range params {
+		for _, prefix := range customFieldPrefixes {
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			key := strings.TrimPrefix(name, prefix)
+			if key == "" || strings.Contains(key, "$") {
+				fields[name] = "The custom field is invalid."
+				continue
+			}
+			query.Custom[name] = values[0]
+		}
+	}
+
+	query.Area = readGeoArea(params.Get("near"), params.Get("radius"), params.Get("bbox"), params.Get("polygon"), fields)
+	return query, fields
+}
+
+// parseSearchDate parses a date of a search in RFC 3339 format or a plain
+// date. A plain date at the end of a range includes the whole day. An empty
+// value is nil, it returns false if the value is invalid.
+func parseSearchDate(value string, end bool) (*time.Time, bool) {
+	if value == "" {
+		return nil, true
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		if end {
+			t = t.Add(time.Nanosecond)
+		}
+		return &t, true
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return nil, false
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return &t, true
+}
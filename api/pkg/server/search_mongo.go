@@ -0,0 +1,377 @@
+package server
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"my.app/pkg/mongoindex"
+)
+
+// searchIndexes are the text index and the compound indexes for the filters
+// and sorts of searches
+var searchIndexes = mongoindex.New([]mongo.IndexModel{
+	{
+		Keys: bson.D{
+			{Key: "filename", Value: "text"},
+			{Key: "tags", Value: "text"},
+			{Key: "metadata.originalfilename", Value: "text"},
+			{Key: "metadata.title", Value: "text"},
+			{Key: "metadata.caption", Value: "text"},
+			{Key: "metadata.make", Value: "text"},
+			{Key: "metadata.model", Value: "text"},
+			{Key: "metadata.creator", Value: "text"},
+			{Key: "metadata.city", Value: "text"},
+			{Key: "metadata.country", Value: "text"},
+		},
+		Options: options.Index().
+			SetName("media_text").
+			SetDefaultLanguage("none").
+			SetWeights(bson.M{
+				"filename":                  10,
+				"tags":                      8,
+				"metadata.originalfilename": 5,
+				"metadata.title":            5,
+				"metadata.make":             3,
+				"metadata.model":            3,
+			}),
+	},
+	{Keys: bson.D{{Key: "datecreated", Value: -1}, {Key: "_id", Value: -1}}},
+	{Keys: bson.D{{Key: "type", Value: 1}, {Key: "datecreated", Value: -1}}},
+	{Keys: bson.D{{Key: "tags", Value: 1}, {Key: "datecreated", Value: -1}}},
+	{Keys: bson.D{{Key: "owner", Value: 1}, {Key: "datecreated", Value: -1}}},
+	{Keys: bson.D{{Key: "metadata.make", Value: 1}, {Key: "metadata.model", Value: 1}, {Key: "datecreated", Value: -1}}},
+	{Keys: bson.D{{Key: "metadata.originaldatetime", Value: -1}}},
+	{Keys: bson.D{{Key: "metadata.geo", Value: "2dsphere"}}},
+})
+
+// maxClusters limits the cells returned for a map view
+const maxClusters = 5000
+
+// minTakenDate separates real dates from the zero dates of documents whose
+// metadata has no date
+var minTakenDate = time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// mongoMediaIndex searches the media collection with a text index and
+// aggregations
+type mongoMediaIndex struct{}
+
+// EnsureIndexes migrates the locations of the media documents and creates
+// the search indexes, which the server does at startup
+func (index *mongoMediaIndex) EnsureIndexes(ctx context.Context) error {
+	collection, err := mediaCollection(ctx)
+	if err != nil {
+		return err
+	}
+
+	// the 2dsphere index fails on locations which are no GeoJSON points
+	if err := migrateGeoPoints(ctx, collection); err != nil {
+		return err
+	}
+	return searchIndexes.Ensure(collection)
+}
+
+// collection returns the media collection, whose search indexes are created
+// on first use if they could not be created at startup
+func (index *mongoMediaIndex) collection(ctx context.Context) (*mongo.Collection, error) {
+	collection, err := mediaCollection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := searchIndexes.Ensure(collection); err != nil {
+		return nil, err
+	}
+	return collection, nil
+}
+
+// Search runs a query as a single aggregation, which counts the facets of
+// all matching documents next to the page
+func (index *mongoMediaIndex) Search(ctx context.Context, query *MediaQuery) (*MediaSearchResult, error) {
+
+	// the text index is required, if it could not be created at startup
+	collection, err := index.collection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: searchFilter(query)}}}
+	if query.Text != "" {
+		pipeline = append(pipeline, bson.D{{Key: "$addFields", Value: bson.M{"_score": bson.M{"$meta": "textScore"}}}})
+	}
+
+	direction := 1
+	if query.Descending {
+		direction = -1
+	}
+	sortField := map[string]string{
+		SortRelevance:   "_score",
+		SortDateCreated: "datecreated",
+		SortDateTaken:   "metadata.originaldatetime",
+		SortFilename:    "filename",
+		SortSize:        "b2FileSize",
+	}[query.Sort]
+	if query.Sort == SortRelevance {
+		direction = -1
+	}
+	page := bson.A{
+		bson.M{"$sort": bson.D{{Key: sortField, Value: direction}, {Key: "_id", Value: direction}}},
+		bson.M{"$skip": query.Skip},
+	}
+	if query.Limit > 0 {
+		page = append(page, bson.M{"$limit": query.Limit})
+	}
+	facets := bson.M{
+		"total":     bson.A{bson.M{"$count": "count"}},
+		"documents": page,
+	}
+	for _, facet := range query.Facets {
+		facets[facet] = facetPipeline(facet)
+	}
+	pipeline = append(pipeline, bson.D{{Key: "$facet", Value: facets}})
+
+	var output []struct {
+		Total []struct {
+			Count int64 `bson:"count"`
+		} `bson:"total"`
+		Documents []*MediaDocument `bson:"documents"`
+		Type      []valueCount     `bson:"type"`
+		Tag       []valueCount     `bson:"tag"`
+		Year      []struct {
+			Year  int   `bson:"_id"`
+			Count int64 `bson:"count"`
+		} `bson:"year"`
+		Camera []struct {
+			Camera struct {
+				Make  string `bson:"make"`
+				Model string `bson:"model"`
+			} `bson:"_id"`
+			Count int64 `bson:"count"`
+		} `bson:"camera"`
+	}
+	cur, err := collection.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, searchError(query, err)
+	}
+	if err := cur.All(ctx, &output); err != nil {
+		return nil, err
+	}
+
+	result := &MediaSearchResult{Documents: []*MediaDocument{}}
+	if len(output) == 0 {
+		return result, nil
+	}
+	out := output[0]
+	if len(out.Total) > 0 {
+		result.Total = out.Total[0].Count
+	}
+	if out.Documents != nil {
+		result.Documents = out.Documents
+	}
+	if len(query.Facets) > 0 {
+		result.Facets = &MediaFacets{Type: facetCounts(out.Type), Tag: facetCounts(out.Tag)}
+		for _, year := range out.Year {
+			result.Facets.Year = append(result.Facets.Year, FacetCount{Value: strconv.Itoa(year.Year), Count: year.Count})
+		}
+		for _, camera := range out.Camera {
+			result.Facets.Camera = append(result.Facets.Camera, FacetCount{
+				Value: camera.Camera.Model,
+				Make:  camera.Camera.Make,
+				Count: camera.Count,
+			})
+		}
+	}
+	return result, nil
+}
+
+// Clusters groups the located documents of a query by the cells of a grid
+// and returns the count and the mean position of every cell
+func (index *mongoMediaIndex) Clusters(ctx context.Context, query *MediaQuery, cellSize float64) ([]GeoCluster, error) {
+	collection, err := index.collection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := searchFilter(query)
+	if query.Area == nil {
+		filter["metadata.geo"] = bson.M{"$exists": true}
+	}
+	cell := func(field string, offset float64) bson.M {
+		return bson.M{"$floor": bson.M{"$divide": bson.A{bson.M{"$add": bson.A{field, offset}}, cellSize}}}
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$project", Value: bson.M{
+			"lng": bson.M{"$arrayElemAt": bson.A{"$metadata.geo.coordinates", 0}},
+			"lat": bson.M{"$arrayElemAt": bson.A{"$metadata.geo.coordinates", 1}},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":        bson.M{"x": cell("$lng", 180), "y": cell("$lat", 90)},
+			"count":      bson.M{"$sum": 1},
+			"lng":        bson.M{"$avg": "$lng"},
+			"lat":        bson.M{"$avg": "$lat"},
+			"documentId": bson.M{"$first": "$_id"},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$limit", Value: maxClusters}},
+	}
+
+	var output []struct {
+		Cell struct {
+			X float64 `bson:"x"`
+			Y float64 `bson:"y"`
+		} `bson:"_id"`
+		Count      int64              `bson:"count"`
+		Longitude  float64            `bson:"lng"`
+		Latitude   float64            `bson:"lat"`
+		DocumentID primitive.ObjectID `bson:"documentId"`
+	}
+	cur, err := collection.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, searchError(query, err)
+	}
+	if err := cur.All(ctx, &output); err != nil {
+		return nil, err
+	}
+
+	clusters := []GeoCluster{}
+	for _, o := range output {
+		cluster := GeoCluster{
+			Latitude:  o.Latitude,
+			Longitude: o.Longitude,
+			Count:     o.Count,
+			Bounds:    gridCell(int(o.Cell.X), int(o.Cell.Y), cellSize),
+		}
+		if o.Count == 1 {
+			id := o.DocumentID
+			cluster.DocumentID = &id
+		}
+		clusters = append(clusters, cluster)
+	}
+	return clusters, nil
+}
+
+// searchError returns errInvalidGeoArea if the database rejected the area of a query
+func searchError(query *MediaQuery, err error) error {
+	if query.Area != nil && isBadValue(err) {
+		return errInvalidGeoArea
+	}
+	return err
+}
+
+// searchFilter returns the filter of the documents which match a query
+func searchFilter(query *MediaQuery) bson.M {
+	filter := query.Access.filter()
+	if query.Text != "" {
+		filter["$text"] = bson.M{"$search": query.Text}
+	}
+	if len(query.Types) > 0 {
+		filter["type"] = bson.M{"$in": query.Types}
+	}
+	if len(query.Tags) > 0 {
+		filter["tags"] = bson.M{"$all": query.Tags}
+	}
+	if query.Owner != "" {
+		filter["owner"] = query.Owner
+	}
+	if query.Make != "" {
+		filter["metadata.make"] = query.Make
+	}
+	if query.Model != "" {
+		filter["metadata.model"] = query.Model
+	}
+	if dates := dateRange(query.CreatedFrom, query.CreatedTo); dates != nil {
+		filter["datecreated"] = dates
+	}
+	if dates := dateRange(query.TakenFrom, query.TakenTo); dates != nil {
+		filter["metadata.originaldatetime"] = dates
+	}
+	if query.Area != nil {
+		filter["metadata.geo"] = query.Area.geoFilter()
+	}
+
+	// custom fields are stored by the frontend, so a value may also be a
+	// boolean or a number
+	for field, value := range query.Custom {
+		values := bson.A{value}
+		if b, err := strconv.ParseBool(value); err == nil {
+			values = append(values, b)
+		}
+		if n, err := strconv.ParseFloat(value, 64); err == nil {
+			values = append(values, n)
+		}
+		filter[field] = bson.M{"$in": values}
+	}
+	return filter
+}
+
+// dateRange returns the condition of a date range, or nil if it is open
+func dateRange(from, to *time.Time) bson.M {
+	if from == nil && to == nil {
+		return nil
+	}
+	dates := bson.M{}
+	if from != nil {
+		dates["$gte"] = *from
+	}
+	if to != nil {
+		dates["$lt"] = *to
+	}
+	return dates
+}
+
+// facetPipeline returns the stages which count the values of a facet
+func facetPipeline(facet string) bson.A {
+	switch facet {
+	case FacetType:
+		return bson.A{
+			bson.M{"$sortByCount": bson.M{"$ifNull": bson.A{"$type", ""}}},
+		}
+	case FacetTag:
+		return bson.A{
+			bson.M{"$unwind": "$tags"},
+			bson.M{"$sortByCount": "$tags"},
+			bson.M{"$limit": maxFacetValues},
+		}
+	case FacetCamera:
+		return bson.A{
+			bson.M{"$match": bson.M{"metadata.model": bson.M{"$nin": bson.A{nil, ""}}}},
+			bson.M{"$group": bson.M{
+				"_id":   bson.M{"make": "$metadata.make", "model": "$metadata.model"},
+				"count": bson.M{"$sum": 1},
+			}},
+			bson.M{"$sort": bson.D{{Key: "count", Value: -1}, {Key: "_id.model", Value: 1}}},
+			bson.M{"$limit": maxFacetValues},
+		}
+	}
+
+	// the year the photo was taken, or the year of the upload
+	return bson.A{
+		bson.M{"$group": bson.M{
+			"_id": bson.M{"$year": bson.M{"$cond": bson.A{
+				bson.M{"$gt": bson.A{"$metadata.originaldatetime", minTakenDate}},
+				"$metadata.originaldatetime",
+				"$datecreated",
+			}}},
+			"count": bson.M{"$sum": 1},
+		}},
+		bson.M{"$sort": bson.M{"_id": -1}},
+	}
+}
+
+// valueCount is a count of $sortByCount
+type valueCount struct {
+	Value string `bson:"_id"`
+	Count int64  `bson:"count"`
+}
+
+func facetCounts(counts []valueCount) []FacetCount {
+	var result []FacetCount
+	for _, c := range counts {
+		result = append(result, FacetCount{Value: c.Value, Count: c.Count})
+	}
+	return result
+}
@@ -27,7 +27,6 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 
 	//"go.mongodb.org/mongo-driver/mongo/readpref"
-	"my.app/pkg/b2"
 )
 
 // HealthCheck performs a health check of the server
@@ -43,127 +42,95 @@ func HealthCheck(ctx echo.Context) error {
 
 // MediaDocument represents a single media document
 type MediaDocument struct {
-	Filename    string
-	DateCreated time.Time
-	Type        string
-	Owner       string
-	URL         string
-	Tags        []string
-	Permissions []string
-	Metadata    Metadata
+	ID primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+
+	// the file in the storage backend, the keys match the documents
+	// which the frontend created for its B2 uploads
+	FileID           string                 `bson:"b2fileId,omitempty" json:"b2fileId,omitempty"`
+	StorageFileName  string                 `bson:"b2fileName,omitempty" json:"b2fileName,omitempty"`
+	ContentType      string                 `bson:"b2ContentType,omitempty" json:"b2ContentType,omitempty"`
+	Size             int64                  `bson:"b2FileSize,omitempty" json:"b2FileSize,omitempty"`
+	ContentSha1      string                 `bson:"contentSha1,omitempty" json:"contentSha1,omitempty"`
+	LastModifiedDate string                 `bson:"lastModifiedDate,omitempty" json:"lastModifiedDate,omitempty"`
+	FileInfo         map[string]interface{} `bson:"fileInfo,omitempty" json:"fileInfo,omitempty"`
+	FilterData       map[string]interface{} `bson:"filterData,omitempty" json:"filterData,omitempty"`
+
+	Filename    string     `bson:"filename,omitempty" json:"filename,omitempty"`
+	DateCreated time.Time  `bson:"datecreated,omitempty" json:"dateCreated"`
+	DateUpdated *time.Time `bson:"dateupdated,omitempty" json:"dateUpdated,omitempty"`
+	Type        string     `bson:"type,omitempty" json:"type,omitempty"`
+	Owner       string     `bson:"owner,omitempty" json:"owner,omitempty"`
+	URL         string     `bson:"url,omitempty" json:"url,omitempty"`
+	Tags        []string   `bson:"tags,omitempty" json:"tags,omitempty"`
+	Permissions []string   `bson:"permissions,omitempty" json:"permissions,omitempty"`
+	Metadata    *Metadata  `bson:"metadata,omitempty" json:"metadata,omitempty"`
+
+	// scaled down derivatives of images
+	Renditions []Rendition `bson:"renditions,omitempty" json:"renditions,omitempty"`
+
+	// the time the checksum, metadata and renditions were added in the background
+	DateProcessed *time.Time `bson:"dateprocessed,omitempty" json:"dateProcessed,omitempty"`
+
+	// the oldest media document with the same content, if this is a copy
+	DuplicateOf *primitive.ObjectID `bson:"duplicateof,omitempty" json:"duplicateOf,omitempty"`
+
+	// the perceptual hash of images as 16 hex digits and its bands, which are
+	// indexed to find similar images
+	PHash      string  `bson:"phash,omitempty" json:"phash,omitempty"`
+	PHashBands []int32 `bson:"phashBands,omitempty" json:"-"`
+
+	// the number of the current version and the history of the file, the
+	// file fields above are those of the current version
+	Version  int            `bson:"version,omitempty" json:"version,omitempty"`
+	Versions []MediaVersion `bson:"versions,omitempty" json:"-"`
+
+	// the time the document was moved to the trash and the user who did
+	DateDeleted *time.Time `bson:"datedeleted,omitempty" json:"dateDeleted,omitempty"`
+	DeletedBy   string     `bson:"deletedby,omitempty" json:"deletedBy,omitempty"`
+
+	// the time a reconciliation found the file of the current version missing
+	// in the storage
+	FileMissing *time.Time `bson:"filemissing,omitempty" json:"fileMissing,omitempty"`
+
+	// the time the scrubber last hashed the file of the current version and
+	// the mismatch it found, if any
+	DateVerified *time.Time  `bson:"dateverified,omitempty" json:"dateVerified,omitempty"`
+	Corruption   *Corruption `bson:"corruption,omitempty" json:"corruption,omitempty"`
 }
 
-// Geoinformation contains the goeinformation of the metadata
+// Geoinformation contains the goeinformation of the metadata. It is stored
+// as GeoJSON point, see MarshalBSON.
 type Geoinformation struct {
-	Latitude  float64
-	Longitude float64
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Altitude  float64 `bson:"altitude,omitempty" json:"altitude,omitempty"`
 }
 
-// Metadata contains the metadata for a MediaDocument
+// Metadata contains the metadata for a MediaDocument. The metadata of images
+// is read from their EXIF, IPTC and XMP fields on upload.
 type Metadata struct {
-	OriginalFilename string
-	OriginalDatetime time.Time
-	Make             string
-	Model            string
-	PixelX           int
-	PixelY           int
-	Geo              Geoinformation
-}
-
-// MediaDocumentRequest defines the parameters for the media document request
-type MediaDocumentRequest struct {
-	UserID    int    `bson:"userId" json:"userId"`
-	MediaType string `bson:"mediaType" json:"mediaType"`
-}
-
-// GetMediaDocument fetches a single media document from the database
-func GetMediaDocument(ctx echo.Context) error {
-
-	req := new(MediaDocumentRequest)
-
-	if err := ctx.Bind(req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "invalid request object")
-	}
-	ctx.Logger().Debugf("received request body: %+v", req)
-
-	// Set MongoDB client options
-	uri := os.Getenv("MONGO_DB_URI")
-	clientOptions := options.Client().ApplyURI(uri)
-
-	// Connect to MongoDB
-	client, err := mongo.Connect(context.TODO(), clientOptions)
-
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// Check the connection
-	err = client.Ping(context.TODO(), nil)
-
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// check the permission in the permissions collection
-	collection := client.Database("test").Collection("users")
-
-	var role bson.M
-
-	filter := bson.M{"user_id": req.UserID}
-
-	err = collection.FindOne(context.TODO(), filter, options.FindOne().SetProjection(bson.M{"_id": 0, "role": 1})).Decode(&role)
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			fmt.Println(err)
-		} else {
-			log.Fatal(err)
-		}
-	}
-
-	// then fetch the collection
-	collection = client.Database("test").Collection("media")
-
-	// create a value into which the result can be decoded
-	var results []*MediaDocument
-
-	filter = bson.M{"role": role["role"]}
-
-	cur, err := collection.Find(context.TODO(), filter)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	for cur.Next(context.TODO()) {
-		var elem MediaDocument
-		err := cur.Decode(&elem)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		results = append(results, &elem)
-	}
-
-	if err := cur.Err(); err != nil {
-		log.Fatal(err)
-	}
-
-	cur.Close(context.TODO())
-
-	fmt.Printf("Found document(s): %+v\n", len(results))
-
-	return ctx.JSON(http.StatusOK, results)
-}
-
-// GetFileList fetches all the users from the database
-func GetFileList(ctx echo.Context) error {
-
-	// First, authorize the B2 account
-	auth := b2.AuthorizeB2account()
-
-	// Now that we are authorized, we can use the token to fetch content from b2 storage
-	files := b2.ListFileNames(auth)
-
-	return ctx.JSON(http.StatusOK, files)
+	OriginalFilename string          `json:"originalFilename"`
+	OriginalDatetime time.Time       `json:"originalDatetime"`
+	Make             string          `json:"make"`
+	Model            string          `json:"model"`
+	PixelX           int             `json:"pixelX"`
+	PixelY           int             `json:"pixelY"`
+	Geo              *Geoinformation `bson:"geo,omitempty" json:"geo,omitempty"`
+
+	Lens         string  `bson:"lens,omitempty" json:"lens,omitempty"`
+	Orientation  int     `bson:"orientation,omitempty" json:"orientation,omitempty"`
+	ExposureTime string  `bson:"exposuretime,omitempty" json:"exposureTime,omitempty"`
+	FNumber      float64 `bson:"fnumber,omitempty" json:"fNumber,omitempty"`
+	ISO          int     `bson:"iso,omitempty" json:"iso,omitempty"`
+	FocalLength  float64 `bson:"focallength,omitempty" json:"focalLength,omitempty"`
+
+	Title     string `bson:"title,omitempty" json:"title,omitempty"`
+	Caption   string `bson:"caption,omitempty" json:"caption,omitempty"`
+	Creator   string `bson:"creator,omitempty" json:"creator,omitempty"`
+	Credit    string `bson:"credit,omitempty" json:"credit,omitempty"`
+	Copyright string `bson:"copyright,omitempty" json:"copyright,omitempty"`
+	City      string `bson:"city,omitempty" json:"city,omitempty"`
+	Country   string `bson:"country,omitempty" json:"country,omitempty"`
 }
 
 type LoginRequest struct {
@@ -1279,53 +1246,3 @@ func GetCSRFToken(ctx echo.Context) error {
 	}
 	return ctx.JSON(http.StatusOK, csrfToken)
 }
-
-// UploadFileToDB uploads file metadata to the database
-func UploadFileToDB(ctx echo.Context) error {
-
-	// Get the jwt token from context
-	user := ctx.Get("user").(*jwt.Token)
-	claims := user.Claims.(jwt.MapClaims)
-
-	// check if the user has admin rights
-	isAdmin := claims["is_admin"].(bool)
-	if !isAdmin {
-		return ctx.JSON(http.StatusUnauthorized, "Administrator rights are required to upload a new file to the database.")
-	}
-
-	reqBody := echo.Map{}
-	if err := ctx.Bind(&reqBody); err != nil {
-		return err
-	}
-
-	ctx.Logger().Debugf("received request body: %+v", reqBody)
-	//fmt.Println("reqBody", reqBody)
-	// Set MongoDB client options
-	uri := os.Getenv("MONGO_DB_URI")
-	clientOptions := options.Client().ApplyURI(uri)
-
-	// Connect to MongoDB
-	client, err := mongo.Connect(context.TODO(), clientOptions)
-
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// Check the connection
-	err = client.Ping(context.TODO(), nil)
-
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	collection := client.Database("db-media").Collection("media")
-
-	insertResult, err := collection.InsertOne(context.TODO(), reqBody)
-	if err != nil {
-		log.Fatal(err)
-	}
-	fmt.Println("Inserted a single document: ", insertResult.InsertedID)
-
-	return ctx.JSON(http.StatusOK, reqBody)
-
-}
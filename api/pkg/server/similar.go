@@ -0,0 +1,164 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"my.app/pkg/phash"
+)
+
+// defaultSimilarDistance is the largest Hamming distance between the
+// perceptual hashes of similar images, unless the request sets another
+const defaultSimilarDistance = 10
+
+// SimilarMediaDocument is a media document with the distance of its image to
+// the image which was searched for
+type SimilarMediaDocument struct {
+	*MediaDocument
+	Distance int `json:"distance"`
+}
+
+// SimilarMediaPage is a page of similar media documents
+type SimilarMediaPage struct {
+	Documents []SimilarMediaDocument `json:"documents"`
+	Total     int64                  `json:"total"`
+	Page      int64                  `json:"page"`
+	PageSize  int64                  `json:"pageSize"`
+}
+
+// FindSimilarMedia returns the images the user may read which look like the
+// image of a media document, the most similar first. The query parameter
+// distance is the largest Hamming distance between the perceptual hashes,
+// page and pageSize select the page.
+//
+// The bands of the hashes are indexed, so only the documents which share a
+// band with one of the probes of the hash are compared.
+func FindSimilarMedia(ctx echo.Context) error {
+
+	distance := defaultSimilarDistance
+	if value := ctx.QueryParam("distance"); value != "" {
+		var err error
+		if distance, err = strconv.Atoi(value); err != nil || distance < 0 || distance > phash.MaxDistance {
+			return ctx.JSON(http.StatusBadRequest, "The distance has to be between 0 and "+strconv.Itoa(phash.MaxDistance)+".")
+		}
+	}
+	page, pageSize, invalid := readPage(ctx)
+	if invalid != "" {
+		return ctx.JSON(http.StatusBadRequest, invalid)
+	}
+
+	reqCtx := ctx.Request().Context()
+	doc, err := findMediaDocument(reqCtx, ctx.Param("id"))
+	if err != nil {
+		return mediaDocumentError(ctx, err)
+	}
+	allowed, err := canRead(ctx, doc)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The permissions could not be checked.")
+	}
+	if !allowed {
+		return ctx.JSON(http.StatusForbidden, "You are not allowed to read this media document.")
+	}
+
+	hash, err := phash.Parse(doc.PHash)
+	if err != nil {
+		return ctx.JSON(http.StatusNotFound, "The media document has no perceptual hash, it is no image or has not been processed yet.")
+	}
+
+	filter, err := readableFilter(ctx)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The permissions could not be checked.")
+	}
+	filter["_id"] = bson.M{"$ne": doc.ID}
+	filter["phashBands"] = bson.M{"$in": phash.Probes(hash, distance)}
+
+	collection, err := mediaCollection(reqCtx)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The similar media documents could not be read.")
+	}
+
+	// only the hashes of the candidates are read, the documents of the page follow
+	var candidates []struct {
+		ID    primitive.ObjectID `bson:"_id"`
+		PHash string             `bson:"phash"`
+	}
+	cur, err := collection.Find(reqCtx, filter, options.Find().SetProjection(bson.M{"phash": 1}))
+	if err == nil {
+		err = cur.All(reqCtx, &candidates)
+	}
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The similar media documents could not be read.")
+	}
+
+	type match struct {
+		id       primitive.ObjectID
+		distance int
+	}
+	matches := []match{}
+	for _, c := range candidates {
+		other, err := phash.Parse(c.PHash)
+		if err != nil {
+			continue
+		}
+		if d := phash.Distance(hash, other); d <= distance {
+			matches = append(matches, match{id: c.ID, distance: d})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].distance != matches[j].distance {
+			return matches[i].distance < matches[j].distance
+		}
+		return matches[i].id.Hex() < matches[j].id.Hex()
+	})
+
+	result := &SimilarMediaPage{
+		Documents: []SimilarMediaDocument{},
+		Total:     int64(len(matches)),
+		Page:      page,
+		PageSize:  pageSize,
+	}
+	start := (page - 1) * pageSize
+	if start >= result.Total {
+		return ctx.JSON(http.StatusOK, result)
+	}
+	end := start + pageSize
+	if end > result.Total {
+		end = result.Total
+	}
+	matches = matches[start:end]
+
+	ids := make([]primitive.ObjectID, len(matches))
+	for i, m := range matches {
+		ids[i] = m.id
+	}
+	var docs []*MediaDocument
+	cur, err = collection.Find(reqCtx, bson.M{"_id": bson.M{"$in": ids}})
+	if err == nil {
+		err = cur.All(reqCtx, &docs)
+	}
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The similar media documents could not be read.")
+	}
+
+	byID := make(map[primitive.ObjectID]*MediaDocument, len(docs))
+	for _, d := range docs {
+		byID[d.ID] = d
+	}
+	for _, m := range matches {
+		// documents which were deleted in the meantime are left out
+		if d, ok := byID[m.id]; ok {
+			result.Documents = append(result.Documents, SimilarMediaDocument{MediaDocument: d, Distance: m.distance})
+		}
+	}
+	return ctx.JSON(http.StatusOK, result)
+}
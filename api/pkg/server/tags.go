@@ -0,0 +1,861 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxSynonyms         = 50
+	maxTagDescription   = 1000
+	maxTagDepth         = 20
+	maxBulkTagDocuments = 1000
+	duplicateKeyCode    = 11000
+)
+
+// errTagNotFound is returned when a tag does not exist
+var errTagNotFound = errors.New("server: tag not found")
+
+// controlledTags reports whether TAG_VOCABULARY is "controlled", which only
+// allows the tags of the vocabulary on media documents. Otherwise, other tags
+// are allowed as well, but tags of the vocabulary are always written like
+// their name in the vocabulary.
+func controlledTags() bool {
+	return os.Getenv("TAG_VOCABULARY") == "controlled"
+}
+
+// Tag is a tag of the vocabulary. Media documents carry the names of their
+// tags, synonyms are replaced by the name when a media document is tagged.
+type Tag struct {
+	ID          primitive.ObjectID  `bson:"_id" json:"id"`
+	Name        string              `bson:"name" json:"name"`
+	Key         string              `bson:"key" json:"-"`
+	Parent      *primitive.ObjectID `bson:"parent,omitempty" json:"parent,omitempty"`
+	Synonyms    []string            `bson:"synonyms,omitempty" json:"synonyms,omitempty"`
+	SynonymKeys []string            `bson:"synonymKeys,omitempty" json:"-"`
+	Description string              `bson:"description,omitempty" json:"description,omitempty"`
+	DateCreated time.Time           `bson:"datecreated" json:"dateCreated"`
+	DateUpdated *time.Time          `bson:"dateupdated,omitempty" json:"dateUpdated,omitempty"`
+
+	// Usage is the number of media documents with the tag
+	Usage int64 `bson:"-" json:"usage"`
+}
+
+// TagPage is a page of the tags of the vocabulary
+type TagPage struct {
+	Tags     []*Tag `json:"tags"`
+	Total    int64  `json:"total"`
+	Page     int64  `json:"page"`
+	PageSize int64  `json:"pageSize"`
+}
+
+// TagRequest holds the fields of a tag which can be set. Fields which are
+// not sent are left as they are, an empty parent makes a top level tag.
+type TagRequest struct {
+	Name        *string   `json:"name"`
+	Parent      *string   `json:"parent"`
+	Synonyms    *[]string `json:"synonyms"`
+	Description *string   `json:"description"`
+}
+
+// MergeTagRequest names the tag another tag is merged into
+type MergeTagRequest struct {
+	Into string `json:"into"`
+}
+
+// TagMediaRequest adds and removes tags of many media documents at once
+type TagMediaRequest struct {
+	IDs    []string `json:"ids"`
+	Add    []string `json:"add"`
+	Remove []string `json:"remove"`
+}
+
+// TagMediaResult counts the media documents of a TagMediaRequest
+type TagMediaResult struct {
+	Matched  int64 `json:"matched"`
+	Modified int64 `json:"modified"`
+}
+
+// normalizeTag trims a tag and reduces its white space to single spaces
+func normalizeTag(tag string) string {
+	return strings.Join(strings.Fields(tag), " ")
+}
+
+// tagKey returns the key which identifies a tag regardless of its case
+func tagKey(tag string) string {
+	return strings.ToLower(normalizeTag(tag))
+}
+
+// resolveTags replaces the tags which match a tag of the vocabulary by name
+// or synonym with the name of the tag. It returns the tags without duplicates
+// and the tags which are not in the vocabulary.
+func resolveTags(ctx context.Context, tags []string) ([]string, []string, error) {
+	if len(tags) == 0 {
+		return tags, nil, nil
+	}
+	keys := make([]string, len(tags))
+	for i, tag := range tags {
+		keys[i] = tagKey(tag)
+	}
+
+	collection, err := tagsCollection(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	cur, err := collection.Find(ctx,
+		bson.M{"$or": bson.A{bson.M{"key": bson.M{"$in": keys}}, bson.M{"synonymKeys": bson.M{"$in": keys}}}},
+		options.Find().SetProjection(bson.M{"name": 1, "key": 1, "synonymKeys": 1}))
+	if err != nil {
+		return nil, nil, err
+	}
+	var vocabulary []*Tag
+	if err := cur.All(ctx, &vocabulary); err != nil {
+		return nil, nil, err
+	}
+	names := make(map[string]string)
+	for _, t := range vocabulary {
+		names[t.Key] = t.Name
+		for _, key := range t.SynonymKeys {
+			names[key] = t.Name
+		}
+	}
+
+	resolved := []string{}
+	var unknown []string
+	for i, tag := range tags {
+		if name, ok := names[keys[i]]; ok {
+			tag = name
+		} else {
+			unknown = append(unknown, tag)
+		}
+		if !hasTag(resolved, tag) {
+			resolved = append(resolved, tag)
+		}
+	}
+	return resolved, unknown, nil
+}
+
+// withoutTags returns the tags which are not in remove
+func withoutTags(tags []string, remove []string) []string {
+	result := []string{}
+	for _, tag := range tags {
+		if !hasTag(remove, tag) {
+			result = append(result, tag)
+		}
+	}
+	return result
+}
+
+// matchingTags returns the condition of the tags which equal one of tags,
+// ignoring the case
+func matchingTags(tags []string) bson.M {
+	patterns := bson.A{}
+	for _, tag := range tags {
+		patterns = append(patterns, primitive.Regex{Pattern: "^" + regexp.QuoteMeta(tag) + "$", Options: "i"})
+	}
+	return bson.M{"$in": patterns}
+}
+
+// mongoLower lowers the ASCII letters of s like $toLower of MongoDB
+func mongoLower(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+	return string(b)
+}
+
+// tagsUpdate returns the update pipeline which removes the tags matching
+// drop or add, ignoring the case, and appends add. The order of the other tags is kept,
+// tags beyond maxTags are not added. Documents whose tags do not change are
+// left as they are.
+func tagsUpdate(drop []string, add []string) bson.A {
+	keys := []string{}
+	for _, tag := range append(append([]string{}, drop...), add...) {
+		keys = append(keys, mongoLower(tag))
+	}
+	kept := bson.M{"$filter": bson.M{
+		"input": bson.M{"$ifNull": bson.A{"$tags", bson.A{}}},
+		"cond":  bson.M{"$not": bson.A{bson.M{"$in": bson.A{bson.M{"$toLower": "$$this"}, bson.M{"$literal": keys}}}}},
+	}}
+	tags := bson.M{"$slice": bson.A{bson.M{"$concatArrays": bson.A{kept, bson.M{"$literal": add}}}, maxTags}}
+	unchanged := bson.M{"$eq": bson.A{tags, bson.M{"$ifNull": bson.A{"$tags", bson.A{}}}}}
+	return bson.A{bson.M{"$set": bson.M{
+		"tags":        bson.M{"$cond": bson.A{unchanged, "$tags", tags}},
+		"dateupdated": bson.M{"$cond": bson.A{unchanged, "$dateupdated", time.Now()}},
+	}}}
+}
+
+// retagMedia replaces the tags which match from, ignoring the case, with to
+// in all media documents. If to is empty, the tags are removed.
+func retagMedia(ctx context.Context, from []string, to string) error {
+	collection, err := mediaCollection(ctx)
+	if err != nil {
+		return err
+	}
+	add := []string{}
+	if to != "" {
+		add = append(add, to)
+	}
+	_, err = collection.UpdateMany(ctx, bson.M{"tags": matchingTags(append(from, add...))}, tagsUpdate(from, add))
+	return err
+}
+
+// tagUsage sets the number of media documents with each of the tags, which
+// are not in the trash
+func tagUsage(ctx context.Context, tags []*Tag) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	names := []string{}
+	for _, t := range tags {
+		names = append(names, t.Name)
+	}
+
+	collection, err := mediaCollection(ctx)
+	if err != nil {
+		return err
+	}
+	cur, err := collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"tags": bson.M{"$in": names}, "datedeleted": bson.M{"$exists": false}}}},
+		{{Key: "$unwind", Value: "$tags"}},
+		{{Key: "$match", Value: bson.M{"tags": bson.M{"$in": names}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$tags", "count": bson.M{"$sum": 1}}}},
+	})
+	if err != nil {
+		return err
+	}
+	var counts []valueCount
+	if err := cur.All(ctx, &counts); err != nil {
+		return err
+	}
+	usage := make(map[string]int64)
+	for _, c := range counts {
+		usage[c.Value] = c.Count
+	}
+	for _, t := range tags {
+		t.Usage = usage[t.Name]
+	}
+	return nil
+}
+
+// findTag reads the tag with the given hex id
+func findTag(ctx context.Context, collection *mongo.Collection, id string) (*Tag, error) {
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, errTagNotFound
+	}
+	tag := new(Tag)
+	err = collection.FindOne(ctx, bson.M{"_id": objID}).Decode(tag)
+	if err == mongo.ErrNoDocuments {
+		return nil, errTagNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tag, nil
+}
+
+// tagError answers a request whose tag could not be read or written
+func tagError(ctx echo.Context, err error) error {
+	if err == errTagNotFound {
+		return ctx.JSON(http.StatusNotFound, "The tag does not exist.")
+	}
+	if isDuplicateKey(err) {
+		return ctx.JSON(http.StatusConflict, "The name or a synonym is used by another tag.")
+	}
+	ctx.Logger().Error(err)
+	return ctx.JSON(http.StatusInternalServerError, "The tag could not be saved.")
+}
+
+// isDuplicateKey reports whether a write violated a unique index
+func isDuplicateKey(err error) bool {
+	var writeErr mongo.WriteException
+	if !errors.As(err, &writeErr) {
+		return false
+	}
+	for _, e := range writeErr.WriteErrors {
+		if e.Code == duplicateKeyCode {
+			return true
+		}
+	}
+	return false
+}
+
+// apply sets the fields of a request on a tag and checks them. It returns
+// the invalid fields with their messages. The tags in ignore may use the
+// same names, like a tag which is merged into tag.
+func (req *TagRequest) apply(ctx context.Context, collection *mongo.Collection, tag *Tag, ignore ...primitive.ObjectID) (map[string]string, error) {
+	fields := make(map[string]string)
+
+	if req.Name != nil {
+		tag.Name = normalizeTag(*req.Name)
+		tag.Key = tagKey(tag.Name)
+	}
+	switch {
+	case tag.Name == "":
+		fields["name"] = "The name is required."
+	case len(tag.Name) > maxTagLength:
+		fields["name"] = "The name must not be longer than " + strconv.Itoa(maxTagLength) + " bytes."
+	}
+
+	if req.Description != nil {
+		tag.Description = strings.TrimSpace(*req.Description)
+		if len(tag.Description) > maxTagDescription {
+			fields["description"] = "The description must not be longer than " + strconv.Itoa(maxTagDescription) + " bytes."
+		}
+	}
+
+	if req.Synonyms != nil {
+		tag.Synonyms = nil
+		for _, synonym := range *req.Synonyms {
+			synonym = normalizeTag(synonym)
+			if synonym != "" && !hasTag(tag.Synonyms, synonym) {
+				tag.Synonyms = append(tag.Synonyms, synonym)
+			}
+		}
+	}
+	tag.Synonyms = withoutTags(tag.Synonyms, []string{tag.Name})
+	tag.SynonymKeys = nil
+	for _, synonym := range tag.Synonyms {
+		if len(synonym) > maxTagLength {
+			fields["synonyms"] = "A synonym must not be longer than " + strconv.Itoa(maxTagLength) + " bytes."
+		}
+		tag.SynonymKeys = append(tag.SynonymKeys, tagKey(synonym))
+	}
+	if len(tag.Synonyms) > maxSynonyms {
+		fields["synonyms"] = "A tag must not have more than " + strconv.Itoa(maxSynonyms) + " synonyms."
+	}
+
+	if req.Parent != nil {
+		tag.Parent = nil
+		if *req.Parent != "" {
+			parent, err := primitive.ObjectIDFromHex(*req.Parent)
+			if err != nil {
+				fields["parent"] = "The parent tag does not exist."
+			} else {
+				tag.Parent = &parent
+			}
+		}
+	}
+	if tag.Parent != nil && fields["parent"] == "" {
+		message, err := checkTagParent(ctx, collection, tag)
+		if err != nil {
+			return nil, err
+		}
+		if message != "" {
+			fields["parent"] = message
+		}
+	}
+	if len(fields) > 0 {
+		return fields, nil
+	}
+
+	// names and synonyms of other tags must not be used
+	keys := append([]string{tag.Key}, tag.SynonymKeys...)
+	other := new(Tag)
+	err := collection.FindOne(ctx, bson.M{
+		"_id": bson.M{"$nin": append([]primitive.ObjectID{tag.ID}, ignore...)},
+		"$or": bson.A{bson.M{"key": bson.M{"$in": keys}}, bson.M{"synonymKeys": bson.M{"$in": keys}}},
+	}).Decode(other)
+	if err == nil {
+		fields["name"] = "The name or a synonym is used by the tag " + other.Name + "."
+	} else if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// checkTagParent checks that the parent of a tag exists and is no descendant
+// of the tag. It returns the message for the client if it is invalid.
+func checkTagParent(ctx context.Context, collection *mongo.Collection, tag *Tag) (string, error) {
+	id := *tag.Parent
+	for depth := 0; depth < maxTagDepth; depth++ {
+		if id == tag.ID {
+			return "A tag cannot be below itself.", nil
+		}
+		parent := new(Tag)
+		err := collection.FindOne(ctx, bson.M{"_id": id}, options.FindOne().SetProjection(bson.M{"parent": 1})).Decode(parent)
+		if err == mongo.ErrNoDocuments {
+			return "The parent tag does not exist.", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if parent.Parent == nil {
+			return "", nil
+		}
+		id = *parent.Parent
+	}
+	return "Tags cannot be nested more than " + strconv.Itoa(maxTagDepth) + " levels deep.", nil
+}
+
+// ListTags returns the tags of the vocabulary with their usage, sorted by
+// name. The query parameter parent selects the tags below a tag, "root" the
+// top level tags. q filters by the beginning of the name, page and pageSize
+// select the page.
+func ListTags(ctx echo.Context) error {
+
+	page, pageSize, invalid := readPage(ctx)
+	if invalid != "" {
+		return ctx.JSON(http.StatusBadRequest, invalid)
+	}
+
+	filter := bson.M{}
+	switch parent := ctx.QueryParam("parent"); parent {
+	case "":
+	case "root":
+		filter["parent"] = bson.M{"$exists": false}
+	default:
+		id, err := primitive.ObjectIDFromHex(parent)
+		if err != nil {
+			return ctx.JSON(http.StatusBadRequest, "The parent has to be the id of a tag or root.")
+		}
+		filter["parent"] = id
+	}
+	if q := tagKey(ctx.QueryParam("q")); q != "" {
+		filter["key"] = primitive.Regex{Pattern: "^" + regexp.QuoteMeta(q)}
+	}
+
+	reqCtx := ctx.Request().Context()
+	collection, err := tagsCollection(reqCtx)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The tags could not be read.")
+	}
+
+	result := &TagPage{Tags: []*Tag{}, Page: page, PageSize: pageSize}
+	result.Total, err = collection.CountDocuments(reqCtx, filter)
+	if err == nil {
+		var cur *mongo.Cursor
+		cur, err = collection.Find(reqCtx, filter, options.Find().
+			SetSort(bson.D{{Key: "key", Value: 1}}).
+			SetSkip((page-1)*pageSize).
+			SetLimit(pageSize))
+		if err == nil {
+			err = cur.All(reqCtx, &result.Tags)
+		}
+	}
+	if err == nil {
+		err = tagUsage(reqCtx, result.Tags)
+	}
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The tags could not be read.")
+	}
+
+	return ctx.JSON(http.StatusOK, result)
+}
+
+// GetTag returns a tag of the vocabulary with its usage
+func GetTag(ctx echo.Context) error {
+
+	reqCtx := ctx.Request().Context()
+	collection, err := tagsCollection(reqCtx)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The tag could not be read.")
+	}
+	tag, err := findTag(reqCtx, collection, ctx.Param("id"))
+	if err == nil {
+		err = tagUsage(reqCtx, []*Tag{tag})
+	}
+	if err != nil {
+		return tagError(ctx, err)
+	}
+
+	return ctx.JSON(http.StatusOK, tag)
+}
+
+// CreateTag adds a tag to the vocabulary. Media documents which carry its
+// name or a synonym in another spelling are changed to carry the name.
+func CreateTag(ctx echo.Context) error {
+
+	// Get the jwt token from context
+	user := ctx.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+
+	// check if the user has admin rights
+	isAdmin := claims["is_admin"].(bool)
+	if !isAdmin {
+		return ctx.JSON(http.StatusUnauthorized, "Administrator rights are required to create a tag.")
+	}
+
+	req := new(TagRequest)
+	if invalid := decodeStrict(ctx, req); invalid != nil {
+		return ctx.JSON(http.StatusBadRequest, invalid)
+	}
+
+	reqCtx := ctx.Request().Context()
+	collection, err := tagsCollection(reqCtx)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The tag could not be saved.")
+	}
+
+	tag := &Tag{ID: primitive.NewObjectID(), DateCreated: time.Now()}
+	fields, err := req.apply(reqCtx, collection, tag)
+	if err != nil {
+		return tagError(ctx, err)
+	}
+	if len(fields) > 0 {
+		return ctx.JSON(http.StatusBadRequest, &ValidationError{Message: "The tag is invalid.", Fields: fields})
+	}
+
+	if _, err := collection.InsertOne(reqCtx, tag); err != nil {
+		return tagError(ctx, err)
+	}
+	if err := retagMedia(reqCtx, append([]string{tag.Name}, tag.Synonyms...), tag.Name); err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The tag was created, but the media documents could not be changed.")
+	}
+	if err := tagUsage(reqCtx, []*Tag{tag}); err != nil {
+		ctx.Logger().Error(err)
+	}
+
+	return ctx.JSON(http.StatusCreated, tag)
+}
+
+// UpdateTag changes a tag of the vocabulary. If the tag is renamed or gets
+// new synonyms, the media documents are changed to carry the new name.
+func UpdateTag(ctx echo.Context) error {
+
+	// Get the jwt token from context
+	user := ctx.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+
+	// check if the user has admin rights
+	isAdmin := claims["is_admin"].(bool)
+	if !isAdmin {
+		return ctx.JSON(http.StatusUnauthorized, "Administrator rights are required to change a tag.")
+	}
+
+	req := new(TagRequest)
+	if invalid := decodeStrict(ctx, req); invalid != nil {
+		return ctx.JSON(http.StatusBadRequest, invalid)
+	}
+
+	reqCtx := ctx.Request().Context()
+	collection, err := tagsCollection(reqCtx)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The tag could not be saved.")
+	}
+	tag, err := findTag(reqCtx, collection, ctx.Param("id"))
+	if err != nil {
+		return tagError(ctx, err)
+	}
+	oldName := tag.Name
+
+	fields, err := req.apply(reqCtx, collection, tag)
+	if err != nil {
+		return tagError(ctx, err)
+	}
+	if len(fields) > 0 {
+		return ctx.JSON(http.StatusBadRequest, &ValidationError{Message: "The tag is invalid.", Fields: fields})
+	}
+
+	now := time.Now()
+	tag.DateUpdated = &now
+	if _, err := collection.ReplaceOne(reqCtx, bson.M{"_id": tag.ID}, tag); err != nil {
+		return tagError(ctx, err)
+	}
+	if req.Name != nil || req.Synonyms != nil {
+		from := append([]string{oldName, tag.Name}, tag.Synonyms...)
+		if err := retagMedia(reqCtx, from, tag.Name); err != nil {
+			ctx.Logger().Error(err)
+			return ctx.JSON(http.StatusInternalServerError, "The tag was saved, but the media documents could not be changed.")
+		}
+	}
+	if err := tagUsage(reqCtx, []*Tag{tag}); err != nil {
+		ctx.Logger().Error(err)
+	}
+
+	return ctx.JSON(http.StatusOK, tag)
+}
+
+// DeleteTag removes a tag from the vocabulary and from all media documents.
+// The tags below it are moved to its parent.
+func DeleteTag(ctx echo.Context) error {
+
+	// Get the jwt token from context
+	user := ctx.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+
+	// check if the user has admin rights
+	isAdmin := claims["is_admin"].(bool)
+	if !isAdmin {
+		return ctx.JSON(http.StatusUnauthorized, "Administrator rights are required to delete a tag.")
+	}
+
+	reqCtx := ctx.Request().Context()
+	collection, err := tagsCollection(reqCtx)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The tag could not be deleted.")
+	}
+	tag, err := findTag(reqCtx, collection, ctx.Param("id"))
+	if err != nil {
+		return tagError(ctx, err)
+	}
+
+	if err := moveChildren(reqCtx, collection, tag.ID, tag.Parent); err == nil {
+		_, err = collection.DeleteOne(reqCtx, bson.M{"_id": tag.ID})
+	}
+	if err == nil {
+		err = retagMedia(reqCtx, append([]string{tag.Name}, tag.Synonyms...), "")
+	}
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The tag could not be deleted.")
+	}
+
+	return ctx.NoContent(http.StatusNoContent)
+}
+
+// MergeTag merges a tag into the tag given in the request. The name and the
+// synonyms of the merged tag become synonyms of the other tag, the media
+// documents and the tags below it are moved to the other tag. If the other
+// tag is below the merged tag, it takes the place of the merged tag.
+func MergeTag(ctx echo.Context) error {
+
+	// Get the jwt token from context
+	user := ctx.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+
+	// check if the user has admin rights
+	isAdmin := claims["is_admin"].(bool)
+	if !isAdmin {
+		return ctx.JSON(http.StatusUnauthorized, "Administrator rights are required to merge tags.")
+	}
+
+	req := new(MergeTagRequest)
+	if invalid := decodeStrict(ctx, req); invalid != nil {
+		return ctx.JSON(http.StatusBadRequest, invalid)
+	}
+
+	reqCtx := ctx.Request().Context()
+	collection, err := tagsCollection(reqCtx)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The tags could not be merged.")
+	}
+	source, err := findTag(reqCtx, collection, ctx.Param("id"))
+	if err != nil {
+		return tagError(ctx, err)
+	}
+	target, err := findTag(reqCtx, collection, req.Into)
+	if err == errTagNotFound {
+		fields := map[string]string{"into": "The tag does not exist."}
+		return ctx.JSON(http.StatusBadRequest, &ValidationError{Message: "The merge is invalid.", Fields: fields})
+	}
+	if err != nil {
+		return tagError(ctx, err)
+	}
+	if source.ID == target.ID {
+		fields := map[string]string{"into": "A tag cannot be merged into itself."}
+		return ctx.JSON(http.StatusBadRequest, &ValidationError{Message: "The merge is invalid.", Fields: fields})
+	}
+
+	// a target below the merged tag takes its place, so that the tags which
+	// are moved below the target are not above it as well
+	below, err := isBelowTag(reqCtx, collection, target, source.ID)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The tags could not be merged.")
+	}
+	if below {
+		target.Parent = source.Parent
+	}
+
+	synonyms := append(append(append([]string{}, target.Synonyms...), source.Name), source.Synonyms...)
+	update := &TagRequest{Synonyms: &synonyms}
+	fields, err := update.apply(reqCtx, collection, target, source.ID)
+	if err != nil {
+		return tagError(ctx, err)
+	}
+	if len(fields) > 0 {
+		return ctx.JSON(http.StatusBadRequest, &ValidationError{Message: "The merge is invalid.", Fields: fields})
+	}
+
+	// the names of the merged tag are released first, since they must be
+	// unique, and restored if the target cannot be saved
+	release := bson.M{"$set": bson.M{"key": "merged:" + source.ID.Hex()}, "$unset": bson.M{"synonymKeys": ""}}
+	if _, err := collection.UpdateOne(reqCtx, bson.M{"_id": source.ID}, release); err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The tags could not be merged.")
+	}
+	now := time.Now()
+	target.DateUpdated = &now
+	if _, err := collection.ReplaceOne(reqCtx, bson.M{"_id": target.ID}, target); err != nil {
+		if _, restoreErr := collection.ReplaceOne(reqCtx, bson.M{"_id": source.ID}, source); restoreErr != nil {
+			ctx.Logger().Error(restoreErr)
+		}
+		return tagError(ctx, err)
+	}
+
+	if err := moveChildren(reqCtx, collection, source.ID, &target.ID); err == nil {
+		_, err = collection.DeleteOne(reqCtx, bson.M{"_id": source.ID})
+	}
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The tags could not be merged.")
+	}
+
+	if err := retagMedia(reqCtx, append([]string{source.Name}, source.Synonyms...), target.Name); err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The tags were merged, but the media documents could not be changed.")
+	}
+	if err := tagUsage(reqCtx, []*Tag{target}); err != nil {
+		ctx.Logger().Error(err)
+	}
+
+	return ctx.JSON(http.StatusOK, target)
+}
+
+// isBelowTag reports whether a tag is below the tag with the given id
+func isBelowTag(ctx context.Context, collection *mongo.Collection, tag *Tag, id primitive.ObjectID) (bool, error) {
+	parent := tag.Parent
+	for depth := 0; parent != nil && depth < maxTagDepth; depth++ {
+		if *parent == id {
+			return true, nil
+		}
+		above := new(Tag)
+		err := collection.FindOne(ctx, bson.M{"_id": *parent}, options.FindOne().SetProjection(bson.M{"parent": 1})).Decode(above)
+		if err == mongo.ErrNoDocuments {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		parent = above.Parent
+	}
+	return false, nil
+}
+
+// moveChildren moves the documents below a document of a hierarchy, like
+// tags or collections, to another parent, or to the top level if parent is
+// nil. If the new parent is a child itself, it moves to the top level.
+func moveChildren(ctx context.Context, collection *mongo.Collection, id primitive.ObjectID, parent *primitive.ObjectID) error {
+	if parent == nil {
+		_, err := collection.UpdateMany(ctx, bson.M{"parent": id}, bson.M{"$unset": bson.M{"parent": ""}})
+		return err
+	}
+	_, err := collection.UpdateMany(ctx, bson.M{"parent": id, "_id": bson.M{"$ne": *parent}}, bson.M{"$set": bson.M{"parent": *parent}})
+	if err == nil {
+		_, err = collection.UpdateOne(ctx, bson.M{"_id": *parent, "parent": id}, bson.M{"$unset": bson.M{"parent": ""}})
+	}
+	return err
+}
+
+// TagMedia adds and removes tags of many media documents in one request.
+// Administrators may tag all documents, other users their own documents.
+// The result counts the documents which were found and those which changed.
+// Tags are only added up to maxTags tags per document.
+func TagMedia(ctx echo.Context) error {
+
+	req := new(TagMediaRequest)
+	if invalid := decodeStrict(ctx, req); invalid != nil {
+		return ctx.JSON(http.StatusBadRequest, invalid)
+	}
+
+	fields := make(map[string]string)
+	ids := []primitive.ObjectID{}
+	for _, id := range req.IDs {
+		objID, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			fields["ids"] = "The ids have to be ids of media documents."
+			break
+		}
+		ids = append(ids, objID)
+	}
+	if len(ids) == 0 || len(ids) > maxBulkTagDocuments {
+		fields["ids"] = "Between 1 and " + strconv.Itoa(maxBulkTagDocuments) + " media documents can be tagged at once."
+	}
+
+	normalize := func(tags []string, field string) []string {
+		result := []string{}
+		for _, tag := range tags {
+			tag = normalizeTag(tag)
+			if tag == "" || hasTag(result, tag) {
+				continue
+			}
+			if len(tag) > maxTagLength {
+				fields[field] = "A tag must not be longer than " + strconv.Itoa(maxTagLength) + " bytes."
+			}
+			result = append(result, tag)
+		}
+		return result
+	}
+	add := normalize(req.Add, "add")
+	remove := normalize(req.Remove, "remove")
+	if len(add) > maxTags {
+		fields["add"] = "A media document must not have more than " + strconv.Itoa(maxTags) + " tags."
+	}
+	if len(add) == 0 && len(remove) == 0 {
+		fields["add"] = "Tags to add or remove are required."
+	}
+
+	reqCtx := ctx.Request().Context()
+	add, unknown, err := resolveTags(reqCtx, add)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The tags could not be checked.")
+	}
+	if len(unknown) > 0 && controlledTags() {
+		fields["add"] = "Unknown tags: " + strings.Join(unknown, ", ") + "."
+	}
+
+	// synonyms remove the tag of the vocabulary as well
+	resolved, _, err := resolveTags(reqCtx, remove)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The tags could not be checked.")
+	}
+	remove = append(remove, withoutTags(resolved, remove)...)
+	if len(fields) > 0 {
+		return ctx.JSON(http.StatusBadRequest, &ValidationError{Message: "The tags are invalid.", Fields: fields})
+	}
+
+	filter := bson.M{"_id": bson.M{"$in": ids}, "datedeleted": bson.M{"$exists": false}}
+
+	// Get the jwt token from context
+	user := ctx.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+
+	if isAdmin, _ := claims["is_admin"].(bool); !isAdmin {
+		userID, _ := claims["ID"].(string)
+		if userID == "" {
+			return ctx.JSON(http.StatusForbidden, "You are not allowed to change these media documents.")
+		}
+		filter["owner"] = userID
+	}
+
+	collection, err := mediaCollection(reqCtx)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The media documents could not be tagged.")
+	}
+	result, err := collection.UpdateMany(reqCtx, filter, tagsUpdate(remove, add))
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The media documents could not be tagged.")
+	}
+
+	return ctx.JSON(http.StatusOK, &TagMediaResult{Matched: result.MatchedCount, Modified: result.ModifiedCount})
+}
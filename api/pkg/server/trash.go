@@ -0,0 +1,363 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"my.app/pkg/jobs"
+)
+
+const (
+	// purgeTrashJob is the type of the jobs which purge the expired trash
+	purgeTrashJob = "purge-trash"
+
+	// defaultTrashRetention is the time items stay in the trash
+	defaultTrashRetention = 30 * 24 * time.Hour
+
+	// defaultTrashPurgeInterval is the time between two purges
+	defaultTrashPurgeInterval = time.Hour
+
+	// purgeBatchSize is the number of items read at once while purging
+	purgeBatchSize = 100
+)
+
+// trashRetention returns the time items stay in the trash, configured with
+// TRASH_RETENTION as a duration like "720h"
+func trashRetention() time.Duration {
+	retention, err := time.ParseDuration(os.Getenv("TRASH_RETENTION"))
+	if err != nil || retention < 0 {
+		return defaultTrashRetention
+	}
+	return retention
+}
+
+// trashPurgeInterval returns the time between two purges, configured with
+// TRASH_PURGE_INTERVAL as a duration like "1h"
+func trashPurgeInterval() time.Duration {
+	interval, err := time.ParseDuration(os.Getenv("TRASH_PURGE_INTERVAL"))
+	if err != nil || interval < time.Minute {
+		return defaultTrashPurgeInterval
+	}
+	return interval
+}
+
+// StartTrashPurger queues a job which purges the expired trash at the start
+// of every TRASH_PURGE_INTERVAL, see schedule
+func StartTrashPurger(logger jobs.Logger) {
+	schedule(logger, purgeTrashJob, trashPurgeInterval())
+}
+
+// purgeTrash deletes the media documents and collections which have been in
+// the trash for longer than TRASH_RETENTION. Items which could not be purged
+// are skipped, the job fails and the remaining items are purged on a retry.
+func purgeTrash(ctx context.Context, job *jobs.Job) error {
+	filter := bson.M{"datedeleted": bson.M{"$lt": time.Now().Add(-trashRetention())}}
+	var purgeErr error
+
+	media, err := mediaCollection(ctx)
+	if err != nil {
+		return err
+	}
+	failed := []primitive.ObjectID{}
+	for {
+		filter["_id"] = bson.M{"$nin": failed}
+		cur, err := media.Find(ctx, filter, options.Find().SetLimit(purgeBatchSize))
+		if err != nil {
+			return err
+		}
+		var docs []*MediaDocument
+		if err := cur.All(ctx, &docs); err != nil {
+			return err
+		}
+		if len(docs) == 0 {
+			break
+		}
+		for _, doc := range docs {
+			if err := purgeMediaDocument(ctx, doc); err != nil {
+				failed = append(failed, doc.ID)
+				if purgeErr == nil {
+					purgeErr = err
+				}
+			}
+		}
+	}
+
+	collections, err := collectionsCollection(ctx)
+	if err != nil {
+		return err
+	}
+	failed = []primitive.ObjectID{}
+	for {
+		filter["_id"] = bson.M{"$nin": failed}
+		cur, err := collections.Find(ctx, filter, options.Find().SetLimit(purgeBatchSize))
+		if err != nil {
+			return err
+		}
+		var trashed []*MediaCollection
+		if err := cur.All(ctx, &trashed); err != nil {
+			return err
+		}
+		if len(trashed) == 0 {
+			break
+		}
+		for _, c := range trashed {
+			if err := purgeCollection(ctx, collections, c); err != nil {
+				failed = append(failed, c.ID)
+				if purgeErr == nil {
+					purgeErr = err
+				}
+			}
+		}
+	}
+	return purgeErr
+}
+
+// ListTrashedMedia returns the media documents in the trash, the most
+// recently deleted first. The query parameters page and pageSize select the page.
+func ListTrashedMedia(ctx echo.Context) error {
+
+	// Get the jwt token from context
+	user := ctx.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+
+	// check if the user has admin rights
+	isAdmin := claims["is_admin"].(bool)
+	if !isAdmin {
+		return ctx.JSON(http.StatusUnauthorized, "Administrator rights are required to list the trash.")
+	}
+
+	page, pageSize, invalid := readPage(ctx)
+	if invalid != "" {
+		return ctx.JSON(http.StatusBadRequest, invalid)
+	}
+
+	reqCtx := ctx.Request().Context()
+	collection, err := mediaCollection(reqCtx)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The trash could not be read.")
+	}
+
+	filter := bson.M{"datedeleted": bson.M{"$exists": true}}
+	result := &MediaDocumentPage{Documents: []*MediaDocument{}, Page: page, PageSize: pageSize}
+	result.Total, err = collection.CountDocuments(reqCtx, filter)
+	if err == nil {
+		var cur *mongo.Cursor
+		cur, err = collection.Find(reqCtx, filter, options.Find().
+			SetSort(bson.D{{Key: "datedeleted", Value: -1}, {Key: "_id", Value: -1}}).
+			SetSkip((page-1)*pageSize).
+			SetLimit(pageSize))
+		if err == nil {
+			err = cur.All(reqCtx, &result.Documents)
+		}
+	}
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The trash could not be read.")
+	}
+
+	return ctx.JSON(http.StatusOK, result)
+}
+
+// RestoreMediaDocument moves a media document out of the trash
+func RestoreMediaDocument(ctx echo.Context) error {
+
+	// Get the jwt token from context
+	user := ctx.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+
+	// check if the user has admin rights
+	isAdmin := claims["is_admin"].(bool)
+	if !isAdmin {
+		return ctx.JSON(http.StatusUnauthorized, "Administrator rights are required to restore a media document.")
+	}
+
+	reqCtx := ctx.Request().Context()
+	doc, err := findTrashedMediaDocument(reqCtx, ctx.Param("id"))
+	if err != nil {
+		return mediaDocumentError(ctx, err)
+	}
+
+	collection, err := mediaCollection(reqCtx)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The media document could not be restored.")
+	}
+	restored := new(MediaDocument)
+	err = collection.FindOneAndUpdate(reqCtx, bson.M{"_id": doc.ID},
+		bson.M{"$unset": bson.M{"datedeleted": "", "deletedby": ""}, "$set": bson.M{"dateupdated": time.Now()}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(restored)
+	if err == mongo.ErrNoDocuments {
+		return ctx.JSON(http.StatusNotFound, "The media document does not exist.")
+	}
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The media document could not be restored.")
+	}
+
+	return ctx.JSON(http.StatusOK, restored)
+}
+
+// PurgeMediaDocument deletes a media document in the trash and its files
+// for good, without waiting for TRASH_RETENTION to pass
+func PurgeMediaDocument(ctx echo.Context) error {
+
+	// Get the jwt token from context
+	user := ctx.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+
+	// check if the user has admin rights
+	isAdmin := claims["is_admin"].(bool)
+	if !isAdmin {
+		return ctx.JSON(http.StatusUnauthorized, "Administrator rights are required to purge a media document.")
+	}
+
+	reqCtx := ctx.Request().Context()
+	doc, err := findTrashedMediaDocument(reqCtx, ctx.Param("id"))
+	if err != nil {
+		return mediaDocumentError(ctx, err)
+	}
+	if err := purgeMediaDocument(reqCtx, doc); err != nil {
+		return storageError(ctx, err)
+	}
+
+	return ctx.NoContent(http.StatusNoContent)
+}
+
+// ListTrashedCollections returns the collections in the trash, the most
+// recently deleted first. The query parameters page and pageSize select the page.
+func ListTrashedCollections(ctx echo.Context) error {
+
+	// Get the jwt token from context
+	user := ctx.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+
+	// check if the user has admin rights
+	isAdmin := claims["is_admin"].(bool)
+	if !isAdmin {
+		return ctx.JSON(http.StatusUnauthorized, "Administrator rights are required to list the trash.")
+	}
+
+	page, pageSize, invalid := readPage(ctx)
+	if invalid != "" {
+		return ctx.JSON(http.StatusBadRequest, invalid)
+	}
+
+	reqCtx := ctx.Request().Context()
+	collection, err := collectionsCollection(reqCtx)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The trash could not be read.")
+	}
+
+	filter := bson.M{"datedeleted": bson.M{"$exists": true}}
+	result := &MediaCollectionPage{Collections: []*MediaCollection{}, Page: page, PageSize: pageSize}
+	result.Total, err = collection.CountDocuments(reqCtx, filter)
+	if err == nil {
+		var cur *mongo.Cursor
+		cur, err = collection.Find(reqCtx, filter, options.Find().
+			SetSort(bson.D{{Key: "datedeleted", Value: -1}, {Key: "_id", Value: -1}}).
+			SetSkip((page-1)*pageSize).
+			SetLimit(pageSize))
+		if err == nil {
+			err = cur.All(reqCtx, &result.Collections)
+		}
+	}
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The trash could not be read.")
+	}
+	for _, c := range result.Collections {
+		c.MediaCount = len(c.Media)
+	}
+
+	return ctx.JSON(http.StatusOK, result)
+}
+
+// RestoreCollection moves a collection out of the trash. If its parent was
+// purged in the meantime, it becomes a top level collection.
+func RestoreCollection(ctx echo.Context) error {
+
+	// Get the jwt token from context
+	user := ctx.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+
+	// check if the user has admin rights
+	isAdmin := claims["is_admin"].(bool)
+	if !isAdmin {
+		return ctx.JSON(http.StatusUnauthorized, "Administrator rights are required to restore a collection.")
+	}
+
+	reqCtx := ctx.Request().Context()
+	collection, err := collectionsCollection(reqCtx)
+	if err != nil {
+		return collectionError(ctx, err)
+	}
+	c, err := findTrashedCollection(reqCtx, collection, ctx.Param("id"))
+	if err != nil {
+		return collectionError(ctx, err)
+	}
+
+	unset := bson.M{"datedeleted": "", "deletedby": ""}
+	if c.Parent != nil {
+		err := collection.FindOne(reqCtx, bson.M{"_id": *c.Parent}).Err()
+		if err == mongo.ErrNoDocuments {
+			unset["parent"] = ""
+		} else if err != nil {
+			return collectionError(ctx, err)
+		}
+	}
+
+	restored := new(MediaCollection)
+	err = collection.FindOneAndUpdate(reqCtx, bson.M{"_id": c.ID},
+		bson.M{"$unset": unset, "$set": bson.M{"dateupdated": time.Now()}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(restored)
+	if err == mongo.ErrNoDocuments {
+		err = errCollectionNotFound
+	}
+	if err != nil {
+		return collectionError(ctx, err)
+	}
+	restored.MediaCount = len(restored.Media)
+
+	return ctx.JSON(http.StatusOK, restored)
+}
+
+// PurgeCollection deletes a collection in the trash for good, without
+// waiting for TRASH_RETENTION to pass. Its media documents are kept.
+func PurgeCollection(ctx echo.Context) error {
+
+	// Get the jwt token from context
+	user := ctx.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+
+	// check if the user has admin rights
+	isAdmin := claims["is_admin"].(bool)
+	if !isAdmin {
+		return ctx.JSON(http.StatusUnauthorized, "Administrator rights are required to purge a collection.")
+	}
+
+	reqCtx := ctx.Request().Context()
+	collection, err := collectionsCollection(reqCtx)
+	if err != nil {
+		return collectionError(ctx, err)
+	}
+	c, err := findTrashedCollection(reqCtx, collection, ctx.Param("id"))
+	if err != nil {
+		return collectionError(ctx, err)
+	}
+	if err := purgeCollection(reqCtx, collection, c); err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The collection could not be purged.")
+	}
+
+	return ctx.NoContent(http.StatusNoContent)
+}
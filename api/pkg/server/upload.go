@@ -0,0 +1,287 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo/v4"
+	"my.app/pkg/storage"
+)
+
+// The upload handlers answer in the shape of the B2 API, since this is what
+// the frontend was built against. The storage backend behind them is
+// selected at startup with storage.SetDefault.
+
+// GetB2UploadURLResponse defines the response of the upload url request
+type GetB2UploadURLResponse struct {
+	AuthorizationToken string `json:"authorizationToken"`
+	BucketID           string `json:"bucketID"`
+	UploadURL          string `json:"uploadUrl"`
+}
+
+// GetUploadURL gets an url from the storage to upload a single file
+func GetUploadURL(ctx echo.Context) error {
+
+	filename := ctx.QueryParam("filename")
+
+	uploadURL, err := storage.Default().GetUploadURL(ctx.Request().Context(), filename)
+	if err != nil {
+		return storageError(ctx, err)
+	}
+
+	response := &GetB2UploadURLResponse{
+		AuthorizationToken: uploadURL.AuthorizationToken,
+		BucketID:           uploadURL.BucketID,
+		UploadURL:          uploadURL.UploadURL,
+	}
+	return ctx.JSON(http.StatusOK, response)
+}
+
+// GetB2LargeUploadStartResponse defines the response of the large file start
+// and finish requests
+type GetB2LargeUploadStartResponse struct {
+	AccountID       string `json:"accountId"`
+	Action          string `json:"action"`
+	BucketID        string `json:"bucketId"`
+	ContentLength   int64  `json:"contentLength"`
+	ContentSha1     string `json:"contentSha1"`
+	ContentType     string `json:"contentType"`
+	FileID          string `json:"fileId"`
+	FileName        string `json:"fileName"`
+	UploadTimestamp int64  `json:"uploadTimestamp"`
+}
+
+func newLargeUploadResponse(file *storage.File, action string) *GetB2LargeUploadStartResponse {
+	return &GetB2LargeUploadStartResponse{
+		Action:          action,
+		ContentLength:   file.ContentLength,
+		ContentSha1:     file.ContentSha1,
+		ContentType:     file.ContentType,
+		FileID:          file.FileID,
+		FileName:        file.FileName,
+		UploadTimestamp: file.UploadTimestamp,
+	}
+}
+
+// StartLargeUpload prepares the upload of a large file in multiple parts and
+// keeps an UploadSession for it. The optional query parameters size and
+// partSize let ResumeUploadSession tell which parts are missing. The optional
+// contentSha1 is the checksum of the whole file, which is kept as file info.
+// The processing compares it with the stored file and the scrubber verifies
+// the file against it later.
+func StartLargeUpload(ctx echo.Context) error {
+
+	// Get the jwt token from context
+	user := ctx.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+
+	filename := ctx.QueryParam("filename")
+	contentType := ctx.QueryParam("contentType")
+	if filename == "" {
+		return ctx.JSON(http.StatusBadRequest, "A filename is required to start a large upload.")
+	}
+	session, invalid := newUploadSession(ctx)
+	if invalid != "" {
+		return ctx.JSON(http.StatusBadRequest, invalid)
+	}
+	var fileInfo map[string]string
+	if session.ContentSha1 != "" {
+		fileInfo = map[string]string{storage.LargeFileSha1: session.ContentSha1}
+	}
+
+	reqCtx := ctx.Request().Context()
+	file, err := storage.Default().StartLargeFile(reqCtx, filename, contentType, fileInfo)
+	if err != nil {
+		return storageError(ctx, err)
+	}
+
+	owner, _ := claims["ID"].(string)
+	if err := createUploadSession(reqCtx, session, file, owner); err != nil {
+		ctx.Logger().Error(err)
+		cancelCtx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+		defer cancel()
+		storage.Default().CancelLargeFile(cancelCtx, file.FileID)
+		return ctx.JSON(http.StatusInternalServerError, "The upload could not be started.")
+	}
+
+	return ctx.JSON(http.StatusOK, newLargeUploadResponse(file, "start"))
+}
+
+// GetB2LargeUploadURLResponse defines the response of the large upload url request
+type GetB2LargeUploadURLResponse struct {
+	FileID             string `json:"fileId"`
+	UploadURL          string `json:"uploadUrl"`
+	AuthorizationToken string `json:"authorizationToken"`
+}
+
+// GetLargeUploadURL gets an url from the storage to upload the parts of a
+// large file. The optional query parameters contentSha1 and contentLength of
+// the part record it in the UploadSession, so that FinishLargeUpload can
+// verify the part which arrived in the storage.
+func GetLargeUploadURL(ctx echo.Context) error {
+
+	fileID := ctx.Param("fileId")
+
+	// the part number is optional, but backends like S3 need it to sign the url
+	var partNumber int64
+	if p := ctx.QueryParam("partNumber"); p != "" {
+		n, err := strconv.ParseInt(p, 10, 64)
+		if err != nil {
+			return ctx.JSON(http.StatusBadRequest, "Invalid part number")
+		}
+		partNumber = n
+	}
+
+	part := UploadedPart{PartNumber: partNumber, ContentSha1: strings.ToLower(ctx.QueryParam("contentSha1"))}
+	if part.ContentSha1 != "" {
+		length, err := strconv.ParseInt(ctx.QueryParam("contentLength"), 10, 64)
+		if partNumber < 1 || !sha1Pattern.MatchString(part.ContentSha1) || err != nil || length < 1 {
+			return ctx.JSON(http.StatusBadRequest, "A part number, the SHA1 checksum and the length are required to record a part.")
+		}
+		part.ContentLength = length
+	}
+
+	_, session, err := readUploadSession(ctx, fileID)
+	if session == nil {
+		return err
+	}
+
+	uploadURL, err := storage.Default().GetUploadPartURL(ctx.Request().Context(), fileID, partNumber)
+	if err != nil {
+		return storageError(ctx, err)
+	}
+
+	// a client which uploads parts keeps its upload alive
+	if part.ContentSha1 != "" {
+		err = recordUploadPart(ctx.Request().Context(), fileID, part)
+	} else {
+		err = touchUploadSession(ctx.Request().Context(), fileID)
+	}
+	if err != nil {
+		ctx.Logger().Error(err)
+	}
+
+	response := &GetB2LargeUploadURLResponse{
+		FileID:             uploadURL.FileID,
+		UploadURL:          uploadURL.UploadURL,
+		AuthorizationToken: uploadURL.AuthorizationToken,
+	}
+	return ctx.JSON(http.StatusOK, response)
+}
+
+type finishLargeUploadRequest struct {
+	FileID        string   `json:"fileId"`
+	PartSha1Array []string `json:"partSha1Array"`
+}
+
+// FinishLargeUpload assembles the uploaded parts of a large file, removes
+// its UploadSession and queues its processing. The parts in the storage have
+// to match partSha1Array and the parts which the client recorded in the
+// session. Without partSha1Array, the recorded checksums are used, which needs
+// the size and part size of the session.
+func FinishLargeUpload(ctx echo.Context) error {
+
+	req := new(finishLargeUploadRequest)
+	if err := ctx.Bind(req); err != nil {
+		return ctx.JSON(http.StatusBadRequest, "Invalid request object")
+	}
+	ctx.Logger().Debugf("received request body: %+v", req)
+
+	_, session, err := readUploadSession(ctx, req.FileID)
+	if session == nil {
+		return err
+	}
+
+	reqCtx := ctx.Request().Context()
+	if err := syncUploadParts(reqCtx, session); err != nil {
+		return storageError(ctx, err)
+	}
+	if len(req.PartSha1Array) == 0 {
+		req.PartSha1Array = session.partSha1Array()
+	}
+	if len(req.PartSha1Array) == 0 {
+		return ctx.JSON(http.StatusBadRequest, "The checksums of the parts are required for this upload.")
+	}
+	if invalid := session.invalidParts(req.PartSha1Array); len(invalid) > 0 {
+		return ctx.JSON(http.StatusConflict, &PartMismatchError{
+			Message: "Parts of the upload are missing or do not match their checksums.",
+			Parts:   invalid,
+		})
+	}
+
+	file, err := storage.Default().FinishLargeFile(reqCtx, req.FileID, req.PartSha1Array)
+	if err != nil {
+		return storageError(ctx, err)
+	}
+	if err := removeUploadSession(reqCtx, req.FileID); err != nil {
+		ctx.Logger().Error(err)
+	}
+
+	// the job waits for the media document, which the client creates next
+	if _, err := enqueueProcessing(reqCtx, file.FileID); err != nil {
+		ctx.Logger().Error(err)
+	}
+
+	return ctx.JSON(http.StatusOK, newLargeUploadResponse(file, "upload"))
+}
+
+// FilePart describes a single uploaded part of a large file
+type FilePart struct {
+	FileID        string `json:"fileId"`
+	PartNumber    int64  `json:"partNumber"`
+	ContentLength int64  `json:"contentLength"`
+	ContentSha1   string `json:"contentSha1"`
+	ContentMd5    string `json:"contentMd5"`
+}
+
+// ListLargeFilePartsResponse defines the response of the list parts request
+type ListLargeFilePartsResponse struct {
+	Parts          []FilePart `json:"parts"`
+	NextPartNumber int64      `json:"nextPartNumber"`
+}
+
+// ListLargeFileParts lists the uploaded parts of a large upload of the user
+func ListLargeFileParts(ctx echo.Context) error {
+
+	fileID := ctx.Param("fileId")
+
+	_, session, err := readUploadSession(ctx, fileID)
+	if session == nil {
+		return err
+	}
+
+	parts, err := storage.Default().ListParts(ctx.Request().Context(), fileID, 1, 1000)
+	if err != nil {
+		return storageError(ctx, err)
+	}
+
+	response := &ListLargeFilePartsResponse{
+		Parts:          make([]FilePart, 0, len(parts.Parts)),
+		NextPartNumber: parts.NextPartNumber,
+	}
+	for _, part := range parts.Parts {
+		response.Parts = append(response.Parts, FilePart(part))
+	}
+	return ctx.JSON(http.StatusOK, response)
+}
+
+// storageError answers a request which failed because of the storage backend
+func storageError(ctx echo.Context, err error) error {
+	ctx.Logger().Error(err)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return ctx.JSON(http.StatusNotFound, "The requested file does not exist.")
+	case errors.Is(err, storage.ErrBadRequest):
+		return ctx.JSON(http.StatusBadRequest, "The storage backend rejected the request.")
+	case errors.Is(err, storage.ErrUnavailable):
+		ctx.Response().Header().Set("Retry-After", "30")
+		return ctx.JSON(http.StatusServiceUnavailable, "The storage backend is busy, please try again later.")
+	case errors.Is(err, context.DeadlineExceeded):
+		return ctx.JSON(http.StatusGatewayTimeout, "The storage backend did not answer in time.")
+	}
+	return ctx.JSON(http.StatusBadGateway, "The storage backend could not handle the request.")
+}
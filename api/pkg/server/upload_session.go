@@ -0,0 +1,514 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"my.app/pkg/jobs"
+	"my.app/pkg/storage"
+)
+
+const (
+	// expireUploadsJob is the type of the jobs which abort the expired uploads
+	expireUploadsJob = "expire-uploads"
+
+	// defaultUploadSessionTTL is the time an upload lives without activity
+	defaultUploadSessionTTL = 24 * time.Hour
+
+	// expireUploadsInterval is the time between two checks for expired uploads
+	expireUploadsInterval = time.Hour
+
+	// maxPartListCount is the number of parts B2 and S3 list at most at once
+	maxPartListCount = 1000
+)
+
+// uploadSessionTTL returns the time an upload lives without activity,
+// configured with UPLOAD_SESSION_TTL as a duration like "24h"
+func uploadSessionTTL() time.Duration {
+	ttl, err := time.ParseDuration(os.Getenv("UPLOAD_SESSION_TTL"))
+	if err != nil || ttl < time.Minute {
+		return defaultUploadSessionTTL
+	}
+	return ttl
+}
+
+// UploadedPart is a part of a large upload which is in the storage
+type UploadedPart struct {
+	PartNumber    int64  `bson:"partNumber" json:"partNumber"`
+	ContentLength int64  `bson:"contentLength" json:"contentLength"`
+	ContentSha1   string `bson:"contentSha1" json:"contentSha1"`
+}
+
+// UploadSession tracks a large upload of a client, so that the client can
+// resume it after it lost its own state, e.g. on a reload of the page. The
+// session is removed when the upload is finished, aborted or expired.
+type UploadSession struct {
+	FileID      string `bson:"_id" json:"fileId"`
+	FileName    string `bson:"fileName" json:"fileName"`
+	ContentType string `bson:"contentType" json:"contentType"`
+	Owner       string `bson:"owner" json:"owner"`
+
+	// the size of the file and its parts and the checksum of the whole file
+	// as announced by the client, empty if unknown
+	Size        int64  `bson:"size,omitempty" json:"size,omitempty"`
+	PartSize    int64  `bson:"partSize,omitempty" json:"partSize,omitempty"`
+	ContentSha1 string `bson:"contentSha1,omitempty" json:"contentSha1,omitempty"`
+
+	// the parts as the client recorded them before their upload, and the
+	// parts in the storage when the session was last resumed
+	Recorded []UploadedPart `bson:"recorded" json:"recorded"`
+	Parts    []UploadedPart `bson:"parts" json:"parts"`
+
+	// the parts which have to be uploaded (again) before the upload can be finished
+	MissingParts []int64 `bson:"-" json:"missingParts"`
+
+	DateCreated time.Time `bson:"datecreated" json:"dateCreated"`
+	DateUpdated time.Time `bson:"dateupdated" json:"dateUpdated"`
+	ExpiresAt   time.Time `bson:"expiresat" json:"expiresAt"`
+}
+
+// UploadSessionPage is a page of the upload sessions
+type UploadSessionPage struct {
+	Uploads  []*UploadSession `json:"uploads"`
+	Total    int64            `json:"total"`
+	Page     int64            `json:"page"`
+	PageSize int64            `json:"pageSize"`
+}
+
+// errUploadNotFound is returned when an upload session does not exist
+var errUploadNotFound = errors.New("upload session not found")
+
+// partCount returns the number of parts of the upload, or 0 if the size or
+// the part size is unknown
+func (session *UploadSession) partCount() int64 {
+	if session.Size <= 0 || session.PartSize <= 0 {
+		return 0
+	}
+	return (session.Size + session.PartSize - 1) / session.PartSize
+}
+
+// partLength returns the expected length of a part, the last part holds the rest
+func (session *UploadSession) partLength(partNumber int64) int64 {
+	count := session.partCount()
+	if partNumber < count {
+		return session.PartSize
+	}
+	return session.Size - (count-1)*session.PartSize
+}
+
+// invalidParts returns the numbers of the parts which are not in the storage,
+// or whose length or checksum differs from the expected length, the part the
+// client recorded or the given checksums. Without a known size, the number of
+// parts is taken from the checksums or from the last part in the storage.
+func (session *UploadSession) invalidParts(sha1s []string) []int64 {
+	stored := make(map[int64]UploadedPart)
+	last := int64(0)
+	for _, part := range session.Parts {
+		stored[part.PartNumber] = part
+		if part.PartNumber > last {
+			last = part.PartNumber
+		}
+	}
+	recorded := make(map[int64]UploadedPart)
+	for _, part := range session.Recorded {
+		recorded[part.PartNumber] = part
+	}
+
+	count := session.partCount()
+	if count == 0 {
+		count = int64(len(sha1s))
+	}
+	if count == 0 {
+		count = last
+	}
+
+	invalid := []int64{}
+	for n := int64(1); n <= count; n++ {
+		part, ok := stored[n]
+		if !ok || (session.partCount() > 0 && part.ContentLength != session.partLength(n)) {
+			invalid = append(invalid, n)
+			continue
+		}
+
+		// B2 and the local storage always know the checksum of a part, S3 only
+		// if the client sent it along
+		expected := part.ContentSha1
+		if sha1s != nil {
+			if n > int64(len(sha1s)) || (expected != "" && expected != sha1s[n-1]) {
+				invalid = append(invalid, n)
+				continue
+			}
+			expected = sha1s[n-1]
+		}
+		if r, ok := recorded[n]; ok && (r.ContentLength != part.ContentLength || (expected != "" && r.ContentSha1 != expected)) {
+			invalid = append(invalid, n)
+		}
+	}
+	return invalid
+}
+
+// partSha1Array returns the checksums of the parts in their order as the
+// client recorded them, or as the storage knows them for parts which were not
+// recorded. It returns nil if the number of parts is unknown.
+func (session *UploadSession) partSha1Array() []string {
+	if session.partCount() == 0 {
+		return nil
+	}
+	sha1s := make([]string, session.partCount())
+	for _, part := range session.Parts {
+		if part.PartNumber <= int64(len(sha1s)) {
+			sha1s[part.PartNumber-1] = part.ContentSha1
+		}
+	}
+	for _, part := range session.Recorded {
+		if part.PartNumber <= int64(len(sha1s)) {
+			sha1s[part.PartNumber-1] = part.ContentSha1
+		}
+	}
+	return sha1s
+}
+
+// PartMismatchError is the answer to a large upload which cannot be finished,
+// since parts are missing or do not match their checksums
+type PartMismatchError struct {
+	Message string  `json:"message"`
+	Parts   []int64 `json:"parts"`
+}
+
+// sha1Pattern matches a hex encoded SHA1 checksum
+var sha1Pattern = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// newUploadSession reads the optional query parameters size, partSize and
+// contentSha1 of a large upload into a new session. If they are invalid, it
+// returns the message for the client.
+func newUploadSession(ctx echo.Context) (*UploadSession, string) {
+	session := &UploadSession{
+		ContentSha1: strings.ToLower(ctx.QueryParam("contentSha1")),
+		Recorded:    []UploadedPart{},
+		Parts:       []UploadedPart{},
+	}
+	var err error
+	if value := ctx.QueryParam("size"); value != "" {
+		session.Size, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || session.Size < 1 {
+			return nil, "The size has to be a positive number."
+		}
+	}
+	if value := ctx.QueryParam("partSize"); value != "" {
+		session.PartSize, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || session.PartSize < minUploadPartSize {
+			return nil, "The partSize has to be at least " + strconv.Itoa(minUploadPartSize) + " bytes."
+		}
+	}
+	if session.partCount() > maxUploadParts {
+		return nil, "The file has more than " + strconv.Itoa(maxUploadParts) + " parts, the partSize has to be larger."
+	}
+	if session.ContentSha1 != "" && !sha1Pattern.MatchString(session.ContentSha1) {
+		return nil, "The contentSha1 has to be a hex encoded SHA1 checksum."
+	}
+	return session, ""
+}
+
+// createUploadSession stores the session of a large upload which was started
+func createUploadSession(ctx context.Context, session *UploadSession, file *storage.File, owner string) error {
+	collection, err := uploadsCollection(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	session.FileID = file.FileID
+	session.FileName = file.FileName
+	session.ContentType = file.ContentType
+	session.Owner = owner
+	session.DateCreated = now
+	session.DateUpdated = now
+	session.ExpiresAt = now.Add(uploadSessionTTL())
+	_, err = collection.InsertOne(ctx, session)
+	return err
+}
+
+// touchUploadSession extends the life of the session of a large upload,
+// if the upload has one
+func touchUploadSession(ctx context.Context, fileID string) error {
+	collection, err := uploadsCollection(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	_, err = collection.UpdateOne(ctx, bson.M{"_id": fileID}, bson.M{"$set": bson.M{
+		"dateupdated": now,
+		"expiresat":   now.Add(uploadSessionTTL()),
+	}})
+	return err
+}
+
+// recordUploadPart adds a part which the client is about to upload to the
+// session of a large upload, if the upload has one, and extends its life. A
+// part which is uploaded again replaces the recorded part.
+func recordUploadPart(ctx context.Context, fileID string, part UploadedPart) error {
+	collection, err := uploadsCollection(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	set := bson.M{
+		"dateupdated": now,
+		"expiresat":   now.Add(uploadSessionTTL()),
+	}
+
+	set["recorded.$"] = part
+	result, err := collection.UpdateOne(ctx, bson.M{"_id": fileID, "recorded.partNumber": part.PartNumber}, bson.M{"$set": set})
+	if err != nil || result.MatchedCount > 0 {
+		return err
+	}
+	delete(set, "recorded.$")
+	_, err = collection.UpdateOne(ctx, bson.M{"_id": fileID, "recorded.partNumber": bson.M{"$ne": part.PartNumber}},
+		bson.M{"$set": set, "$push": bson.M{"recorded": part}})
+	return err
+}
+
+// findUploadSession reads the session of a large upload, or returns
+// errUploadNotFound if the upload has none
+func findUploadSession(ctx context.Context, collection *mongo.Collection, fileID string) (*UploadSession, error) {
+	session := new(UploadSession)
+	err := collection.FindOne(ctx, bson.M{"_id": fileID}).Decode(session)
+	if err == mongo.ErrNoDocuments {
+		return nil, errUploadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// removeUploadSession deletes the session of a large upload which was
+// finished or canceled
+func removeUploadSession(ctx context.Context, fileID string) error {
+	collection, err := uploadsCollection(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = collection.DeleteOne(ctx, bson.M{"_id": fileID})
+	return err
+}
+
+// syncUploadParts reads the parts of the upload which are in the storage
+func syncUploadParts(ctx context.Context, session *UploadSession) error {
+	parts := []UploadedPart{}
+	start := int64(1)
+	for {
+		list, err := storage.Default().ListParts(ctx, session.FileID, start, maxPartListCount)
+		if err != nil {
+			return err
+		}
+		for _, part := range list.Parts {
+			parts = append(parts, UploadedPart{
+				PartNumber:    part.PartNumber,
+				ContentLength: part.ContentLength,
+				ContentSha1:   part.ContentSha1,
+			})
+		}
+		if list.NextPartNumber == 0 {
+			break
+		}
+		start = list.NextPartNumber
+	}
+	session.Parts = parts
+	return nil
+}
+
+// isGone reports whether the storage does not know a large file anymore. B2
+// rejects the ids of files which were finished or canceled as bad requests.
+func isGone(err error) bool {
+	return errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrBadRequest)
+}
+
+// expireUploads cancels the large uploads whose session expired and removes
+// their sessions. Uploads which could not be canceled are tried again on the
+// next run.
+func expireUploads(ctx context.Context, job *jobs.Job) error {
+	collection, err := uploadsCollection(ctx)
+	if err != nil {
+		return err
+	}
+	cur, err := collection.Find(ctx, bson.M{"expiresat": bson.M{"$lt": time.Now()}})
+	if err != nil {
+		return err
+	}
+	var sessions []*UploadSession
+	if err := cur.All(ctx, &sessions); err != nil {
+		return err
+	}
+
+	var expireErr error
+	for _, session := range sessions {
+		err := storage.Default().CancelLargeFile(ctx, session.FileID)
+		if err == nil || isGone(err) {
+			err = removeUploadSession(ctx, session.FileID)
+		}
+		if err != nil && expireErr == nil {
+			expireErr = err
+		}
+	}
+	return expireErr
+}
+
+// StartUploadExpirer queues a job which aborts the large uploads without
+// activity for UPLOAD_SESSION_TTL every hour, see schedule
+func StartUploadExpirer(logger jobs.Logger) {
+	schedule(logger, expireUploadsJob, expireUploadsInterval)
+}
+
+// readUploadSession reads the session of a large upload, which only the
+// owner and administrators may access. It answers the request and returns
+// nil if the session does not exist or belongs to another user. Every handler
+// of a large upload reads its session first, so that users cannot add parts
+// to, list or finish the uploads of others.
+func readUploadSession(ctx echo.Context, fileID string) (*mongo.Collection, *UploadSession, error) {
+
+	// Get the jwt token from context
+	user := ctx.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+
+	reqCtx := ctx.Request().Context()
+	collection, err := uploadsCollection(reqCtx)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return nil, nil, ctx.JSON(http.StatusInternalServerError, "The upload could not be read.")
+	}
+	session, err := findUploadSession(reqCtx, collection, fileID)
+	if err == errUploadNotFound {
+		return nil, nil, ctx.JSON(http.StatusNotFound, "The upload does not exist.")
+	}
+	if err != nil {
+		ctx.Logger().Error(err)
+		return nil, nil, ctx.JSON(http.StatusInternalServerError, "The upload could not be read.")
+	}
+
+	isAdmin := claims["is_admin"].(bool)
+	userID, _ := claims["ID"].(string)
+	if !isAdmin && session.Owner != userID {
+		return nil, nil, ctx.JSON(http.StatusForbidden, "You are not allowed to access this upload.")
+	}
+	return collection, session, nil
+}
+
+// ListUploadSessions returns the large uploads of the user which are in
+// progress, the most recently active first. The query parameters page and
+// pageSize select the page. The missing parts are those known at the last resume.
+func ListUploadSessions(ctx echo.Context) error {
+
+	// Get the jwt token from context
+	user := ctx.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+	owner, _ := claims["ID"].(string)
+
+	page, pageSize, invalid := readPage(ctx)
+	if invalid != "" {
+		return ctx.JSON(http.StatusBadRequest, invalid)
+	}
+
+	reqCtx := ctx.Request().Context()
+	collection, err := uploadsCollection(reqCtx)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The uploads could not be read.")
+	}
+
+	filter := bson.M{"owner": owner, "expiresat": bson.M{"$gte": time.Now()}}
+	total, err := collection.CountDocuments(reqCtx, filter)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The uploads could not be read.")
+	}
+	cur, err := collection.Find(reqCtx, filter, options.Find().
+		SetSort(bson.D{{Key: "dateupdated", Value: -1}}).
+		SetSkip((page-1)*pageSize).
+		SetLimit(pageSize))
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The uploads could not be read.")
+	}
+	sessions := []*UploadSession{}
+	if err := cur.All(reqCtx, &sessions); err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The uploads could not be read.")
+	}
+	for _, session := range sessions {
+		session.MissingParts = session.invalidParts(nil)
+	}
+
+	return ctx.JSON(http.StatusOK, &UploadSessionPage{Uploads: sessions, Total: total, Page: page, PageSize: pageSize})
+}
+
+// ResumeUploadSession returns a large upload with the parts which are in the
+// storage and those which are missing, and extends its life. The client
+// uploads the missing parts with urls of GetLargeUploadURL and finishes the
+// upload with FinishLargeUpload, which takes the checksums of the parts from
+// the session if the client does not send them.
+func ResumeUploadSession(ctx echo.Context) error {
+
+	collection, session, err := readUploadSession(ctx, ctx.Param("fileId"))
+	if session == nil {
+		return err
+	}
+
+	reqCtx := ctx.Request().Context()
+	if err := syncUploadParts(reqCtx, session); err != nil {
+		if isGone(err) {
+			if err := removeUploadSession(reqCtx, session.FileID); err != nil {
+				ctx.Logger().Error(err)
+			}
+			return ctx.JSON(http.StatusNotFound, "The upload does not exist anymore.")
+		}
+		return storageError(ctx, err)
+	}
+
+	now := time.Now()
+	session.DateUpdated = now
+	session.ExpiresAt = now.Add(uploadSessionTTL())
+	_, err = collection.UpdateOne(reqCtx, bson.M{"_id": session.FileID}, bson.M{"$set": bson.M{
+		"parts":       session.Parts,
+		"dateupdated": session.DateUpdated,
+		"expiresat":   session.ExpiresAt,
+	}})
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The upload could not be saved.")
+	}
+
+	session.MissingParts = session.invalidParts(nil)
+	return ctx.JSON(http.StatusOK, session)
+}
+
+// AbortUploadSession cancels a large upload, which removes its parts from
+// the storage, and deletes its session
+func AbortUploadSession(ctx echo.Context) error {
+
+	_, session, err := readUploadSession(ctx, ctx.Param("fileId"))
+	if session == nil {
+		return err
+	}
+
+	reqCtx := ctx.Request().Context()
+	if err := storage.Default().CancelLargeFile(reqCtx, session.FileID); err != nil && !isGone(err) {
+		return storageError(ctx, err)
+	}
+	if err := removeUploadSession(reqCtx, session.FileID); err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The upload could not be removed.")
+	}
+
+	return ctx.NoContent(http.StatusNoContent)
+}
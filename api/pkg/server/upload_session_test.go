@@ -0,0 +1,95 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInvalidParts(t *testing.T) {
+	stored := []UploadedPart{{1, 10, "a"}, {2, 10, "b"}, {3, 5, "c"}}
+
+	tests := []struct {
+		name     string
+		session  UploadSession
+		sha1s    []string
+		expected []int64
+	}{
+		{
+			name:     "complete",
+			session:  UploadSession{Size: 25, PartSize: 10, Parts: stored},
+			expected: []int64{},
+		},
+		{
+			name:     "missing part",
+			session:  UploadSession{Size: 25, PartSize: 10, Parts: []UploadedPart{stored[0], stored[2]}},
+			expected: []int64{2},
+		},
+		{
+			name:     "wrong length",
+			session:  UploadSession{Size: 30, PartSize: 10, Parts: stored},
+			expected: []int64{3},
+		},
+		{
+			name:     "recorded checksum differs",
+			session:  UploadSession{Size: 25, PartSize: 10, Parts: stored, Recorded: []UploadedPart{{2, 10, "b"}, {3, 5, "x"}}},
+			expected: []int64{3},
+		},
+		{
+			name:     "given checksums differ",
+			session:  UploadSession{Size: 25, PartSize: 10, Parts: stored},
+			sha1s:    []string{"a", "z", "c"},
+			expected: []int64{2},
+		},
+		{
+			name:     "too few checksums",
+			session:  UploadSession{Size: 25, PartSize: 10, Parts: stored},
+			sha1s:    []string{"a", "b"},
+			expected: []int64{3},
+		},
+		{
+			name:     "unknown size counts the checksums",
+			session:  UploadSession{Parts: stored[:2]},
+			sha1s:    []string{"a", "b", "c"},
+			expected: []int64{3},
+		},
+		{
+			name:     "unknown size counts the stored parts",
+			session:  UploadSession{Parts: []UploadedPart{stored[0], stored[2]}},
+			expected: []int64{2},
+		},
+		{
+			// S3 only knows the checksum of a part if the client sent it
+			name:     "checksum unknown to the storage",
+			session:  UploadSession{Size: 25, PartSize: 10, Parts: []UploadedPart{{1, 10, ""}, {2, 10, ""}, {3, 5, ""}}, Recorded: []UploadedPart{{1, 10, "a"}}},
+			sha1s:    []string{"x", "b", "c"},
+			expected: []int64{1},
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.session.invalidParts(tt.sha1s); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.expected)
+		}
+	}
+}
+
+func TestPartSha1Array(t *testing.T) {
+	session := UploadSession{Parts: []UploadedPart{{1, 10, "a"}, {2, 10, "b"}}}
+	if sha1s := session.partSha1Array(); sha1s != nil {
+		t.Errorf("got %v without a size", sha1s)
+	}
+
+	// recorded checksums take precedence over those of the storage
+	session = UploadSession{
+		Size:     25,
+		PartSize: 10,
+		Parts:    []UploadedPart{{1, 10, "a"}, {2, 10, "b"}, {4, 10, "d"}},
+		Recorded: []UploadedPart{{2, 10, "x"}, {3, 5, "c"}},
+	}
+	expected := []string{"a", "x", "c"}
+	if sha1s := session.partSha1Array(); !reflect.DeepEqual(sha1s, expected) {
+		t.Errorf("got %v, want %v", sha1s, expected)
+	}
+	if invalid := session.invalidParts(session.partSha1Array()); !reflect.DeepEqual(invalid, []int64{2, 3}) {
+		t.Errorf("invalid parts %v, want the changed part 2 and the missing part 3", invalid)
+	}
+}
@@ -0,0 +1,394 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"my.app/pkg/storage"
+)
+
+// errVersionConflict is returned when the current version of a media
+// document changed while a version was added or promoted
+var errVersionConflict = errors.New("server: the version of the media document changed")
+
+// MediaVersion is a file which was uploaded for a media document. The
+// current version is also stored in the file fields of the document.
+type MediaVersion struct {
+	Number          int       `bson:"number" json:"number"`
+	FileID          string    `bson:"b2fileId" json:"b2fileId"`
+	StorageFileName string    `bson:"b2fileName" json:"b2fileName"`
+	ContentType     string    `bson:"b2ContentType" json:"b2ContentType"`
+	Size            int64     `bson:"b2FileSize" json:"b2FileSize"`
+	ContentSha1     string    `bson:"contentSha1,omitempty" json:"contentSha1,omitempty"`
+	Filename        string    `bson:"filename,omitempty" json:"filename,omitempty"`
+	Uploader        string    `bson:"uploader,omitempty" json:"uploader,omitempty"`
+	DateCreated     time.Time `bson:"datecreated" json:"dateCreated"`
+}
+
+// MediaVersionList lists the versions of a media document in the order of their numbers
+type MediaVersionList struct {
+	Current  int            `json:"current"`
+	Versions []MediaVersion `json:"versions"`
+}
+
+// MediaVersionRequest attaches a file which the client uploaded to the
+// storage by itself as a new version
+type MediaVersionRequest struct {
+	FileID   string `json:"b2fileId"`
+	Filename string `json:"filename"`
+}
+
+// versionFolder returns the folder in the folder of a document, which holds
+// the files of a version uploaded through the API
+func versionFolder(number int) string {
+	return "v" + strconv.Itoa(number)
+}
+
+// currentVersion returns the number of the current version, which is 1 for
+// documents that were never versioned
+func (doc *MediaDocument) currentVersion() int {
+	if doc.Version < 1 {
+		return 1
+	}
+	return doc.Version
+}
+
+// versions returns the versions of a document. Documents which were never
+// versioned have their file as the first version.
+func (doc *MediaDocument) versions() []MediaVersion {
+	if len(doc.Versions) > 0 || doc.FileID == "" {
+		return doc.Versions
+	}
+	return []MediaVersion{{
+		Number:          1,
+		FileID:          doc.FileID,
+		StorageFileName: doc.StorageFileName,
+		ContentType:     doc.ContentType,
+		Size:            doc.Size,
+		ContentSha1:     doc.ContentSha1,
+		Filename:        doc.Filename,
+		Uploader:        doc.Owner,
+		DateCreated:     doc.DateCreated,
+	}}
+}
+
+// findVersion returns the version with the number of the path parameter
+// version, or nil
+func (doc *MediaDocument) findVersion(ctx echo.Context) *MediaVersion {
+	number, err := strconv.Atoi(ctx.Param("version"))
+	if err != nil {
+		return nil
+	}
+	versions := doc.versions()
+	for i := range versions {
+		if versions[i].Number == number {
+			return &versions[i]
+		}
+	}
+	return nil
+}
+
+// setCurrentVersion makes a version the current version of a document and
+// saves the versions. The results of the processing of the former version are
+// removed and the new version is processed in the background. It returns the
+// updated document. Once the document is updated, the version is saved, so
+// the failures of the cleanup and of the processing are only logged.
+func setCurrentVersion(ctx echo.Context, collection *mongo.Collection, doc *MediaDocument, versions []MediaVersion, current MediaVersion) (*MediaDocument, error) {
+	reqCtx := ctx.Request().Context()
+
+	// the version must not have changed in the meantime
+	filter := bson.M{"_id": doc.ID, "version": doc.Version}
+	if doc.Version == 0 {
+		filter["version"] = bson.M{"$exists": false}
+	}
+	set := bson.M{
+		"version":       current.Number,
+		"versions":      versions,
+		"b2fileId":      current.FileID,
+		"b2fileName":    current.StorageFileName,
+		"b2ContentType": current.ContentType,
+		"b2FileSize":    current.Size,
+		"type":          strings.SplitN(current.ContentType, "/", 2)[0],
+		"dateupdated":   time.Now(),
+	}
+	unset := bson.M{
+		"metadata":      "",
+		"renditions":    "",
+		"phash":         "",
+		"phashBands":    "",
+		"duplicateof":   "",
+		"dateprocessed": "",
+	}
+	if current.ContentSha1 != "" {
+		set["contentSha1"] = current.ContentSha1
+	} else {
+		unset["contentSha1"] = ""
+	}
+
+	updated := new(MediaDocument)
+	err := collection.FindOneAndUpdate(reqCtx, filter, bson.M{"$set": set, "$unset": unset},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(updated)
+	if err == mongo.ErrNoDocuments {
+		return nil, errVersionConflict
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the copies of the former content get another original
+	if err := promoteDuplicates(reqCtx, collection, doc); err != nil {
+		ctx.Logger().Error(err)
+	}
+	if err := removeRenditions(reqCtx, storage.Default(), doc); err != nil {
+		ctx.Logger().Error(err)
+	}
+	if _, err := reprocessMedia(reqCtx, current.FileID); err != nil {
+		ctx.Logger().Error(err)
+	}
+	return updated, nil
+}
+
+// versionError answers a request whose version could not be saved
+func versionError(ctx echo.Context, err error) error {
+	if err == errVersionConflict {
+		return ctx.JSON(http.StatusConflict, "The media document got another version at the same time, please try again.")
+	}
+	ctx.Logger().Error(err)
+	return ctx.JSON(http.StatusInternalServerError, "The version could not be saved.")
+}
+
+// ListMediaVersions returns the versions of a media document
+func ListMediaVersions(ctx echo.Context) error {
+
+	doc, err := findMediaDocument(ctx.Request().Context(), ctx.Param("id"))
+	if err != nil {
+		return mediaDocumentError(ctx, err)
+	}
+
+	allowed, err := canRead(ctx, doc)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The permissions could not be checked.")
+	}
+	if !allowed {
+		return ctx.JSON(http.StatusForbidden, "You are not allowed to read this media document.")
+	}
+
+	versions := doc.versions()
+	if versions == nil {
+		versions = []MediaVersion{}
+	}
+	return ctx.JSON(http.StatusOK, &MediaVersionList{Current: doc.currentVersion(), Versions: versions})
+}
+
+// DownloadMediaVersion sends the file of a version like DownloadMedia
+func DownloadMediaVersion(ctx echo.Context) error {
+
+	doc, err := findMediaDocument(ctx.Request().Context(), ctx.Param("id"))
+	if err != nil {
+		return mediaDocumentError(ctx, err)
+	}
+
+	allowed, err := canRead(ctx, doc)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The permissions could not be checked.")
+	}
+	if !allowed {
+		return ctx.JSON(http.StatusForbidden, "You are not allowed to download this file.")
+	}
+	version := doc.findVersion(ctx)
+	if version == nil {
+		return ctx.JSON(http.StatusNotFound, "The version does not exist.")
+	}
+
+	file := &storage.File{
+		FileID:        version.FileID,
+		FileName:      version.StorageFileName,
+		ContentLength: version.Size,
+		ContentType:   version.ContentType,
+	}
+	return sendFile(ctx, file, version.Filename)
+}
+
+// UploadMediaVersion adds a new version to a media document, which
+// administrators and the owner may. The new version becomes the current one,
+// the earlier files are kept.
+//
+// The file is sent like to UploadMedia, either as the "file" field of a
+// multipart form or as the raw request body with its name in the filename
+// query parameter. A file which the client uploaded to the storage by itself
+// is attached with a json body like MediaVersionRequest.
+func UploadMediaVersion(ctx echo.Context) error {
+
+	reqCtx := ctx.Request().Context()
+	doc, err := findMediaDocument(reqCtx, ctx.Param("id"))
+	if err != nil {
+		return mediaDocumentError(ctx, err)
+	}
+	if !canWrite(ctx, doc) {
+		return ctx.JSON(http.StatusForbidden, "You are not allowed to change this media document.")
+	}
+
+	collection, err := mediaCollection(reqCtx)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The version could not be saved.")
+	}
+
+	// Get the jwt token from context
+	user := ctx.Get("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+
+	versions := doc.versions()
+	version := MediaVersion{Number: 1, DateCreated: time.Now()}
+	if len(versions) > 0 {
+		version.Number = versions[len(versions)-1].Number + 1
+	}
+	version.Uploader, _ = claims["ID"].(string)
+
+	req := ctx.Request()
+	mediaType, params, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	var file *storage.File
+	uploaded := false
+
+	switch mediaType {
+	case "application/json":
+		attach := new(MediaVersionRequest)
+		if invalid := decodeStrict(ctx, attach); invalid != nil {
+			return ctx.JSON(http.StatusBadRequest, invalid)
+		}
+		fields := make(map[string]string)
+		if attach.FileID == "" {
+			fields["b2fileId"] = "The id of the stored file is required."
+			return ctx.JSON(http.StatusBadRequest, &ValidationError{Message: "The version is invalid.", Fields: fields})
+		}
+		file, err = storage.Default().GetFileInfo(reqCtx, attach.FileID)
+		if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrBadRequest) {
+			fields["b2fileId"] = "The file does not exist in the storage."
+			return ctx.JSON(http.StatusBadRequest, &ValidationError{Message: "The version is invalid.", Fields: fields})
+		}
+		if err != nil {
+			return storageError(ctx, err)
+		}
+
+		// a file belongs to a single media document
+		err = collection.FindOne(reqCtx, bson.M{"$or": bson.A{
+			bson.M{"b2fileId": file.FileID},
+			bson.M{"versions.b2fileId": file.FileID},
+		}}).Err()
+		if err == nil {
+			return ctx.JSON(http.StatusConflict, "A media document for this file exists already.")
+		}
+		if err != mongo.ErrNoDocuments {
+			ctx.Logger().Error(err)
+			return ctx.JSON(http.StatusInternalServerError, "The version could not be saved.")
+		}
+
+		version.Filename = strings.TrimSpace(attach.Filename)
+		if version.Filename == "" {
+			version.Filename = path.Base(file.FileName)
+		}
+		version.ContentSha1 = fileSha1(file)
+
+	case "multipart/form-data":
+		upload := &MediaDocument{ID: doc.ID}
+		form := multipart.NewReader(req.Body, params["boundary"])
+		for {
+			part, partErr := form.NextPart()
+			if partErr == io.EOF {
+				break
+			}
+			if partErr != nil {
+				if file != nil {
+					removeStoredFile(ctx, file)
+				}
+				return ctx.JSON(http.StatusBadRequest, "The multipart form could not be read.")
+			}
+			if part.FormName() == "file" && file == nil {
+				file, err = uploadMediaFile(reqCtx, upload, doc.ID.Hex()+"/"+versionFolder(version.Number), part.FileName(), part.Header.Get("Content-Type"), part)
+			}
+			part.Close()
+			if err != nil {
+				break
+			}
+		}
+		version.Filename, version.ContentSha1 = upload.Filename, upload.ContentSha1
+		uploaded = true
+
+	default:
+		upload := &MediaDocument{ID: doc.ID}
+		file, err = uploadMediaFile(reqCtx, upload, doc.ID.Hex()+"/"+versionFolder(version.Number), ctx.QueryParam("filename"), req.Header.Get("Content-Type"), req.Body)
+		version.Filename, version.ContentSha1 = upload.Filename, upload.ContentSha1
+		uploaded = true
+	}
+
+	if err != nil {
+		if file != nil {
+			removeStoredFile(ctx, file)
+		}
+		return uploadError(ctx, err)
+	}
+	if file == nil {
+		return ctx.JSON(http.StatusBadRequest, "A file is required.")
+	}
+	version.FileID = file.FileID
+	version.StorageFileName = file.FileName
+	version.ContentType = file.ContentType
+	version.Size = file.ContentLength
+
+	updated, err := setCurrentVersion(ctx, collection, doc, append(versions, version), version)
+	if err != nil {
+		if uploaded {
+			removeStoredFile(ctx, file)
+		}
+		return versionError(ctx, err)
+	}
+
+	return ctx.JSON(http.StatusCreated, updated)
+}
+
+// PromoteMediaVersion makes an earlier version the current version of a media
+// document again, which administrators and the owner may
+func PromoteMediaVersion(ctx echo.Context) error {
+
+	reqCtx := ctx.Request().Context()
+	doc, err := findMediaDocument(reqCtx, ctx.Param("id"))
+	if err != nil {
+		return mediaDocumentError(ctx, err)
+	}
+	if !canWrite(ctx, doc) {
+		return ctx.JSON(http.StatusForbidden, "You are not allowed to change this media document.")
+	}
+	version := doc.findVersion(ctx)
+	if version == nil {
+		return ctx.JSON(http.StatusNotFound, "The version does not exist.")
+	}
+	if version.Number == doc.currentVersion() {
+		return ctx.JSON(http.StatusOK, doc)
+	}
+
+	collection, err := mediaCollection(reqCtx)
+	if err != nil {
+		ctx.Logger().Error(err)
+		return ctx.JSON(http.StatusInternalServerError, "The version could not be saved.")
+	}
+	updated, err := setCurrentVersion(ctx, collection, doc, doc.versions(), *version)
+	if err != nil {
+		return versionError(ctx, err)
+	}
+
+	return ctx.JSON(http.StatusOK, updated)
+}
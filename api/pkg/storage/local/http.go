@@ -0,0 +1,198 @@
+package local
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"my.app/pkg/storage"
+)
+
+const (
+	uploadPath     = "/storage/upload"
+	uploadPartPath = "/storage/upload_part/"
+	downloadPath   = "/storage/download/"
+)
+
+// Register adds the routes which serve the upload and download urls of the backend.
+// The routes authorize requests by themselves and must not be placed behind
+// the csrf or jwt middleware of the API.
+func (s *Storage) Register(e *echo.Echo) {
+	e.POST(uploadPath, s.uploadFile)
+	e.POST(uploadPartPath+":fileId", s.uploadPart)
+	e.GET(downloadPath+":fileId", s.downloadFile)
+}
+
+// errorResponse is the error format of the B2 API
+type errorResponse struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func apiError(ctx echo.Context, status int, code string, message string) error {
+	return ctx.JSON(status, &errorResponse{Status: status, Code: code, Message: message})
+}
+
+// uploadFileResponse is the response of a single file upload, as returned by b2_upload_file
+type uploadFileResponse struct {
+	storage.File
+	Action   string `json:"action"`
+	BucketID string `json:"bucketId"`
+}
+
+// uploadFile receives a single file, like b2_upload_file
+func (s *Storage) uploadFile(ctx echo.Context) error {
+
+	req := ctx.Request()
+	if !s.checkToken(req.Header.Get("Authorization"), "") {
+		return apiError(ctx, http.StatusUnauthorized, "bad_auth_token", "Invalid authorization token")
+	}
+
+	fileName, err := url.PathUnescape(req.Header.Get("X-Bz-File-Name"))
+	if err != nil || fileName == "" {
+		return apiError(ctx, http.StatusBadRequest, "bad_request", "Invalid X-Bz-File-Name header")
+	}
+
+	fileInfo := make(map[string]string)
+	for name := range req.Header {
+		if strings.HasPrefix(name, "X-Bz-Info-") {
+			value, _ := url.PathUnescape(req.Header.Get(name))
+			fileInfo[strings.ToLower(strings.TrimPrefix(name, "X-Bz-Info-"))] = value
+		}
+	}
+
+	path, size, sha1, err := s.receive(req.Body)
+	if err != nil {
+		return apiError(ctx, http.StatusInternalServerError, "internal_error", "Could not store the file")
+	}
+	defer os.Remove(path)
+
+	if status, code, message := checkContent(req, size, sha1); status != 0 {
+		return apiError(ctx, status, code, message)
+	}
+
+	file, err := s.addFile(path, storage.File{
+		FileName:      fileName,
+		ContentLength: size,
+		ContentType:   req.Header.Get("Content-Type"),
+		ContentSha1:   sha1,
+		FileInfo:      fileInfo,
+	})
+	if err != nil {
+		return apiError(ctx, http.StatusInternalServerError, "internal_error", "Could not store the file")
+	}
+
+	return ctx.JSON(http.StatusOK, &uploadFileResponse{File: *file, Action: "upload", BucketID: bucketID})
+}
+
+// uploadPartResponse is the response of a part upload, as returned by b2_upload_part
+type uploadPartResponse struct {
+	storage.Part
+	UploadTimestamp int64 `json:"uploadTimestamp"`
+}
+
+// uploadPart receives a single part of a large file, like b2_upload_part
+func (s *Storage) uploadPart(ctx echo.Context) error {
+
+	req := ctx.Request()
+	fileID := ctx.Param("fileId")
+	if !s.checkToken(req.Header.Get("Authorization"), fileID) {
+		return apiError(ctx, http.StatusUnauthorized, "bad_auth_token", "Invalid authorization token")
+	}
+	if _, err := s.largeFileInfo(fileID); err != nil {
+		return apiError(ctx, http.StatusBadRequest, "bad_request", "No active large file with this id")
+	}
+
+	partNumber, err := strconv.ParseInt(req.Header.Get("X-Bz-Part-Number"), 10, 64)
+	if err != nil || partNumber < 1 || partNumber > maxPartNumber {
+		return apiError(ctx, http.StatusBadRequest, "bad_request", "Invalid X-Bz-Part-Number header")
+	}
+
+	path, size, sha1, err := s.receive(req.Body)
+	if err != nil {
+		return apiError(ctx, http.StatusInternalServerError, "internal_error", "Could not store the part")
+	}
+	defer os.Remove(path)
+
+	if status, code, message := checkContent(req, size, sha1); status != 0 {
+		return apiError(ctx, status, code, message)
+	}
+
+	part, err := s.addPart(path, fileID, partNumber, size, sha1)
+	if err != nil {
+		return apiError(ctx, http.StatusInternalServerError, "internal_error", "Could not store the part")
+	}
+
+	return ctx.JSON(http.StatusOK, &uploadPartResponse{Part: *part, UploadTimestamp: timestamp(time.Now())})
+}
+
+// checkContent compares the received content with the length and checksum
+// announced in the request headers. It returns a zero status if they match.
+func checkContent(req *http.Request, size int64, sha1 string) (int, string, string) {
+	if req.ContentLength >= 0 && req.ContentLength != size {
+		return http.StatusBadRequest, "bad_request", "Content-Length does not match the received content"
+	}
+	expected := req.Header.Get("X-Bz-Content-Sha1")
+	if expected == "" {
+		return http.StatusBadRequest, "bad_request", "Missing X-Bz-Content-Sha1 header"
+	}
+	if expected != "do_not_verify" && !strings.EqualFold(expected, sha1) {
+		return http.StatusBadRequest, "bad_request", "Checksum did not match data received"
+	}
+	return 0, "", ""
+}
+
+// DownloadURL returns a signed url which allows to download a file for the given duration
+func (s *Storage) DownloadURL(ctx context.Context, file *storage.File, validFor time.Duration) (string, error) {
+	exp := strconv.FormatInt(time.Now().Add(validFor).Unix(), 10)
+	return s.baseURL + downloadPath + file.FileID + "?expires=" + exp + "&signature=" + s.sign(file.FileID, exp), nil
+}
+
+// sign creates the signature of a download url
+func (s *Storage) sign(fileID string, expires string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(fileID + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// downloadFile serves a file for a signed download url. Range requests are supported.
+func (s *Storage) downloadFile(ctx echo.Context) error {
+
+	fileID := ctx.Param("fileId")
+	expires := ctx.QueryParam("expires")
+	signature := ctx.QueryParam("signature")
+
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > exp || !hmac.Equal([]byte(signature), []byte(s.sign(fileID, expires))) {
+		return apiError(ctx, http.StatusUnauthorized, "unauthorized", "Invalid or expired download url")
+	}
+
+	file, err := s.fileInfo(fileID)
+	if err != nil {
+		return apiError(ctx, http.StatusNotFound, "not_found", "File not present")
+	}
+	f, err := os.Open(s.filePath(fileID))
+	if err != nil {
+		return apiError(ctx, http.StatusNotFound, "not_found", "File not present")
+	}
+	defer f.Close()
+
+	header := ctx.Response().Header()
+	header.Set("Content-Type", file.ContentType)
+	header.Set("X-Bz-File-Id", file.FileID)
+	header.Set("X-Bz-File-Name", url.PathEscape(file.FileName))
+	header.Set("X-Bz-Content-Sha1", file.ContentSha1)
+	header.Set("X-Bz-Upload-Timestamp", strconv.FormatInt(file.UploadTimestamp, 10))
+	modified := time.Unix(0, file.UploadTimestamp*int64(time.Millisecond))
+	http.ServeContent(ctx.Response(), ctx.Request(), file.FileName, modified, f)
+	return nil
+}
@@ -0,0 +1,729 @@
+// Package local implements a storage backend which keeps the media files in a
+// directory on the local filesystem. It is meant for offline development and
+// on-prem installations without a cloud account.
+//
+// The upload and download urls handed out by the backend are served by the
+// API process itself (see Register) and behave like their B2 counterparts,
+// so clients written against the B2 upload flow work unchanged.
+package local
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"my.app/pkg/storage"
+)
+
+const (
+	// bucketID is reported as bucket of all files, since there is only one directory
+	bucketID = "local"
+
+	// tokenLifetime is the time an upload authorization token stays valid
+	tokenLifetime = 24 * time.Hour
+
+	defaultMaxFileCount = 100
+	maxFileCount        = 10000
+	defaultMaxPartCount = 100
+	maxPartCount        = 1000
+	maxPartNumber       = 10000
+)
+
+var fileIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// Storage is the storage backend for the local filesystem
+type Storage struct {
+	dir     string
+	baseURL string
+	secret  []byte
+
+	mu     sync.Mutex
+	tokens map[string]uploadToken
+}
+
+// uploadToken authorizes uploads to the storage.
+// Tokens for large files are only valid for the parts of a single file.
+type uploadToken struct {
+	fileID  string
+	expires time.Time
+}
+
+// New creates a local storage backend which keeps the files in dir.
+// baseURL is the url under which clients reach the routes added by Register,
+// secret is the key to sign download urls. If secret is empty, a random key
+// is used and download urls become invalid when the process restarts.
+func New(dir string, baseURL string, secret []byte) (*Storage, error) {
+	for _, d := range []string{"files", "large", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return nil, err
+		}
+	}
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+	}
+	return &Storage{
+		dir:     dir,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		secret:  secret,
+		tokens:  make(map[string]uploadToken),
+	}, nil
+}
+
+// NewFromEnv creates a local storage backend configured by the
+// LOCAL_STORAGE_DIR, LOCAL_STORAGE_URL and LOCAL_STORAGE_SECRET environment variables
+func NewFromEnv() (*Storage, error) {
+	dir := os.Getenv("LOCAL_STORAGE_DIR")
+	if dir == "" {
+		dir = "data"
+	}
+	baseURL := os.Getenv("LOCAL_STORAGE_URL")
+	if baseURL == "" {
+		baseURL = "http://localhost:5000"
+	}
+	return New(dir, baseURL, []byte(os.Getenv("LOCAL_STORAGE_SECRET")))
+}
+
+// Authorize checks that the storage directory is accessible
+func (s *Storage) Authorize(ctx context.Context) error {
+	_, err := os.Stat(filepath.Join(s.dir, "files"))
+	return err
+}
+
+// ListFiles lists the latest version of every file in the storage
+func (s *Storage) ListFiles(ctx context.Context, req storage.ListFilesRequest) (*storage.FileList, error) {
+
+	count := req.MaxFileCount
+	if count <= 0 {
+		count = defaultMaxFileCount
+	}
+	if count > maxFileCount {
+		count = maxFileCount
+	}
+
+	files, err := s.latestFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	// files are listed in the order of their names, starting at StartFileName.
+	// Files inside a folder are replaced by a single entry for the folder.
+	list := &storage.FileList{Files: []storage.File{}}
+	entries := 0
+	for _, file := range files {
+		if !strings.HasPrefix(file.FileName, req.Prefix) {
+			continue
+		}
+		name := file.FileName
+		folder, inFolder := req.Folder(name)
+		if inFolder {
+			if n := len(list.Folders); n > 0 && list.Folders[n-1] == folder {
+				continue
+			}
+			name = folder
+		}
+		if name < req.StartFileName {
+			continue
+		}
+		if entries == count {
+			list.NextFileName = name
+			break
+		}
+		entries++
+		if inFolder {
+			list.Folders = append(list.Folders, folder)
+		} else {
+			list.Files = append(list.Files, file)
+		}
+	}
+	return list, nil
+}
+
+// latestFiles reads the latest version of every file sorted by the file name
+func (s *Storage) latestFiles() ([]storage.File, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(s.dir, "files"))
+	if err != nil {
+		return nil, err
+	}
+
+	latest := make(map[string]storage.File)
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		file, err := s.readFileInfo(filepath.Join(s.dir, "files", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := latest[file.FileName]; ok && other.UploadTimestamp > file.UploadTimestamp {
+			continue
+		}
+		latest[file.FileName] = *file
+	}
+
+	files := make([]storage.File, 0, len(latest))
+	for _, file := range latest {
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].FileName < files[j].FileName
+	})
+	return files, nil
+}
+
+// GetUploadURL returns the url to upload a single file to this backend
+func (s *Storage) GetUploadURL(ctx context.Context, fileName string) (*storage.UploadURL, error) {
+	token, err := s.newToken("")
+	if err != nil {
+		return nil, err
+	}
+	return &storage.UploadURL{
+		BucketID:           bucketID,
+		UploadURL:          s.baseURL + uploadPath,
+		AuthorizationToken: token,
+	}, nil
+}
+
+// UploadFile stores a single file which is uploaded through the API
+func (s *Storage) UploadFile(ctx context.Context, req storage.UploadFileRequest, body io.ReadSeeker) (*storage.File, error) {
+
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	path, size, sha1, err := s.receive(body)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(path)
+
+	if err := verify(req.ContentLength, req.ContentSha1, size, sha1); err != nil {
+		return nil, err
+	}
+
+	return s.addFile(path, storage.File{
+		FileName:      req.FileName,
+		ContentLength: size,
+		ContentType:   req.ContentType,
+		ContentSha1:   sha1,
+		FileInfo:      req.FileInfo,
+	})
+}
+
+// addFile moves a received file into the storage. The file gets a new id and
+// upload timestamp, the content type is derived from the name if it is missing.
+func (s *Storage) addFile(path string, file storage.File) (*storage.File, error) {
+	fileID, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	file.FileID = fileID
+	file.UploadTimestamp = timestamp(time.Now())
+	if file.ContentType == "" || file.ContentType == "b2/x-auto" {
+		file.ContentType = mime.TypeByExtension(filepath.Ext(file.FileName))
+		if file.ContentType == "" {
+			file.ContentType = "application/octet-stream"
+		}
+	}
+
+	if err := s.store(path, &file); err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// StartLargeFile prepares the upload of a large file in multiple parts
+func (s *Storage) StartLargeFile(ctx context.Context, fileName string, contentType string, fileInfo map[string]string) (*storage.File, error) {
+
+	fileID, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	file := &storage.File{
+		FileID:          fileID,
+		FileName:        fileName,
+		ContentType:     contentType,
+		ContentSha1:     "none",
+		FileInfo:        fileInfo,
+		UploadTimestamp: timestamp(time.Now()),
+	}
+
+	if err := os.Mkdir(s.largeFileDir(fileID), 0755); err != nil {
+		return nil, err
+	}
+	if err := s.writeJSON(filepath.Join(s.largeFileDir(fileID), "info.json"), file); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// GetUploadPartURL returns the url to upload the parts of a large file to this backend
+func (s *Storage) GetUploadPartURL(ctx context.Context, fileID string, partNumber int64) (*storage.UploadPartURL, error) {
+
+	if _, err := s.largeFileInfo(fileID); err != nil {
+		return nil, err
+	}
+
+	token, err := s.newToken(fileID)
+	if err != nil {
+		return nil, err
+	}
+	return &storage.UploadPartURL{
+		FileID:             fileID,
+		UploadURL:          s.baseURL + uploadPartPath + fileID,
+		AuthorizationToken: token,
+	}, nil
+}
+
+// UploadPart stores a part of a large file which is uploaded through the API
+func (s *Storage) UploadPart(ctx context.Context, fileID string, partNumber int64, contentLength int64, contentSha1 string, body io.ReadSeeker) (*storage.Part, error) {
+
+	if _, err := s.largeFileInfo(fileID); err != nil {
+		return nil, err
+	}
+	if partNumber < 1 || partNumber > maxPartNumber {
+		return nil, fmt.Errorf("local: invalid part number %d: %w", partNumber, storage.ErrBadRequest)
+	}
+
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	path, size, sha1, err := s.receive(body)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(path)
+
+	if err := verify(contentLength, contentSha1, size, sha1); err != nil {
+		return nil, err
+	}
+	return s.addPart(path, fileID, partNumber, size, sha1)
+}
+
+// addPart moves a received part into the directory of its large file
+func (s *Storage) addPart(path string, fileID string, partNumber int64, size int64, sha1 string) (*storage.Part, error) {
+	part := &storage.Part{
+		FileID:        fileID,
+		PartNumber:    partNumber,
+		ContentLength: size,
+		ContentSha1:   sha1,
+	}
+	if err := os.Rename(path, s.partPath(fileID, partNumber)); err != nil {
+		return nil, err
+	}
+	if err := s.writeJSON(s.partPath(fileID, partNumber)+".json", part); err != nil {
+		return nil, err
+	}
+	return part, nil
+}
+
+// verify compares received content with the expected length and SHA1 checksum
+func verify(expectedLength int64, expectedSha1 string, size int64, sha1 string) error {
+	if expectedLength != size {
+		return fmt.Errorf("local: received %d bytes instead of %d: %w", size, expectedLength, storage.ErrBadRequest)
+	}
+	if !strings.EqualFold(expectedSha1, sha1) {
+		return fmt.Errorf("local: checksum does not match the received content: %w", storage.ErrBadRequest)
+	}
+	return nil
+}
+
+// FinishLargeFile assembles the uploaded parts of a large file into a single file
+func (s *Storage) FinishLargeFile(ctx context.Context, fileID string, partSha1Array []string) (*storage.File, error) {
+
+	file, err := s.largeFileInfo(fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	parts, err := s.parts(fileID)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 0 || len(parts) != len(partSha1Array) {
+		return nil, fmt.Errorf("local: %d parts uploaded but %d checksums given: %w", len(parts), len(partSha1Array), storage.ErrBadRequest)
+	}
+	for i, part := range parts {
+		if part.PartNumber != int64(i+1) {
+			return nil, fmt.Errorf("local: part %d is missing: %w", i+1, storage.ErrBadRequest)
+		}
+		if part.ContentSha1 != partSha1Array[i] {
+			return nil, fmt.Errorf("local: checksum of part %d does not match: %w", part.PartNumber, storage.ErrBadRequest)
+		}
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Join(s.dir, "tmp"), fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha1.New()
+	for _, part := range parts {
+		if err := appendFile(io.MultiWriter(tmp, hash), s.partPath(fileID, part.PartNumber)); err != nil {
+			tmp.Close()
+			return nil, err
+		}
+		file.ContentLength += part.ContentLength
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	// the checksum of the whole file is known if the uploader added it
+	sha1 := hex.EncodeToString(hash.Sum(nil))
+	if sum := file.FileInfo[storage.LargeFileSha1]; sum != "" && sum != sha1 {
+		return nil, fmt.Errorf("local: checksum of the file does not match %s: %w", storage.LargeFileSha1, storage.ErrBadRequest)
+	}
+	file.ContentSha1 = sha1
+
+	if err := s.store(tmp.Name(), file); err != nil {
+		return nil, err
+	}
+	if err := os.RemoveAll(s.largeFileDir(fileID)); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func appendFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// CancelLargeFile removes a large file which has not been finished and its parts
+func (s *Storage) CancelLargeFile(ctx context.Context, fileID string) error {
+
+	if _, err := s.largeFileInfo(fileID); err != nil {
+		return err
+	}
+	return os.RemoveAll(s.largeFileDir(fileID))
+}
+
+// ListParts lists the uploaded parts of a large file
+func (s *Storage) ListParts(ctx context.Context, fileID string, startPartNumber int64, maxCount int) (*storage.PartList, error) {
+
+	if _, err := s.largeFileInfo(fileID); err != nil {
+		return nil, err
+	}
+	if maxCount <= 0 {
+		maxCount = defaultMaxPartCount
+	}
+	if maxCount > maxPartCount {
+		maxCount = maxPartCount
+	}
+
+	parts, err := s.parts(fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	start := sort.Search(len(parts), func(i int) bool {
+		return parts[i].PartNumber >= startPartNumber
+	})
+	parts = parts[start:]
+
+	list := &storage.PartList{Parts: parts}
+	if len(parts) > maxCount {
+		list.Parts = parts[:maxCount]
+		list.NextPartNumber = parts[maxCount].PartNumber
+	}
+	return list, nil
+}
+
+// ListUnfinishedLargeFiles lists the large files which have not been finished, ordered by their id
+func (s *Storage) ListUnfinishedLargeFiles(ctx context.Context, startFileID string, maxCount int) (*storage.UnfinishedFileList, error) {
+
+	count := maxCount
+	if count <= 0 {
+		count = defaultMaxFileCount
+	}
+	if count > maxFileCount {
+		count = maxFileCount
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(s.dir, "large"))
+	if err != nil {
+		return nil, err
+	}
+
+	// ReadDir sorts the entries by name, which is the file id
+	list := &storage.UnfinishedFileList{Files: []storage.File{}}
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() < startFileID {
+			continue
+		}
+		if len(list.Files) == count {
+			list.NextFileID = entry.Name()
+			break
+		}
+		// a large file which is being started or canceled has no information
+		file, err := s.largeFileInfo(entry.Name())
+		if err == storage.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		list.Files = append(list.Files, *file)
+	}
+	return list, nil
+}
+
+// parts reads the uploaded parts of a large file sorted by the part number
+func (s *Storage) parts(fileID string) ([]storage.Part, error) {
+	entries, err := ioutil.ReadDir(s.largeFileDir(fileID))
+	if err != nil {
+		return nil, err
+	}
+
+	parts := []storage.Part{}
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".json" || entry.Name() == "info.json" {
+			continue
+		}
+		part := storage.Part{}
+		if err := s.readJSON(filepath.Join(s.largeFileDir(fileID), entry.Name()), &part); err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].PartNumber < parts[j].PartNumber
+	})
+	return parts, nil
+}
+
+// Download opens a file in the storage
+func (s *Storage) Download(ctx context.Context, fileID string) (io.ReadCloser, *storage.File, error) {
+	return s.DownloadRange(ctx, fileID, 0, -1)
+}
+
+// DownloadRange opens a file in the storage and reads a part of it
+func (s *Storage) DownloadRange(ctx context.Context, fileID string, offset int64, length int64) (io.ReadCloser, *storage.File, error) {
+
+	file, err := s.fileInfo(fileID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.Open(s.filePath(fileID))
+	if os.IsNotExist(err) {
+		return nil, nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if offset == 0 && length < 0 {
+		return f, file, nil
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if length < 0 {
+		length = file.ContentLength - offset
+	}
+	return &limitedFile{Reader: io.LimitReader(f, length), Closer: f}, file, nil
+}
+
+// limitedFile reads a part of a file
+type limitedFile struct {
+	io.Reader
+	io.Closer
+}
+
+// GetFileInfo reads the information of a file in the storage
+func (s *Storage) GetFileInfo(ctx context.Context, fileID string) (*storage.File, error) {
+	return s.fileInfo(fileID)
+}
+
+// Delete removes a file from the storage
+func (s *Storage) Delete(ctx context.Context, fileName string, fileID string) error {
+
+	file, err := s.fileInfo(fileID)
+	if err != nil {
+		return err
+	}
+	if file.FileName != fileName {
+		return storage.ErrNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Remove(s.filePath(fileID) + ".json"); err != nil {
+		return err
+	}
+	return os.Remove(s.filePath(fileID))
+}
+
+// store moves an uploaded file into the storage and writes its information
+func (s *Storage) store(path string, file *storage.File) error {
+	if err := os.Rename(path, s.filePath(file.FileID)); err != nil {
+		return err
+	}
+	return s.writeJSON(s.filePath(file.FileID)+".json", file)
+}
+
+func (s *Storage) filePath(fileID string) string {
+	return filepath.Join(s.dir, "files", fileID)
+}
+
+func (s *Storage) largeFileDir(fileID string) string {
+	return filepath.Join(s.dir, "large", fileID)
+}
+
+func (s *Storage) partPath(fileID string, partNumber int64) string {
+	return filepath.Join(s.largeFileDir(fileID), strconv.FormatInt(partNumber, 10))
+}
+
+// fileInfo reads the information of a stored file
+func (s *Storage) fileInfo(fileID string) (*storage.File, error) {
+	if !fileIDPattern.MatchString(fileID) {
+		return nil, storage.ErrNotFound
+	}
+	return s.readFileInfo(s.filePath(fileID) + ".json")
+}
+
+// largeFileInfo reads the information of a large file which has not been finished yet
+func (s *Storage) largeFileInfo(fileID string) (*storage.File, error) {
+	if !fileIDPattern.MatchString(fileID) {
+		return nil, storage.ErrNotFound
+	}
+	return s.readFileInfo(filepath.Join(s.largeFileDir(fileID), "info.json"))
+}
+
+func (s *Storage) readFileInfo(path string) (*storage.File, error) {
+	file := new(storage.File)
+	if err := s.readJSON(path, file); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (s *Storage) readJSON(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return storage.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeJSON atomically replaces the file at path with the json encoding of v
+func (s *Storage) writeJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Join(s.dir, "tmp"), "info")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// newToken creates an upload authorization token.
+// If fileID is set, the token is only valid to upload parts of this large file.
+func (s *Storage) newToken(fileID string) (string, error) {
+	token, err := newID()
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for t, ut := range s.tokens {
+		if now.After(ut.expires) {
+			delete(s.tokens, t)
+		}
+	}
+	s.tokens[token] = uploadToken{fileID: fileID, expires: now.Add(tokenLifetime)}
+	return token, nil
+}
+
+// checkToken checks whether the token allows uploads of the given large file,
+// or of single files if fileID is empty
+func (s *Storage) checkToken(token string, fileID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ut, ok := s.tokens[token]
+	return ok && ut.fileID == fileID && time.Now().Before(ut.expires)
+}
+
+// newID creates a random id for files and tokens
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// timestamp converts t into milliseconds since the epoch, like B2 does
+func timestamp(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// receive writes the content of r into a temporary file and returns its path,
+// size and SHA1 checksum. The caller has to remove the file.
+func (s *Storage) receive(r io.Reader) (string, int64, string, error) {
+	tmp, err := ioutil.TempFile(filepath.Join(s.dir, "tmp"), "upload")
+	if err != nil {
+		return "", 0, "", err
+	}
+
+	hash := sha1.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", 0, "", err
+	}
+	return tmp.Name(), size, hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,128 @@
+package local_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"my.app/pkg/storage"
+	"my.app/pkg/storage/local"
+)
+
+var _ storage.Storage = (*local.Storage)(nil)
+
+func newBackend(t *testing.T) *local.Storage {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	backend, err := local.New(dir, "http://localhost:5000", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend
+}
+
+func sha1Hex(data []byte) string {
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestUploadFile(t *testing.T) {
+	backend := newBackend(t)
+	ctx := context.Background()
+	data := []byte("hello world")
+
+	file, err := backend.UploadFile(ctx, storage.UploadFileRequest{
+		FileName:      "hello.txt",
+		ContentLength: int64(len(data)),
+		ContentSha1:   sha1Hex(data),
+	}, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.ContentSha1 != sha1Hex(data) || file.ContentType != "text/plain; charset=utf-8" {
+		t.Errorf("unexpected file %+v", file)
+	}
+
+	_, err = backend.UploadFile(ctx, storage.UploadFileRequest{
+		FileName:      "hello.txt",
+		ContentLength: int64(len(data)),
+		ContentSha1:   sha1Hex([]byte("other")),
+	}, bytes.NewReader(data))
+	if !errors.Is(err, storage.ErrBadRequest) {
+		t.Errorf("upload with a wrong checksum: got %v, want a bad request", err)
+	}
+}
+
+func TestFinishLargeFile(t *testing.T) {
+	parts := [][]byte{[]byte("first part, "), []byte("second part, "), []byte("third part")}
+	whole := bytes.Join(parts, nil)
+	sha1s := []string{sha1Hex(parts[0]), sha1Hex(parts[1]), sha1Hex(parts[2])}
+
+	tests := []struct {
+		name          string
+		largeFileSha1 string
+		uploaded      []int
+		partSha1Array []string
+	}{
+		{"fewer checksums than parts", "", []int{1, 2, 3}, sha1s[:2]},
+		{"missing part", "", []int{1, 3}, []string{sha1s[0], sha1s[2]}},
+		{"wrong part checksum", "", []int{1, 2, 3}, []string{sha1s[0], sha1s[2], sha1s[1]}},
+		{"wrong file checksum", sha1Hex(parts[0]), []int{1, 2, 3}, sha1s},
+	}
+	for _, tt := range tests {
+		backend := newBackend(t)
+		ctx := context.Background()
+		file, err := backend.StartLargeFile(ctx, "large.bin", "", map[string]string{storage.LargeFileSha1: tt.largeFileSha1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range tt.uploaded {
+			data := parts[n-1]
+			if _, err := backend.UploadPart(ctx, file.FileID, int64(n), int64(len(data)), sha1Hex(data), bytes.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := backend.FinishLargeFile(ctx, file.FileID, tt.partSha1Array); !errors.Is(err, storage.ErrBadRequest) {
+			t.Errorf("%s: got %v, want a bad request", tt.name, err)
+		}
+	}
+
+	backend := newBackend(t)
+	ctx := context.Background()
+	file, err := backend.StartLargeFile(ctx, "large.bin", "", map[string]string{storage.LargeFileSha1: sha1Hex(whole)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, data := range parts {
+		if _, err := backend.UploadPart(ctx, file.FileID, int64(i+1), int64(len(data)), sha1s[i], bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	finished, err := backend.FinishLargeFile(ctx, file.FileID, sha1s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the checksum of the whole file was computed while the parts were assembled
+	if finished.ContentLength != int64(len(whole)) || finished.ContentSha1 != sha1Hex(whole) {
+		t.Errorf("unexpected finished file %+v", finished)
+	}
+
+	body, _, err := backend.Download(ctx, finished.FileID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadAll(body)
+	body.Close()
+	if !bytes.Equal(content, whole) {
+		t.Errorf("downloaded %q, want %q", content, whole)
+	}
+}
@@ -0,0 +1,98 @@
+package s3
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"my.app/pkg/storage"
+)
+
+const (
+	// maxRetries is the number of times a failed request is retried
+	maxRetries = 5
+
+	// minBackoff and maxBackoff limit the wait before a retry, which doubles
+	// with every attempt unless S3 sends a Retry-After header
+	minBackoff = 1 * time.Second
+	maxBackoff = 64 * time.Second
+)
+
+// Error is an error returned by S3
+type Error struct {
+	// Method and Key identify the request which failed
+	Method string `xml:"-"`
+	Key    string `xml:"-"`
+
+	Status  int    `xml:"-"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("s3: %s %s failed: %d %s: %s", e.Method, e.Key, e.Status, e.Code, e.Message)
+}
+
+// Is maps the error to the errors of the storage package
+func (e *Error) Is(target error) bool {
+	switch target {
+	case storage.ErrNotFound:
+		return e.notFound()
+	case storage.ErrBadRequest:
+		return (e.Status == http.StatusBadRequest || e.Status == http.StatusForbidden) && !e.notFound() && !e.retryable()
+	case storage.ErrUnavailable:
+		return e.retryable()
+	}
+	return false
+}
+
+func (e *Error) notFound() bool {
+	return e.Status == http.StatusNotFound || e.Code == "NoSuchKey" || e.Code == "NoSuchUpload"
+}
+
+// retryable reports whether the request should be retried. S3 asks clients
+// to slow down with a 503 SlowDown, some compatible services with a 429.
+func (e *Error) retryable() bool {
+	switch e.Status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusServiceUnavailable:
+		return true
+	}
+	return e.Code == "SlowDown" || e.Code == "RequestTimeout" || e.Code == "InternalError"
+}
+
+// parseError reads the error from a failed response. Responses without an
+// error document, like those of HEAD requests, get the code from the HTTP status.
+func parseError(method string, key string, resp *http.Response) *Error {
+	apiErr := &Error{}
+	xml.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(apiErr)
+
+	apiErr.Method = method
+	apiErr.Key = key
+	apiErr.Status = resp.StatusCode
+	if apiErr.Code == "" {
+		apiErr.Code = "HTTPError"
+	}
+	if apiErr.Message == "" {
+		apiErr.Message = resp.Status
+	}
+	return apiErr
+}
+
+// retryDelay returns how long to wait before the retry after the given attempt.
+// The delay requested with Retry-After takes precedence over the backoff.
+func retryDelay(header http.Header, attempt int) time.Duration {
+	if seconds, err := strconv.Atoi(header.Get("Retry-After")); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	backoff := maxBackoff
+	if attempt < 6 {
+		backoff = minBackoff << uint(attempt)
+	}
+	// add up to a second of jitter so that clients do not retry in lockstep
+	return backoff + time.Duration(rand.Int63n(int64(time.Second)))
+}
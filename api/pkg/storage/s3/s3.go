@@ -0,0 +1,748 @@
+// Package s3 implements a storage backend for S3 compatible object storages
+// like AWS S3, MinIO or Wasabi. Requests are signed with Signature Version 4.
+//
+// Files are identified by their object key. Large files are mapped onto S3
+// multipart uploads, their file id encodes the upload id and the object key.
+// Clients upload single files and parts with a PUT request to the presigned
+// urls returned by GetUploadURL and GetUploadPartURL.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"my.app/pkg/storage"
+)
+
+const (
+	// presignLifetime is the time a presigned upload url stays valid
+	presignLifetime = 24 * time.Hour
+
+	defaultMaxFileCount = 100
+	maxFileCount        = 1000
+	maxPartCount        = 1000
+)
+
+// Config defines the connection to an S3 bucket
+type Config struct {
+	// Endpoint is the url of the S3 service, e.g. https://s3.eu-central-1.amazonaws.com
+	// or http://localhost:9000 for a local MinIO
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// PathStyle addresses the bucket in the path instead of the host name.
+	// This is needed for MinIO and most other S3 compatible services.
+	PathStyle bool
+}
+
+// Storage is the storage backend for S3 compatible object storages
+type Storage struct {
+	endpoint  *url.URL
+	bucket    string
+	pathStyle bool
+	signer    *signer
+	client    *http.Client
+}
+
+// New creates an S3 storage backend
+func New(config Config) (*Storage, error) {
+	endpoint, err := url.Parse(strings.TrimSuffix(config.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("s3: invalid endpoint %q", config.Endpoint)
+	}
+	if config.Bucket == "" {
+		return nil, errors.New("s3: no bucket configured")
+	}
+	region := config.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &Storage{
+		endpoint:  endpoint,
+		bucket:    config.Bucket,
+		pathStyle: config.PathStyle,
+		signer: &signer{
+			accessKeyID:     config.AccessKeyID,
+			secretAccessKey: config.SecretAccessKey,
+			region:          region,
+		},
+		client: &http.Client{},
+	}, nil
+}
+
+// NewFromEnv creates an S3 storage backend configured by the S3_* environment variables
+func NewFromEnv() (*Storage, error) {
+	pathStyle, _ := strconv.ParseBool(os.Getenv("S3_PATH_STYLE"))
+	return New(Config{
+		Endpoint:        os.Getenv("S3_ENDPOINT"),
+		Region:          os.Getenv("S3_REGION"),
+		Bucket:          os.Getenv("S3_BUCKET"),
+		AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		PathStyle:       pathStyle,
+	})
+}
+
+// objectURL returns the url of an object in the bucket, or of the bucket itself if key is empty
+func (s *Storage) objectURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	path := "/" + key
+	if s.pathStyle {
+		path = "/" + s.bucket + path
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(s.endpoint.Path, "/") + path
+	u.RawPath = uriEncode(u.Path, false)
+	if query != nil {
+		u.RawQuery = canonicalQuery(query)
+	}
+	return &u
+}
+
+// do signs and sends a request to S3. Responses with an error status are
+// converted into an *Error and their body is closed.
+func (s *Storage) do(ctx context.Context, method string, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	hash := sha256.Sum256(body)
+	return s.send(ctx, method, key, query, header, bytes.NewReader(body), int64(len(body)), hex.EncodeToString(hash[:]))
+}
+
+// doStream is like do, but streams the body instead of signing its hash
+func (s *Storage) doStream(ctx context.Context, method string, key string, query url.Values, header http.Header, body io.ReadSeeker, contentLength int64) (*http.Response, error) {
+	return s.send(ctx, method, key, query, header, body, contentLength, unsignedPayload)
+}
+
+// send signs the request with the given payload hash and sends it. It is
+// retried with exponential backoff while S3 answers with a retryable status,
+// the body is read from its start again for every attempt.
+func (s *Storage) send(ctx context.Context, method string, key string, query url.Values, header http.Header, body io.ReadSeeker, contentLength int64, payloadHash string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+
+		// the body is not closed by the client, it is needed again for a retry
+		var requestBody io.Reader = http.NoBody
+		if contentLength > 0 {
+			requestBody = ioutil.NopCloser(body)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, s.objectURL(key, query).String(), requestBody)
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = contentLength
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		s.signer.sign(req, payloadHash, time.Now())
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode < 300 {
+			return resp, nil
+		}
+
+		apiErr := parseError(method, key, resp)
+		resp.Body.Close()
+		if !apiErr.retryable() || attempt == maxRetries {
+			return nil, apiErr
+		}
+
+		timer := time.NewTimer(retryDelay(resp.Header, attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// doXML sends a request to S3 and decodes the xml response into v
+func (s *Storage) doXML(ctx context.Context, method string, key string, query url.Values, header http.Header, body []byte, v interface{}) error {
+	resp, err := s.do(ctx, method, key, query, header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return xml.NewDecoder(resp.Body).Decode(v)
+}
+
+// Authorize checks that the bucket is accessible with the configured credentials
+func (s *Storage) Authorize(ctx context.Context) error {
+	resp, err := s.do(ctx, "HEAD", "", nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// listBucketResult is the response of ListObjectsV2
+type listBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		ETag         string    `xml:"ETag"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated bool `xml:"IsTruncated"`
+}
+
+// ListFiles lists the objects in the bucket ordered by their key
+func (s *Storage) ListFiles(ctx context.Context, req storage.ListFilesRequest) (*storage.FileList, error) {
+
+	count := req.MaxFileCount
+	if count <= 0 {
+		count = defaultMaxFileCount
+	}
+	if count > maxFileCount {
+		count = maxFileCount
+	}
+
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("max-keys", strconv.Itoa(count+1))
+	if req.StartFileName != "" {
+		query.Set("start-after", req.StartFileName)
+	}
+	if req.Prefix != "" {
+		query.Set("prefix", req.Prefix)
+	}
+	if req.Delimiter != "" {
+		query.Set("delimiter", req.Delimiter)
+	}
+
+	result := new(listBucketResult)
+	if err := s.doXML(ctx, "GET", "", query, nil, nil, result); err != nil {
+		return nil, err
+	}
+
+	// S3 returns objects and common prefixes separately, they are merged
+	// to find the names which belong to this page
+	type entry struct {
+		name   string
+		file   *storage.File
+		folder bool
+	}
+	entries := []entry{}
+
+	// StartFileName is part of the list, but start-after excludes it
+	if _, inFolder := req.Folder(req.StartFileName); req.StartFileName != "" && strings.HasPrefix(req.StartFileName, req.Prefix) && !inFolder {
+		file, err := s.head(ctx, req.StartFileName)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return nil, err
+		}
+		if file != nil {
+			entries = append(entries, entry{name: file.FileName, file: file})
+		}
+	}
+	for _, object := range result.Contents {
+		entries = append(entries, entry{name: object.Key, file: &storage.File{
+			FileID:          object.Key,
+			FileName:        object.Key,
+			ContentLength:   object.Size,
+			UploadTimestamp: timestamp(object.LastModified),
+		}})
+	}
+	for _, prefix := range result.CommonPrefixes {
+		entries = append(entries, entry{name: prefix.Prefix, folder: true})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+
+	list := &storage.FileList{Files: []storage.File{}}
+	for i, e := range entries {
+		if i == count {
+			list.NextFileName = e.name
+			break
+		}
+		if e.folder {
+			list.Folders = append(list.Folders, e.name)
+		} else {
+			list.Files = append(list.Files, *e.file)
+		}
+	}
+	return list, nil
+}
+
+// GetUploadURL returns a presigned url to upload a single file with a PUT request
+func (s *Storage) GetUploadURL(ctx context.Context, fileName string) (*storage.UploadURL, error) {
+	if fileName == "" {
+		return nil, fmt.Errorf("s3: a file name is required to upload a file: %w", storage.ErrBadRequest)
+	}
+	u := s.signer.presign("PUT", s.objectURL(fileName, nil), presignLifetime, time.Now())
+	return &storage.UploadURL{
+		BucketID:  s.bucket,
+		UploadURL: u.String(),
+	}, nil
+}
+
+// UploadFile uploads a single object to the bucket. The SHA1 checksum is
+// kept in the object metadata, since S3 does not compute it, and is reported
+// as unverified.
+func (s *Storage) UploadFile(ctx context.Context, req storage.UploadFileRequest, body io.ReadSeeker) (*storage.File, error) {
+
+	header := http.Header{}
+	if req.ContentType != "" {
+		header.Set("Content-Type", req.ContentType)
+	}
+	header.Set("X-Amz-Meta-Sha1", req.ContentSha1)
+	for name, value := range req.FileInfo {
+		header.Set("X-Amz-Meta-"+name, value)
+	}
+
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	resp, err := s.doStream(ctx, "PUT", req.FileName, nil, header, body, req.ContentLength)
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	return s.head(ctx, req.FileName)
+}
+
+// StartLargeFile creates a multipart upload. The checksum of the whole file
+// becomes the SHA1 checksum of the object, as for UploadFile. The parts are
+// uploaded with their SHA1 checksums, which S3 verifies.
+func (s *Storage) StartLargeFile(ctx context.Context, fileName string, contentType string, fileInfo map[string]string) (*storage.File, error) {
+
+	header := http.Header{}
+	header.Set("X-Amz-Checksum-Algorithm", "SHA1")
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	for name, value := range fileInfo {
+		if name == storage.LargeFileSha1 {
+			header.Set("X-Amz-Meta-Sha1", value)
+			continue
+		}
+		header.Set("X-Amz-Meta-"+name, value)
+	}
+
+	result := struct {
+		UploadID string `xml:"UploadId"`
+	}{}
+	if err := s.doXML(ctx, "POST", fileName, url.Values{"uploads": {""}}, header, nil, &result); err != nil {
+		return nil, err
+	}
+
+	return &storage.File{
+		FileID:          multipartFileID(result.UploadID, fileName),
+		FileName:        fileName,
+		ContentType:     contentType,
+		FileInfo:        fileInfo,
+		UploadTimestamp: timestamp(time.Now()),
+	}, nil
+}
+
+// multipartFileID combines the upload id and the object key of a multipart
+// upload into an url safe file id
+func multipartFileID(uploadID string, key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(uploadID + "\n" + key))
+}
+
+// parseMultipartFileID splits a file id created by multipartFileID
+func parseMultipartFileID(fileID string) (string, string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(fileID)
+	if err != nil {
+		return "", "", storage.ErrNotFound
+	}
+	parts := strings.SplitN(string(b), "\n", 2)
+	if len(parts) != 2 {
+		return "", "", storage.ErrNotFound
+	}
+	return parts[0], parts[1], nil
+}
+
+// GetUploadPartURL returns a presigned url to upload a part of a multipart upload with a PUT request.
+// The request has to carry the base64 encoded SHA1 checksum of the part in the
+// x-amz-checksum-sha1 header, like UploadPart sends it.
+func (s *Storage) GetUploadPartURL(ctx context.Context, fileID string, partNumber int64) (*storage.UploadPartURL, error) {
+
+	uploadID, key, err := parseMultipartFileID(fileID)
+	if err != nil {
+		return nil, err
+	}
+	if partNumber < 1 || partNumber > 10000 {
+		return nil, fmt.Errorf("s3: invalid part number %d: %w", partNumber, storage.ErrBadRequest)
+	}
+
+	query := url.Values{}
+	query.Set("partNumber", strconv.FormatInt(partNumber, 10))
+	query.Set("uploadId", uploadID)
+	u := s.signer.presign("PUT", s.objectURL(key, query), presignLifetime, time.Now())
+
+	return &storage.UploadPartURL{
+		FileID:    fileID,
+		UploadURL: u.String(),
+	}, nil
+}
+
+// UploadPart uploads a part of a multipart upload. S3 rejects the part if it
+// does not match its SHA1 checksum.
+func (s *Storage) UploadPart(ctx context.Context, fileID string, partNumber int64, contentLength int64, contentSha1 string, body io.ReadSeeker) (*storage.Part, error) {
+
+	uploadID, key, err := parseMultipartFileID(fileID)
+	if err != nil {
+		return nil, err
+	}
+	if partNumber < 1 || partNumber > 10000 {
+		return nil, fmt.Errorf("s3: invalid part number %d: %w", partNumber, storage.ErrBadRequest)
+	}
+	sum, err := hex.DecodeString(contentSha1)
+	if err != nil || len(sum) != 20 {
+		return nil, fmt.Errorf("s3: invalid checksum %q of part %d: %w", contentSha1, partNumber, storage.ErrBadRequest)
+	}
+	header := http.Header{}
+	header.Set("X-Amz-Checksum-Sha1", base64.StdEncoding.EncodeToString(sum))
+	header.Set("X-Amz-Sdk-Checksum-Algorithm", "SHA1")
+
+	query := url.Values{}
+	query.Set("partNumber", strconv.FormatInt(partNumber, 10))
+	query.Set("uploadId", uploadID)
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	resp, err := s.doStream(ctx, "PUT", key, query, header, body, contentLength)
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	return &storage.Part{
+		FileID:        fileID,
+		PartNumber:    partNumber,
+		ContentLength: contentLength,
+		ContentSha1:   contentSha1,
+	}, nil
+}
+
+// completeMultipartUpload is the request body of CompleteMultipartUpload
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+type completedPart struct {
+	PartNumber   int64  `xml:"PartNumber"`
+	ETag         string `xml:"ETag"`
+	ChecksumSHA1 string `xml:"ChecksumSHA1,omitempty"`
+}
+
+// FinishLargeFile completes a multipart upload.
+// The parts uploaded to S3 are checked against partSha1Array if S3 knows their SHA1 checksums.
+func (s *Storage) FinishLargeFile(ctx context.Context, fileID string, partSha1Array []string) (*storage.File, error) {
+
+	uploadID, key, err := parseMultipartFileID(fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	parts, err := s.listAllParts(ctx, uploadID, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 0 || len(parts) != len(partSha1Array) {
+		return nil, fmt.Errorf("s3: %d parts uploaded but %d checksums given: %w", len(parts), len(partSha1Array), storage.ErrBadRequest)
+	}
+
+	complete := completeMultipartUpload{}
+	for i, part := range parts {
+		if part.PartNumber != int64(i+1) {
+			return nil, fmt.Errorf("s3: part %d is missing: %w", i+1, storage.ErrBadRequest)
+		}
+		if sha1 := part.sha1(); sha1 != "" && sha1 != partSha1Array[i] {
+			return nil, fmt.Errorf("s3: checksum of part %d does not match: %w", part.PartNumber, storage.ErrBadRequest)
+		}
+		complete.Parts = append(complete.Parts, completedPart{PartNumber: part.PartNumber, ETag: part.ETag, ChecksumSHA1: part.ChecksumSHA1})
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return nil, err
+	}
+	result := &Error{}
+	// S3 may report an error inside a 200 response of CompleteMultipartUpload
+	if err := s.doXML(ctx, "POST", key, url.Values{"uploadId": {uploadID}}, nil, body, result); err != nil {
+		return nil, err
+	}
+	if result.Code != "" {
+		result.Method, result.Key, result.Status = "POST", key, http.StatusOK
+		return nil, result
+	}
+
+	return s.head(ctx, key)
+}
+
+// CancelLargeFile aborts a multipart upload
+func (s *Storage) CancelLargeFile(ctx context.Context, fileID string) error {
+
+	uploadID, key, err := parseMultipartFileID(fileID)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, "DELETE", key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+// head reads the information of an object
+func (s *Storage) head(ctx context.Context, key string) (*storage.File, error) {
+	resp, err := s.do(ctx, "HEAD", key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return objectFile(key, resp), nil
+}
+
+// objectFile reads the information of an object from the headers of a response.
+// S3 does not check the SHA1 checksum in the metadata, so it is reported as
+// unverified like B2 does, and as the LargeFileSha1 which it was given as.
+func objectFile(key string, resp *http.Response) *storage.File {
+	modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	length, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	sha1 := "none"
+	var fileInfo map[string]string
+	if meta := resp.Header.Get("X-Amz-Meta-Sha1"); meta != "" {
+		sha1 = "unverified:" + meta
+		fileInfo = map[string]string{storage.LargeFileSha1: meta}
+	}
+	return &storage.File{
+		FileID:          key,
+		FileName:        key,
+		ContentLength:   length,
+		ContentType:     resp.Header.Get("Content-Type"),
+		ContentSha1:     sha1,
+		FileInfo:        fileInfo,
+		UploadTimestamp: timestamp(modified),
+	}
+}
+
+// listPartsResult is the response of ListParts
+type listPartsResult struct {
+	Parts []part `xml:"Part"`
+
+	IsTruncated          bool  `xml:"IsTruncated"`
+	NextPartNumberMarker int64 `xml:"NextPartNumberMarker"`
+}
+
+type part struct {
+	PartNumber   int64  `xml:"PartNumber"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	ChecksumSHA1 string `xml:"ChecksumSHA1"`
+}
+
+// sha1 returns the hex encoded SHA1 checksum of the part, if S3 knows it
+func (p *part) sha1() string {
+	b, err := base64.StdEncoding.DecodeString(p.ChecksumSHA1)
+	if err != nil || len(b) == 0 {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// listParts reads a page of the uploaded parts of a multipart upload
+func (s *Storage) listParts(ctx context.Context, uploadID string, key string, startPartNumber int64, maxCount int) (*listPartsResult, error) {
+	query := url.Values{}
+	query.Set("uploadId", uploadID)
+	query.Set("max-parts", strconv.Itoa(maxCount))
+	if startPartNumber > 1 {
+		query.Set("part-number-marker", strconv.FormatInt(startPartNumber-1, 10))
+	}
+
+	result := new(listPartsResult)
+	if err := s.doXML(ctx, "GET", key, query, nil, nil, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// listAllParts reads all uploaded parts of a multipart upload
+func (s *Storage) listAllParts(ctx context.Context, uploadID string, key string) ([]part, error) {
+	parts := []part{}
+	start := int64(1)
+	for {
+		result, err := s.listParts(ctx, uploadID, key, start, maxPartCount)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, result.Parts...)
+		if !result.IsTruncated {
+			return parts, nil
+		}
+		start = result.NextPartNumberMarker + 1
+	}
+}
+
+// ListParts lists the uploaded parts of a multipart upload
+func (s *Storage) ListParts(ctx context.Context, fileID string, startPartNumber int64, maxCount int) (*storage.PartList, error) {
+
+	uploadID, key, err := parseMultipartFileID(fileID)
+	if err != nil {
+		return nil, err
+	}
+	if maxCount <= 0 || maxCount > maxPartCount {
+		maxCount = maxPartCount
+	}
+
+	result, err := s.listParts(ctx, uploadID, key, startPartNumber, maxCount)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &storage.PartList{Parts: []storage.Part{}}
+	for _, part := range result.Parts {
+		list.Parts = append(list.Parts, storage.Part{
+			FileID:        fileID,
+			PartNumber:    part.PartNumber,
+			ContentLength: part.Size,
+			ContentSha1:   part.sha1(),
+			ContentMd5:    strings.Trim(part.ETag, `"`),
+		})
+	}
+	if result.IsTruncated {
+		list.NextPartNumber = result.NextPartNumberMarker + 1
+	}
+	return list, nil
+}
+
+// listMultipartUploadsResult is the response of ListMultipartUploads
+type listMultipartUploadsResult struct {
+	Uploads []struct {
+		Key       string    `xml:"Key"`
+		UploadID  string    `xml:"UploadId"`
+		Initiated time.Time `xml:"Initiated"`
+	} `xml:"Upload"`
+
+	IsTruncated        bool   `xml:"IsTruncated"`
+	NextKeyMarker      string `xml:"NextKeyMarker"`
+	NextUploadIDMarker string `xml:"NextUploadIdMarker"`
+}
+
+// ListUnfinishedLargeFiles lists the multipart uploads which have been neither
+// completed nor aborted. S3 continues a listing after the key and upload id
+// of the last upload, so NextFileID is the id of the last listed upload.
+func (s *Storage) ListUnfinishedLargeFiles(ctx context.Context, startFileID string, maxCount int) (*storage.UnfinishedFileList, error) {
+
+	if maxCount <= 0 {
+		maxCount = defaultMaxFileCount
+	}
+	if maxCount > maxFileCount {
+		maxCount = maxFileCount
+	}
+
+	query := url.Values{}
+	query.Set("uploads", "")
+	query.Set("max-uploads", strconv.Itoa(maxCount))
+	if startFileID != "" {
+		uploadID, key, err := parseMultipartFileID(startFileID)
+		if err != nil {
+			return nil, storage.ErrBadRequest
+		}
+		query.Set("key-marker", key)
+		query.Set("upload-id-marker", uploadID)
+	}
+
+	result := new(listMultipartUploadsResult)
+	if err := s.doXML(ctx, "GET", "", query, nil, nil, result); err != nil {
+		return nil, err
+	}
+
+	list := &storage.UnfinishedFileList{Files: []storage.File{}}
+	for _, upload := range result.Uploads {
+		list.Files = append(list.Files, storage.File{
+			FileID:          multipartFileID(upload.UploadID, upload.Key),
+			FileName:        upload.Key,
+			UploadTimestamp: timestamp(upload.Initiated),
+		})
+	}
+	if result.IsTruncated {
+		list.NextFileID = multipartFileID(result.NextUploadIDMarker, result.NextKeyMarker)
+	}
+	return list, nil
+}
+
+// Download downloads an object from the bucket
+func (s *Storage) Download(ctx context.Context, fileID string) (io.ReadCloser, *storage.File, error) {
+	return s.DownloadRange(ctx, fileID, 0, -1)
+}
+
+// DownloadRange downloads a part of an object from the bucket
+func (s *Storage) DownloadRange(ctx context.Context, fileID string, offset int64, length int64) (io.ReadCloser, *storage.File, error) {
+	header := http.Header{}
+	if offset > 0 || length >= 0 {
+		header.Set("Range", storage.RangeHeader(offset, length))
+	}
+	resp, err := s.do(ctx, "GET", fileID, nil, header, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file := objectFile(fileID, resp)
+	if resp.StatusCode == http.StatusPartialContent {
+		file.ContentLength = storage.ContentRangeLength(resp.Header.Get("Content-Range"))
+	}
+	return resp.Body, file, nil
+}
+
+// GetFileInfo reads the information of an object in the bucket
+func (s *Storage) GetFileInfo(ctx context.Context, fileID string) (*storage.File, error) {
+	return s.head(ctx, fileID)
+}
+
+// DownloadURL returns a presigned url to download an object for the given duration
+func (s *Storage) DownloadURL(ctx context.Context, file *storage.File, validFor time.Duration) (string, error) {
+	return s.signer.presign("GET", s.objectURL(file.FileID, nil), validFor, time.Now()).String(), nil
+}
+
+// Delete deletes an object from the bucket
+func (s *Storage) Delete(ctx context.Context, fileName string, fileID string) error {
+	resp, err := s.do(ctx, "DELETE", fileID, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+// timestamp converts t into milliseconds since the epoch
+func timestamp(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,308 @@
+package s3_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"my.app/pkg/storage"
+	"my.app/pkg/storage/s3"
+	"my.app/pkg/storage/s3/s3test"
+)
+
+var _ storage.Storage = (*s3.Storage)(nil)
+var _ storage.URLSigner = (*s3.Storage)(nil)
+
+const bucket = "media"
+
+func newBackend(t *testing.T) (*s3test.Server, *s3.Storage) {
+	t.Helper()
+	srv := s3test.NewServer(bucket)
+	t.Cleanup(srv.Close)
+	backend, err := s3.New(s3.Config{
+		Endpoint:        srv.URL,
+		Bucket:          bucket,
+		AccessKeyID:     "test-access-key",
+		SecretAccessKey: "test-secret-key",
+		PathStyle:       true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, backend
+}
+
+func sha1Hex(data []byte) string {
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func upload(t *testing.T, backend *s3.Storage, fileName string, data []byte) *storage.File {
+	t.Helper()
+	file, err := backend.UploadFile(context.Background(), storage.UploadFileRequest{
+		FileName:      fileName,
+		ContentType:   "text/plain",
+		ContentLength: int64(len(data)),
+		ContentSha1:   sha1Hex(data),
+	}, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("upload %s: %v", fileName, err)
+	}
+	return file
+}
+
+func TestAuthorize(t *testing.T) {
+	srv, backend := newBackend(t)
+	if err := backend.Authorize(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	other, _ := s3.New(s3.Config{Endpoint: srv.URL, Bucket: "missing", PathStyle: true})
+	if err := other.Authorize(context.Background()); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("got %v, want not found for a missing bucket", err)
+	}
+}
+
+func TestUploadAndDownload(t *testing.T) {
+	srv, backend := newBackend(t)
+	ctx := context.Background()
+	data := []byte("hello world")
+
+	file := upload(t, backend, "folder/hello world.txt", data)
+	if file.FileID != "folder/hello world.txt" || file.ContentLength != int64(len(data)) || file.ContentSha1 != "unverified:"+sha1Hex(data) {
+		t.Errorf("unexpected file %+v", file)
+	}
+	if stored, ok := srv.Object(bucket, "folder/hello world.txt"); !ok || !bytes.Equal(stored, data) {
+		t.Errorf("stored %q, want %q", stored, data)
+	}
+
+	body, downloaded, err := backend.Download(ctx, file.FileID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadAll(body)
+	body.Close()
+	if !bytes.Equal(content, data) || downloaded.ContentType != "text/plain" {
+		t.Errorf("downloaded %q as %+v", content, downloaded)
+	}
+
+	body, downloaded, err = backend.DownloadRange(ctx, file.FileID, 6, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ = ioutil.ReadAll(body)
+	body.Close()
+	if string(content) != "wor" || downloaded.ContentLength != int64(len(data)) {
+		t.Errorf("downloaded range %q of %d bytes", content, downloaded.ContentLength)
+	}
+
+	if _, _, err := backend.Download(ctx, "missing.txt"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("download of a missing file: got %v, want not found", err)
+	}
+}
+
+func TestPresignedUpload(t *testing.T) {
+	srv, backend := newBackend(t)
+	uploadURL, err := backend.GetUploadURL(context.Background(), "presigned.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("PUT", uploadURL.UploadURL, bytes.NewReader([]byte("presigned")))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if stored, ok := srv.Object(bucket, "presigned.txt"); !ok || string(stored) != "presigned" {
+		t.Errorf("stored %q", stored)
+	}
+
+	if _, err := backend.GetUploadURL(context.Background(), ""); !errors.Is(err, storage.ErrBadRequest) {
+		t.Errorf("upload url without a name: got %v, want a bad request", err)
+	}
+}
+
+func TestListFiles(t *testing.T) {
+	_, backend := newBackend(t)
+	for _, name := range []string{"a.jpg", "b.jpg", "photos/c.jpg", "photos/d.jpg"} {
+		upload(t, backend, name, []byte(name))
+	}
+	ctx := context.Background()
+
+	list, err := backend.ListFiles(ctx, storage.ListFilesRequest{Delimiter: "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Files) != 2 || list.Files[0].FileName != "a.jpg" || list.Files[1].FileName != "b.jpg" {
+		t.Errorf("unexpected files %+v", list.Files)
+	}
+	if len(list.Folders) != 1 || list.Folders[0] != "photos/" {
+		t.Errorf("unexpected folders %v", list.Folders)
+	}
+
+	list, err = backend.ListFiles(ctx, storage.ListFilesRequest{MaxFileCount: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Files) != 3 || list.NextFileName != "photos/d.jpg" {
+		t.Errorf("unexpected first page %+v", list)
+	}
+	list, err = backend.ListFiles(ctx, storage.ListFilesRequest{StartFileName: list.NextFileName, MaxFileCount: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Files) != 1 || list.Files[0].FileName != "photos/d.jpg" || list.NextFileName != "" {
+		t.Errorf("unexpected last page %+v", list)
+	}
+}
+
+func TestLargeFile(t *testing.T) {
+	srv, backend := newBackend(t)
+	ctx := context.Background()
+	parts := [][]byte{[]byte("first part, "), []byte("second part")}
+	whole := bytes.Join(parts, nil)
+
+	file, err := backend.StartLargeFile(ctx, "large.bin", "application/octet-stream", map[string]string{storage.LargeFileSha1: sha1Hex(whole)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unfinished, err := backend.ListUnfinishedLargeFiles(ctx, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unfinished.Files) != 1 || unfinished.Files[0].FileID != file.FileID {
+		t.Errorf("unexpected unfinished files %+v", unfinished.Files)
+	}
+
+	if _, err := backend.GetUploadPartURL(ctx, file.FileID, 0); !errors.Is(err, storage.ErrBadRequest) {
+		t.Errorf("upload url for part 0: got %v, want a bad request", err)
+	}
+	sha1s := []string{}
+	for i, data := range parts {
+		if _, err := backend.UploadPart(ctx, file.FileID, int64(i+1), int64(len(data)), sha1Hex(data), bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		sha1s = append(sha1s, sha1Hex(data))
+	}
+
+	list, err := backend.ListParts(ctx, file.FileID, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Parts) != 1 || list.Parts[0].ContentLength != int64(len(parts[0])) || list.Parts[0].ContentSha1 != sha1s[0] || list.NextPartNumber != 2 {
+		t.Errorf("unexpected first page of parts %+v", list)
+	}
+
+	// S3 verifies the checksum of a part
+	if _, err := backend.UploadPart(ctx, file.FileID, 3, int64(len(parts[0])), sha1s[1], bytes.NewReader(parts[0])); !errors.Is(err, storage.ErrBadRequest) {
+		t.Errorf("upload of a part with another checksum: got %v, want a bad request", err)
+	}
+	if _, err := backend.UploadPart(ctx, file.FileID, 3, int64(len(parts[0])), "invalid", bytes.NewReader(parts[0])); !errors.Is(err, storage.ErrBadRequest) {
+		t.Errorf("upload of a part with an invalid checksum: got %v, want a bad request", err)
+	}
+
+	if _, err := backend.FinishLargeFile(ctx, file.FileID, sha1s[:1]); !errors.Is(err, storage.ErrBadRequest) {
+		t.Errorf("finish with a missing checksum: got %v, want a bad request", err)
+	}
+	if _, err := backend.FinishLargeFile(ctx, file.FileID, []string{sha1s[1], sha1s[0]}); !errors.Is(err, storage.ErrBadRequest) {
+		t.Errorf("finish with swapped checksums: got %v, want a bad request", err)
+	}
+	finished, err := backend.FinishLargeFile(ctx, file.FileID, sha1s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if finished.FileID != "large.bin" || finished.ContentLength != int64(len(whole)) || finished.ContentSha1 != "unverified:"+sha1Hex(whole) {
+		t.Errorf("unexpected finished file %+v", finished)
+	}
+	if stored, ok := srv.Object(bucket, "large.bin"); !ok || !bytes.Equal(stored, whole) {
+		t.Errorf("stored %q, want %q", stored, whole)
+	}
+	if _, err := backend.ListParts(ctx, file.FileID, 1, 10); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("list parts of a finished file: got %v, want not found", err)
+	}
+}
+
+func TestCancelLargeFile(t *testing.T) {
+	_, backend := newBackend(t)
+	ctx := context.Background()
+
+	file, err := backend.StartLargeFile(ctx, "canceled.bin", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.CancelLargeFile(ctx, file.FileID); err != nil {
+		t.Fatal(err)
+	}
+	unfinished, err := backend.ListUnfinishedLargeFiles(ctx, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unfinished.Files) != 0 {
+		t.Errorf("canceled file is still listed: %+v", unfinished.Files)
+	}
+	if err := backend.CancelLargeFile(ctx, file.FileID); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("cancel twice: got %v, want not found", err)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	srv, backend := newBackend(t)
+	ctx := context.Background()
+	file := upload(t, backend, "deleted.txt", []byte("gone"))
+
+	if err := backend.Delete(ctx, file.FileName, file.FileID); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := srv.Object(bucket, "deleted.txt"); ok {
+		t.Error("the object is still stored")
+	}
+	if _, err := backend.GetFileInfo(ctx, file.FileID); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("file info of a deleted file: got %v, want not found", err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	srv, backend := newBackend(t)
+	ctx := context.Background()
+
+	srv.Fail("GET", 1, http.StatusForbidden, "AccessDenied")
+	_, err := backend.ListFiles(ctx, storage.ListFilesRequest{})
+	if !errors.Is(err, storage.ErrBadRequest) {
+		t.Errorf("got %v, want a bad request for 403", err)
+	}
+	apiErr := &s3.Error{}
+	if !errors.As(err, &apiErr) || apiErr.Code != "AccessDenied" {
+		t.Errorf("got %#v, want the S3 error", err)
+	}
+
+	// the body is sent again on every retry
+	srv.Fail("PUT", 2, http.StatusServiceUnavailable, "SlowDown")
+	upload(t, backend, "retried.txt", []byte("retried"))
+	if stored, _ := srv.Object(bucket, "retried.txt"); string(stored) != "retried" {
+		t.Errorf("stored %q after the retries", stored)
+	}
+
+	// the first try and 5 retries fail
+	srv.Fail("GET", 6, http.StatusInternalServerError, "InternalError")
+	if _, err := backend.ListFiles(ctx, storage.ListFilesRequest{}); !errors.Is(err, storage.ErrUnavailable) {
+		t.Errorf("got %v, want unavailable after the last retry", err)
+	}
+
+	// bad requests are not retried, the second fault is left for the next call
+	srv.Fail("GET", 2, http.StatusBadRequest, "InvalidArgument")
+	if _, err := backend.ListFiles(ctx, storage.ListFilesRequest{}); !errors.Is(err, storage.ErrBadRequest) {
+		t.Errorf("got %v, want a bad request", err)
+	}
+	if _, err := backend.ListFiles(ctx, storage.ListFilesRequest{}); !errors.Is(err, storage.ErrBadRequest) {
+		t.Errorf("got %v, want the second bad request", err)
+	}
+	if _, err := backend.ListFiles(ctx, storage.ListFilesRequest{}); err != nil {
+		t.Error(err)
+	}
+}
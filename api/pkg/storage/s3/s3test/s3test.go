@@ -0,0 +1,499 @@
+// Package s3test provides an in-process fake of the S3 API which keeps the
+// objects in memory. It supports the operations used by the s3 storage
+// backend with path style addressing. Request signatures are not checked.
+package s3test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is a fake S3 server
+type Server struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	buckets map[string]map[string]*object
+	uploads map[string]*upload
+	faults  map[string][]fault
+}
+
+// fault is an error response which is sent instead of handling a request
+type fault struct {
+	status int
+	code   string
+}
+
+type object struct {
+	data         []byte
+	contentType  string
+	etag         string
+	meta         http.Header
+	lastModified time.Time
+
+	// checksumSHA1 is the base64 encoded SHA1 checksum of a part, if the
+	// client sent it
+	checksumSHA1 string
+}
+
+type upload struct {
+	bucket      string
+	key         string
+	contentType string
+	meta        http.Header
+	initiated   time.Time
+	parts       map[int64]*object
+}
+
+// NewServer starts a fake S3 server with the given buckets.
+// The caller has to close the server.
+func NewServer(buckets ...string) *Server {
+	s := &Server{
+		buckets: make(map[string]map[string]*object),
+		uploads: make(map[string]*upload),
+		faults:  make(map[string][]fault),
+	}
+	for _, bucket := range buckets {
+		s.buckets[bucket] = make(map[string]*object)
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Object returns the content of an object, or false if it does not exist
+func (s *Server) Object(bucket string, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, ok := s.buckets[bucket][key]
+	if !ok {
+		return nil, false
+	}
+	return obj.data, true
+}
+
+// Fail lets the next count requests with the method, like "PUT", fail with
+// the given status and error code. Retryable failures carry a Retry-After of
+// zero seconds so that clients retry without waiting.
+func (s *Server) Fail(method string, count int, status int, code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := 0; i < count; i++ {
+		s.faults[method] = append(s.faults[method], fault{status: status, code: code})
+	}
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if faults := s.faults[r.Method]; len(faults) > 0 {
+		s.faults[r.Method] = faults[1:]
+		switch faults[0].status {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusServiceUnavailable:
+			w.Header().Set("Retry-After", "0")
+		}
+		writeError(w, faults[0].status, faults[0].code, "Injected fault")
+		return
+	}
+
+	path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	objects, ok := s.buckets[path[0]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+	query := r.URL.Query()
+
+	if len(path) == 1 || path[1] == "" {
+		switch r.Method {
+		case "HEAD":
+			w.WriteHeader(http.StatusOK)
+		case "GET":
+			if _, isUploads := query["uploads"]; isUploads {
+				s.listMultipartUploads(w, query, path[0])
+				return
+			}
+			s.listObjects(w, query, objects)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "Method not allowed")
+		}
+		return
+	}
+
+	bucket, key := path[0], path[1]
+	_, isUploads := query["uploads"]
+	uploadID := query.Get("uploadId")
+	switch {
+	case r.Method == "POST" && isUploads:
+		s.createMultipartUpload(w, r, bucket, key)
+	case uploadID != "":
+		up, ok := s.uploads[uploadID]
+		if !ok || up.bucket != bucket || up.key != key {
+			writeError(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist")
+			return
+		}
+		switch r.Method {
+		case "PUT":
+			s.uploadPart(w, r, up)
+		case "GET":
+			s.listParts(w, query, uploadID, up)
+		case "POST":
+			s.completeMultipartUpload(w, r, uploadID, up)
+		case "DELETE":
+			delete(s.uploads, uploadID)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "Method not allowed")
+		}
+	case r.Method == "PUT":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		obj := newObject(body, r.Header.Get("Content-Type"))
+		obj.meta = metaHeaders(r.Header)
+		objects[key] = obj
+		w.Header().Set("ETag", obj.etag)
+		w.WriteHeader(http.StatusOK)
+	case r.Method == "GET" || r.Method == "HEAD":
+		obj, ok := objects[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		for name, values := range obj.meta {
+			w.Header()[name] = values
+		}
+		w.Header().Set("ETag", obj.etag)
+		w.Header().Set("Content-Type", obj.contentType)
+		w.Header().Set("Last-Modified", obj.lastModified.UTC().Format(http.TimeFormat))
+		http.ServeContent(w, r, "", obj.lastModified, bytes.NewReader(obj.data))
+	case r.Method == "DELETE":
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "Method not allowed")
+	}
+}
+
+func (s *Server) listObjects(w http.ResponseWriter, query map[string][]string, objects map[string]*object) {
+	get := func(name string) string {
+		if v := query[name]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	maxKeys, err := strconv.Atoi(get("max-keys"))
+	if err != nil || maxKeys <= 0 || maxKeys > 1000 {
+		maxKeys = 1000
+	}
+
+	// keys inside a folder are rolled up into a common prefix
+	prefix, delimiter := get("prefix"), get("delimiter")
+	keys := []string{}
+	folders := make(map[string]bool)
+	for key := range objects {
+		if key <= get("start-after") || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			folder := key[:len(prefix)+i+len(delimiter)]
+			if !folders[folder] {
+				folders[folder] = true
+				keys = append(keys, folder)
+			}
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	type commonPrefix struct {
+		Prefix string `xml:"Prefix"`
+	}
+	type content struct {
+		Key          string `xml:"Key"`
+		LastModified string `xml:"LastModified"`
+		ETag         string `xml:"ETag"`
+		Size         int    `xml:"Size"`
+	}
+	result := struct {
+		XMLName        xml.Name       `xml:"ListBucketResult"`
+		Contents       []content      `xml:"Contents"`
+		CommonPrefixes []commonPrefix `xml:"CommonPrefixes"`
+		KeyCount       int            `xml:"KeyCount"`
+		IsTruncated    bool           `xml:"IsTruncated"`
+	}{}
+	for _, key := range keys {
+		if result.KeyCount == maxKeys {
+			result.IsTruncated = true
+			break
+		}
+		result.KeyCount++
+		if folders[key] {
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: key})
+			continue
+		}
+		obj := objects[key]
+		result.Contents = append(result.Contents, content{
+			Key:          key,
+			LastModified: obj.lastModified.UTC().Format(time.RFC3339Nano),
+			ETag:         obj.etag,
+			Size:         len(obj.data),
+		})
+	}
+	writeXML(w, http.StatusOK, result)
+}
+
+func (s *Server) createMultipartUpload(w http.ResponseWriter, r *http.Request, bucket string, key string) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	uploadID := hex.EncodeToString(b)
+	s.uploads[uploadID] = &upload{
+		bucket:      bucket,
+		key:         key,
+		contentType: r.Header.Get("Content-Type"),
+		meta:        metaHeaders(r.Header),
+		initiated:   time.Now(),
+		parts:       make(map[int64]*object),
+	}
+	writeXML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		UploadID string   `xml:"UploadId"`
+	}{Bucket: bucket, Key: key, UploadID: uploadID})
+}
+
+// listMultipartUploads lists the uploads of a bucket ordered by their key and
+// initiation, after the upload given by key-marker and upload-id-marker
+func (s *Server) listMultipartUploads(w http.ResponseWriter, query map[string][]string, bucket string) {
+	maxUploads, err := strconv.Atoi(first(query["max-uploads"]))
+	if err != nil || maxUploads <= 0 || maxUploads > 1000 {
+		maxUploads = 1000
+	}
+	keyMarker := first(query["key-marker"])
+	uploadIDMarker := first(query["upload-id-marker"])
+
+	ids := []string{}
+	for id, up := range s.uploads {
+		if up.bucket == bucket {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := s.uploads[ids[i]], s.uploads[ids[j]]
+		if a.key != b.key {
+			return a.key < b.key
+		}
+		if !a.initiated.Equal(b.initiated) {
+			return a.initiated.Before(b.initiated)
+		}
+		return ids[i] < ids[j]
+	})
+
+	// skip the uploads up to and including the marker
+	start := 0
+	for start < len(ids) && keyMarker != "" {
+		up := s.uploads[ids[start]]
+		if up.key > keyMarker {
+			break
+		}
+		start++
+		if up.key == keyMarker && ids[start-1] == uploadIDMarker {
+			break
+		}
+	}
+
+	type listedUpload struct {
+		Key       string    `xml:"Key"`
+		UploadID  string    `xml:"UploadId"`
+		Initiated time.Time `xml:"Initiated"`
+	}
+	result := struct {
+		XMLName            xml.Name       `xml:"ListMultipartUploadsResult"`
+		Bucket             string         `xml:"Bucket"`
+		Uploads            []listedUpload `xml:"Upload"`
+		IsTruncated        bool           `xml:"IsTruncated"`
+		NextKeyMarker      string         `xml:"NextKeyMarker"`
+		NextUploadIDMarker string         `xml:"NextUploadIdMarker"`
+	}{Bucket: bucket}
+	for _, id := range ids[start:] {
+		if len(result.Uploads) == maxUploads {
+			result.IsTruncated = true
+			break
+		}
+		up := s.uploads[id]
+		result.Uploads = append(result.Uploads, listedUpload{Key: up.key, UploadID: id, Initiated: up.initiated})
+		result.NextKeyMarker = up.key
+		result.NextUploadIDMarker = id
+	}
+	writeXML(w, http.StatusOK, result)
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, r *http.Request, up *upload) {
+	partNumber, err := strconv.ParseInt(r.URL.Query().Get("partNumber"), 10, 64)
+	if err != nil || partNumber < 1 || partNumber > 10000 {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", "Invalid part number")
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	part := newObject(body, "")
+	if checksum := r.Header.Get("X-Amz-Checksum-Sha1"); checksum != "" {
+		sum := sha1.Sum(body)
+		if checksum != base64.StdEncoding.EncodeToString(sum[:]) {
+			writeError(w, http.StatusBadRequest, "BadDigest", "The SHA1 you specified did not match the calculated checksum.")
+			return
+		}
+		part.checksumSHA1 = checksum
+	}
+	up.parts[partNumber] = part
+	w.Header().Set("ETag", part.etag)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) listParts(w http.ResponseWriter, query map[string][]string, uploadID string, up *upload) {
+	marker, _ := strconv.ParseInt(first(query["part-number-marker"]), 10, 64)
+	maxParts, err := strconv.Atoi(first(query["max-parts"]))
+	if err != nil || maxParts <= 0 || maxParts > 1000 {
+		maxParts = 1000
+	}
+
+	numbers := []int64{}
+	for n := range up.parts {
+		if n > marker {
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+
+	type part struct {
+		PartNumber   int64  `xml:"PartNumber"`
+		ETag         string `xml:"ETag"`
+		Size         int    `xml:"Size"`
+		ChecksumSHA1 string `xml:"ChecksumSHA1,omitempty"`
+	}
+	result := struct {
+		XMLName              xml.Name `xml:"ListPartsResult"`
+		UploadID             string   `xml:"UploadId"`
+		Parts                []part   `xml:"Part"`
+		IsTruncated          bool     `xml:"IsTruncated"`
+		NextPartNumberMarker int64    `xml:"NextPartNumberMarker"`
+	}{UploadID: uploadID}
+	for _, n := range numbers {
+		if len(result.Parts) == maxParts {
+			result.IsTruncated = true
+			break
+		}
+		p := up.parts[n]
+		result.Parts = append(result.Parts, part{PartNumber: n, ETag: p.etag, Size: len(p.data), ChecksumSHA1: p.checksumSHA1})
+		result.NextPartNumberMarker = n
+	}
+	writeXML(w, http.StatusOK, result)
+}
+
+func (s *Server) completeMultipartUpload(w http.ResponseWriter, r *http.Request, uploadID string, up *upload) {
+	request := struct {
+		Parts []struct {
+			PartNumber   int64  `xml:"PartNumber"`
+			ETag         string `xml:"ETag"`
+			ChecksumSHA1 string `xml:"ChecksumSHA1"`
+		} `xml:"Part"`
+	}{}
+	if err := xml.NewDecoder(r.Body).Decode(&request); err != nil || len(request.Parts) == 0 {
+		writeError(w, http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed")
+		return
+	}
+
+	var data []byte
+	for i, p := range request.Parts {
+		part, ok := up.parts[p.PartNumber]
+		if !ok || part.etag != p.ETag || part.checksumSHA1 != p.ChecksumSHA1 {
+			writeError(w, http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found")
+			return
+		}
+		if i > 0 && p.PartNumber <= request.Parts[i-1].PartNumber {
+			writeError(w, http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order")
+			return
+		}
+		data = append(data, part.data...)
+	}
+
+	obj := newObject(data, up.contentType)
+	obj.meta = up.meta
+	s.buckets[up.bucket][up.key] = obj
+	delete(s.uploads, uploadID)
+
+	writeXML(w, http.StatusOK, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string   `xml:"Bucket"`
+		Key     string   `xml:"Key"`
+		ETag    string   `xml:"ETag"`
+	}{Bucket: up.bucket, Key: up.key, ETag: obj.etag})
+}
+
+func newObject(data []byte, contentType string) *object {
+	if contentType == "" {
+		contentType = "binary/octet-stream"
+	}
+	sum := md5.Sum(data)
+	return &object{
+		data:         data,
+		contentType:  contentType,
+		etag:         `"` + hex.EncodeToString(sum[:]) + `"`,
+		meta:         http.Header{},
+		lastModified: time.Now(),
+	}
+}
+
+// metaHeaders returns the user defined metadata of a request
+func metaHeaders(header http.Header) http.Header {
+	meta := http.Header{}
+	for name, values := range header {
+		if strings.HasPrefix(name, "X-Amz-Meta-") {
+			meta[name] = values
+		}
+	}
+	return meta
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	writeXML(w, status, struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}{Code: code, Message: message})
+}
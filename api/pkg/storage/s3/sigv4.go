@@ -0,0 +1,180 @@
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signature Version 4 signing of S3 requests, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+
+const (
+	signAlgorithm   = "AWS4-HMAC-SHA256"
+	signService     = "s3"
+	amzDateFormat   = "20060102T150405Z"
+	scopeDateFormat = "20060102"
+
+	// unsignedPayload is used as payload hash when the body is not signed
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// signer signs requests with the credentials of an S3 account
+type signer struct {
+	accessKeyID     string
+	secretAccessKey string
+	region          string
+}
+
+// sign adds the Authorization header to req. payloadHash is the hex encoded
+// SHA256 of the body, or unsignedPayload.
+func (s *signer) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	req.Header.Set("X-Amz-Date", now.Format(amzDateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := signedHeaders(req)
+	scope := s.scope(now)
+	canonical := canonicalRequest(req, headers, canonicalQuery(req.URL.Query()), payloadHash)
+	signature := s.signature(now, stringToSign(now, scope, canonical))
+
+	req.Header.Set("Authorization", signAlgorithm+
+		" Credential="+s.accessKeyID+"/"+scope+
+		", SignedHeaders="+strings.Join(headers, ";")+
+		", Signature="+signature)
+}
+
+// presign returns a copy of u which carries the signature in its query
+// parameters and is valid for the given duration. Only the host header is
+// signed, so the client may send any other header with the request.
+func (s *signer) presign(method string, u *url.URL, expires time.Duration, now time.Time) *url.URL {
+	now = now.UTC()
+	scope := s.scope(now)
+
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", signAlgorithm)
+	query.Set("X-Amz-Credential", s.accessKeyID+"/"+scope)
+	query.Set("X-Amz-Date", now.Format(amzDateFormat))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expires/time.Second)))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	signed := *u
+	signed.RawQuery = canonicalQuery(query)
+
+	req := &http.Request{Method: method, URL: &signed, Host: u.Host, Header: http.Header{}}
+	canonical := canonicalRequest(req, []string{"host"}, signed.RawQuery, unsignedPayload)
+	signature := s.signature(now, stringToSign(now, scope, canonical))
+
+	signed.RawQuery += "&X-Amz-Signature=" + signature
+	return &signed
+}
+
+func (s *signer) scope(now time.Time) string {
+	return now.Format(scopeDateFormat) + "/" + s.region + "/" + signService + "/aws4_request"
+}
+
+func (s *signer) signature(now time.Time, stringToSign string) string {
+	key := hmacSHA256([]byte("AWS4"+s.secretAccessKey), now.Format(scopeDateFormat))
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, signService)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func stringToSign(now time.Time, scope string, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	return signAlgorithm + "\n" + now.Format(amzDateFormat) + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+}
+
+// signedHeaders returns the sorted, lower case names of the headers which are signed
+func signedHeaders(req *http.Request) []string {
+	headers := []string{"host"}
+	for name := range req.Header {
+		name = strings.ToLower(name)
+		if name == "content-type" || name == "content-md5" || name == "range" || strings.HasPrefix(name, "x-amz-") {
+			headers = append(headers, name)
+		}
+	}
+	sort.Strings(headers)
+	return headers
+}
+
+func canonicalRequest(req *http.Request, headers []string, query string, payloadHash string) string {
+	var b strings.Builder
+	b.WriteString(req.Method + "\n")
+	b.WriteString(canonicalPath(req.URL.Path) + "\n")
+	b.WriteString(query + "\n")
+	for _, name := range headers {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.Host
+			if value == "" {
+				value = req.URL.Host
+			}
+		}
+		b.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+	b.WriteString("\n" + strings.Join(headers, ";") + "\n")
+	b.WriteString(payloadHash)
+	return b.String()
+}
+
+func canonicalPath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return uriEncode(path, false)
+}
+
+// canonicalQuery encodes the query parameters sorted by name
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	params := []string{}
+	for _, key := range keys {
+		values := append([]string{}, query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			params = append(params, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// uriEncode encodes s as required by SigV4: every byte except the unreserved
+// characters of RFC 3986 is percent encoded. Slashes are kept unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&15])
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
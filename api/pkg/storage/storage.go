@@ -0,0 +1,225 @@
+// Package storage defines the interface between the media API and the
+// object storage backend the media files are kept in.
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The errors of the storage backends match these errors with errors.Is
+var (
+	// ErrNotFound is returned when a requested file does not exist in the storage
+	ErrNotFound = errors.New("storage: file not found")
+
+	// ErrBadRequest is returned when the storage rejects the parameters of a request
+	ErrBadRequest = errors.New("storage: bad request")
+
+	// ErrUnavailable is returned when the storage is busy or temporarily unavailable
+	ErrUnavailable = errors.New("storage: temporarily unavailable")
+
+	// ErrNotSignable is returned by a URLSigner which cannot sign an url for
+	// the file alone, the file has to be streamed instead
+	ErrNotSignable = errors.New("storage: no url can be signed for the file")
+)
+
+// LargeFileSha1 is the file info which holds the SHA1 checksum of a whole
+// large file, since the storage only knows the checksums of its parts
+const LargeFileSha1 = "large_file_sha1"
+
+// File describes a single file in the storage. ContentSha1 is "none" if the
+// storage does not know the checksum and starts with "unverified:" if the
+// storage did not check it against the content.
+type File struct {
+	FileID          string            `json:"fileId"`
+	FileName        string            `json:"fileName"`
+	ContentLength   int64             `json:"contentLength"`
+	ContentType     string            `json:"contentType"`
+	ContentSha1     string            `json:"contentSha1"`
+	FileInfo        map[string]string `json:"fileInfo,omitempty"`
+	UploadTimestamp int64             `json:"uploadTimestamp"`
+}
+
+// FileList is a single page of files in the storage. Files and folders
+// together are at most MaxFileCount entries of the listing.
+type FileList struct {
+	Files        []File   `json:"files"`
+	Folders      []string `json:"folders"`
+	NextFileName string   `json:"nextFileName"`
+}
+
+// ListFilesRequest defines the parameters to list files in the storage
+type ListFilesRequest struct {
+	// StartFileName is the first name of the listing, the NextFileName of the previous page
+	StartFileName string
+	MaxFileCount  int
+
+	// Prefix limits the listing to names which start with it
+	Prefix string
+
+	// Delimiter groups the names which contain it after the prefix into folders.
+	// A folder is listed as the part of the name up to and including the delimiter.
+	Delimiter string
+}
+
+// Folder returns the folder a file name belongs to in a listing with the
+// given prefix and delimiter, or false if the name is listed as a file
+func (req *ListFilesRequest) Folder(fileName string) (string, bool) {
+	if req.Delimiter == "" || !strings.HasPrefix(fileName, req.Prefix) {
+		return "", false
+	}
+	i := strings.Index(fileName[len(req.Prefix):], req.Delimiter)
+	if i < 0 {
+		return "", false
+	}
+	return fileName[:len(req.Prefix)+i+len(req.Delimiter)], true
+}
+
+// UnfinishedFileList is a single page of the large files which have been
+// started but neither finished nor canceled
+type UnfinishedFileList struct {
+	Files []File `json:"files"`
+
+	// NextFileID is the startFileID of the next page, empty on the last page
+	NextFileID string `json:"nextFileId"`
+}
+
+// UploadURL contains the url and token needed to upload a single file
+type UploadURL struct {
+	BucketID           string
+	UploadURL          string
+	AuthorizationToken string
+}
+
+// UploadFileRequest describes a single file which the API uploads to the storage
+type UploadFileRequest struct {
+	FileName      string
+	ContentType   string
+	ContentLength int64
+	ContentSha1   string
+	FileInfo      map[string]string
+}
+
+// UploadPartURL contains the url and token needed to upload parts of a large file
+type UploadPartURL struct {
+	FileID             string
+	UploadURL          string
+	AuthorizationToken string
+}
+
+// Part describes a single uploaded part of a large file
+type Part struct {
+	FileID        string `json:"fileId"`
+	PartNumber    int64  `json:"partNumber"`
+	ContentLength int64  `json:"contentLength"`
+	ContentSha1   string `json:"contentSha1"`
+	ContentMd5    string `json:"contentMd5"`
+}
+
+// PartList is a single page of uploaded parts of a large file
+type PartList struct {
+	Parts          []Part `json:"parts"`
+	NextPartNumber int64  `json:"nextPartNumber"`
+}
+
+// Storage is implemented by every storage backend
+type Storage interface {
+	// Authorize checks the credentials of the backend
+	Authorize(ctx context.Context) error
+
+	// ListFiles lists the files in the storage ordered by file name
+	ListFiles(ctx context.Context, req ListFilesRequest) (*FileList, error)
+
+	// GetUploadURL returns an url which a client can use to upload a single file.
+	// The file name is only used by backends which sign the url for a single file.
+	GetUploadURL(ctx context.Context, fileName string) (*UploadURL, error)
+
+	// UploadFile uploads a single file from the API to the storage. The body is
+	// read from its start again when the upload has to be retried.
+	UploadFile(ctx context.Context, req UploadFileRequest, body io.ReadSeeker) (*File, error)
+
+	// StartLargeFile prepares the upload of a large file in multiple parts. The
+	// file info is kept with the file, see LargeFileSha1.
+	StartLargeFile(ctx context.Context, fileName string, contentType string, fileInfo map[string]string) (*File, error)
+
+	// GetUploadPartURL returns an url which a client can use to upload parts of a large file.
+	// The part number is only used by backends which sign the url for a single part.
+	GetUploadPartURL(ctx context.Context, fileID string, partNumber int64) (*UploadPartURL, error)
+
+	// UploadPart uploads a part of a large file from the API to the storage. The
+	// body is read from its start again when the upload has to be retried.
+	UploadPart(ctx context.Context, fileID string, partNumber int64, contentLength int64, contentSha1 string, body io.ReadSeeker) (*Part, error)
+
+	// FinishLargeFile assembles the uploaded parts of a large file
+	FinishLargeFile(ctx context.Context, fileID string, partSha1Array []string) (*File, error)
+
+	// CancelLargeFile aborts the upload of a large file and removes its parts
+	CancelLargeFile(ctx context.Context, fileID string) error
+
+	// ListParts lists the parts which have been uploaded for a large file
+	ListParts(ctx context.Context, fileID string, startPartNumber int64, maxPartCount int) (*PartList, error)
+
+	// ListUnfinishedLargeFiles lists the large files which have been started
+	// but neither finished nor canceled
+	ListUnfinishedLargeFiles(ctx context.Context, startFileID string, maxFileCount int) (*UnfinishedFileList, error)
+
+	// Download returns the content of a file. The caller has to close the reader.
+	Download(ctx context.Context, fileID string) (io.ReadCloser, *File, error)
+
+	// DownloadRange returns length bytes of a file starting at offset, or the
+	// rest of the file if length is negative. The caller has to close the reader.
+	DownloadRange(ctx context.Context, fileID string, offset int64, length int64) (io.ReadCloser, *File, error)
+
+	// GetFileInfo returns the information of a stored file
+	GetFileInfo(ctx context.Context, fileID string) (*File, error)
+
+	// Delete removes a file from the storage
+	Delete(ctx context.Context, fileName string, fileID string) error
+}
+
+// URLSigner is implemented by storage backends which can hand out download
+// urls that work without further authorization for a limited time
+type URLSigner interface {
+	// DownloadURL returns an url to download the file which is valid for the given duration
+	DownloadURL(ctx context.Context, file *File, validFor time.Duration) (string, error)
+}
+
+// RangeHeader returns the value of an HTTP Range header which requests
+// length bytes starting at offset, or the rest of the content if length is negative
+func RangeHeader(offset int64, length int64) string {
+	if length < 0 {
+		return "bytes=" + strconv.FormatInt(offset, 10) + "-"
+	}
+	return "bytes=" + strconv.FormatInt(offset, 10) + "-" + strconv.FormatInt(offset+length-1, 10)
+}
+
+// ContentRangeLength returns the complete length of the content from the
+// value of an HTTP Content-Range header, or -1 if it is unknown
+func ContentRangeLength(contentRange string) int64 {
+	i := strings.LastIndex(contentRange, "/")
+	if i < 0 {
+		return -1
+	}
+	length, err := strconv.ParseInt(contentRange[i+1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return length
+}
+
+var defaultStorage Storage
+
+// SetDefault sets the storage backend used by the API.
+// It has to be called once at startup before the server accepts requests.
+func SetDefault(s Storage) {
+	defaultStorage = s
+}
+
+// Default returns the storage backend used by the API
+func Default() Storage {
+	return defaultStorage
+}
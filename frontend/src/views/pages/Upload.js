@@ -324,86 +324,27 @@ class Upload extends React.Component {
   }
 
   uploadFile = async (file) => {
-    try {     
-      const { data } = await axios.get('/api/secure/media/upload/authorize');
-      console.log("auth: ",data);
-      
-      /*
-      const { uploadUrl, authorizationToken } = data;
-      console.log(uploadUrl);
-      try {
-        const b2axios = axios.create()
-        const { data } = await b2axios.post('https://cors-anywhere.herokuapp.com/'+uploadUrl, data: file.file, {
-          headers: {
-            "Content-Type": file.file.type,
-            "Authorization":  authorizationToken,
-            "X-Bz-File-Name": encodeURI(file.file.name),
-            "X-Bz-Content-Sha1": file.sha1array[0]
-          }, 
-          
-          onUploadProgress : (progressEvent) => {
-            const { loaded, total } = progressEvent;
-            let percent = Math.floor( loaded * 100  / total );
-            console.log(`${loaded}kb of ${total}kb | ${percent}%`)
-          }
-        })
-      } catch(err) {
-        console.log(err);
-      }
+    // The file is sent to the API, which streams it to the storage and
+    // creates the media document. This works for small and large files.
+    const formData = new FormData();
+    formData.append('fileInfo', JSON.stringify(file.fileInfo));
+    formData.append('filterData', JSON.stringify(this.state.form));
+    if (file.file.lastModifiedDate) {
+      formData.append('lastModifiedDate', file.file.lastModifiedDate.toISOString());
+    }
+    formData.append('file', file.file, file.file.name);
 
-      */
-
-      /*
-      fetch(data.uploadUrl, {
-        method: 'POST',
-        headers: {
-          "Content-Type": file.file.type,
-          "Authorization":  data.authorizationToken,
-          "X-Bz-File-Name": encodeURI(file.file.name),
-          "X-Bz-Content-Sha1": file.sha1array[0]
-        },
-        body: file.file
-      }).then(
-        response => response.json()
-      ).then(
-        success => {
-          console.log("File successfully uploaded to B2 storage: ",file.file.name);
-          this.uploadFileInfoToDatabase(success, file);
+    try {
+      const { data } = await axios.post('/api/secure/media/upload', formData, {
+        onUploadProgress : (progressEvent) => {
+          const { loaded, total } = progressEvent;
+          let percent = Math.floor( loaded * 100  / total );
+          console.log(`${loaded} of ${total} bytes | ${percent}%`)
         }
-
-      ).catch(
-        error => console.log(error)
-      );
-      
-      */
-      let xhr = new XMLHttpRequest();
-      xhr.open('POST', data.uploadUrl);
-      console.log('OPENED', xhr.status);
-
-      xhr.onprogress = () => {
-        console.log('LOADING', xhr.status);
-      };
-      
-      xhr.upload.onprogress = (event) => {
-        console.log(`Uploaded ${event.loaded} of ${event.total} bytes`);
-      };
-
-      xhr.onload = () => {
-          console.log('DONE', xhr.status);
-          console.log(xhr.response);
-          this.uploadFileInfoToDatabase(xhr.response, file);
-      };
-      
-      xhr.setRequestHeader("Content-Type", file.file.type);
-      xhr.setRequestHeader("Authorization",  data.authorizationToken);
-      xhr.setRequestHeader("X-Bz-File-Name", encodeURI(file.file.name));
-      xhr.setRequestHeader("X-Bz-Content-Sha1", file.sha1array[0]);
-
-
-      xhr.send(file.file);
-
+      });
+      console.log("File successfully uploaded: ", data);
     } catch(err) {
-      console.log(err)
+      console.log(err);
     }
   }
 
@@ -528,19 +469,7 @@ class Upload extends React.Component {
     console.log("Uploading Files");
    
     this.state.fileList.forEach(file => {
-
-      // Check for big files
-      // If a file is >100MB, then use large file upload
-      if(file.file.size > 100000000) {
-      //if(file.file.size > 10000000) {
-        this.uploadLargeFile(file);
-      } else if (file.file.size > 1000000000000)  {
-        // TODO in this case we need to adjust the partSize since max number of parts is 10'000
-        console.log("File is too big to upload.")
-      } else {
-        this.uploadFile(file);
-      }
-      
+      this.uploadFile(file);
     })
 
     this.setState({